@@ -48,8 +48,10 @@ var (
 )
 
 func TestBenchParallelServe(t *testing.T) {
+	requireRealOrch(t)
+
 	var (
-		servedTh      uint64
+		keepAlive     = NewNeverEvict()
 		pinnedFuncNum int
 		isSyncOffload = true
 		serveMetrics  = make([]*metrics.Metric, *parallelNum)
@@ -63,7 +65,7 @@ func TestBenchParallelServe(t *testing.T) {
 	imageName, isPresent := images[*funcName]
 	require.True(t, isPresent, "Function is not supported")
 
-	funcPool = NewFuncPool(!isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, !isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	createResultsDir()
 
@@ -124,8 +126,10 @@ func TestBenchParallelServe(t *testing.T) {
 }
 
 func TestBenchWarmServe(t *testing.T) {
+	requireRealOrch(t)
+
 	var (
-		servedTh          uint64
+		keepAlive         = NewNeverEvict()
 		pinnedFuncNum     int
 		isSyncOffload     = true
 		images            = getAllImages()
@@ -136,7 +140,7 @@ func TestBenchWarmServe(t *testing.T) {
 	imageName, isPresent := images[*funcName]
 	require.True(t, isPresent, "Function is not supported")
 
-	funcPool = NewFuncPool(!isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, !isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	createResultsDir()
 
@@ -189,8 +193,10 @@ func TestBenchWarmServe(t *testing.T) {
 }
 
 func TestBenchServe(t *testing.T) {
+	requireRealOrch(t)
+
 	var (
-		servedTh          uint64
+		keepAlive         = NewNeverEvict()
 		pinnedFuncNum     int
 		isSyncOffload     = true
 		images            = getAllImages()
@@ -201,7 +207,7 @@ func TestBenchServe(t *testing.T) {
 	imageName, isPresent := images[*funcName]
 	require.True(t, isPresent, "Function is not supported")
 
-	funcPool = NewFuncPool(!isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, !isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	createResultsDir()
 
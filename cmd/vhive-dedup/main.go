@@ -0,0 +1,75 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// vhive-dedup reports how much disk space deduplicating the guest memory files of the snapshots stored on a node
+// would save, e.g., to choose the chunk size of the page store (-snapDedup).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+func main() {
+	snapshotsDir := flag.String("snapshotsDir", "/fccd/snapshots/functions", "Folder of the snapshots to analyze")
+	chunkSize := flag.Int64("chunkSize", int64(os.Getpagesize()), "Size of the deduplicated chunks in bytes")
+	flag.Parse()
+
+	report, err := snapshotting.AnalyzeDedup(*snapshotsDir, *chunkSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to analyze snapshots: %v\n", err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "REVISION\tGENERATION\tSIZE\tZERO\tEXCLUSIVE\t")
+	for _, snap := range report.Snapshots {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t\n", snap.Revision, snap.Generation, formatBytes(snap.TotalBytes),
+			formatBytes(snap.ZeroBytes), formatBytes(snap.ExclusiveBytes))
+	}
+	_ = w.Flush()
+
+	fmt.Printf("\nSnapshots:     %d\n", len(report.Snapshots))
+	fmt.Printf("Chunk size:    %s\n", formatBytes(report.ChunkSize))
+	fmt.Printf("Total size:    %s\n", formatBytes(report.TotalBytes))
+	fmt.Printf("Zero chunks:   %s\n", formatBytes(report.ZeroBytes))
+	fmt.Printf("Unique chunks: %s\n", formatBytes(report.UniqueBytes))
+	fmt.Printf("Dedup ratio:   %.2fx\n", report.Ratio())
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,89 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// vhive-memory-manager serves the user-level page faults of the VMs loaded from snapshots in a process of its own,
+// which vHive connects to with the -upfSocket flag, so that the page fault handler can be restarted, profiled and
+// pinned to CPUs separately from the vHive daemon.
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vhive-serverless/vhive/memory/manager"
+)
+
+func main() {
+	socketPath := flag.String("socket", "/run/vhive/memory-manager.sock", "Unix socket on which the memory manager is served")
+	isMetricsMode := flag.Bool("metrics", false, "Calculate UPF metrics")
+	prefetch := flag.String("prefetch", "", "Prefetch guest memory pages outside the working set in the background after loading a snapshot, valid options: address, probability (disabled by default)")
+	prefetchRate := flag.Uint64("prefetchRate", 0, "Maximum rate of the background prefetching of guest memory in bytes per second (0 means unlimited)")
+	faultWorkers := flag.Int("faultWorkers", 0, "Number of goroutines serving the page faults of each VM concurrently (0 means the default of 4)")
+	traceDir := flag.String("traceDir", "", "Directory where the page faults of each VM loaded from a snapshot are traced for analysis with vhive-trace (disabled by default)")
+	rerecordThreshold := flag.Float64("rerecordThreshold", 0, "Ratio of the pages missing from the recorded working set of a snapshot to its size, above which the pages missed by a VM are merged into the working set (0 means disabled)")
+	debug := flag.Bool("dbg", false, "Enable debug logging")
+	flag.Parse()
+
+	log.SetOutput(os.Stdout)
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	prefetchOrder, err := manager.ParsePrefetchOrder(*prefetch)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *rerecordThreshold < 0 {
+		log.Fatal("The working set re-recording threshold must not be negative")
+	}
+
+	m := manager.NewMemoryManager(manager.MemoryManagerCfg{
+		MetricsModeOn:     *isMetricsMode,
+		Prefetch:          manager.PrefetchCfg{Order: prefetchOrder, Rate: *prefetchRate},
+		FaultWorkers:      *faultWorkers,
+		FaultTraceDir:     *traceDir,
+		RerecordThreshold: *rerecordThreshold,
+	})
+
+	l, err := manager.Listen(*socketPath)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *socketPath, err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		_ = l.Close()
+	}()
+
+	log.Infof("Serving the memory manager on %s", *socketPath)
+	if err := manager.Serve(l, m); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Fatalf("Failed to serve the memory manager: %v", err)
+	}
+}
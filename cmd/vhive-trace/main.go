@@ -0,0 +1,139 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// vhive-trace analyzes the page fault traces written by the memory manager, i.e., the working set traces stored in
+// the snapshot folders and the fault traces of VM activations (-upfTraceDir), e.g., to study how stable the working
+// set of a function is across inputs.
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/vhive-serverless/vhive/memory/manager"
+)
+
+const usage = `Usage:
+  vhive-trace stats <trace>          print the working set size, locality and region histograms of a trace
+  vhive-trace diff <trace> <trace>   compare the pages faulted on in two traces
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; {
+	case cmd == "stats" && len(args) == 1:
+		err = printStats(args[0])
+	case cmd == "diff" && len(args) == 2:
+		err = printDiff(args[0], args[1])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to analyze traces: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func printStats(path string) error {
+	trace, err := manager.LoadTrace(path)
+	if err != nil {
+		return err
+	}
+	stats := trace.Stats()
+
+	fmt.Printf("Page size:          %s\n", formatBytes(stats.PageSize))
+	fmt.Printf("Pages:              %d\n", stats.Pages)
+	fmt.Printf("Working set size:   %s\n", formatBytes(stats.Bytes))
+	fmt.Printf("From working set:   %d\n", stats.FromWorkingSet)
+	fmt.Printf("Missed:             %d\n", stats.Pages-stats.FromWorkingSet)
+	fmt.Printf("Duration:           %v\n", stats.Duration)
+	fmt.Printf("Sequential faults:  %.1f%%\n", 100*stats.Sequential)
+
+	fmt.Println("\nStride between consecutive faults (pages):")
+	printHistogram(stats.StrideHistogram)
+	fmt.Println("\nRegions of contiguous pages (pages):")
+	printHistogram(stats.RegionHistogram)
+
+	return nil
+}
+
+func printDiff(firstPath, secondPath string) error {
+	first, err := manager.LoadTrace(firstPath)
+	if err != nil {
+		return err
+	}
+	second, err := manager.LoadTrace(secondPath)
+	if err != nil {
+		return err
+	}
+	diff, err := manager.DiffTraces(first, second)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Page size:    %s\n", formatBytes(diff.PageSize))
+	fmt.Printf("Common:       %d pages (%s)\n", diff.Common, formatBytes(uint64(diff.Common)*diff.PageSize))
+	fmt.Printf("Only first:   %d pages (%s)\n", diff.OnlyFirst, formatBytes(uint64(diff.OnlyFirst)*diff.PageSize))
+	fmt.Printf("Only second:  %d pages (%s)\n", diff.OnlySecond, formatBytes(uint64(diff.OnlySecond)*diff.PageSize))
+	fmt.Printf("Similarity:   %.1f%%\n", 100*diff.Similarity())
+
+	return nil
+}
+
+func printHistogram(buckets []manager.HistogramBucket) {
+	total := 0
+	for _, bucket := range buckets {
+		total += bucket.Count
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "RANGE\tCOUNT\tSHARE\t")
+	for _, bucket := range buckets {
+		bounds := fmt.Sprintf("%d", bucket.Min)
+		if bucket.Max != bucket.Min {
+			bounds = fmt.Sprintf("%d-%d", bucket.Min, bucket.Max)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\t\n", bounds, bucket.Count, 100*float64(bucket.Count)/float64(total))
+	}
+	_ = w.Flush()
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -27,6 +27,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/vhive-serverless/vhive/misc"
 	"github.com/vhive-serverless/vhive/snapshotting"
 	"strconv"
 	"sync"
@@ -39,55 +40,67 @@ import (
 
 type coordinator struct {
 	sync.Mutex
-	orch   *ctriface.Orchestrator
+	orch   ctriface.VMController
 	nextID uint64
 
-	activeInstances     map[string]*funcInstance
-	snapshotManager     *snapshotting.SnapshotManager
-	withoutOrchestrator bool
+	activeInstances  map[string]*funcInstance
+	snapshotManager  *snapshotting.SnapshotManager
+	snapshotsEnabled bool
+	snapshotsDir     string
 }
 
 type coordinatorOption func(*coordinator)
 
-// withoutOrchestrator is used for testing the coordinator without calling the orchestrator
-func withoutOrchestrator() coordinatorOption {
+// withSnapshots enables snapshots of the functions, which are kept in snapshotsDir
+func withSnapshots(enabled bool, snapshotsDir string) coordinatorOption {
 	return func(c *coordinator) {
-		c.withoutOrchestrator = true
+		c.snapshotsEnabled = enabled
+		c.snapshotsDir = snapshotsDir
 	}
 }
 
-func newFirecrackerCoordinator(orch *ctriface.Orchestrator, opts ...coordinatorOption) *coordinator {
+// withSnapshotManager sets the snapshot manager of the coordinator, which is shared with the function pool.
+// Otherwise, the coordinator has its own snapshot manager rooted at snapshotsDir.
+func withSnapshotManager(snapshotManager *snapshotting.SnapshotManager) coordinatorOption {
+	return func(c *coordinator) {
+		c.snapshotManager = snapshotManager
+	}
+}
+
+func newFirecrackerCoordinator(orch ctriface.VMController, opts ...coordinatorOption) *coordinator {
 	c := &coordinator{
 		activeInstances: make(map[string]*funcInstance),
 		orch:            orch,
+		snapshotsDir:    "/fccd/test/snapshots",
 	}
 
 	for _, opt := range opts {
 		opt(c)
 	}
 
-	snapshotsDir := "/fccd/test/snapshots"
-	if !c.withoutOrchestrator {
-		snapshotsDir = orch.GetSnapshotsDir()
+	if c.snapshotManager == nil {
+		c.snapshotManager = snapshotting.NewSnapshotManager(c.snapshotsDir)
 	}
-	c.snapshotManager = snapshotting.NewSnapshotManager(snapshotsDir)
 
 	return c
 }
 
 func (c *coordinator) startVM(ctx context.Context, image, revision string) (*funcInstance, error) {
-	return c.startVMWithEnvironment(ctx, image, revision, []string{})
+	return c.startVMWithEnvironment(ctx, image, revision, []string{}, ctriface.MachineConfig{})
 }
 
-func (c *coordinator) startVMWithEnvironment(ctx context.Context, image, revision string, environment []string) (*funcInstance, error) {
-	if c.orch != nil && c.orch.GetSnapshotsEnabled() {
+// startVMWithEnvironment starts a VM of the function, which is loaded from the snapshot of the revision with the
+// machine configuration it was taken with if there is one.
+func (c *coordinator) startVMWithEnvironment(ctx context.Context, image, revision string, environment []string, machineCfg ctriface.MachineConfig) (*funcInstance, error) {
+	if c.snapshotsEnabled {
 		// Check if snapshot is available
+		// The snapshot is released once the VM loaded from it is stopped
 		if snap, err := c.snapshotManager.AcquireSnapshot(revision); err == nil {
 			return c.orchLoadInstance(ctx, snap)
 		}
 	}
 
-	return c.orchStartVM(ctx, image, revision, environment)
+	return c.orchStartVM(ctx, image, revision, environment, machineCfg)
 }
 
 func (c *coordinator) stopVM(ctx context.Context, containerID string) error {
@@ -102,7 +115,7 @@ func (c *coordinator) stopVM(ctx context.Context, containerID string) error {
 		return nil
 	}
 
-	if c.orch != nil && c.orch.GetSnapshotsEnabled() && !fi.SnapBooted {
+	if c.snapshotsEnabled && !fi.SnapBooted {
 		err := c.orchCreateSnapshot(ctx, fi)
 		if err != nil {
 			log.Printf("Err creating snapshot %s\n", err)
@@ -135,7 +148,7 @@ func (c *coordinator) insertActive(containerID string, fi *funcInstance) error {
 	return nil
 }
 
-func (c *coordinator) orchStartVM(ctx context.Context, image, revision string, envVariables []string) (*funcInstance, error) {
+func (c *coordinator) orchStartVM(ctx context.Context, image, revision string, envVariables []string, machineCfg ctriface.MachineConfig) (*funcInstance, error) {
 	vmID := c.getVMID()
 	logger := log.WithFields(
 		log.Fields{
@@ -147,24 +160,18 @@ func (c *coordinator) orchStartVM(ctx context.Context, image, revision string, e
 
 	logger.Debug("creating fresh instance")
 
-	var (
-		resp *ctriface.StartVMResponse
-		err  error
-	)
-
 	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*40)
 	defer cancel()
 
-	if !c.withoutOrchestrator {
-		resp, _, err = c.orch.StartVMWithEnvironment(ctxTimeout, vmID, image, envVariables)
-		if err != nil {
-			logger.WithError(err).Error("coordinator failed to start VM")
-		}
+	resp, _, err := c.orch.StartVMWithEnvironment(ctxTimeout, vmID, image, envVariables, machineCfg)
+	if err != nil {
+		logger.WithError(err).Error("coordinator failed to start VM")
+		return nil, &misc.BootErr{VMID: vmID, Err: err}
 	}
 
 	fi := newFuncInstance(vmID, image, revision, false, resp)
 	logger.Debug("successfully created fresh instance")
-	return fi, err
+	return fi, nil
 }
 
 func (c *coordinator) orchLoadInstance(ctx context.Context, snap *snapshotting.Snapshot) (*funcInstance, error) {
@@ -184,15 +191,23 @@ func (c *coordinator) orchLoadInstance(ctx context.Context, snap *snapshotting.S
 	resp, _, err := c.orch.LoadSnapshot(ctxTimeout, vmID, snap)
 	if err != nil {
 		logger.WithError(err).Error("failed to load VM")
-		return nil, err
+		c.releaseSnapshot(snap)
+		return nil, &misc.SnapshotErr{Op: misc.SnapshotLoad, VMID: vmID, Revision: snap.GetId(), Err: err}
 	}
 
 	if _, err := c.orch.ResumeVM(ctxTimeout, vmID); err != nil {
 		logger.WithError(err).Error("failed to load VM")
-		return nil, err
+		// The VM that could not be stopped may still use the snapshot
+		if err := c.orch.StopSingleVM(ctx, vmID); err != nil {
+			logger.WithError(err).Warn("failed to stop VM that could not be resumed")
+		} else {
+			c.releaseSnapshot(snap)
+		}
+		return nil, &misc.SnapshotErr{Op: misc.SnapshotLoad, VMID: vmID, Revision: snap.GetId(), Err: err}
 	}
 
 	fi := newFuncInstance(vmID, snap.GetImage(), snap.GetId(), true, resp)
+	fi.Snapshot = snap
 	logger.Debug("successfully loaded instance from snapshot")
 	return fi, nil
 }
@@ -211,46 +226,63 @@ func (c *coordinator) orchCreateSnapshot(ctx context.Context, fi *funcInstance)
 
 	fi.Logger.Debug("creating instance snapshot before stopping")
 
-	if !c.withoutOrchestrator {
-		err = c.orch.PauseVM(ctxTimeout, fi.VmID)
-		if err != nil {
-			fi.Logger.WithError(err).Error("failed to pause VM")
-			return err
+	// A snapshot that could not be created is discarded, so that the next instance of the revision creates it again
+	abort := func(err error) error {
+		if err := c.snapshotManager.AbortSnapshot(fi.Revision); err != nil {
+			fi.Logger.WithError(err).Warn("failed to abort snapshot")
 		}
+		return &misc.SnapshotErr{Op: misc.SnapshotCreate, VMID: fi.VmID, Revision: fi.Revision, Err: err}
+	}
 
-		err = c.orch.CreateSnapshot(ctxTimeout, fi.VmID, snap)
-		if err != nil {
-			fi.Logger.WithError(err).Error("failed to create snapshot")
-			return err
-		}
+	err = c.orch.PauseVM(ctxTimeout, fi.VmID)
+	if err != nil {
+		fi.Logger.WithError(err).Error("failed to pause VM")
+		return abort(err)
+	}
 
-		if _, err := c.orch.ResumeVM(ctx, fi.VmID); err != nil {
-			fi.Logger.WithError(err).Error("failed to resume VM")
-			return err
-		}
+	err = c.orch.CreateSnapshot(ctxTimeout, fi.VmID, snap)
+	if err != nil {
+		fi.Logger.WithError(err).Error("failed to create snapshot")
+		return abort(err)
+	}
+
+	// The snapshot is valid even if the VM cannot be resumed, which is stopped right after anyway
+	_, resumeErr := c.orch.ResumeVM(ctx, fi.VmID)
+	if resumeErr != nil {
+		fi.Logger.WithError(resumeErr).Error("failed to resume VM")
 	}
 
 	if err := c.snapshotManager.CommitSnapshot(fi.Revision); err != nil {
 		fi.Logger.WithError(err).Error("failed to commit snapshot")
-		return err
+		return abort(err)
 	}
 
-	return nil
+	return resumeErr
 }
 
 func (c *coordinator) orchStopVM(ctx context.Context, fi *funcInstance) error {
-	if c.withoutOrchestrator {
-		return nil
-	}
-
 	if err := c.orch.StopSingleVM(ctx, fi.VmID); err != nil {
 		fi.Logger.WithError(err).Error("failed to stop VM for instance")
 		return err
 	}
 
+	// The VM loaded from the snapshot used its files until it stopped, which is when its working set is recorded
+	if fi.Snapshot != nil {
+		if err := c.snapshotManager.UploadWorkingSet(fi.Snapshot); err != nil {
+			fi.Logger.WithError(err).Warn("failed to upload working set to the snapshot store")
+		}
+		c.releaseSnapshot(fi.Snapshot)
+	}
+
 	return nil
 }
 
+func (c *coordinator) releaseSnapshot(snap *snapshotting.Snapshot) {
+	if err := c.snapshotManager.ReleaseSnapshot(snap); err != nil {
+		log.WithError(err).Warn("failed to release snapshot")
+	}
+}
+
 func (c *coordinator) getVMID() string {
 	return fmt.Sprintf("%s-%s", strconv.Itoa(int(atomic.AddUint64(&c.nextID, 1))), (uuid.New()).String()[:16])
 }
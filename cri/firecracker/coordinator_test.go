@@ -29,8 +29,13 @@ import (
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+
+	"github.com/vhive-serverless/vhive/ctriface/fake"
+	"github.com/vhive-serverless/vhive/misc"
 )
 
 const (
@@ -42,9 +47,15 @@ var (
 )
 
 func TestMain(m *testing.M) {
-	coord = newFirecrackerCoordinator(nil, withoutOrchestrator())
+	snapshotsDir, err := os.MkdirTemp("", "snapshots")
+	if err != nil {
+		panic(err)
+	}
+
+	coord = newFirecrackerCoordinator(fake.NewVMController(), withSnapshots(false, snapshotsDir))
 
 	ret := m.Run()
+	_ = os.RemoveAll(snapshotsDir)
 	os.Exit(ret)
 }
 
@@ -123,3 +134,109 @@ func TestOrchCreateSnapshot(t *testing.T) {
 	err = coord.stopVM(context.Background(), containerID)
 	require.NoError(t, err, "could not stop VM")
 }
+
+func TestSnapshotBoot(t *testing.T) {
+	vmc := fake.NewVMController()
+	c := newFirecrackerCoordinator(vmc, withSnapshots(true, t.TempDir()))
+	revision := "myrev-1"
+
+	// The first instance of the revision boots and is snapshotted when it is stopped
+	fi, err := c.startVM(context.Background(), testImageName, revision)
+	require.NoError(t, err, "could not start VM")
+	require.False(t, fi.SnapBooted, "first instance was loaded from a snapshot")
+	require.NoError(t, c.insertActive("1", fi), "could not insert mapping")
+	require.NoError(t, c.stopVM(context.Background(), "1"), "could not stop VM")
+	require.Equal(t, 1, vmc.CallCount(fake.CreateSnapshot), "snapshot was not created")
+
+	// The next instance is loaded from the snapshot and is not snapshotted again
+	fi, err = c.startVM(context.Background(), testImageName, revision)
+	require.NoError(t, err, "could not load VM")
+	require.True(t, fi.SnapBooted, "second instance was not loaded from a snapshot")
+	require.NotNil(t, fi.Snapshot, "snapshot is not held by the loaded instance")
+	require.NoError(t, c.insertActive("2", fi), "could not insert mapping")
+	require.NoError(t, c.stopVM(context.Background(), "2"), "could not stop VM")
+
+	// The snapshot is released once the instance loaded from it is stopped
+	require.Error(t, c.snapshotManager.ReleaseSnapshot(fi.Snapshot), "snapshot is still in use")
+
+	require.Equal(t, 1, vmc.CallCount(fake.StartVM))
+	require.Equal(t, 1, vmc.CallCount(fake.LoadSnapshot))
+	require.Equal(t, 1, vmc.CallCount(fake.CreateSnapshot))
+	require.Empty(t, vmc.VMs(), "VMs were not stopped")
+}
+
+func TestSnapshotFailure(t *testing.T) {
+	failed := false
+	vmc := fake.NewVMController(fake.WithFailureFunc(func(call fake.Call) error {
+		if call.Method == fake.CreateSnapshot && !failed {
+			failed = true
+			return errors.New("injected failure")
+		}
+		return nil
+	}))
+	c := newFirecrackerCoordinator(vmc, withSnapshots(true, t.TempDir()))
+	revision := "myrev-1"
+
+	fi, err := c.startVM(context.Background(), testImageName, revision)
+	require.NoError(t, err, "could not start VM")
+	require.NoError(t, c.insertActive("1", fi), "could not insert mapping")
+
+	// The VM is stopped even if it could not be snapshotted
+	require.NoError(t, c.stopVM(context.Background(), "1"), "could not stop VM")
+	require.Empty(t, vmc.VMs(), "VM was not stopped")
+
+	_, err = c.snapshotManager.AcquireSnapshot(revision)
+	require.Error(t, err, "failed snapshot is available")
+
+	// The next instance of the revision is snapshotted again
+	fi, err = c.startVM(context.Background(), testImageName, revision)
+	require.NoError(t, err, "could not start VM")
+	require.False(t, fi.SnapBooted, "instance was loaded from a failed snapshot")
+	require.NoError(t, c.insertActive("2", fi), "could not insert mapping")
+	require.NoError(t, c.stopVM(context.Background(), "2"), "could not stop VM")
+
+	_, err = c.snapshotManager.AcquireSnapshot(revision)
+	require.NoError(t, err, "snapshot was not created again")
+}
+
+func TestSnapshotResumeFailure(t *testing.T) {
+	vmc := fake.NewVMController(fake.WithFailureFunc(func(call fake.Call) error {
+		if call.Method == fake.ResumeVM {
+			return errors.New("injected failure")
+		}
+		return nil
+	}))
+	c := newFirecrackerCoordinator(vmc, withSnapshots(true, t.TempDir()))
+	revision := "myrev-1"
+
+	fi, err := c.startVM(context.Background(), testImageName, revision)
+	require.NoError(t, err, "could not start VM")
+	require.NoError(t, c.insertActive("1", fi), "could not insert mapping")
+
+	// The snapshot is kept even though the VM could not be resumed after it was created
+	require.NoError(t, c.stopVM(context.Background(), "1"), "could not stop VM")
+	require.Empty(t, vmc.VMs(), "VM was not stopped")
+
+	snap, err := c.snapshotManager.AcquireSnapshot(revision)
+	require.NoError(t, err, "snapshot was discarded")
+	require.NoError(t, c.snapshotManager.ReleaseSnapshot(snap), "could not release snapshot")
+}
+
+func TestStartVMTimeout(t *testing.T) {
+	vmc := fake.NewVMController(fake.WithLatency(fake.StartVM, time.Minute))
+	c := newFirecrackerCoordinator(vmc, withSnapshots(false, t.TempDir()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := c.startVM(ctx, testImageName, "myrev-1")
+	require.ErrorIs(t, err, context.DeadlineExceeded, "slow VM start did not time out")
+	var bootErr *misc.BootErr
+	require.ErrorAs(t, err, &bootErr)
+	require.Empty(t, vmc.VMs(), "VM was started")
+
+	calls := vmc.Calls()
+	require.Len(t, calls, 1)
+	require.Equal(t, fake.StartVM, calls[0].Method)
+	require.ErrorIs(t, calls[0].Err, context.DeadlineExceeded)
+}
@@ -25,6 +25,7 @@ package firecracker
 import (
 	log "github.com/sirupsen/logrus"
 	"github.com/vhive-serverless/vhive/ctriface"
+	"github.com/vhive-serverless/vhive/snapshotting"
 )
 
 type funcInstance struct {
@@ -34,6 +35,8 @@ type funcInstance struct {
 	Logger          *log.Entry
 	SnapBooted      bool
 	StartVMResponse *ctriface.StartVMResponse
+	// Snapshot the VM was loaded from, which is in use until the VM is stopped
+	Snapshot *snapshotting.Snapshot
 }
 
 func newFuncInstance(vmID, image, revision string, snapBooted bool, startVMResponse *ctriface.StartVMResponse) *funcInstance {
@@ -0,0 +1,93 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Plamen Petrov and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package firecracker
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/vhive-serverless/vhive/ctriface"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// Pod annotations that configure the VMs of a function, which take precedence over the resource limits of the user
+// container
+const (
+	vcpuCountAnnotation   = "vhive.io/vcpus"
+	memSizeMibAnnotation  = "vhive.io/memory-mib"
+	htEnabledAnnotation   = "vhive.io/smt"
+	kernelArgsAnnotation  = "vhive.io/kernel-args"
+	kernelImageAnnotation = "vhive.io/kernel-image"
+)
+
+const mib = 1 << 20
+
+// machineConfigFromRequest returns the machine configuration of the VM of a user container. The vCPU count and the
+// memory size are taken from the CPU and memory limits of the container, rounded up, unless they are set by the
+// annotations of the pod or of the container. Zero fields are left to the orchestrator defaults.
+func machineConfigFromRequest(r *criapi.CreateContainerRequest) (ctriface.MachineConfig, error) {
+	var cfg ctriface.MachineConfig
+
+	if resources := r.GetConfig().GetLinux().GetResources(); resources != nil {
+		if quota, period := resources.GetCpuQuota(), resources.GetCpuPeriod(); quota > 0 && period > 0 {
+			cfg.VcpuCount = uint32((quota + period - 1) / period)
+		}
+		if limit := resources.GetMemoryLimitInBytes(); limit > 0 {
+			cfg.MemSizeMib = uint32((limit + mib - 1) / mib)
+		}
+	}
+
+	annotations := make(map[string]string)
+	for key, value := range r.GetSandboxConfig().GetAnnotations() {
+		annotations[key] = value
+	}
+	for key, value := range r.GetConfig().GetAnnotations() {
+		annotations[key] = value
+	}
+
+	if value, ok := annotations[vcpuCountAnnotation]; ok {
+		vcpus, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || vcpus == 0 {
+			return cfg, fmt.Errorf("invalid %s annotation %q", vcpuCountAnnotation, value)
+		}
+		cfg.VcpuCount = uint32(vcpus)
+	}
+	if value, ok := annotations[memSizeMibAnnotation]; ok {
+		memSize, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || memSize == 0 {
+			return cfg, fmt.Errorf("invalid %s annotation %q", memSizeMibAnnotation, value)
+		}
+		cfg.MemSizeMib = uint32(memSize)
+	}
+	if value, ok := annotations[htEnabledAnnotation]; ok {
+		htEnabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid %s annotation %q", htEnabledAnnotation, value)
+		}
+		cfg.HtEnabled = htEnabled
+	}
+	cfg.KernelArgs = annotations[kernelArgsAnnotation]
+	cfg.KernelImagePath = annotations[kernelImageAnnotation]
+
+	return cfg, nil
+}
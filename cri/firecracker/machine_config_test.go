@@ -0,0 +1,75 @@
+package firecracker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/ctriface"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestMachineConfigFromRequest(t *testing.T) {
+	r := &criapi.CreateContainerRequest{
+		Config: &criapi.ContainerConfig{
+			Linux: &criapi.LinuxContainerConfig{
+				Resources: &criapi.LinuxContainerResources{
+					CpuPeriod:          100000,
+					CpuQuota:           150000,
+					MemoryLimitInBytes: 1536<<20 + 1,
+				},
+			},
+		},
+	}
+
+	cfg, err := machineConfigFromRequest(r)
+	require.NoError(t, err)
+	require.Equal(t, ctriface.MachineConfig{VcpuCount: 2, MemSizeMib: 1537}, cfg)
+
+	r.SandboxConfig = &criapi.PodSandboxConfig{
+		Annotations: map[string]string{
+			vcpuCountAnnotation:   "4",
+			memSizeMibAnnotation:  "2048",
+			htEnabledAnnotation:   "true",
+			kernelArgsAnnotation:  "console=ttyS0",
+			kernelImageAnnotation: "/var/lib/firecracker-containerd/runtime/vmlinux",
+		},
+	}
+	// The annotations of the container take precedence over the ones of the pod
+	r.Config.Annotations = map[string]string{vcpuCountAnnotation: "8"}
+
+	cfg, err = machineConfigFromRequest(r)
+	require.NoError(t, err)
+	require.Equal(t, ctriface.MachineConfig{
+		VcpuCount:       8,
+		MemSizeMib:      2048,
+		HtEnabled:       true,
+		KernelArgs:      "console=ttyS0",
+		KernelImagePath: "/var/lib/firecracker-containerd/runtime/vmlinux",
+	}, cfg)
+}
+
+func TestMachineConfigFromRequestDefaults(t *testing.T) {
+	cfg, err := machineConfigFromRequest(&criapi.CreateContainerRequest{})
+	require.NoError(t, err)
+	require.Equal(t, ctriface.MachineConfig{}, cfg)
+}
+
+func TestMachineConfigFromRequestInvalidAnnotations(t *testing.T) {
+	for _, annotation := range []string{vcpuCountAnnotation, memSizeMibAnnotation, htEnabledAnnotation} {
+		r := &criapi.CreateContainerRequest{
+			SandboxConfig: &criapi.PodSandboxConfig{
+				Annotations: map[string]string{annotation: "many"},
+			},
+		}
+		_, err := machineConfigFromRequest(r)
+		require.Error(t, err, annotation)
+	}
+
+	r := &criapi.CreateContainerRequest{
+		SandboxConfig: &criapi.PodSandboxConfig{
+			Annotations: map[string]string{vcpuCountAnnotation: "0"},
+		},
+	}
+	_, err := machineConfigFromRequest(r)
+	require.Error(t, err)
+}
@@ -31,6 +31,7 @@ import (
 	"github.com/vhive-serverless/vhive/common"
 	"github.com/vhive-serverless/vhive/cri"
 	"github.com/vhive-serverless/vhive/ctriface"
+	"github.com/vhive-serverless/vhive/snapshotting"
 	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
@@ -59,7 +60,8 @@ type VMConfig struct {
 	guestPort string
 }
 
-func NewFirecrackerService(orch *ctriface.Orchestrator) (*FirecrackerService, error) {
+// NewFirecrackerService Returns the CRI service of the firecracker VMs, whose snapshots are kept by snapshotManager
+func NewFirecrackerService(orch *ctriface.Orchestrator, snapshotManager *snapshotting.SnapshotManager) (*FirecrackerService, error) {
 	fs := new(FirecrackerService)
 	stockRuntimeClient, err := cri.NewStockRuntimeServiceClient()
 	if err != nil {
@@ -67,7 +69,8 @@ func NewFirecrackerService(orch *ctriface.Orchestrator) (*FirecrackerService, er
 		return nil, err
 	}
 	fs.stockRuntimeClient = stockRuntimeClient
-	fs.coordinator = newFirecrackerCoordinator(orch)
+	fs.coordinator = newFirecrackerCoordinator(orch, withSnapshots(orch.GetSnapshotsEnabled(), snapshotting.FunctionSnapshotsDir(orch.GetSnapshotsDir())),
+		withSnapshotManager(snapshotManager))
 	fs.vmConfigs = make(map[string]*VMConfig)
 	return fs, nil
 }
@@ -118,8 +121,14 @@ func (fs *FirecrackerService) createUserContainer(ctx context.Context, r *criapi
 		return nil, err
 	}
 
+	machineCfg, err := machineConfigFromRequest(r)
+	if err != nil {
+		log.WithError(err).Error()
+		return nil, err
+	}
+
 	environment := common.ToStringArray(config.GetEnvs())
-	funcInst, err := fs.coordinator.startVMWithEnvironment(context.Background(), guestImage, revision, environment)
+	funcInst, err := fs.coordinator.startVMWithEnvironment(context.Background(), guestImage, revision, environment, machineCfg)
 	if err != nil {
 		log.WithError(err).Error("failed to start VM")
 		return nil, err
@@ -0,0 +1,376 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Plamen Petrov and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package fake provides an in-memory VM controller to test the users of the orchestrator without KVM and
+// firecracker-containerd.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/vhive-serverless/vhive/ctriface"
+	"github.com/vhive-serverless/vhive/metrics"
+	"github.com/vhive-serverless/vhive/misc"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+// Method is a method of the VM controller.
+type Method string
+
+const (
+	StartVM        Method = "StartVM"
+	StopSingleVM   Method = "StopSingleVM"
+	PauseVM        Method = "PauseVM"
+	ResumeVM       Method = "ResumeVM"
+	CreateSnapshot Method = "CreateSnapshot"
+	LoadSnapshot   Method = "LoadSnapshot"
+	// The fake VMs run without the memory manager, so that there are no stats to dump
+	DumpUPFPageStats    Method = "DumpUPFPageStats"
+	DumpUPFLatencyStats Method = "DumpUPFLatencyStats"
+)
+
+// GuestPort is the port that the guest services of the VMs listen on, like the functions in the VMs do.
+const GuestPort = "50051"
+
+// Call is a call to the VM controller, which is recorded once it returns.
+type Call struct {
+	Method Method
+	VMID   string
+	Err    error
+}
+
+// Option configures the VM controller.
+type Option func(*VMController)
+
+// WithLatency delays every call to the method.
+func WithLatency(method Method, latency time.Duration) Option {
+	return func(c *VMController) {
+		c.latencies[method] = latency
+	}
+}
+
+// WithFailure makes every call to the method fail with err.
+func WithFailure(method Method, err error) Option {
+	return WithFailureFunc(func(call Call) error {
+		if call.Method == method {
+			return err
+		}
+		return nil
+	})
+}
+
+// WithFailureFunc makes the calls fail with the error returned by fail, if any, which is called before the call takes
+// effect and must not call the VM controller.
+func WithFailureFunc(fail func(call Call) error) Option {
+	return func(c *VMController) {
+		c.fail = fail
+	}
+}
+
+// WithGuestServices serves the gRPC services registered by register at the guest IP and GuestPort of every VM that is
+// started or loaded, until the VM is stopped.
+func WithGuestServices(register func(s *grpc.Server)) Option {
+	return func(c *VMController) {
+		c.registerGuestServices = register
+	}
+}
+
+type vmState int
+
+const (
+	vmRunning vmState = iota
+	vmPaused
+)
+
+type vm struct {
+	state   vmState
+	guestIP string
+	server  *grpc.Server
+}
+
+// VMController is a VM controller that keeps its VMs in memory. VMs are only reachable if guest services are
+// configured, at loopback addresses that are distinct across controllers.
+type VMController struct {
+	sync.Mutex
+	latencies             map[Method]time.Duration
+	fail                  func(call Call) error
+	registerGuestServices func(s *grpc.Server)
+
+	vms   map[string]*vm
+	calls []Call
+}
+
+// nextIP is the index of the next guest IP, shared by the controllers of the process so that their VMs can run side
+// by side
+var nextIP atomic.Int64
+
+var _ ctriface.VMController = (*VMController)(nil)
+
+// NewVMController returns a VM controller without VMs.
+func NewVMController(opts ...Option) *VMController {
+	c := &VMController{
+		latencies: make(map[Method]time.Duration),
+		vms:       make(map[string]*vm),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Calls returns the calls that returned so far, in the order in which they returned.
+func (c *VMController) Calls() []Call {
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]Call(nil), c.calls...)
+}
+
+// CallCount returns the number of calls to the method that returned so far.
+func (c *VMController) CallCount(method Method) int {
+	c.Lock()
+	defer c.Unlock()
+
+	count := 0
+	for _, call := range c.calls {
+		if call.Method == method {
+			count++
+		}
+	}
+	return count
+}
+
+// VMs returns the IDs of the VMs that are running or paused.
+func (c *VMController) VMs() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	vmIDs := make([]string, 0, len(c.vms))
+	for vmID := range c.vms {
+		vmIDs = append(vmIDs, vmID)
+	}
+	return vmIDs
+}
+
+// call waits for the latency of the method, then applies fn unless a failure is injected, and records the call.
+func (c *VMController) call(ctx context.Context, method Method, vmID string, fn func() error) error {
+	c.Lock()
+	latency := c.latencies[method]
+	c.Unlock()
+
+	err := ctx.Err()
+	if latency > 0 && err == nil {
+		timer := time.NewTimer(latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			err = ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	call := Call{Method: method, VMID: vmID}
+	if err == nil && c.fail != nil {
+		err = c.fail(call)
+	}
+	if err == nil {
+		err = fn()
+	}
+
+	call.Err = err
+	c.calls = append(c.calls, call)
+	return err
+}
+
+// addVM adds a VM in the state, serving the guest services if configured. It is called with the lock held.
+func (c *VMController) addVM(vmID string, state vmState) (*ctriface.StartVMResponse, error) {
+	if _, ok := c.vms[vmID]; ok {
+		return nil, errors.Errorf("VM %s exists", vmID)
+	}
+
+	ip := nextIP.Add(1) - 1
+	v := &vm{
+		state:   state,
+		guestIP: fmt.Sprintf("127.1.%d.%d", ip/254%256, 1+ip%254),
+	}
+
+	if c.registerGuestServices != nil {
+		lis, err := net.Listen("tcp", net.JoinHostPort(v.guestIP, GuestPort))
+		if err != nil {
+			return nil, errors.Wrapf(err, "serving guest services of VM %s", vmID)
+		}
+
+		v.server = grpc.NewServer()
+		c.registerGuestServices(v.server)
+		go func() {
+			if err := v.server.Serve(lis); err != nil {
+				log.WithFields(log.Fields{"vmID": vmID}).WithError(err).Warn("Guest services failed")
+			}
+		}()
+	}
+
+	c.vms[vmID] = v
+	return &ctriface.StartVMResponse{GuestIP: v.guestIP}, nil
+}
+
+// getVM returns the VM in the state. It is called with the lock held.
+func (c *VMController) getVM(vmID string, state vmState) (*vm, error) {
+	v, ok := c.vms[vmID]
+	if !ok {
+		return nil, misc.NonExistErr("VM " + vmID)
+	}
+	if v.state != state {
+		return nil, errors.Errorf("VM %s is in the wrong state", vmID)
+	}
+	return v, nil
+}
+
+// StartVM starts a running VM.
+func (c *VMController) StartVM(ctx context.Context, vmID, imageName string) (*ctriface.StartVMResponse, *metrics.Metric, error) {
+	return c.StartVMWithEnvironment(ctx, vmID, imageName, []string{}, ctriface.MachineConfig{})
+}
+
+// StartVMWithEnvironment starts a running VM.
+func (c *VMController) StartVMWithEnvironment(ctx context.Context, vmID, imageName string, environmentVariables []string, machineCfg ctriface.MachineConfig) (*ctriface.StartVMResponse, *metrics.Metric, error) {
+	var resp *ctriface.StartVMResponse
+	err := c.call(ctx, StartVM, vmID, func() (err error) {
+		resp, err = c.addVM(vmID, vmRunning)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, metrics.NewMetric(), nil
+}
+
+// StopSingleVM stops a running or paused VM.
+func (c *VMController) StopSingleVM(ctx context.Context, vmID string) error {
+	return c.call(ctx, StopSingleVM, vmID, func() error {
+		v, ok := c.vms[vmID]
+		if !ok {
+			return misc.NonExistErr("VM " + vmID)
+		}
+
+		if v.server != nil {
+			v.server.Stop()
+		}
+		delete(c.vms, vmID)
+		return nil
+	})
+}
+
+// PauseVM pauses a running VM.
+func (c *VMController) PauseVM(ctx context.Context, vmID string) error {
+	return c.call(ctx, PauseVM, vmID, func() error {
+		v, err := c.getVM(vmID, vmRunning)
+		if err != nil {
+			return err
+		}
+
+		v.state = vmPaused
+		return nil
+	})
+}
+
+// ResumeVM resumes a paused VM.
+func (c *VMController) ResumeVM(ctx context.Context, vmID string) (*metrics.Metric, error) {
+	err := c.call(ctx, ResumeVM, vmID, func() error {
+		v, err := c.getVM(vmID, vmPaused)
+		if err != nil {
+			return err
+		}
+
+		v.state = vmRunning
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return metrics.NewMetric(), nil
+}
+
+// CreateSnapshot writes the snapshot info and empty VM state and guest memory files of a paused VM.
+func (c *VMController) CreateSnapshot(ctx context.Context, vmID string, snap *snapshotting.Snapshot) error {
+	return c.call(ctx, CreateSnapshot, vmID, func() error {
+		if _, err := c.getVM(vmID, vmPaused); err != nil {
+			return err
+		}
+
+		for _, path := range []string{snap.GetSnapshotFilePath(), snap.GetMemFilePath()} {
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				return err
+			}
+		}
+		return snap.SerializeSnapInfo()
+	})
+}
+
+// LoadSnapshot starts a paused VM, which has to be resumed like a VM loaded by the orchestrator.
+func (c *VMController) LoadSnapshot(ctx context.Context, vmID string, snap *snapshotting.Snapshot) (*ctriface.StartVMResponse, *metrics.Metric, error) {
+	var resp *ctriface.StartVMResponse
+	err := c.call(ctx, LoadSnapshot, vmID, func() (err error) {
+		resp, err = c.addVM(vmID, vmPaused)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, metrics.NewMetric(), nil
+}
+
+// DumpUPFPageStats checks that the VM exists, but does not write any stats.
+func (c *VMController) DumpUPFPageStats(vmID, _, _ string) error {
+	return c.call(context.Background(), DumpUPFPageStats, vmID, func() error {
+		if _, ok := c.vms[vmID]; !ok {
+			return misc.NonExistErr("VM " + vmID)
+		}
+		return nil
+	})
+}
+
+// DumpUPFLatencyStats checks that the VM exists, but does not write any stats.
+func (c *VMController) DumpUPFLatencyStats(vmID, _, _ string) error {
+	return c.call(context.Background(), DumpUPFLatencyStats, vmID, func() error {
+		if _, ok := c.vms[vmID]; !ok {
+			return misc.NonExistErr("VM " + vmID)
+		}
+		return nil
+	})
+}
@@ -64,8 +64,60 @@ type StartVMResponse struct {
 
 const (
 	testImageName = "ghcr.io/ease-lab/helloworld:var_workload"
+
+	defaultVcpuCount  = 1
+	defaultMemSizeMib = 512
+	defaultKernelArgs = "ro noapic reboot=k panic=1 acpi=off pci=off nomodules systemd.log_color=false systemd.journald.forward_to_console systemd.unit=firecracker.target init=/sbin/overlay-init tsc=reliable quiet ipv6.disable=1 console=ttyS0"
 )
 
+// MachineConfig is the machine configuration of the VMs of a function. Zero fields take the default values, i.e.,
+// one vCPU, 512MiB of memory, no SMT, the default kernel command line and the kernel image configured in
+// firecracker-containerd.
+type MachineConfig struct {
+	VcpuCount       uint32
+	MemSizeMib      uint32
+	HtEnabled       bool
+	KernelArgs      string
+	KernelImagePath string
+}
+
+// withDefaults returns the configuration with the default values in place of the zero fields.
+func (c MachineConfig) withDefaults() MachineConfig {
+	if c.VcpuCount == 0 {
+		c.VcpuCount = defaultVcpuCount
+	}
+	if c.MemSizeMib == 0 {
+		c.MemSizeMib = defaultMemSizeMib
+	}
+	if c.KernelArgs == "" {
+		c.KernelArgs = defaultKernelArgs
+	}
+	return c
+}
+
+// validate checks that Firecracker can create a VM with the configuration.
+func (c MachineConfig) validate(hugePages bool) error {
+	if c.HtEnabled && c.VcpuCount > 1 && c.VcpuCount%2 != 0 {
+		return errors.Errorf("SMT requires an even number of vCPUs, got %d", c.VcpuCount)
+	}
+	// The guest memory size must be a multiple of the huge page size
+	if hugePages && c.MemSizeMib%2 != 0 {
+		return errors.Errorf("guest memory backed by 2MiB huge pages cannot be %dMiB", c.MemSizeMib)
+	}
+	return nil
+}
+
+// snapshotMachineConfig returns the machine configuration recorded in the snapshot info.
+func snapshotMachineConfig(snap *snapshotting.Snapshot) MachineConfig {
+	return MachineConfig{
+		VcpuCount:       snap.VcpuCount,
+		MemSizeMib:      snap.MemSizeMib,
+		HtEnabled:       snap.HtEnabled,
+		KernelArgs:      snap.KernelArgs,
+		KernelImagePath: snap.KernelImagePath,
+	}
+}
+
 func withNamespace(ctx context.Context, snapshotter, vmID string) context.Context {
 	if snapshotter == "proxy" {
 		// http-address-resolver assumes that the containerd namespace is the VM ID
@@ -77,10 +129,12 @@ func withNamespace(ctx context.Context, snapshotter, vmID string) context.Contex
 
 // StartVM Boots a VM if it does not exist
 func (o *Orchestrator) StartVM(ctx context.Context, vmID, imageName string) (_ *StartVMResponse, _ *metrics.Metric, retErr error) {
-	return o.StartVMWithEnvironment(ctx, vmID, imageName, []string{})
+	return o.StartVMWithEnvironment(ctx, vmID, imageName, []string{}, MachineConfig{})
 }
 
-func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageName string, environmentVariables []string) (_ *StartVMResponse, _ *metrics.Metric, retErr error) {
+// StartVMWithEnvironment Boots a VM with the given machine configuration and the environment variables of the
+// container
+func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageName string, environmentVariables []string, machineCfg MachineConfig) (_ *StartVMResponse, _ *metrics.Metric, retErr error) {
 	var (
 		startVMMetric = metrics.NewMetric()
 		tStart        time.Time
@@ -89,6 +143,11 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 	logger := log.WithFields(log.Fields{"vmID": vmID, "image": imageName})
 	logger.Debug("StartVM: Received StartVM")
 
+	machineCfg = machineCfg.withDefaults()
+	if err := machineCfg.validate(o.hugePages); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid machine configuration")
+	}
+
 	vm, err := o.vmPool.Allocate(vmID)
 	if err != nil {
 		logger.Error("failed to allocate VM in VM pool")
@@ -101,8 +160,15 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 			if err := o.vmPool.Free(vmID); err != nil {
 				logger.WithError(err).Errorf("failed to free VM from pool after failure")
 			}
+			o.machineCfgs.Delete(vmID)
+			o.removeVMRecord(vmID)
 		}
 	}()
+	o.machineCfgs.Store(vmID, machineCfg)
+
+	if err := o.writeVMRecord(vm, imageName, false, machineCfg); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to record VM")
+	}
 
 	ctx = withNamespace(ctx, o.snapshotter, vmID)
 
@@ -116,7 +182,7 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 	}
 
 	tStart = time.Now()
-	conf := o.getVMConfig(vm)
+	conf := o.getVMConfig(vm, machineCfg)
 	_, err = o.fcClient.CreateVM(ctx, conf)
 	startVMMetric.MetricMap[metrics.FcCreateVM] = metrics.ToUS(time.Since(tStart))
 	if err != nil {
@@ -245,15 +311,7 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 	if o.GetUPFEnabled() {
 		logger.Debug("Registering VM with the memory manager")
 
-		stateCfg := manager.SnapshotStateCfg{
-			VMID:           vmID,
-			GuestMemPath:   o.getMemoryFile(vmID),
-			BaseDir:        o.getVMBaseDir(vmID),
-			GuestMemSize:   int(conf.MachineCfg.MemSizeMib) * 1024 * 1024,
-			IsLazyMode:     o.isLazyMode,
-			VMMStatePath:   o.getSnapshotFile(vmID),
-			WorkingSetPath: o.getWorkingSetFile(vmID),
-		}
+		stateCfg := o.getVMStateCfg(vmID, conf.MachineCfg.MemSizeMib)
 		if err := o.memoryManager.RegisterVM(stateCfg); err != nil {
 			return nil, nil, errors.Wrap(err, "failed to register VM with memory manager")
 			// NOTE (Plamen): Potentially need a defer(DeregisteVM) here if RegisterVM is not last to execute
@@ -274,11 +332,8 @@ func (o *Orchestrator) StopSingleVM(ctx context.Context, vmID string) error {
 	ctx = withNamespace(ctx, o.snapshotter, vmID)
 	vm, err := o.vmPool.GetVM(vmID)
 	if err != nil {
-		if _, ok := err.(*misc.NonExistErr); ok {
-			logger.Panic("StopVM: VM does not exist")
-		}
-		logger.Panic("StopVM: GetVM() failed for an unknown reason")
-
+		logger.WithError(err).Error("StopVM: VM does not exist")
+		return err
 	}
 
 	logger = log.WithFields(log.Fields{"vmID": vmID})
@@ -324,6 +379,8 @@ func (o *Orchestrator) StopSingleVM(ctx context.Context, vmID string) error {
 	}
 
 	o.workloadIo.Delete(vmID)
+	o.machineCfgs.Delete(vmID)
+	o.removeVMRecord(vmID)
 
 	if vm.SnapBooted && o.snapshotter == "devmapper" {
 		if err := o.devMapper.RemoveDeviceSnapshot(ctx, vm.ContainerSnapKey); err != nil {
@@ -342,17 +399,38 @@ func (o *Orchestrator) getImage(ctx context.Context, imageName string) (*contain
 	return o.imageManager.GetImage(ctx, imageName, o.snapshotter != "proxy")
 }
 
-func (o *Orchestrator) getVMConfig(vm *misc.VM) *proto.CreateVMRequest {
-	kernelArgs := "ro noapic reboot=k panic=1 acpi=off pci=off nomodules systemd.log_color=false systemd.journald.forward_to_console systemd.unit=firecracker.target init=/sbin/overlay-init tsc=reliable quiet ipv6.disable=1 console=ttyS0"
+// getVMStateCfg returns the memory manager configuration of a VM that is booted from scratch, whose guest memory is
+// recorded when a snapshot of it is created.
+func (o *Orchestrator) getVMStateCfg(vmID string, memSizeMib uint32) manager.SnapshotStateCfg {
+	return manager.SnapshotStateCfg{
+		VMID:           vmID,
+		GuestMemPath:   o.getMemoryFile(vmID),
+		BaseDir:        o.getVMBaseDir(vmID),
+		GuestMemSize:   int(memSizeMib) * 1024 * 1024,
+		IsLazyMode:     o.isLazyMode,
+		VMMStatePath:   o.getSnapshotFile(vmID),
+		WorkingSetPath: o.getWorkingSetFile(vmID),
+	}
+}
+
+func (o *Orchestrator) getVMConfig(vm *misc.VM, cfg MachineConfig) *proto.CreateVMRequest {
+	cfg = cfg.withDefaults()
+
+	machineCfg := &proto.FirecrackerMachineConfiguration{
+		VcpuCount:  cfg.VcpuCount,
+		MemSizeMib: cfg.MemSizeMib,
+		HtEnabled:  cfg.HtEnabled,
+	}
+	if o.hugePages {
+		machineCfg.HugePages = hugePages2M
+	}
 
 	return &proto.CreateVMRequest{
-		VMID:           vm.ID,
-		TimeoutSeconds: 100,
-		KernelArgs:     kernelArgs,
-		MachineCfg: &proto.FirecrackerMachineConfiguration{
-			VcpuCount:  1,
-			MemSizeMib: 512,
-		},
+		VMID:            vm.ID,
+		TimeoutSeconds:  100,
+		KernelArgs:      cfg.KernelArgs,
+		KernelImagePath: cfg.KernelImagePath,
+		MachineCfg:      machineCfg,
 		NetworkInterfaces: []*proto.FirecrackerNetworkInterface{{
 			AllowMMDS: true,
 			StaticConfig: &proto.StaticNetworkConfiguration{
@@ -431,6 +509,12 @@ func (o *Orchestrator) ResumeVM(ctx context.Context, vmID string) (*metrics.Metr
 	}
 	resumeVMMetric.MetricMap[metrics.FcResume] = metrics.ToUS(time.Since(tStart))
 
+	if o.GetUPFEnabled() {
+		if err := o.memoryManager.StartPrefetch(vmID); err != nil {
+			logger.WithError(err).Warn("failed to start prefetching guest memory")
+		}
+	}
+
 	return resumeVMMetric, nil
 }
 
@@ -467,6 +551,15 @@ func (o *Orchestrator) CreateSnapshot(ctx context.Context, vmID string, snap *sn
 		}
 	}
 
+	if cfg, ok := o.machineCfgs.Load(vmID); ok {
+		machineCfg := cfg.(MachineConfig)
+		snap.VcpuCount = machineCfg.VcpuCount
+		snap.MemSizeMib = machineCfg.MemSizeMib
+		snap.HtEnabled = machineCfg.HtEnabled
+		snap.KernelArgs = machineCfg.KernelArgs
+		snap.KernelImagePath = machineCfg.KernelImagePath
+	}
+
 	logger = log.WithFields(log.Fields{"vmID": vmID})
 	logger.Debug("Serializing snapshot info")
 	if err := snap.SerializeSnapInfo(); err != nil {
@@ -497,10 +590,6 @@ func configureSnapshotMemoryBackend(conf *proto.CreateVMRequest, backendType, ba
 
 // LoadSnapshot Loads a snapshot of a VM
 func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snapshotting.Snapshot) (_ *StartVMResponse, _ *metrics.Metric, retErr error) {
-	if err := o.validateUPFMode(); err != nil {
-		return nil, nil, err
-	}
-
 	var (
 		loadSnapshotMetric = metrics.NewMetric()
 		tStart             time.Time
@@ -526,10 +615,23 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snap
 			if err := o.vmPool.Free(vmID); err != nil {
 				logger.WithError(err).Errorf("failed to free VM from pool after failure")
 			}
+			o.machineCfgs.Delete(vmID)
+			o.removeVMRecord(vmID)
 		}
 	}()
 
-	conf := o.getVMConfig(vm)
+	// The VM is created with the machine configuration of the VM that the snapshot was taken of
+	machineCfg := snapshotMachineConfig(snap).withDefaults()
+	if err := machineCfg.validate(o.hugePages); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid machine configuration of the snapshot")
+	}
+	o.machineCfgs.Store(vmID, machineCfg)
+
+	if err := o.writeVMRecord(vm, snap.GetImage(), true, machineCfg); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to record VM")
+	}
+
+	conf := o.getVMConfig(vm, machineCfg)
 	conf.LoadSnapshot = true
 	conf.SnapshotPath = snap.GetSnapshotFilePath()
 	configureSnapshotMemoryBackend(conf, "File", snap.GetMemFilePath())
@@ -595,14 +697,18 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snap
 		configureSnapshotMemoryBackend(conf, "Uffd", uffdSock)
 
 		if err := o.memoryManager.PrepareSnapshotLoad(manager.SnapshotStateCfg{
-			VMID:             vmID,
-			VMMStatePath:     snap.GetSnapshotFilePath(),
-			GuestMemPath:     snap.GetMemFilePath(),
-			InstanceSockAddr: uffdSock,
-			BaseDir:          o.getVMBaseDir(vmID),
-			GuestMemSize:     int(conf.MachineCfg.MemSizeMib) * 1024 * 1024,
-			IsLazyMode:       o.isLazyMode,
-			WorkingSetPath:   o.getWorkingSetFile(vmID),
+			VMID:                   vmID,
+			VMMStatePath:           snap.GetSnapshotFilePath(),
+			GuestMemPath:           snap.GetMemFilePath(),
+			InstanceSockAddr:       uffdSock,
+			BaseDir:                o.getVMBaseDir(vmID),
+			GuestMemSize:           int(conf.MachineCfg.MemSizeMib) * 1024 * 1024,
+			IsLazyMode:             o.isLazyMode,
+			WorkingSetPath:         snap.GetWorkingSetFilePath(),
+			TracePath:              snap.GetTraceFilePath(),
+			ZeroPagesPath:          snap.GetZeroPagesFilePath(),
+			CompressedGuestMemPath: snap.GetCompressedMemFilePath(),
+			MemManifestPath:        snap.GetMemManifestFilePath(),
 		}); err != nil {
 			return nil, nil, err
 		}
@@ -23,6 +23,7 @@
 package ctriface
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"os/exec"
@@ -49,6 +50,7 @@ import (
 	"github.com/vhive-serverless/vhive/memory/manager"
 	"github.com/vhive-serverless/vhive/metrics"
 	"github.com/vhive-serverless/vhive/misc"
+	"github.com/vhive-serverless/vhive/snapshotting"
 
 	_ "github.com/davecgh/go-spew/spew" //tmp
 )
@@ -57,6 +59,8 @@ const (
 	containerdAddress      = "/run/firecracker-containerd/containerd.sock"
 	containerdTTRPCAddress = containerdAddress + ".ttrpc"
 	namespaceName          = "firecracker-containerd"
+	// Firecracker machine configuration value that backs the guest memory with 2MiB hugetlbfs pages
+	hugePages2M = "2M"
 )
 
 type WorkloadIoWriter struct {
@@ -87,11 +91,43 @@ type DockerCredentials struct {
 	DockerCredentials map[string]RegistryCredentials `json:"docker-credentials"`
 }
 
+// memoryManager serves the user-level page faults of the VMs, either in the vHive process (*manager.MemoryManager)
+// or in a standalone memory manager process (*manager.Client).
+type memoryManager interface {
+	RegisterVM(cfg manager.SnapshotStateCfg) error
+	PrepareSnapshotLoad(cfg manager.SnapshotStateCfg) error
+	DeregisterVM(vmID string) error
+	Activate(vmID string, socketReadyCh chan<- struct{}) error
+	FetchState(vmID string) error
+	Deactivate(vmID string) error
+	StartPrefetch(vmID string) error
+	DumpUPFPageStats(vmID, functionName, metricsOutFilePath string) error
+	DumpUPFLatencyStats(vmID, functionName, latencyOutFilePath string) error
+	GetUPFLatencyStats(vmID string) ([]*metrics.Metric, error)
+}
+
+// VMController Drives the lifecycle of VMs. It is implemented by the Orchestrator, and by fake.VMController to test
+// its users without KVM and firecracker-containerd.
+type VMController interface {
+	StartVM(ctx context.Context, vmID, imageName string) (*StartVMResponse, *metrics.Metric, error)
+	StartVMWithEnvironment(ctx context.Context, vmID, imageName string, environmentVariables []string, machineCfg MachineConfig) (*StartVMResponse, *metrics.Metric, error)
+	StopSingleVM(ctx context.Context, vmID string) error
+	PauseVM(ctx context.Context, vmID string) error
+	ResumeVM(ctx context.Context, vmID string) (*metrics.Metric, error)
+	CreateSnapshot(ctx context.Context, vmID string, snap *snapshotting.Snapshot) error
+	LoadSnapshot(ctx context.Context, vmID string, snap *snapshotting.Snapshot) (*StartVMResponse, *metrics.Metric, error)
+	DumpUPFPageStats(vmID, functionName, metricsOutFilePath string) error
+	DumpUPFLatencyStats(vmID, functionName, latencyOutFilePath string) error
+}
+
+var _ VMController = (*Orchestrator)(nil)
+
 // Orchestrator Drives all VMs
 type Orchestrator struct {
 	vmPool            *misc.VMPool
 	cachedImages      map[string]containerd.Image
 	workloadIo        sync.Map // vmID string -> WorkloadIoWriter
+	machineCfgs       sync.Map // vmID string -> MachineConfig
 	snapshotter       string
 	client            *containerd.Client
 	fcClient          *fcclient.Client
@@ -99,20 +135,27 @@ type Orchestrator struct {
 	imageManager      *image.ImageManager
 	dockerCredentials DockerCredentials
 	// store *skv.KVStore
-	snapshotsEnabled bool
-	isUPFEnabled     bool
-	isLazyMode       bool
-	snapshotsDir     string
-	isMetricsMode    bool
-	netPoolSize      int
-	dns              []string
+	snapshotsEnabled     bool
+	isUPFEnabled         bool
+	isLazyMode           bool
+	upfPrefetch          manager.PrefetchCfg
+	upfFaultWorkers      int
+	upfTraceDir          string
+	upfRerecordThreshold float64
+	upfSocket            string
+	reconcilePolicy      ReconcilePolicy
+	hugePages            bool
+	snapshotsDir         string
+	isMetricsMode        bool
+	netPoolSize          int
+	dns                  []string
 
 	vethPrefix  string
 	clonePrefix string
 
 	setExpIface bool
 
-	memoryManager *manager.MemoryManager
+	memoryManager memoryManager
 }
 
 // NewOrchestrator Initializes a new orchestrator
@@ -126,6 +169,7 @@ func NewOrchestrator(snapshotter, hostIface string, opts ...OrchestratorOption)
 	o.netPoolSize = 10
 	o.vethPrefix = "172.17"
 	o.clonePrefix = "172.18"
+	o.reconcilePolicy = ReconcileReport
 
 	o.dns = getK8sDNS()
 
@@ -145,9 +189,16 @@ func NewOrchestrator(snapshotter, hostIface string, opts ...OrchestratorOption)
 		log.Panicf("Failed to create snapshots dir %s", o.snapshotsDir)
 	}
 
-	if o.GetUPFEnabled() {
+	if o.GetUPFEnabled() && o.upfSocket != "" {
+		log.Infof("Using the memory manager serving %s", o.upfSocket)
+		o.memoryManager = manager.NewClient(o.upfSocket)
+	} else if o.GetUPFEnabled() {
 		managerCfg := manager.MemoryManagerCfg{
-			MetricsModeOn: o.isMetricsMode,
+			MetricsModeOn:     o.isMetricsMode,
+			Prefetch:          o.upfPrefetch,
+			FaultWorkers:      o.upfFaultWorkers,
+			FaultTraceDir:     o.upfTraceDir,
+			RerecordThreshold: o.upfRerecordThreshold,
 		}
 		o.memoryManager = manager.NewMemoryManager(managerCfg)
 	}
@@ -169,6 +220,10 @@ func NewOrchestrator(snapshotter, hostIface string, opts ...OrchestratorOption)
 	o.devMapper = devmapper.NewDeviceMapper(o.client)
 	o.imageManager = image.NewImageManager(o.client, o.snapshotter)
 
+	if _, err := o.Reconcile(context.Background(), o.reconcilePolicy); err != nil {
+		log.WithError(err).Error("Failed to reconcile the VMs and resources left behind by a previous run")
+	}
+
 	return o
 }
 
@@ -203,11 +258,24 @@ func (o *Orchestrator) setupCloseHandler() {
 }
 
 // Cleanup Removes the bridges created by the VM pool's tap manager
-// Cleans up snapshots directory
+// Cleans up snapshots directory, keeping committed snapshots so that they can be
+// reused after a restart
 func (o *Orchestrator) Cleanup() {
 	o.vmPool.CleanupNetwork()
-	if err := os.RemoveAll(o.snapshotsDir); err != nil {
-		log.Panic("failed to delete snapshots dir", err)
+
+	entries, err := os.ReadDir(o.snapshotsDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Panic("failed to read snapshots dir", err)
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(o.snapshotsDir, entry.Name())
+		if snapshotting.IsFunctionSnapshotsEntry(entry.Name()) || snapshotting.ContainsSnapshots(path) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			log.Panic("failed to delete snapshots dir", err)
+		}
 	}
 }
 
@@ -24,11 +24,10 @@ package ctriface
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-)
 
-var errUPFRequiresLazyMode = errors.New("UPF currently requires lazy mode")
+	"github.com/vhive-serverless/vhive/memory/manager"
+)
 
 // OrchestratorOption Options to pass to Orchestrator
 type OrchestratorOption func(*Orchestrator)
@@ -72,11 +71,64 @@ func WithLazyMode(isLazyMode bool) OrchestratorOption {
 	}
 }
 
-func (o *Orchestrator) validateUPFMode() error {
-	if o.isUPFEnabled && !o.isLazyMode {
-		return errUPFRequiresLazyMode
+// WithUPFPrefetch Sets the background prefetching of the guest memory
+// pages outside the working set of VMs loaded from snapshots.
+func WithUPFPrefetch(cfg manager.PrefetchCfg) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.upfPrefetch = cfg
+	}
+}
+
+// WithUPFFaultWorkers Sets the number of goroutines serving the
+// page faults of each VM concurrently.
+func WithUPFFaultWorkers(faultWorkers int) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.upfFaultWorkers = faultWorkers
+	}
+}
+
+// WithUPFTraceDir Sets the directory where the page faults of each
+// VM loaded from a snapshot are traced, which is disabled if empty.
+func WithUPFTraceDir(traceDir string) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.upfTraceDir = traceDir
+	}
+}
+
+// WithUPFRerecordThreshold Sets the ratio of the pages missing from the
+// recorded working set of a snapshot to its size, above which the pages
+// missed by a VM are merged into the working set, which is disabled if 0.
+func WithUPFRerecordThreshold(threshold float64) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.upfRerecordThreshold = threshold
+	}
+}
+
+// WithUPFSocket Sets the unix socket of a standalone memory manager
+// process (vhive-memory-manager) serving the page faults of the VMs,
+// which are served in-process if empty. The memory manager options of
+// the orchestrator are ignored in favor of those of the process.
+func WithUPFSocket(socketPath string) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.upfSocket = socketPath
+	}
+}
+
+// WithReconcilePolicy Sets what is done with the VMs and resources left
+// behind by a previous vHive process when the orchestrator is created,
+// which are only reported by default.
+func WithReconcilePolicy(policy ReconcilePolicy) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.reconcilePolicy = policy
+	}
+}
+
+// WithHugePages Sets whether the guest memory of the VMs is backed by
+// 2MiB huge pages from hugetlbfs instead of base pages.
+func WithHugePages(hugePages bool) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.hugePages = hugePages
 	}
-	return nil
 }
 
 // WithMetricsMode Sets the metrics mode
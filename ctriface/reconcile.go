@@ -0,0 +1,429 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Plamen Petrov and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ctriface
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+	"github.com/go-multierror/multierror"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vhive-serverless/vhive/misc"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+// ReconcilePolicy selects what the orchestrator does with the VMs and resources that a previous vHive process left
+// behind, e.g., when it crashed, which are looked for when the orchestrator is created.
+type ReconcilePolicy string
+
+const (
+	// ReconcileDisabled does not look for the VMs and resources left behind.
+	ReconcileDisabled ReconcilePolicy = "none"
+	// ReconcileReport only logs the VMs and resources left behind.
+	ReconcileReport ReconcilePolicy = "report"
+	// ReconcileTeardown stops the VMs and removes the resources left behind.
+	ReconcileTeardown ReconcilePolicy = "teardown"
+	// ReconcileAdopt adds the VMs that are still running to the VM pool, and tears down the VMs that cannot be
+	// adopted and the resources that do not belong to adopted VMs.
+	ReconcileAdopt ReconcilePolicy = "adopt"
+)
+
+// ParseReconcilePolicy returns the reconcile policy with the given name.
+func ParseReconcilePolicy(name string) (ReconcilePolicy, error) {
+	switch policy := ReconcilePolicy(name); policy {
+	case ReconcileDisabled, ReconcileReport, ReconcileTeardown, ReconcileAdopt:
+		return policy, nil
+	default:
+		return ReconcileDisabled, errors.Errorf("unknown reconcile policy %q", name)
+	}
+}
+
+// ReconcileResult lists the VMs and resources left behind by a previous vHive process that a reconciliation found.
+type ReconcileResult struct {
+	// VMs recorded by the previous process
+	VMs []string
+	// VMs added to the VM pool, a subset of VMs
+	AdoptedVMs []string
+	// Containers, leased container snapshots, network namespaces and VM base dirs that do not belong to adopted VMs
+	Containers []string
+	Leases     []string
+	Networks   []string
+	Dirs       []string
+}
+
+// vmRecord describes a VM of the orchestrator. It is stored in the base dir of the VM while the VM exists, so that
+// the VM can be found again after vHive crashes.
+type vmRecord struct {
+	ID               string
+	ContainerSnapKey string
+	SnapBooted       bool
+	ImageName        string
+	NetworkID        int
+	UPF              bool
+	MachineCfg       MachineConfig
+}
+
+// baseImageSnapSuffix is the suffix of the keys of the temporary image snapshots created by DeviceMapper.CreatePatch
+const baseImageSnapSuffix = "-base-image"
+
+func (o *Orchestrator) getVMRecordFile(vmID string) string {
+	return filepath.Join(o.getVMBaseDir(vmID), "vm_info")
+}
+
+// writeVMRecord stores the record of a VM, which is connected to the network when it is allocated in the VM pool.
+func (o *Orchestrator) writeVMRecord(vm *misc.VM, imageName string, snapBooted bool, machineCfg MachineConfig) error {
+	record := vmRecord{
+		ID:               vm.ID,
+		ContainerSnapKey: vm.ContainerSnapKey,
+		SnapBooted:       snapBooted,
+		ImageName:        imageName,
+		NetworkID:        vm.NetConfig.GetID(),
+		UPF:              o.GetUPFEnabled(),
+		MachineCfg:       machineCfg,
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(o.getVMBaseDir(vm.ID), 0777); err != nil {
+		return err
+	}
+
+	return os.WriteFile(o.getVMRecordFile(vm.ID), data, 0644)
+}
+
+func (o *Orchestrator) removeVMRecord(vmID string) {
+	if err := os.Remove(o.getVMRecordFile(vmID)); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{"vmID": vmID}).WithError(err).Warn("failed to remove VM record")
+	}
+}
+
+// readVMRecords returns the records of the VMs stored in the snapshots dir.
+func (o *Orchestrator) readVMRecords() ([]*vmRecord, error) {
+	entries, err := os.ReadDir(o.snapshotsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*vmRecord
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(o.getVMRecordFile(entry.Name()))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		record := new(vmRecord)
+		if err := json.Unmarshal(data, record); err != nil {
+			log.WithError(err).Warnf("Ignoring invalid VM record in %s", o.getVMBaseDir(entry.Name()))
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// Reconcile looks for the VMs and resources that a previous vHive process left behind, and adopts or tears them down
+// according to the policy. VMs are found through the records stored in their base dirs and through their containers,
+// leases through the container snapshot keys of the VMs, network namespaces through their names, and VM base dirs
+// as the directories of the snapshots dir that do not contain snapshots.
+func (o *Orchestrator) Reconcile(ctx context.Context, policy ReconcilePolicy) (*ReconcileResult, error) {
+	result := new(ReconcileResult)
+	if policy == ReconcileDisabled {
+		return result, nil
+	}
+
+	logger := log.WithFields(log.Fields{"policy": policy})
+	logger.Info("Reconciling the VMs and resources left behind by a previous run")
+
+	var (
+		teardown = policy != ReconcileReport
+		adopted  = make(map[string]bool)
+		errs     []error
+	)
+
+	records, err := o.readVMRecords()
+	if err != nil {
+		return result, errors.Wrap(err, "reading VM records")
+	}
+
+	for _, record := range records {
+		vmLogger := logger.WithFields(log.Fields{"vmID": record.ID})
+		result.VMs = append(result.VMs, record.ID)
+
+		if policy == ReconcileAdopt {
+			err := o.adoptVM(ctx, record)
+			if err == nil {
+				vmLogger.Info("Adopted VM")
+				result.AdoptedVMs = append(result.AdoptedVMs, record.ID)
+				adopted[record.ID] = true
+				continue
+			}
+			vmLogger.WithError(err).Warn("Failed to adopt VM")
+		}
+
+		if !teardown {
+			vmLogger.Warn("Found VM left behind")
+			continue
+		}
+
+		vmLogger.Info("Tearing down VM")
+		if err := o.teardownVM(ctx, record); err != nil {
+			errs = append(errs, errors.Wrapf(err, "tearing down VM %s", record.ID))
+		}
+	}
+
+	// The containers of all VMs are in the same namespace, except with the proxy snapshotter
+	namespaceNames := []string{namespaceName}
+	if o.snapshotter == "proxy" {
+		namespaceNames = namespaceNames[:0]
+		for _, record := range records {
+			namespaceNames = append(namespaceNames, record.ID)
+		}
+	}
+	for _, ns := range namespaceNames {
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		containers, err := o.client.Containers(nsCtx)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "listing containers in namespace %s", ns))
+			continue
+		}
+
+		for _, container := range containers {
+			vmID, ok := misc.VMIDFromContainerSnapKey(container.ID())
+			if !ok || adopted[vmID] {
+				continue
+			}
+
+			logger.WithFields(log.Fields{"vmID": vmID, "container": container.ID()}).Warn("Found container left behind")
+			result.Containers = append(result.Containers, container.ID())
+			if teardown {
+				if err := o.removeContainer(nsCtx, vmID, container); err != nil {
+					errs = append(errs, errors.Wrapf(err, "removing container %s", container.ID()))
+				}
+			}
+		}
+	}
+
+	if o.snapshotter == "devmapper" {
+		nsCtx := namespaces.WithNamespace(ctx, namespaceName)
+		snapKeys, err := o.devMapper.ListLeasedSnapshots(nsCtx)
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "listing leases"))
+		}
+
+		for _, snapKey := range snapKeys {
+			// The temporary image snapshots of patches never belong to a VM
+			vmID, ok := misc.VMIDFromContainerSnapKey(strings.TrimSuffix(snapKey, baseImageSnapSuffix))
+			if !ok || (adopted[vmID] && !strings.HasSuffix(snapKey, baseImageSnapSuffix)) {
+				continue
+			}
+
+			logger.WithFields(log.Fields{"vmID": vmID, "lease": snapKey}).Warn("Found container snapshot left behind")
+			result.Leases = append(result.Leases, snapKey)
+			if teardown {
+				if err := o.devMapper.RemoveStaleDeviceSnapshot(nsCtx, snapKey); err != nil {
+					errs = append(errs, errors.Wrapf(err, "removing container snapshot %s", snapKey))
+				}
+			}
+		}
+	}
+
+	networkIDs, err := o.vmPool.StaleNetworks()
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "listing network namespaces"))
+	}
+	for _, networkID := range networkIDs {
+		name := fmt.Sprintf("uvmns%d", networkID)
+		logger.WithFields(log.Fields{"netns": name}).Warn("Found network left behind")
+		result.Networks = append(result.Networks, name)
+		if teardown {
+			if err := o.vmPool.RemoveStaleNetwork(networkID); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(o.snapshotsDir)
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "reading snapshots dir"))
+	}
+	for _, entry := range entries {
+		path := filepath.Join(o.snapshotsDir, entry.Name())
+		if !entry.IsDir() || adopted[entry.Name()] || snapshotting.IsFunctionSnapshotsEntry(entry.Name()) || snapshotting.ContainsSnapshots(path) {
+			continue
+		}
+
+		logger.WithFields(log.Fields{"dir": path}).Warn("Found VM base dir left behind")
+		result.Dirs = append(result.Dirs, path)
+		if teardown {
+			if err := os.RemoveAll(path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	logger.WithFields(log.Fields{
+		"VMs":        len(result.VMs),
+		"adopted":    len(result.AdoptedVMs),
+		"containers": len(result.Containers),
+		"leases":     len(result.Leases),
+		"networks":   len(result.Networks),
+		"dirs":       len(result.Dirs),
+	}).Info("Reconciled the VMs and resources left behind by a previous run")
+
+	return result, multierror.Of(errs...)
+}
+
+// adoptVM adds a VM that is still running to the VM pool.
+func (o *Orchestrator) adoptVM(ctx context.Context, record *vmRecord) error {
+	ctx = withNamespace(ctx, o.snapshotter, record.ID)
+
+	if _, err := o.fcClient.GetVMInfo(ctx, &proto.GetVMInfoRequest{VMID: record.ID}); err != nil {
+		return errors.Wrap(err, "VM is not running")
+	}
+
+	if record.UPF != o.GetUPFEnabled() {
+		return errors.New("VM was started with a different user-level page faults mode")
+	}
+	// The page faults of a VM loaded from a snapshot were served by the memory manager of the previous process, unless
+	// it runs standalone
+	if record.UPF && record.SnapBooted && o.upfSocket == "" {
+		return errors.New("the page faults of the VM were served by the previous process")
+	}
+
+	vm := &misc.VM{
+		ID:               record.ID,
+		ContainerSnapKey: record.ContainerSnapKey,
+		SnapBooted:       record.SnapBooted,
+	}
+
+	if record.ImageName != "" {
+		image, err := o.getImage(ctx, record.ImageName)
+		if err != nil {
+			return errors.Wrap(err, "failed to get image")
+		}
+		vm.Image = image
+	}
+
+	if !record.SnapBooted {
+		container, err := o.client.LoadContainer(ctx, record.ContainerSnapKey)
+		if err != nil {
+			return errors.Wrap(err, "failed to load container")
+		}
+		task, err := container.Task(ctx, nil)
+		if err != nil {
+			return errors.Wrap(err, "failed to load task")
+		}
+		ch, err := task.Wait(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to wait for task")
+		}
+		vm.Container = &container
+		vm.Task = &task
+		vm.TaskCh = ch
+	}
+
+	if record.UPF && !record.SnapBooted && o.upfSocket == "" {
+		stateCfg := o.getVMStateCfg(record.ID, record.MachineCfg.withDefaults().MemSizeMib)
+		if err := o.memoryManager.RegisterVM(stateCfg); err != nil {
+			return errors.Wrap(err, "failed to register VM with memory manager")
+		}
+	}
+
+	if err := o.vmPool.Adopt(vm, record.NetworkID); err != nil {
+		if record.UPF && !record.SnapBooted && o.upfSocket == "" {
+			_ = o.memoryManager.DeregisterVM(record.ID)
+		}
+		return err
+	}
+
+	if record.SnapBooted && o.snapshotter == "devmapper" {
+		if err := o.devMapper.AdoptDeviceSnapshot(ctx, record.ContainerSnapKey); err != nil {
+			_ = o.vmPool.Free(record.ID)
+			return errors.Wrap(err, "failed to adopt container snapshot")
+		}
+	}
+
+	o.machineCfgs.Store(record.ID, record.MachineCfg)
+	iologger := NewWorkloadIoWriter(record.ID)
+	o.workloadIo.Store(record.ID, &iologger)
+
+	return nil
+}
+
+// teardownVM stops a VM that was not adopted. Its container, container snapshot, network and base dir are removed
+// with the other resources left behind.
+func (o *Orchestrator) teardownVM(ctx context.Context, record *vmRecord) error {
+	ctx = withNamespace(ctx, o.snapshotter, record.ID)
+
+	if _, err := o.fcClient.GetVMInfo(ctx, &proto.GetVMInfoRequest{VMID: record.ID}); err == nil {
+		if _, err := o.fcClient.StopVM(ctx, &proto.StopVMRequest{VMID: record.ID}); err != nil {
+			return errors.Wrap(err, "failed to stop firecracker-containerd VM")
+		}
+	}
+
+	// A standalone memory manager still holds the state of the VM
+	if record.UPF && o.GetUPFEnabled() && o.upfSocket != "" {
+		_ = o.memoryManager.Deactivate(record.ID)
+		if err := o.memoryManager.DeregisterVM(record.ID); err != nil {
+			log.WithFields(log.Fields{"vmID": record.ID}).WithError(err).Debug("VM is not registered with the memory manager")
+		}
+	}
+
+	return nil
+}
+
+// removeContainer deletes a container left behind along with its task and snapshot, and stops its VM.
+func (o *Orchestrator) removeContainer(ctx context.Context, vmID string, container containerd.Container) error {
+	if task, err := container.Task(ctx, nil); err == nil {
+		if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil {
+			log.WithFields(log.Fields{"vmID": vmID}).WithError(err).Warn("failed to delete task")
+		}
+	}
+
+	if _, err := o.fcClient.GetVMInfo(ctx, &proto.GetVMInfoRequest{VMID: vmID}); err == nil {
+		if _, err := o.fcClient.StopVM(ctx, &proto.StopVMRequest{VMID: vmID}); err != nil {
+			log.WithFields(log.Fields{"vmID": vmID}).WithError(err).Warn("failed to stop firecracker-containerd VM")
+		}
+	}
+
+	return container.Delete(ctx, containerd.WithSnapshotCleanup)
+}
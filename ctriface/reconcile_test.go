@@ -0,0 +1,63 @@
+package ctriface
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/misc"
+	"github.com/vhive-serverless/vhive/networking"
+)
+
+func TestParseReconcilePolicy(t *testing.T) {
+	for _, policy := range []ReconcilePolicy{ReconcileDisabled, ReconcileReport, ReconcileTeardown, ReconcileAdopt} {
+		parsed, err := ParseReconcilePolicy(string(policy))
+		require.NoError(t, err)
+		require.Equal(t, policy, parsed)
+	}
+
+	_, err := ParseReconcilePolicy("ignore")
+	require.Error(t, err)
+}
+
+func TestVMRecords(t *testing.T) {
+	o := &Orchestrator{snapshotsDir: t.TempDir(), isUPFEnabled: true}
+
+	vm := misc.NewVM("1")
+	vm.NetConfig = networking.NewNetworkConfig(3, "eth0", "", "172.17", "172.18")
+	machineCfg := MachineConfig{VcpuCount: 2, MemSizeMib: 1024}
+	require.NoError(t, o.writeVMRecord(vm, testImageName, true, machineCfg))
+
+	// Neither the base dirs of VMs without records nor invalid records are VMs
+	require.NoError(t, os.MkdirAll(o.getVMBaseDir("2"), 0777))
+	require.NoError(t, os.MkdirAll(o.getVMBaseDir("3"), 0777))
+	require.NoError(t, os.WriteFile(o.getVMRecordFile("3"), []byte("{"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(o.snapshotsDir, "vm_info"), nil, 0644))
+
+	records, err := o.readVMRecords()
+	require.NoError(t, err)
+	require.Equal(t, []*vmRecord{{
+		ID:               "1",
+		ContainerSnapKey: vm.ContainerSnapKey,
+		SnapBooted:       true,
+		ImageName:        testImageName,
+		NetworkID:        3,
+		UPF:              true,
+		MachineCfg:       machineCfg,
+	}}, records)
+
+	o.removeVMRecord("1")
+	o.removeVMRecord("2")
+	records, err = o.readVMRecords()
+	require.NoError(t, err)
+	require.Empty(t, records)
+}
+
+func TestReconcileDisabled(t *testing.T) {
+	o := &Orchestrator{snapshotsDir: t.TempDir()}
+
+	result, err := o.Reconcile(t.Context(), ReconcileDisabled)
+	require.NoError(t, err)
+	require.Equal(t, &ReconcileResult{}, result)
+}
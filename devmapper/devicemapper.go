@@ -27,6 +27,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/leases"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/opencontainers/image-spec/identity"
@@ -137,6 +138,56 @@ func (dmpr *DeviceMapper) RemoveDeviceSnapshot(ctx context.Context, snapKey stri
 	return nil
 }
 
+// ListLeasedSnapshots returns the keys of the device snapshots that are leased in containerd, which include the
+// snapshots created through CreateDeviceSnapshot by previous device mappers, e.g., before vHive crashed.
+func (dmpr *DeviceMapper) ListLeasedSnapshots(ctx context.Context) ([]string, error) {
+	leaseList, err := dmpr.leaseManager.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapKeys := make([]string, 0, len(leaseList))
+	for _, lease := range leaseList {
+		snapKeys = append(snapKeys, lease.ID)
+	}
+	return snapKeys, nil
+}
+
+// AdoptDeviceSnapshot takes over the device snapshot identified by the given snapKey, which was created through
+// CreateDeviceSnapshot by a previous device mapper, so that it can be removed with RemoveDeviceSnapshot.
+func (dmpr *DeviceMapper) AdoptDeviceSnapshot(ctx context.Context, snapKey string) error {
+	dmpr.Lock()
+	defer dmpr.Unlock()
+
+	if _, present := dmpr.leases[snapKey]; present {
+		return errors.New(fmt.Sprintf("Adopt device snapshot: lease for key %s already exists", snapKey))
+	}
+
+	mounts, err := dmpr.snapshotService.Mounts(ctx, snapKey)
+	if err != nil {
+		return err
+	}
+
+	// Devmapper always only has a single mount /dev/mapper/fc-thinpool-snap-x
+	dmpr.snapDevices[snapKey] = NewDeviceSnapshot(mounts[0].Source)
+	dmpr.leases[snapKey] = &leases.Lease{ID: snapKey}
+	return nil
+}
+
+// RemoveStaleDeviceSnapshot removes the device snapshot identified by the given snapKey and its lease, which were
+// left behind by a previous device mapper. The snapshot may not exist if its creation was interrupted.
+func (dmpr *DeviceMapper) RemoveStaleDeviceSnapshot(ctx context.Context, snapKey string) error {
+	if err := dmpr.snapshotService.Remove(ctx, snapKey); err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+
+	if err := dmpr.leaseManager.Delete(ctx, leases.Lease{ID: snapKey}); err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
 // GetImageSnapshot retrieves the device mapper snapshot for a given image.
 func (dmpr *DeviceMapper) GetImageSnapshot(ctx context.Context, image containerd.Image) (*DeviceSnapshot, error) {
 	imageSnapKey, err := getImageKey(image, ctx)
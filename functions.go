@@ -25,10 +25,10 @@ package main
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -36,7 +36,6 @@ import (
 
 	"github.com/vhive-serverless/vhive/ctriface"
 
-	"golang.org/x/sync/semaphore"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
 	"google.golang.org/grpc/codes"
@@ -48,6 +47,7 @@ import (
 	"github.com/vhive-serverless/vhive/common"
 	hpb "github.com/vhive-serverless/vhive/examples/protobuf/helloworld"
 	"github.com/vhive-serverless/vhive/metrics"
+	"github.com/vhive-serverless/vhive/misc"
 	"github.com/vhive-serverless/vhive/snapshotting"
 )
 
@@ -58,25 +58,39 @@ var isTestMode bool // set with a call to NewFuncPool
 // FuncPool Pool of functions
 type FuncPool struct {
 	sync.Mutex
-	funcMap         map[string]*Function
-	saveMemoryMode  bool
-	servedTh        uint64
-	pinnedFuncNum   int
-	stats           *Stats
-	snapshotManager *snapshotting.SnapshotManager
+	funcMap          map[string]*Function
+	vmController     ctriface.VMController
+	snapshotsEnabled bool
+	saveMemoryMode   bool
+	keepAlive        KeepAlivePolicy
+	scaling          ScalingCfg
+	clock            Clock
+	pinnedFuncNum    int
+	stats            *Stats
+	snapshotManager  *snapshotting.SnapshotManager
 }
 
-// NewFuncPool Initializes a pool of functions. Functions can only be added
-// but never removed from the map.
-func NewFuncPool(saveMemoryMode bool, servedTh uint64, pinnedFuncNum int, testModeOn bool) *FuncPool {
+// reapInterval is the period at which the instances of idle functions are stopped or pre-warmed
+const reapInterval = time.Second
+
+// NewFuncPool Initializes a pool of functions, whose VMs are driven by vmController. Functions can only be added
+// but never removed from the map. In the memory saving mode, the instances of the functions that are not pinned are
+// kept alive according to the keep-alive policy once the functions are idle. Functions scale out to multiple
+// instances according to the scaling configuration.
+func NewFuncPool(vmController ctriface.VMController, snapshotsEnabled, saveMemoryMode bool, keepAlive KeepAlivePolicy, scaling ScalingCfg, pinnedFuncNum int, testModeOn bool, snapshotManager *snapshotting.SnapshotManager) *FuncPool {
 	p := new(FuncPool)
 	p.funcMap = make(map[string]*Function)
+	p.vmController = vmController
+	p.snapshotsEnabled = snapshotsEnabled
 	p.saveMemoryMode = saveMemoryMode
-	p.servedTh = servedTh
+	p.keepAlive = keepAlive
+	p.scaling = scaling
+	p.clock = realClock{}
 	p.pinnedFuncNum = pinnedFuncNum
 	p.stats = NewStats()
-	p.snapshotManager = snapshotting.NewSnapshotManager("/fccd/snapshots")
+	p.snapshotManager = snapshotManager
 
+	// Tests drive the reaper with a simulated clock
 	if !testModeOn {
 		heartbeat := time.NewTicker(60 * time.Second)
 
@@ -86,6 +100,17 @@ func NewFuncPool(saveMemoryMode bool, servedTh uint64, pinnedFuncNum int, testMo
 				log.Info("FuncPool heartbeat: ", p.stats.SprintStats())
 			}
 		}()
+
+		if saveMemoryMode {
+			reaper := time.NewTicker(reapInterval)
+
+			go func() {
+				for {
+					<-reaper.C
+					p.reapIdleInstances(p.clock.Now())
+				}
+			}()
+		}
 	}
 
 	isTestMode = testModeOn
@@ -110,8 +135,8 @@ func (p *FuncPool) getFunction(fID, imageName string) *Function {
 			isToPin = false
 		}
 
-		logger.Debugf("Created function, pinned=%t, shut down after %d requests", isToPin, p.servedTh)
-		p.funcMap[fID] = NewFunction(fID, imageName, p.stats, p.servedTh, isToPin, p.snapshotManager)
+		logger.Debugf("Created function, pinned=%t", isToPin)
+		p.funcMap[fID] = NewFunction(fID, imageName, p.stats, isToPin, p.vmController, p.snapshotsEnabled, p.snapshotManager, p.scaling, p.clock)
 
 		if err := p.stats.CreateStats(fID); err != nil {
 			logger.Panic("GetFunction: Function exists")
@@ -125,20 +150,49 @@ func (p *FuncPool) getFunction(fID, imageName string) *Function {
 func (p *FuncPool) Serve(ctx context.Context, fID, imageName, payload string) (*hpb.FwdHelloResp, *metrics.Metric, error) {
 	f := p.getFunction(fID, imageName)
 
+	if idle, wasIdle := f.startRequest(p.clock.Now()); wasIdle {
+		p.keepAlive.RecordIdle(fID, idle)
+	}
+	defer func() {
+		f.endRequest(p.clock.Now())
+	}()
+
 	return f.Serve(ctx, fID, imageName, payload)
 }
 
+// reapIdleInstances Stops the instances of the idle functions that are not pinned and are outside of their keep-alive
+// windows, and pre-warms the instances of those that are within them
+func (p *FuncPool) reapIdleInstances(now time.Time) {
+	p.Lock()
+	funcs := make([]*Function, 0, len(p.funcMap))
+	for _, f := range p.funcMap {
+		if !f.isPinnedInMem {
+			funcs = append(funcs, f)
+		}
+	}
+	p.Unlock()
+
+	var wg sync.WaitGroup
+	for _, f := range funcs {
+		wg.Add(1)
+		go func(f *Function) {
+			defer wg.Done()
+
+			if f.reap(now, p.keepAlive.Window(f.fID)) {
+				f.preWarm()
+			}
+		}(f)
+	}
+	wg.Wait()
+}
+
 // AddInstance Adds instance of the function
 func (p *FuncPool) AddInstance(fID, imageName string) (string, error) {
 	f := p.getFunction(fID, imageName)
 
-	logger := log.WithFields(log.Fields{"fID": f.fID})
-
-	f.OnceAddInstance.Do(
-		func() {
-			logger.Debug("Function is inactive, starting the instance...")
-			f.AddInstance()
-		})
+	if _, err := f.AddInstance(); err != nil {
+		return "Failed to start instance", err
+	}
 
 	return "Instance started", nil
 }
@@ -169,57 +223,51 @@ func (p *FuncPool) DumpUPFLatencyStats(fID, imageName, functionName, latencyOutF
 
 // Function type
 type Function struct {
-	sync.RWMutex
-	OnceAddInstance        *sync.Once
+	sync.Mutex
 	fID                    string
 	imageName              string
-	vmID                   string
 	lastInstanceID         int
 	isPinnedInMem          bool // if pinned, the orchestrator does not stop/offload it)
 	stats                  *Stats
-	servedTh               uint64
-	sem                    *semaphore.Weighted
-	servedSyncCounter      int64
 	isSnapshotReady        bool // if ready, the orchestrator should load the instance rather than creating it
 	OnceCreateSnapInstance *sync.Once
-	funcClient             *hpb.GreeterClient
-	conn                   *grpc.ClientConn
-	guestIP                string
+	vmController           ctriface.VMController
+	snapshotsEnabled       bool
 	snapshotManager        *snapshotting.SnapshotManager
+	scaling                ScalingCfg
+	clock                  Clock
+
+	instances []*instance // instances that serve requests, in the order they were added
+	starting  int         // number of instances being added
+	stopping  int         // number of instances that were removed but are not stopped yet
+	queue     []*waiter   // requests waiting for an instance, in the order they arrived
+
+	activity  sync.Mutex
+	inFlight  int       // number of requests being served, guarded by activity
+	idleSince time.Time // when the last request was served, guarded by activity
 }
 
 // NewFunction Initializes a function
 // Note: for numerical fIDs, [0, hotFunctionsNum) and [hotFunctionsNum; hotFunctionsNum+warmFunctionsNum)
 // are functions that are pinned in memory (stopping or offloading by the daemon is not allowed)
-func NewFunction(fID, imageName string, Stats *Stats, servedTh uint64, isToPin bool, snapshotManager *snapshotting.SnapshotManager) *Function {
+func NewFunction(fID, imageName string, Stats *Stats, isToPin bool, vmController ctriface.VMController, snapshotsEnabled bool, snapshotManager *snapshotting.SnapshotManager, scaling ScalingCfg, clock Clock) *Function {
 	f := new(Function)
 	f.fID = fID
 	f.imageName = imageName
-	f.OnceAddInstance = new(sync.Once)
 	f.isPinnedInMem = isToPin
 	f.stats = Stats
 	f.OnceCreateSnapInstance = new(sync.Once)
+	f.vmController = vmController
+	f.snapshotsEnabled = snapshotsEnabled
 	f.snapshotManager = snapshotManager
-
-	// Normal distribution with stddev=servedTh/2, mean=servedTh
-	thresh := int64(rand.NormFloat64()*float64(servedTh/2) + float64(servedTh))
-	if thresh <= 0 {
-		thresh = int64(servedTh)
-	}
-	if isTestMode && servedTh == 40 { // 40 is used in tests
-		thresh = 40
-	}
-
-	f.servedTh = uint64(thresh)
-	f.sem = semaphore.NewWeighted(int64(f.servedTh))
-	f.servedSyncCounter = int64(f.servedTh) // cannot use uint64 for the counter due to the overflow
+	f.scaling = scaling
+	f.clock = clock
 
 	log.WithFields(
 		log.Fields{
 			"fID":      f.fID,
 			"image":    f.imageName,
 			"isPinned": f.isPinnedInMem,
-			"servedTh": f.servedTh,
 		},
 	).Info("New function added")
 
@@ -230,74 +278,53 @@ func NewFunction(fID, imageName string, Stats *Stats, servedTh uint64, isToPin b
 // function instances when necessary.
 //
 // Synchronization description:
-//  1. Function needs to start an instance (with a unique vmID) if there are none: goroutines are synchronized with do.Once
-//  2. Function (that is not pinned) can serve only up to servedTh requests (controlled by a WeightedSemaphore)
-//     a. The last goroutine needs to trigger the function's instance shutdown, then reset the semaphore,
-//     allowing new goroutines to serve their requests.
-//     b. The last goroutine is determined by the atomic counter: the goroutine with syncID==0 shuts down
-//     the instance.
-//     c. Instance shutdown is performed asynchronously because all instances have unique IDs.
+//  1. The request is dispatched to the least loaded instance of the function that can serve another request. If
+//     there is none, the request is queued, and instances are added while the queued requests exceed the concurrency
+//     of the instances being added, up to the maximum number of instances of the function.
+//  2. Once an instance has served a request, it serves the next queued request, if any.
+//  3. The instances of a function that is not pinned are stopped by the reaper of the function pool once the function
+//     has been idle, i.e., has not served requests, for longer than its keep-alive policy allows. Requests that find
+//     the instances stopped add them again. Likewise, the reaper stops all but one instance of a function that is
+//     not idle once they have been idle beyond the keep-alive window of the function.
 func (f *Function) Serve(ctx context.Context, fID, imageName, reqPayload string) (*hpb.FwdHelloResp, *metrics.Metric, error) {
 	var (
 		serveMetric = metrics.NewMetric()
 		tStart      time.Time
-		syncID      int64 = -1 // default is no synchronization
-		isColdStart       = false
 	)
 
 	logger := log.WithFields(log.Fields{"fID": f.fID})
 
-	if !f.isPinnedInMem {
-		if err := f.sem.Acquire(context.Background(), 1); err != nil {
-			logger.Panic("Failed to acquire semaphore for serving")
-		}
-
-		syncID = atomic.AddInt64(&f.servedSyncCounter, -1) // unique number for goroutines acquiring the semaphore
+	inst, isColdStart, err := f.acquireInstance(ctx, serveMetric)
+	if err != nil {
+		// The instance could not be added, the next request adds it again
+		return &hpb.FwdHelloResp{IsColdStart: isColdStart, Payload: ""}, serveMetric, err
 	}
 
 	f.stats.IncServed(f.fID)
 
-	f.OnceAddInstance.Do(
-		func() {
-			var metr *metrics.Metric
-			isColdStart = true
-			logger.Debug("Function is inactive, starting the instance...")
-			tStart = time.Now()
-			metr = f.AddInstance()
-			serveMetric.MetricMap[metrics.AddInstance] = metrics.ToUS(time.Since(tStart))
-
-			if metr != nil {
-				for k, v := range metr.MetricMap {
-					serveMetric.MetricMap[k] = v
-				}
-			}
-		})
-
-	f.RLock()
-
 	// FIXME: keep a strict deadline for forwarding RPCs to a warm function
 	// Eventually, it needs to be RPC-dependent and probably client-defined
 	ctxFwd, cancel := context.WithDeadline(context.Background(), time.Now().Add(20*time.Second))
 	defer cancel()
 
 	tStart = time.Now()
-	resp, err := f.fwdRPC(ctxFwd, reqPayload)
+	resp, err := f.fwdRPC(ctxFwd, inst, reqPayload)
 	serveMetric.MetricMap[metrics.FuncInvocation] = metrics.ToUS(time.Since(tStart))
 
 	if err != nil && ctxFwd.Err() == context.Canceled {
 		// context deadline exceeded
-		f.RUnlock()
+		f.releaseInstance(inst)
 		return &hpb.FwdHelloResp{IsColdStart: isColdStart, Payload: ""}, serveMetric, err
 	} else if err != nil {
 		if e, ok := status.FromError(err); ok {
 			switch e.Code() {
 			case codes.DeadlineExceeded:
 				// deadline exceeded
-				f.RUnlock()
+				f.releaseInstance(inst)
 				return &hpb.FwdHelloResp{IsColdStart: isColdStart, Payload: ""}, serveMetric, err
 			default:
 				logger.Warn("Function returned error: ", err)
-				f.RUnlock()
+				f.releaseInstance(inst)
 				return &hpb.FwdHelloResp{IsColdStart: isColdStart, Payload: ""}, serveMetric, err
 			}
 		} else {
@@ -305,148 +332,321 @@ func (f *Function) Serve(ctx context.Context, fID, imageName, reqPayload string)
 		}
 	}
 
-	if orch.GetSnapshotsEnabled() {
-		f.OnceCreateSnapInstance.Do(
+	var resumeErr, snapErr error
+	if f.snapshotsEnabled {
+		f.Lock()
+		once := f.OnceCreateSnapInstance
+		f.Unlock()
+
+		once.Do(
 			func() {
 				logger.Debug("First time offloading, need to create a snapshot first")
-				f.CreateInstanceSnapshot()
-				f.isSnapshotReady = true
+				resumeErr, snapErr = f.CreateInstanceSnapshot(inst.vmID)
+				if snapErr == nil {
+					f.Lock()
+					f.isSnapshotReady = true
+					f.Unlock()
+				}
 			})
 	}
 
-	f.RUnlock()
-
-	if !f.isPinnedInMem && syncID == 0 {
-		logger.Debugf("Function has to shut down its instance, served %d requests", f.GetStatServed())
-		tStart = time.Now()
-		if _, err := f.RemoveInstance(false); err != nil {
-			logger.Panic("Failed to remove instance after servedTh expired", err)
+	if resumeErr != nil || snapErr != nil {
+		f.Lock()
+		if resumeErr != nil {
+			// The instance that could not be resumed is stopped once it is released
+			logger.WithError(resumeErr).Warn("Failed to resume instance after creating its snapshot")
+			f.detachInstance(inst)
 		}
-		serveMetric.MetricMap[metrics.RetireOld] = metrics.ToUS(time.Since(tStart))
-		f.ZeroServedStat()
-		f.servedSyncCounter = int64(f.servedTh) // reset counter
-		f.sem.Release(int64(f.servedTh))
+		if snapErr != nil {
+			// The request has been served, the next request tries to create the snapshot again
+			logger.WithError(snapErr).Warn("Failed to create instance snapshot")
+			f.OnceCreateSnapInstance = new(sync.Once)
+		}
+		f.Unlock()
 	}
 
+	f.releaseInstance(inst)
+
 	return &hpb.FwdHelloResp{IsColdStart: isColdStart, Payload: resp.Message}, serveMetric, err
 }
 
-// FwdRPC Forward the RPC to an instance, then forwards the response back.
-func (f *Function) fwdRPC(ctx context.Context, reqPayload string) (*hpb.HelloReply, error) {
-	f.RLock()
-	defer f.RUnlock()
+// startRequest Records that a request to the function arrived at the time, and returns for how long the function
+// had been idle if it was
+func (f *Function) startRequest(now time.Time) (time.Duration, bool) {
+	f.activity.Lock()
+	defer f.activity.Unlock()
 
-	logger := log.WithFields(log.Fields{"fID": f.fID})
+	f.inFlight++
+	if f.inFlight > 1 || f.idleSince.IsZero() {
+		return 0, false
+	}
+
+	return now.Sub(f.idleSince), true
+}
+
+// endRequest Records that a request to the function was served at the time
+func (f *Function) endRequest(now time.Time) {
+	f.activity.Lock()
+	defer f.activity.Unlock()
+
+	f.inFlight--
+	if f.inFlight == 0 {
+		f.idleSince = now
+	}
+}
 
-	funcClient := *f.funcClient
+// idleTime Returns for how long the function has been idle at the time, if it has served requests and is idle
+func (f *Function) idleTime(now time.Time) (time.Duration, bool) {
+	f.activity.Lock()
+	defer f.activity.Unlock()
+
+	if f.inFlight > 0 || f.idleSince.IsZero() {
+		return 0, false
+	}
+
+	return now.Sub(f.idleSince), true
+}
+
+// reap Stops the instances of the function if the function has been idle outside of the keep-alive window at the
+// time, or otherwise all but one of its instances that have been idle beyond the window, and reports whether an
+// instance has to be pre-warmed since the function has been idle within the window
+func (f *Function) reap(now time.Time, window KeepAliveWindow) bool {
+	f.Lock()
+
+	// Requests that arrive meanwhile add new instances
+	idle, isIdle := f.idleTime(now)
+	if isIdle && !window.contains(idle) {
+		idleInstances := f.detachInstances()
+		f.Unlock()
+
+		for _, inst := range idleInstances {
+			log.WithFields(log.Fields{"fID": f.fID, "vmID": inst.vmID, "idle": idle}).Debug("Stopping the instance of the idle function")
+			_ = f.stopInstance(inst)
+		}
+
+		return false
+	}
+
+	idleInstances := f.scaleDown(now, window)
+	isToPreWarm := isIdle && len(f.instances)+f.starting == 0 && window.PreWarm > 0
+	f.Unlock()
+
+	for _, inst := range idleInstances {
+		log.WithFields(log.Fields{"fID": f.fID, "vmID": inst.vmID}).Debug("Scaling down idle instance")
+		_ = f.stopInstance(inst)
+	}
+
+	return isToPreWarm
+}
+
+// preWarm Adds an instance of the function unless it has one or one is being added
+func (f *Function) preWarm() {
+	// The failure is logged, the next request adds the instance again
+	_, _ = f.AddInstance()
+}
+
+// FwdRPC Forward the RPC to an instance, then forwards the response back.
+func (f *Function) fwdRPC(ctx context.Context, inst *instance, reqPayload string) (*hpb.HelloReply, error) {
+	logger := log.WithFields(log.Fields{"fID": f.fID, "vmID": inst.vmID})
 
 	logger.Debug("FwdRPC: Forwarding RPC to function instance")
-	resp, err := funcClient.SayHello(ctx, &hpb.HelloRequest{Name: reqPayload})
+	resp, err := inst.funcClient.SayHello(ctx, &hpb.HelloRequest{Name: reqPayload})
 	logger.Debug("FwdRPC: Received a response from the  function instance")
 
 	return resp, err
 }
 
-// AddInstance Starts a VM, waits till it is ready.
-// Note: this function is called from sync.Once construct
-func (f *Function) AddInstance() *metrics.Metric {
+// AddInstance Adds an instance of the function unless it has one or one is being added. If the instance cannot be
+// started or loaded from the snapshot, the function is left without an instance, so that the next request adds it
+// again.
+func (f *Function) AddInstance() (*metrics.Metric, error) {
+	f.Lock()
+	if len(f.instances)+f.starting > 0 {
+		f.Unlock()
+		return nil, nil
+	}
+	vmID := f.newVMID()
+	f.starting++
+	f.Unlock()
+
+	inst, metr, err := f.bootInstance(vmID)
+
 	f.Lock()
 	defer f.Unlock()
 
-	logger := log.WithFields(log.Fields{"fID": f.fID})
+	f.instanceAdded(inst, metr, err)
+
+	return metr, err
+}
+
+// bootInstance Starts a VM, or loads it from the snapshot of the function if it is ready, and waits till the function
+// in the VM is reachable.
+func (f *Function) bootInstance(vmID string) (*instance, *metrics.Metric, error) {
+	logger := log.WithFields(log.Fields{"fID": f.fID, "vmID": vmID})
 
 	logger.Debug("Adding instance")
 
-	var metr *metrics.Metric = nil
+	var (
+		metr *metrics.Metric = nil
+		resp *ctriface.StartVMResponse
+		snap *snapshotting.Snapshot
+		err  error
+	)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
 	defer cancel()
 
-	if f.isSnapshotReady {
-		var resp *ctriface.StartVMResponse
+	f.Lock()
+	isSnapshotReady := f.isSnapshotReady
+	f.Unlock()
 
-		resp, metr = f.LoadInstance(f.getVMID())
-		f.guestIP = resp.GuestIP
-		f.vmID = f.getVMID()
-		f.lastInstanceID++
+	if isSnapshotReady {
+		resp, snap, metr, err = f.LoadInstance(vmID)
+		if err != nil {
+			// The snapshot may be broken or gone, the next instance boots from scratch and is snapshotted again
+			f.Lock()
+			f.isSnapshotReady = false
+			f.OnceCreateSnapInstance = new(sync.Once)
+			f.Unlock()
+			return nil, nil, err
+		}
 	} else {
-		resp, _, err := orch.StartVM(ctx, f.getVMID(), f.imageName)
+		resp, _, err = f.vmController.StartVM(ctx, vmID, f.imageName)
 		if err != nil {
-			log.Panic(err)
+			return nil, nil, &misc.BootErr{VMID: vmID, Err: err}
 		}
-		f.guestIP = resp.GuestIP
-		f.vmID = f.getVMID()
-		f.lastInstanceID++
 	}
 
 	tStart := time.Now()
-	funcClient, err := f.getFuncClient()
+	conn, funcClient, err := getFuncClient(resp.GuestIP)
 	if metr != nil {
 		metr.MetricMap[metrics.ConnectFuncClient] = metrics.ToUS(time.Since(tStart))
 	}
 	if err != nil {
-		logger.Panic("Failed to acquire func client", err)
+		if err := f.vmController.StopSingleVM(context.Background(), vmID); err != nil {
+			logger.WithError(err).Warn("Failed to stop unreachable instance")
+		} else if snap != nil {
+			f.releaseSnapshot(snap)
+		}
+		return nil, nil, &misc.BootErr{VMID: vmID, Err: err}
 	}
-	f.funcClient = &funcClient
-
-	f.stats.IncStarted(f.fID)
 
-	return metr
+	return &instance{vmID: vmID, conn: conn, funcClient: funcClient, snap: snap}, metr, nil
 }
 
-// RemoveInstanceAsync Stops an instance (VM) of the function.
-func (f *Function) RemoveInstanceAsync() {
-	logger := log.WithFields(log.Fields{"fID": f.fID})
+// RemoveInstance Stops the instances (VMs) of the function. The instances that serve requests are stopped once they
+// have served them.
+func (f *Function) RemoveInstance(isSync bool) (string, error) {
+	logger := log.WithFields(log.Fields{"fID": f.fID, "isSync": isSync})
 
-	logger.Debug("Removing instance (async)")
+	logger.Debug("Removing instance")
 
-	go func(vmID string) {
-		err := orch.StopSingleVM(context.Background(), vmID)
-		if err != nil {
-			log.Warn(err)
+	f.Lock()
+	if len(f.instances) == 0 {
+		f.Unlock()
+		return "", misc.NonExistErr("instance of function " + f.fID)
+	}
+	idleInstances := f.detachInstances()
+	f.Unlock()
+
+	if !isSync {
+		vmIDs := make([]string, 0, len(idleInstances))
+		for _, inst := range idleInstances {
+			go f.stopInstance(inst)
+			vmIDs = append(vmIDs, inst.vmID)
 		}
-	}(f.vmID)
+		return "Successfully removed (async) instance " + strings.Join(vmIDs, ", "), nil
+	}
+
+	var err error
+	for _, inst := range idleInstances {
+		if stopErr := f.stopInstance(inst); stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}
+
+	return "", err
 }
 
-// RemoveInstance Stops an instance (VM) of the function.
-func (f *Function) RemoveInstance(isSync bool) (string, error) {
-	f.Lock()
-	defer f.Unlock()
+// detachInstances Detaches all instances of the function, and returns those that are idle, which have to be stopped
+// by the caller. It is called with the lock held.
+func (f *Function) detachInstances() []*instance {
+	instances := append([]*instance(nil), f.instances...)
 
-	logger := log.WithFields(log.Fields{"fID": f.fID, "isSync": isSync})
+	idleInstances := make([]*instance, 0, len(instances))
+	for _, inst := range instances {
+		f.detachInstance(inst)
+		if inst.inFlight == 0 {
+			idleInstances = append(idleInstances, inst)
+		}
+	}
 
-	logger.Debug("Removing instance")
+	return idleInstances
+}
 
-	var (
-		r   string
-		err error
-	)
+// removeVM Closes the connection to the instance, stops its VM and releases the snapshot it was loaded from
+func (f *Function) removeVM(inst *instance) error {
+	_ = inst.conn.Close()
 
-	f.OnceAddInstance = new(sync.Once)
+	if err := f.vmController.StopSingleVM(context.Background(), inst.vmID); err != nil {
+		return err
+	}
 
-	if isSync {
-		err = orch.StopSingleVM(context.Background(), f.vmID)
-	} else {
-		f.RemoveInstanceAsync()
-		r = "Successfully removed (async) instance " + f.vmID
+	// The VM loaded from the snapshot used its files until it stopped, which is when its working set is recorded
+	if inst.snap != nil {
+		if err := f.snapshotManager.UploadWorkingSet(inst.snap); err != nil {
+			log.WithFields(log.Fields{"fID": f.fID}).WithError(err).Warn("Failed to upload working set to the snapshot store")
+		}
+		f.releaseSnapshot(inst.snap)
 	}
 
-	return r, err
+	return nil
+}
+
+// releaseSnapshot Releases the snapshot once no VM that was loaded from it runs anymore
+func (f *Function) releaseSnapshot(snap *snapshotting.Snapshot) {
+	if err := f.snapshotManager.ReleaseSnapshot(snap); err != nil {
+		log.WithFields(log.Fields{"fID": f.fID}).WithError(err).Warn("Failed to release snapshot")
+	}
 }
 
 // DumpUPFPageStats Dumps the memory manager's stats about the number of
 // the unique pages and the number of the pages that are reused across invocations
 func (f *Function) DumpUPFPageStats(functionName, metricsOutFilePath string) error {
-	return orch.DumpUPFPageStats(f.vmID, functionName, metricsOutFilePath)
+	vmID, err := f.firstVMID()
+	if err != nil {
+		return err
+	}
+
+	return f.vmController.DumpUPFPageStats(vmID, functionName, metricsOutFilePath)
 }
 
 // DumpUPFLatencyStats Dumps the memory manager's latency stats
 func (f *Function) DumpUPFLatencyStats(functionName, latencyOutFilePath string) error {
-	return orch.DumpUPFLatencyStats(f.vmID, functionName, latencyOutFilePath)
+	vmID, err := f.firstVMID()
+	if err != nil {
+		return err
+	}
+
+	return f.vmController.DumpUPFLatencyStats(vmID, functionName, latencyOutFilePath)
 }
 
-// CreateInstanceSnapshot Creates a snapshot of the instance
-func (f *Function) CreateInstanceSnapshot() {
+// firstVMID Returns the vmID of the first instance of the function
+func (f *Function) firstVMID() (string, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if len(f.instances) == 0 {
+		return "", misc.NonExistErr("instance of function " + f.fID)
+	}
+
+	return f.instances[0].vmID, nil
+}
+
+// CreateInstanceSnapshot Creates a snapshot of the instance and resumes it. The error of resuming the instance,
+// which is not running unless it is nil, is returned separately from the error of creating the snapshot, since the
+// snapshot is committed even if the instance could not be resumed.
+func (f *Function) CreateInstanceSnapshot(vmID string) (resumeErr, err error) {
 	logger := log.WithFields(log.Fields{"fID": f.fID})
 
 	logger.Debug("Creating instance snapshot")
@@ -454,35 +654,45 @@ func (f *Function) CreateInstanceSnapshot() {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
 
-	err := orch.PauseVM(ctx, f.vmID)
-	if err != nil {
-		log.Panic(err)
+	snapErr := func(err error) error {
+		return &misc.SnapshotErr{Op: misc.SnapshotCreate, VMID: vmID, Revision: f.fID, Err: err}
 	}
 
-	snap, err := f.snapshotManager.InitSnapshot(f.fID, f.imageName)
+	err = f.vmController.PauseVM(ctx, vmID)
 	if err != nil {
-		log.Panic(err)
+		return nil, snapErr(err)
 	}
 
-	err = orch.CreateSnapshot(ctx, f.vmID, snap)
-	if err != nil {
-		log.Panic(err)
+	snap, err := f.snapshotManager.InitSnapshot(f.fID, f.imageName)
+	if err == nil {
+		err = f.vmController.CreateSnapshot(ctx, vmID, snap)
+		if err != nil {
+			if err := f.snapshotManager.AbortSnapshot(f.fID); err != nil {
+				logger.WithError(err).Warn("Failed to abort snapshot")
+			}
+		}
 	}
 
-	_, err = orch.ResumeVM(ctx, f.vmID)
+	// The instance is resumed whether or not its snapshot was created
+	_, resumeErr = f.vmController.ResumeVM(ctx, vmID)
 	if err != nil {
-		log.Panic(err)
+		return resumeErr, snapErr(err)
 	}
 
-	err = f.snapshotManager.CommitSnapshot(f.fID)
-	if err != nil {
-		log.Panic(err)
+	if err := f.snapshotManager.CommitSnapshot(f.fID); err != nil {
+		if err := f.snapshotManager.AbortSnapshot(f.fID); err != nil {
+			logger.WithError(err).Warn("Failed to abort snapshot")
+		}
+		return resumeErr, snapErr(err)
 	}
+
+	return resumeErr, nil
 }
 
-// LoadInstance Loads a new instance of the function from its snapshot and resumes it
+// LoadInstance Loads a new instance of the function from its snapshot and resumes it. The snapshot is returned
+// acquired, and has to be released once the instance is stopped, since the instance keeps using its files.
 // The tap, the shim and the vmID remain the same
-func (f *Function) LoadInstance(vmID string) (*ctriface.StartVMResponse, *metrics.Metric) {
+func (f *Function) LoadInstance(vmID string) (*ctriface.StartVMResponse, *snapshotting.Snapshot, *metrics.Metric, error) {
 	logger := log.WithFields(log.Fields{"fID": f.fID})
 
 	logger.Debug("Loading instance")
@@ -490,26 +700,37 @@ func (f *Function) LoadInstance(vmID string) (*ctriface.StartVMResponse, *metric
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
 	defer cancel()
 
+	snapErr := func(err error) error {
+		return &misc.SnapshotErr{Op: misc.SnapshotLoad, VMID: vmID, Revision: f.fID, Err: err}
+	}
+
 	snap, err := f.snapshotManager.AcquireSnapshot(f.fID)
 	if err != nil {
-		log.Panic(err)
+		return nil, nil, nil, snapErr(err)
 	}
 
-	resp, loadMetr, err := orch.LoadSnapshot(ctx, vmID, snap)
+	resp, loadMetr, err := f.vmController.LoadSnapshot(ctx, vmID, snap)
 	if err != nil {
-		log.Panic(err)
+		f.releaseSnapshot(snap)
+		return nil, nil, nil, snapErr(err)
 	}
 
-	resumeMetr, err := orch.ResumeVM(ctx, vmID)
+	resumeMetr, err := f.vmController.ResumeVM(ctx, vmID)
 	if err != nil {
-		log.Panic(err)
+		// The instance that could not be stopped may still use the snapshot
+		if err := f.vmController.StopSingleVM(context.Background(), vmID); err != nil {
+			logger.WithError(err).Warn("Failed to stop instance that could not be resumed")
+		} else {
+			f.releaseSnapshot(snap)
+		}
+		return nil, nil, nil, snapErr(err)
 	}
 
 	for k, v := range resumeMetr.MetricMap {
 		loadMetr.MetricMap[k] = v
 	}
 
-	return resp, loadMetr
+	return resp, snap, loadMetr, nil
 }
 
 // GetStatServed Returns the served counter value
@@ -522,12 +743,15 @@ func (f *Function) ZeroServedStat() {
 	atomic.StoreUint64(&f.stats.statMap[f.fID].served, 0)
 }
 
-// getVMID Creates the vmID for the function
-func (f *Function) getVMID() string {
-	return fmt.Sprintf("%s-%d", f.fID, f.lastInstanceID)
+// newVMID Creates the vmID for a new instance of the function, which is never reused. It is called with the lock held.
+func (f *Function) newVMID() string {
+	vmID := fmt.Sprintf("%s-%d", f.fID, f.lastInstanceID)
+	f.lastInstanceID++
+
+	return vmID
 }
 
-func (f *Function) getFuncClient() (hpb.GreeterClient, error) {
+func getFuncClient(guestIP string) (*grpc.ClientConn, hpb.GreeterClient, error) {
 	backoffConfig := backoff.DefaultConfig
 	backoffConfig.MaxDelay = 5 * time.Second
 	connParams := grpc.ConnectParams{
@@ -540,18 +764,18 @@ func (f *Function) getFuncClient() (hpb.GreeterClient, error) {
 		grpc.WithContextDialer(contextDialer),
 	}
 
-	conn, err := grpc.NewClient(f.guestIP+":50051", gopts...)
+	conn, err := grpc.NewClient(guestIP+":50051", gopts...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	f.conn = conn
 
 	// This timeout must be large enough for all functions to start up (e.g., ML training takes few seconds)
 	if err := common.WaitForConnectionReady(conn, 60*time.Second); err != nil {
-		return nil, err
+		_ = conn.Close()
+		return nil, nil, err
 	}
 
-	return hpb.NewGreeterClient(conn), nil
+	return conn, hpb.NewGreeterClient(conn), nil
 }
 
 func contextDialer(ctx context.Context, address string) (net.Conn, error) {
@@ -0,0 +1,232 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Plamen Petrov and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/ctriface/fake"
+	hpb "github.com/vhive-serverless/vhive/examples/protobuf/helloworld"
+	"github.com/vhive-serverless/vhive/misc"
+	"github.com/vhive-serverless/vhive/snapshotting"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// failFirst Fails the first call to each of the methods
+func failFirst(methods ...fake.Method) fake.Option {
+	failed := make(map[fake.Method]bool)
+	return fake.WithFailureFunc(func(call fake.Call) error {
+		for _, method := range methods {
+			if call.Method == method && !failed[method] {
+				failed[method] = true
+				return errors.New("injected failure")
+			}
+		}
+		return nil
+	})
+}
+
+// newFakeFuncPool Returns a function pool whose functions run in fake VMs and keep their snapshots in a temporary
+// directory
+func newFakeFuncPool(t *testing.T, snapshotsEnabled bool, opts ...fake.Option) (*FuncPool, *fake.VMController) {
+	if *isRealOrchTest {
+		t.Skip("skipping test that runs functions in fake VMs")
+	}
+
+	// The options may serve other guest services
+	opts = append([]fake.Option{fake.WithGuestServices(func(s *grpc.Server) {
+		hpb.RegisterGreeterServer(s, &testGreeter{})
+	})}, opts...)
+	vmc := fake.NewVMController(opts...)
+
+	var (
+		keepAlive     = NewNeverEvict()
+		pinnedFuncNum int
+	)
+	p := NewFuncPool(vmc, snapshotsEnabled, !isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, snapshotting.NewSnapshotManager(t.TempDir()))
+
+	return p, vmc
+}
+
+func TestServeBootFailure(t *testing.T) {
+	fID := "boot-failure"
+	p, vmc := newFakeFuncPool(t, false, failFirst(fake.StartVM))
+
+	_, _, err := p.Serve(context.Background(), fID, testImageName, "world")
+	var bootErr *misc.BootErr
+	require.ErrorAs(t, err, &bootErr, "Failed boot was not reported")
+	require.Equal(t, codes.Unavailable, status.Code(statusError(err)))
+
+	// The next request starts the instance again
+	resp, _, err := p.Serve(context.Background(), fID, testImageName, "world")
+	require.NoError(t, err, "Function returned error")
+	require.True(t, resp.IsColdStart)
+	require.Equal(t, "Hello, world!", resp.Payload)
+
+	require.Equal(t, 2, vmc.CallCount(fake.StartVM))
+	require.Equal(t, 1, int(p.stats.statMap[fID].started), "Cold start (starts) stats are wrong")
+	require.Equal(t, 1, int(p.stats.statMap[fID].served), "Cold start (served) stats are wrong")
+
+	message, err := p.RemoveInstance(fID, testImageName, true)
+	require.NoError(t, err, "Function returned error, "+message)
+}
+
+func TestAddInstanceBootFailure(t *testing.T) {
+	fID := "add-failure"
+	p, vmc := newFakeFuncPool(t, false, failFirst(fake.StartVM))
+
+	_, err := p.AddInstance(fID, testImageName)
+	var bootErr *misc.BootErr
+	require.ErrorAs(t, err, &bootErr, "Failed boot was not reported")
+
+	message, err := p.AddInstance(fID, testImageName)
+	require.NoError(t, err, "Function returned error, "+message)
+	require.Len(t, vmc.VMs(), 1)
+
+	message, err = p.RemoveInstance(fID, testImageName, true)
+	require.NoError(t, err, "Function returned error, "+message)
+
+	// Removing the instance again fails since it does not exist anymore
+	_, err = p.RemoveInstance(fID, testImageName, true)
+	var nonExistErr misc.NonExistErr
+	require.ErrorAs(t, err, &nonExistErr)
+	require.Equal(t, codes.NotFound, status.Code(statusError(err)))
+}
+
+func TestServeSnapshotFailures(t *testing.T) {
+	fID := "snapshot-failure"
+	p, vmc := newFakeFuncPool(t, true, failFirst(fake.CreateSnapshot, fake.LoadSnapshot))
+
+	serve := func() *hpb.FwdHelloResp {
+		resp, _, err := p.Serve(context.Background(), fID, testImageName, "world")
+		require.NoError(t, err, "Function returned error")
+		require.Equal(t, "Hello, world!", resp.Payload)
+		return resp
+	}
+	remove := func() {
+		message, err := p.RemoveInstance(fID, testImageName, true)
+		require.NoError(t, err, "Function returned error, "+message)
+	}
+
+	// Failing to create the snapshot does not fail the request, the next request creates it
+	serve()
+	require.False(t, p.funcMap[fID].isSnapshotReady, "Failed snapshot is ready")
+	serve()
+	require.True(t, p.funcMap[fID].isSnapshotReady, "Snapshot was not created again")
+	remove()
+
+	// Failing to load the snapshot fails the request, the next request boots the instance from scratch
+	_, _, err := p.Serve(context.Background(), fID, testImageName, "world")
+	var snapErr *misc.SnapshotErr
+	require.ErrorAs(t, err, &snapErr, "Failed snapshot load was not reported")
+	require.Equal(t, misc.SnapshotLoad, snapErr.Op)
+	require.Equal(t, codes.Unavailable, status.Code(statusError(err)))
+
+	serve()
+	remove()
+
+	// The instance booted from scratch was snapshotted again, which the next instance is loaded from
+	serve()
+	remove()
+
+	require.Equal(t, 2, vmc.CallCount(fake.StartVM))
+	require.Equal(t, 3, vmc.CallCount(fake.CreateSnapshot))
+	require.Equal(t, 2, vmc.CallCount(fake.LoadSnapshot))
+	require.Empty(t, vmc.VMs(), "VMs were not stopped")
+}
+
+func TestSnapshotHeldWhileLoaded(t *testing.T) {
+	fID := "snapshot-held"
+	p, _ := newFakeFuncPool(t, true)
+
+	for i := 0; i < 2; i++ {
+		_, _, err := p.Serve(context.Background(), fID, testImageName, "world")
+		require.NoError(t, err, "Function returned error")
+		if i == 0 {
+			message, err := p.RemoveInstance(fID, testImageName, true)
+			require.NoError(t, err, "Function returned error, "+message)
+		}
+	}
+
+	// The instance loaded from the snapshot holds it until the instance is removed
+	f := p.funcMap[fID]
+	require.Len(t, f.instances, 1)
+	snap := f.instances[0].snap
+	require.NotNil(t, snap, "Snapshot is not held by the loaded instance")
+
+	message, err := p.RemoveInstance(fID, testImageName, true)
+	require.NoError(t, err, "Function returned error, "+message)
+	require.Error(t, p.snapshotManager.ReleaseSnapshot(snap), "Snapshot is still in use")
+}
+
+func TestServeSnapshotResumeFailure(t *testing.T) {
+	fID := "resume-failure"
+	p, vmc := newFakeFuncPool(t, true, failFirst(fake.ResumeVM))
+
+	// The snapshot is committed even though the instance could not be resumed, which is stopped
+	resp, _, err := p.Serve(context.Background(), fID, testImageName, "world")
+	require.NoError(t, err, "Function returned error")
+	require.Equal(t, "Hello, world!", resp.Payload)
+	require.True(t, p.funcMap[fID].isSnapshotReady, "Snapshot was discarded")
+	require.Eventually(t, func() bool { return len(vmc.VMs()) == 0 }, 10*time.Second, time.Millisecond,
+		"Instance that could not be resumed was not stopped")
+
+	// The next instance is loaded from the snapshot
+	resp, _, err = p.Serve(context.Background(), fID, testImageName, "world")
+	require.NoError(t, err, "Function returned error")
+	require.Equal(t, "Hello, world!", resp.Payload)
+
+	message, err := p.RemoveInstance(fID, testImageName, true)
+	require.NoError(t, err, "Function returned error, "+message)
+
+	require.Equal(t, 1, vmc.CallCount(fake.StartVM))
+	require.Equal(t, 1, vmc.CallCount(fake.CreateSnapshot))
+	require.Equal(t, 1, vmc.CallCount(fake.LoadSnapshot))
+}
+
+func TestDumpUPFStats(t *testing.T) {
+	fID := "dump-stats"
+	p, vmc := newFakeFuncPool(t, false)
+
+	// The stats of functions without instances cannot be dumped
+	err := p.DumpUPFPageStats(fID, testImageName, fID, "")
+	var nonExistErr misc.NonExistErr
+	require.ErrorAs(t, err, &nonExistErr)
+
+	_, _, err = p.Serve(context.Background(), fID, testImageName, "world")
+	require.NoError(t, err, "Function returned error")
+
+	require.NoError(t, p.DumpUPFPageStats(fID, testImageName, fID, ""), "Failed to dump page stats")
+	require.NoError(t, p.DumpUPFLatencyStats(fID, testImageName, fID, ""), "Failed to dump latency stats")
+	require.Equal(t, 1, vmc.CallCount(fake.DumpUPFPageStats))
+	require.Equal(t, 1, vmc.CallCount(fake.DumpUPFLatencyStats))
+
+	message, err := p.RemoveInstance(fID, testImageName, true)
+	require.NoError(t, err, "Function returned error, "+message)
+}
@@ -0,0 +1,250 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Plamen Petrov and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// KeepAliveForever Keep-alive duration of the instances that are never stopped
+const KeepAliveForever = time.Duration(math.MaxInt64)
+
+// KeepAliveWindow Period during which the instance of an idle function is kept alive, relative to the end of the
+// last request to the function. The instance is stopped as soon as the function becomes idle if PreWarm is positive,
+// started again once the function has been idle for PreWarm, and stopped after it has been idle for
+// PreWarm+KeepAlive.
+type KeepAliveWindow struct {
+	PreWarm   time.Duration
+	KeepAlive time.Duration
+}
+
+// contains reports whether the instance of a function that has been idle for the duration is kept alive
+func (w KeepAliveWindow) contains(idle time.Duration) bool {
+	return idle >= w.PreWarm && idle-w.PreWarm < w.KeepAlive
+}
+
+// expired reports whether an instance that has been idle for the duration is past the end of the window
+func (w KeepAliveWindow) expired(idle time.Duration) bool {
+	return idle >= w.PreWarm && idle-w.PreWarm >= w.KeepAlive
+}
+
+// KeepAlivePolicy Decides how long the instances of idle functions are kept alive
+type KeepAlivePolicy interface {
+	// RecordIdle records that a request to the function arrived after the function had been idle for the duration
+	RecordIdle(fID string, idle time.Duration)
+	// Window returns the keep-alive window of the function
+	Window(fID string) KeepAliveWindow
+}
+
+// ParseKeepAlivePolicy Returns the keep-alive policy with the given name, where ttl is the keep-alive duration of the
+// fixed policy and of the functions whose idle times the hybrid policy cannot predict
+func ParseKeepAlivePolicy(name string, ttl time.Duration) (KeepAlivePolicy, error) {
+	switch name {
+	case "fixed":
+		return NewFixedKeepAlive(ttl), nil
+	case "hybrid":
+		cfg := DefaultHybridKeepAliveCfg()
+		cfg.Fallback = ttl
+		return NewHybridKeepAlive(cfg), nil
+	case "never":
+		return NewNeverEvict(), nil
+	default:
+		return nil, fmt.Errorf("unknown keep-alive policy %q", name)
+	}
+}
+
+//////////////////////////////// Fixed keep-alive //////////////////////////////////////////////
+
+type fixedKeepAlive struct {
+	ttl time.Duration
+}
+
+// NewFixedKeepAlive Returns a policy that keeps the instances of idle functions alive for ttl
+func NewFixedKeepAlive(ttl time.Duration) KeepAlivePolicy {
+	return &fixedKeepAlive{ttl: ttl}
+}
+
+func (p *fixedKeepAlive) RecordIdle(string, time.Duration) {}
+
+func (p *fixedKeepAlive) Window(string) KeepAliveWindow {
+	return KeepAliveWindow{KeepAlive: p.ttl}
+}
+
+//////////////////////////////// Never evict //////////////////////////////////////////////
+
+type neverEvict struct{}
+
+// NewNeverEvict Returns a policy that keeps the instances of idle functions alive forever
+func NewNeverEvict() KeepAlivePolicy {
+	return neverEvict{}
+}
+
+func (neverEvict) RecordIdle(string, time.Duration) {}
+
+func (neverEvict) Window(string) KeepAliveWindow {
+	return KeepAliveWindow{KeepAlive: KeepAliveForever}
+}
+
+//////////////////////////////// Hybrid keep-alive //////////////////////////////////////////////
+
+// HybridKeepAliveCfg Configuration of the hybrid keep-alive policy, which predicts when a function is invoked next
+// from the histogram of its idle times (Shahrad et al., "Serverless in the Wild", USENIX ATC'20)
+type HybridKeepAliveCfg struct {
+	// BinWidth is the width of the bins of the histograms
+	BinWidth time.Duration
+	// Range is the longest idle time that is recorded in the histograms
+	Range time.Duration
+	// HeadPercentile of the idle times after which the instance is pre-warmed
+	HeadPercentile float64
+	// TailPercentile of the idle times after which the instance is stopped
+	TailPercentile float64
+	// Margin by which the head percentile is decreased and the tail percentile increased
+	Margin float64
+	// MinSamples is the number of idle times that have to be recorded before the histogram is used
+	MinSamples uint64
+	// CVThreshold is the coefficient of variation of the bin counts above which the histogram is representative.
+	// Flat histograms do not predict the idle times
+	CVThreshold float64
+	// Fallback keep-alive duration of the functions whose idle times cannot be predicted
+	Fallback time.Duration
+}
+
+// DefaultHybridKeepAliveCfg Returns the configuration of the hybrid policy evaluated by Shahrad et al.
+func DefaultHybridKeepAliveCfg() HybridKeepAliveCfg {
+	return HybridKeepAliveCfg{
+		BinWidth:       time.Minute,
+		Range:          4 * time.Hour,
+		HeadPercentile: 5,
+		TailPercentile: 99,
+		Margin:         0.1,
+		MinSamples:     5,
+		CVThreshold:    2,
+		Fallback:       4 * time.Hour,
+	}
+}
+
+// idleHistogram Idle times of a function
+type idleHistogram struct {
+	bins []uint64
+	// Number of idle times that are recorded in the bins
+	samples uint64
+	// Number of idle times that are longer than the range of the histogram
+	outOfBounds uint64
+}
+
+type hybridKeepAlive struct {
+	sync.Mutex
+	cfg        HybridKeepAliveCfg
+	histograms map[string]*idleHistogram
+}
+
+// NewHybridKeepAlive Returns a policy that pre-warms the instances of idle functions shortly before they are likely
+// to be invoked and keeps them alive until they are unlikely to be invoked, according to the histograms of their
+// idle times. The instances of the functions whose idle times cannot be predicted are kept alive for cfg.Fallback.
+func NewHybridKeepAlive(cfg HybridKeepAliveCfg) KeepAlivePolicy {
+	return &hybridKeepAlive{
+		cfg:        cfg,
+		histograms: make(map[string]*idleHistogram),
+	}
+}
+
+func (p *hybridKeepAlive) RecordIdle(fID string, idle time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	h, ok := p.histograms[fID]
+	if !ok {
+		h = &idleHistogram{bins: make([]uint64, p.cfg.Range/p.cfg.BinWidth)}
+		p.histograms[fID] = h
+	}
+
+	bin := int(idle / p.cfg.BinWidth)
+	if bin >= len(h.bins) {
+		h.outOfBounds++
+		return
+	}
+	h.bins[bin]++
+	h.samples++
+}
+
+func (p *hybridKeepAlive) Window(fID string) KeepAliveWindow {
+	p.Lock()
+	defer p.Unlock()
+
+	fallback := KeepAliveWindow{KeepAlive: p.cfg.Fallback}
+
+	// Functions that are mostly idle for longer than the range are not predicted by the histogram
+	h, ok := p.histograms[fID]
+	if !ok || h.samples < p.cfg.MinSamples || h.outOfBounds > h.samples || !h.isRepresentative(p.cfg.CVThreshold) {
+		return fallback
+	}
+
+	var (
+		head = time.Duration(float64(h.percentile(p.cfg.HeadPercentile)) * float64(p.cfg.BinWidth) * (1 - p.cfg.Margin))
+		tail = time.Duration(float64(h.percentile(p.cfg.TailPercentile)+1) * float64(p.cfg.BinWidth) * (1 + p.cfg.Margin))
+	)
+
+	return KeepAliveWindow{PreWarm: head, KeepAlive: tail - head}
+}
+
+// isRepresentative reports whether the coefficient of variation of the bin counts exceeds the threshold
+func (h *idleHistogram) isRepresentative(cvThreshold float64) bool {
+	mean := float64(h.samples) / float64(len(h.bins))
+
+	var variance float64
+	for _, count := range h.bins {
+		variance += (float64(count) - mean) * (float64(count) - mean)
+	}
+	variance /= float64(len(h.bins))
+
+	return math.Sqrt(variance)/mean > cvThreshold
+}
+
+// percentile returns the index of the bin that contains the percentile of the idle times in the histogram
+func (h *idleHistogram) percentile(percentile float64) int {
+	target := uint64(math.Ceil(percentile / 100 * float64(h.samples)))
+
+	var count uint64
+	for bin, binCount := range h.bins {
+		count += binCount
+		if count >= max(target, 1) {
+			return bin
+		}
+	}
+
+	return len(h.bins) - 1
+}
+
+// Clock Tells the time of the function pool, which is simulated in tests
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,229 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Plamen Petrov and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/ctriface/fake"
+)
+
+// newKeepAliveFuncPool Returns a function pool in the save memory mode, whose functions run in fake VMs and are kept
+// alive according to the policy with the simulated clock
+func newKeepAliveFuncPool(t *testing.T, keepAlive KeepAlivePolicy, opts ...fake.Option) (*FuncPool, *fake.VMController, *simClock) {
+	p, vmc := newFakeFuncPool(t, false, opts...)
+	p.saveMemoryMode = true
+	p.keepAlive = keepAlive
+
+	clock := newSimClock()
+	p.clock = clock
+
+	return p, vmc, clock
+}
+
+func testHybridKeepAliveCfg() HybridKeepAliveCfg {
+	return HybridKeepAliveCfg{
+		BinWidth:       time.Minute,
+		Range:          time.Hour,
+		HeadPercentile: 5,
+		TailPercentile: 99,
+		Margin:         0.1,
+		MinSamples:     3,
+		CVThreshold:    2,
+		Fallback:       5 * time.Minute,
+	}
+}
+
+func TestParseKeepAlivePolicy(t *testing.T) {
+	for _, name := range []string{"fixed", "hybrid", "never"} {
+		policy, err := ParseKeepAlivePolicy(name, time.Minute)
+		require.NoError(t, err, "Failed to parse policy "+name)
+		require.NotNil(t, policy)
+	}
+
+	_, err := ParseKeepAlivePolicy("lru", time.Minute)
+	require.Error(t, err, "Unknown policy was parsed")
+}
+
+func TestFixedKeepAlive(t *testing.T) {
+	policy := NewFixedKeepAlive(10 * time.Minute)
+	policy.RecordIdle("f", time.Hour)
+
+	window := policy.Window("f")
+	require.Equal(t, KeepAliveWindow{KeepAlive: 10 * time.Minute}, window)
+	require.True(t, window.contains(0))
+	require.True(t, window.contains(10*time.Minute-time.Second))
+	require.False(t, window.contains(10*time.Minute))
+}
+
+func TestNeverEvict(t *testing.T) {
+	policy := NewNeverEvict()
+	policy.RecordIdle("f", time.Minute)
+
+	window := policy.Window("f")
+	require.True(t, window.contains(0))
+	require.True(t, window.contains(365*24*time.Hour))
+}
+
+func TestHybridKeepAliveFallback(t *testing.T) {
+	cfg := testHybridKeepAliveCfg()
+	fallback := KeepAliveWindow{KeepAlive: cfg.Fallback}
+
+	policy := NewHybridKeepAlive(cfg)
+	require.Equal(t, fallback, policy.Window("unknown"), "Function without idle times is predicted")
+
+	// Too few idle times
+	policy.RecordIdle("few", 10*time.Minute)
+	policy.RecordIdle("few", 10*time.Minute)
+	require.Equal(t, fallback, policy.Window("few"), "Function with too few idle times is predicted")
+
+	// Most idle times are longer than the range of the histogram
+	for i := 0; i < 3; i++ {
+		policy.RecordIdle("rare", 10*time.Minute)
+	}
+	for i := 0; i < 4; i++ {
+		policy.RecordIdle("rare", 2*time.Hour)
+	}
+	require.Equal(t, fallback, policy.Window("rare"), "Function that is mostly idle out of range is predicted")
+
+	// Idle times spread evenly over the histogram
+	for i := 0; i < 60; i++ {
+		policy.RecordIdle("flat", time.Duration(i)*time.Minute)
+	}
+	require.Equal(t, fallback, policy.Window("flat"), "Function with a flat histogram is predicted")
+}
+
+func TestHybridKeepAlivePrediction(t *testing.T) {
+	policy := NewHybridKeepAlive(testHybridKeepAliveCfg())
+
+	for i := 0; i < 10; i++ {
+		policy.RecordIdle("periodic", 30*time.Minute+time.Duration(i)*time.Second)
+	}
+
+	// The instance is pre-warmed 10% before the head bin, and kept alive until 10% after the tail bin
+	window := policy.Window("periodic")
+	require.Equal(t, 27*time.Minute, window.PreWarm)
+	require.Equal(t, 34*time.Minute+6*time.Second, window.PreWarm+window.KeepAlive)
+
+	require.False(t, window.contains(time.Minute), "Instance is kept alive before the function is invoked")
+	require.True(t, window.contains(30*time.Minute), "Instance is not kept alive when the function is invoked")
+	require.False(t, window.contains(35*time.Minute), "Instance is kept alive after the function is invoked")
+
+	// Other functions are not affected
+	require.Equal(t, KeepAliveWindow{KeepAlive: 5 * time.Minute}, policy.Window("other"))
+}
+
+func TestReapIdleInstances(t *testing.T) {
+	fID := "10"
+	p, vmc, clock := newKeepAliveFuncPool(t, NewFixedKeepAlive(time.Minute))
+
+	serve := func() bool {
+		resp, _, err := p.Serve(context.Background(), fID, testImageName, "world")
+		require.NoError(t, err, "Function returned error")
+		require.Equal(t, "Hello, world!", resp.Payload)
+		return resp.IsColdStart
+	}
+
+	require.True(t, serve())
+
+	clock.Advance(30 * time.Second)
+	p.reapIdleInstances(clock.Now())
+	require.Equal(t, 0, vmc.CallCount(fake.StopSingleVM), "Instance was stopped within its keep-alive window")
+	require.False(t, serve())
+
+	clock.Advance(time.Minute)
+	p.reapIdleInstances(clock.Now())
+	require.Equal(t, 1, vmc.CallCount(fake.StopSingleVM), "Idle instance was not stopped")
+	require.Empty(t, vmc.VMs())
+
+	// Reaping again does not stop the stopped instance
+	clock.Advance(time.Minute)
+	p.reapIdleInstances(clock.Now())
+	require.Equal(t, 1, vmc.CallCount(fake.StopSingleVM))
+
+	require.True(t, serve())
+	require.Equal(t, 2, int(p.stats.statMap[fID].started), "Cold start (starts) stats are wrong")
+
+	message, err := p.RemoveInstance(fID, testImageName, true)
+	require.NoError(t, err, "Function returned error, "+message)
+}
+
+func TestReapPinnedInstances(t *testing.T) {
+	p, vmc, clock := newKeepAliveFuncPool(t, NewFixedKeepAlive(time.Minute))
+
+	for _, fID := range []string{"0", "not-numeric"} {
+		_, _, err := p.Serve(context.Background(), fID, testImageName, "world")
+		require.NoError(t, err, "Function returned error")
+	}
+
+	clock.Advance(time.Hour)
+	p.reapIdleInstances(clock.Now())
+	require.Equal(t, 0, vmc.CallCount(fake.StopSingleVM), "Pinned instance was stopped")
+	require.Len(t, vmc.VMs(), 2)
+}
+
+func TestReapPreWarm(t *testing.T) {
+	fID := "11"
+	cfg := testHybridKeepAliveCfg()
+	cfg.Margin = 0
+	p, vmc, clock := newKeepAliveFuncPool(t, NewHybridKeepAlive(cfg))
+
+	serve := func() bool {
+		resp, _, err := p.Serve(context.Background(), fID, testImageName, "world")
+		require.NoError(t, err, "Function returned error")
+		require.Equal(t, "Hello, world!", resp.Payload)
+		return resp.IsColdStart
+	}
+
+	// The function is invoked every 10 minutes
+	require.True(t, serve())
+	for i := 0; i < 3; i++ {
+		clock.Advance(10 * time.Minute)
+		require.False(t, serve())
+	}
+	require.Equal(t, KeepAliveWindow{PreWarm: 10 * time.Minute, KeepAlive: time.Minute}, p.keepAlive.Window(fID))
+
+	// The instance is stopped until the function is about to be invoked again
+	clock.Advance(time.Second)
+	p.reapIdleInstances(clock.Now())
+	require.Equal(t, 1, vmc.CallCount(fake.StopSingleVM), "Instance was not stopped before its keep-alive window")
+
+	clock.Advance(10*time.Minute - time.Second)
+	p.reapIdleInstances(clock.Now())
+	require.Equal(t, 2, vmc.CallCount(fake.StartVM), "Instance was not pre-warmed")
+	require.False(t, serve(), "Request to the pre-warmed instance was a cold start")
+
+	// The instance is stopped once the function is not invoked within the window
+	clock.Advance(time.Second)
+	p.reapIdleInstances(clock.Now())
+	clock.Advance(10 * time.Minute)
+	p.reapIdleInstances(clock.Now())
+	require.Equal(t, 3, vmc.CallCount(fake.StartVM))
+	clock.Advance(time.Minute)
+	p.reapIdleInstances(clock.Now())
+	require.Equal(t, 3, vmc.CallCount(fake.StopSingleVM), "Instance was not stopped after its keep-alive window")
+	require.Empty(t, vmc.VMs())
+}
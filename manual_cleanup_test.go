@@ -34,10 +34,10 @@ import (
 
 func TestParallelServe(t *testing.T) {
 	var (
-		servedTh      uint64 = 1
+		keepAlive     = NewNeverEvict()
 		pinnedFuncNum int
 	)
-	funcPool = NewFuncPool(isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	// Pull image to work around parallel pulling limitation
 	resp, _, err := funcPool.Serve(context.Background(), "plr-fnc", testImageName, "world")
@@ -69,10 +69,10 @@ func TestParallelServe(t *testing.T) {
 func TestServeThree(t *testing.T) {
 	fID := "200"
 	var (
-		servedTh      uint64 = 1
+		keepAlive     = NewNeverEvict()
 		pinnedFuncNum int
 	)
-	funcPool = NewFuncPool(isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	resp, _, err := funcPool.Serve(context.Background(), fID, testImageName, "world")
 	require.NoError(t, err, "Function returned error on 1st run")
@@ -0,0 +1,169 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+const (
+	// uffdMsgBatchSize is the maximum number of uffd_msgs read from the userfaultfd at once
+	uffdMsgBatchSize = 16
+	// defaultFaultWorkers is the default number of workers serving the page faults of a VM
+	defaultFaultWorkers = 4
+)
+
+// pageFault is a page fault dispatched to the fault workers.
+type pageFault struct {
+	address uint64
+	// address of the faulting guest page, which identifies the faults on the same page
+	pageAddr uint64
+}
+
+// faultDispatcher serves the page faults read by the poller of a VM on a pool of workers, so that the faults of
+// different vCPUs are served concurrently. A fault on a page that is already being served is dropped, since
+// installing the page wakes all the threads waiting on it.
+type faultDispatcher struct {
+	state   *SnapshotState
+	fd      int
+	faultCh chan pageFault
+	// faults that have been dispatched and not served yet
+	pending   sync.WaitGroup
+	workersWG sync.WaitGroup
+
+	mu sync.Mutex
+	// faulting pages that are being served
+	inflight map[uint64]struct{}
+	// first error returned by a worker
+	err error
+}
+
+// newFaultDispatcher starts the workers serving the page faults on the userfaultfd fd.
+func newFaultDispatcher(s *SnapshotState, fd, workers int) *faultDispatcher {
+	d := &faultDispatcher{
+		state:    s,
+		fd:       fd,
+		faultCh:  make(chan pageFault, workers),
+		inflight: make(map[uint64]struct{}),
+	}
+
+	d.workersWG.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.serveFaults()
+	}
+
+	return d
+}
+
+func (d *faultDispatcher) serveFaults() {
+	defer d.workersWG.Done()
+
+	for fault := range d.faultCh {
+		err := d.state.servePageFault(d.fd, fault.address)
+
+		d.mu.Lock()
+		delete(d.inflight, fault.pageAddr)
+		if err != nil && d.err == nil {
+			d.err = fmt.Errorf("serving page fault at %#x: %w", fault.address, err)
+		}
+		d.mu.Unlock()
+		d.pending.Done()
+	}
+}
+
+// dispatch hands a page fault to the workers, unless its page is already being served. It returns the first error
+// returned by a worker, after which the VM's page faults can no longer be served.
+func (d *faultDispatcher) dispatch(address uint64) error {
+	copyArgs, err := pageFaultCopyArgsForFault(d.state.guestRegionMappings, address)
+	if err != nil {
+		return fmt.Errorf("serving page fault at %#x: %w", address, err)
+	}
+
+	d.mu.Lock()
+	if d.err != nil {
+		defer d.mu.Unlock()
+		return d.err
+	}
+	if _, ok := d.inflight[copyArgs.dstAddr]; ok {
+		d.mu.Unlock()
+		return nil
+	}
+	d.inflight[copyArgs.dstAddr] = struct{}{}
+	d.mu.Unlock()
+
+	d.pending.Add(1)
+	d.faultCh <- pageFault{address: address, pageAddr: copyArgs.dstAddr}
+
+	return nil
+}
+
+// wait waits until all the dispatched page faults have been served, and returns the first error returned by a
+// worker.
+func (d *faultDispatcher) wait() error {
+	d.pending.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.err
+}
+
+// stop waits for the dispatched page faults to be served and stops the workers.
+func (d *faultDispatcher) stop() {
+	close(d.faultCh)
+	d.workersWG.Wait()
+}
+
+// handleUffdMsgs handles a batch of uffd_msgs read from the userfaultfd. With a dispatcher, page faults are served
+// by its workers, while the other events are handled once the page faults read before them have been served, so
+// that, e.g., a page that is removed after being faulted on is served with zeros afterward.
+func (s *SnapshotState) handleUffdMsgs(fd int, msgs []byte, dispatcher *faultDispatcher) error {
+	msgSize := sizeOfUFFDMsg()
+	if len(msgs)%msgSize != 0 {
+		return fmt.Errorf("read incomplete uffd_msg: %d bytes", len(msgs))
+	}
+
+	for ; len(msgs) > 0; msgs = msgs[msgSize:] {
+		msg := msgs[:msgSize]
+
+		if dispatcher != nil {
+			if msg[0] == uffdPageFault() {
+				if err := dispatcher.dispatch(binary.LittleEndian.Uint64(msg[16:])); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := dispatcher.wait(); err != nil {
+				return err
+			}
+		}
+
+		if err := s.handleUffdMsg(fd, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
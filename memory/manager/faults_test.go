@@ -0,0 +1,136 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// gatedUffd blocks the copies until the gate is closed, reporting each copy that starts on entered.
+type gatedUffd struct {
+	*fakeUffd
+	gate    chan struct{}
+	entered chan uint64
+}
+
+func (g *gatedUffd) copyPages(fd int, src, dst, mode, length uint64) (uint64, error) {
+	g.entered <- dst
+	<-g.gate
+	return g.fakeUffd.copyPages(fd, src, dst, mode, length)
+}
+
+func TestFaultDispatcherServesFaultsConcurrently(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+
+	state, fake := newReplayState(t, PrefetchCfg{}, baseAddr, 4)
+	uffd := &gatedUffd{fakeUffd: fake, gate: make(chan struct{}), entered: make(chan uint64, 8)}
+	state.uffd = uffd
+
+	dispatcher := newFaultDispatcher(state, 0, 4)
+	defer dispatcher.stop()
+
+	var msgs []byte
+	for _, addr := range []uint64{baseAddr, baseAddr + pageSize, baseAddr + pageSize + 0x10, baseAddr + 2*pageSize} {
+		msgs = append(msgs, uffdPageFaultMsg(addr)...)
+	}
+	msgs = append(msgs, uffdRangeMsg(uffdEventRemove(), baseAddr+3*pageSize, baseAddr+4*pageSize)...)
+	msgs = append(msgs, uffdPageFaultMsg(baseAddr+3*pageSize)...)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- state.handleUffdMsgs(0, msgs, dispatcher) }()
+
+	// The faults on different pages are served at the same time, while the second fault on page 1 is dropped
+	var entered []uint64
+	for len(entered) < 3 {
+		select {
+		case dst := <-uffd.entered:
+			entered = append(entered, dst)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("copies in progress = %#x, want 3 concurrent copies", entered)
+		}
+	}
+	close(uffd.gate)
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("handleUffdMsgs returned error: %v", err)
+	}
+	if err := dispatcher.wait(); err != nil {
+		t.Fatalf("wait returned error: %v", err)
+	}
+
+	copies := uffd.ops[:3]
+	sort.Slice(copies, func(i, j int) bool { return copies[i].dst < copies[j].dst })
+	want := []fakeUffdOp{
+		{src: testGuestMemPointer(t, state.guestMem, 0), dst: baseAddr, length: pageSize},
+		{src: testGuestMemPointer(t, state.guestMem, pageSize), dst: baseAddr + pageSize, length: pageSize},
+		{src: testGuestMemPointer(t, state.guestMem, 2*pageSize), dst: baseAddr + 2*pageSize, length: pageSize},
+		// The removed page is served after the faults read before the removal
+		{zero: true, dst: baseAddr + 3*pageSize, length: pageSize},
+	}
+	if !reflect.DeepEqual(uffd.ops, want) {
+		t.Fatalf("uffd ops = %+v, want %+v", uffd.ops, want)
+	}
+}
+
+func TestFaultDispatcherRecordsConcurrentFaults(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+	pages := uint64(64)
+
+	dir := t.TempDir()
+	guestMemPath := filepath.Join(dir, "mem_file")
+	prepareGuestMemoryFile(t, guestMemPath, int(pages*pageSize))
+
+	state := NewSnapshotState(SnapshotStateCfg{
+		VMID:           "vm-record",
+		GuestMemPath:   guestMemPath,
+		WorkingSetPath: filepath.Join(dir, "working_set_pages"),
+		TracePath:      filepath.Join(dir, "trace"),
+		GuestMemSize:   int(pages * pageSize),
+		metricsModeOn:  true,
+	})
+	uffd := activateWithFakeUffd(t, state, []GuestRegionUffdMapping{{
+		BaseHostVirtAddr: baseAddr,
+		Size:             pages * pageSize,
+		PageSize:         pageSize,
+	}})
+	t.Cleanup(func() { _ = state.unmapGuestMemory() })
+
+	dispatcher := newFaultDispatcher(state, 0, 8)
+	for round := 0; round < 2; round++ {
+		var msgs []byte
+		for page := uint64(0); page < pages; page++ {
+			msgs = append(msgs, uffdPageFaultMsg(baseAddr+page*pageSize)...)
+		}
+		if err := state.handleUffdMsgs(0, msgs, dispatcher); err != nil {
+			t.Fatalf("handleUffdMsgs returned error: %v", err)
+		}
+	}
+	if err := dispatcher.wait(); err != nil {
+		t.Fatalf("wait returned error: %v", err)
+	}
+	dispatcher.stop()
+
+	if got := len(state.trace.trace); got != int(pages) {
+		t.Fatalf("trace length = %d, want %d", got, pages)
+	}
+	if got := len(uffd.ops); got < int(pages) || got > 2*int(pages) {
+		t.Fatalf("uffd ops = %d, want between %d and %d", got, pages, 2*pages)
+	}
+	if _, ok := state.currentMetric.MetricMap[firstWakeMetric]; !ok {
+		t.Fatal("the first page fault was not measured")
+	}
+}
+
+func TestHandleUffdMsgsRejectsIncompleteMessages(t *testing.T) {
+	state, _ := newReplayState(t, PrefetchCfg{}, 0x7f0000000000, 4)
+
+	msg := uffdPageFaultMsg(0x7f0000000000)
+	if err := state.handleUffdMsgs(0, msg[:len(msg)-1], nil); err == nil {
+		t.Fatal("handleUffdMsgs succeeded for an incomplete uffd_msg")
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"runtime"
 	"strconv"
 	"sync"
 	"time"
@@ -41,11 +42,28 @@ const (
 	serveUniqueMetric = "ServeUnique"
 	installWSMetric   = "InstallWS"
 	fetchStateMetric  = "FetchState"
+	// time from reading the first page fault until the faulting thread is woken
+	firstWakeMetric = "FirstWake"
 )
 
 // MemoryManagerCfg Global config of the manager
 type MemoryManagerCfg struct {
 	MetricsModeOn bool
+	// InstallParallelism bounds the number of concurrent copies that install the working set of a VM,
+	// runtime.NumCPU() by default
+	InstallParallelism int
+	// FaultWorkers is the number of goroutines serving the page faults of each VM concurrently, 4 by default. With a
+	// single worker, the faults are served one at a time by the goroutine that reads them
+	FaultWorkers int
+	// FaultTraceDir is the directory where the page faults of each VM activation are stored as a trace for offline
+	// analysis, e.g., with vhive-trace, disabled if empty
+	FaultTraceDir string
+	// RerecordThreshold is the ratio of the pages that a VM faults on outside the recorded working set of its
+	// snapshot to the size of the working set, above which these pages are merged into the working set when the VM
+	// is deactivated, disabled if 0
+	RerecordThreshold float64
+	// Prefetch configures the background prefetching of the guest memory pages outside the working set
+	Prefetch PrefetchCfg
 }
 
 // MemoryManager Serves page faults coming from VMs
@@ -53,6 +71,11 @@ type MemoryManager struct {
 	sync.Mutex
 	MemoryManagerCfg
 	instances map[string]*SnapshotState // Indexed by vmID
+	// number of faults on each page outside the working set, indexed by the guest memory file of the snapshot
+	faultCounts map[string]map[uint64]uint64
+	// serializes regenerating the working set of each snapshot with loading it, indexed by the working set file
+	workingSetLocks map[string]*sync.RWMutex
+	snapshotCache   *snapshotCache
 }
 
 // NewMemoryManager Initializes a new memory manager
@@ -61,7 +84,16 @@ func NewMemoryManager(cfg MemoryManagerCfg) *MemoryManager {
 
 	m := new(MemoryManager)
 	m.instances = make(map[string]*SnapshotState)
+	m.faultCounts = make(map[string]map[uint64]uint64)
+	m.workingSetLocks = make(map[string]*sync.RWMutex)
+	m.snapshotCache = newSnapshotCache()
 	m.MemoryManagerCfg = cfg
+	if m.InstallParallelism <= 0 {
+		m.InstallParallelism = runtime.NumCPU()
+	}
+	if m.FaultWorkers <= 0 {
+		m.FaultWorkers = defaultFaultWorkers
+	}
 
 	return m
 }
@@ -83,6 +115,12 @@ func (m *MemoryManager) RegisterVM(cfg SnapshotStateCfg) error {
 	}
 
 	cfg.metricsModeOn = m.MetricsModeOn
+	cfg.installParallelism = m.InstallParallelism
+	cfg.faultWorkers = m.FaultWorkers
+	cfg.faultTraceDir = m.FaultTraceDir
+	cfg.rerecordThreshold = m.RerecordThreshold
+	cfg.snapshotCache = m.snapshotCache
+	cfg.prefetch = m.Prefetch
 	state := NewSnapshotState(cfg)
 
 	m.instances[vmID] = state
@@ -102,6 +140,12 @@ func (m *MemoryManager) PrepareSnapshotLoad(cfg SnapshotStateCfg) error {
 	}
 
 	cfg.metricsModeOn = m.MetricsModeOn
+	cfg.installParallelism = m.InstallParallelism
+	cfg.faultWorkers = m.FaultWorkers
+	cfg.faultTraceDir = m.FaultTraceDir
+	cfg.rerecordThreshold = m.RerecordThreshold
+	cfg.snapshotCache = m.snapshotCache
+	cfg.prefetch = m.Prefetch
 
 	state, ok := m.instances[vmID]
 	if !ok {
@@ -140,6 +184,7 @@ func (m *MemoryManager) DeregisterVM(vmID string) error {
 		return errors.New("failed to deactivate, VM still active")
 	}
 
+	state.releaseWorkingSet()
 	delete(m.instances, vmID)
 
 	return nil
@@ -235,7 +280,10 @@ func (m *MemoryManager) FetchState(vmID string) error {
 		tStart = time.Now()
 	}
 
+	workingSetLock := m.workingSetLock(state.WorkingSetPath)
+	workingSetLock.RLock()
 	err := state.fetchState()
+	workingSetLock.RUnlock()
 	if err == nil && !tStart.IsZero() {
 		state.currentMetric.MetricMap[fetchStateMetric] = metrics.ToUS(time.Since(tStart))
 	}
@@ -273,6 +321,7 @@ func (m *MemoryManager) Deactivate(vmID string) error {
 		return errors.New("VM not activated")
 	}
 
+	state.stopPrefetch()
 	state.stopPolling()
 	state.waitForPoller()
 	state.closeWakeFD()
@@ -281,8 +330,13 @@ func (m *MemoryManager) Deactivate(vmID string) error {
 		logger.Error("Failed to munmap guest memory")
 		return err
 	}
+	state.releaseWorkingSet()
 
 	state.processMetrics()
+	m.mergeFaultCounts(state)
+	if err := state.writeFaultTrace(); err != nil {
+		logger.WithError(err).Warn("Failed to write the fault trace")
+	}
 
 	if state.userFaultFD != nil {
 		defer func() { _ = state.userFaultFD.Close() }()
@@ -293,10 +347,29 @@ func (m *MemoryManager) Deactivate(vmID string) error {
 		if err != nil {
 			return err
 		}
-		if err := state.trace.ProcessRecord(state.GuestMemPath, state.WorkingSetPath, pageSize); err != nil {
+		guestMem, err := state.openGuestMemFile()
+		if err != nil {
+			return err
+		}
+		err = state.trace.processRecordFrom(guestMem, state.WorkingSetPath, pageSize)
+		_ = guestMem.Close()
+		if err != nil {
 			return err
 		}
+		// Replay the persisted working set, which may have been recorded by another VM loaded from the same snapshot
+		state.loadRecordedWorkingSet()
+	} else if state.missRatio() > m.RerecordThreshold {
+		logger.WithField("missRatio", state.missRatio()).Debug("Merging the missed pages into the working set")
+
+		workingSetLock := m.workingSetLock(state.WorkingSetPath)
+		workingSetLock.Lock()
+		err := state.mergeMissedPages()
+		workingSetLock.Unlock()
+		if err != nil {
+			logger.WithError(err).Warn("Failed to merge the missed pages into the working set")
+		}
 	}
+	state.missedPages = nil
 
 	state.isRecordReady = true
 	state.isActive = false
@@ -304,6 +377,78 @@ func (m *MemoryManager) Deactivate(vmID string) error {
 	return nil
 }
 
+// StartPrefetch starts prefetching the guest memory pages of an active VM that are not in its working set in the
+// background, if the prefetcher is enabled. It should be called once the VM is resumed, which is also the reference
+// of the timestamps of the traced page faults. The prefetcher does not run while the working set is being recorded,
+// since the prefetched pages would be missing from the record.
+func (m *MemoryManager) StartPrefetch(vmID string) error {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+
+	m.Lock()
+
+	state, ok := m.instances[vmID]
+	if !ok {
+		m.Unlock()
+		logger.Error("VM not registered with the memory manager")
+		return errors.New("VM not registered with the memory manager")
+	}
+
+	var hotPages []uint64
+	if m.Prefetch.Order == PrefetchProbabilityOrder {
+		hotPages = hottestPages(m.faultCounts[state.GuestMemPath])
+	}
+
+	m.Unlock()
+
+	if state.isActive {
+		state.markResumed()
+	}
+
+	if !state.isActive || !state.isRecordReady || state.installedPages == nil || state.prefetchStopCh != nil {
+		return nil
+	}
+
+	logger.Debug("Starting to prefetch guest memory")
+	state.startPrefetch(int(state.userFaultFD.Fd()), hotPages)
+
+	return nil
+}
+
+// mergeFaultCounts accumulates the faults on the pages outside the working set of a VM for the snapshot it was
+// loaded from.
+func (m *MemoryManager) mergeFaultCounts(state *SnapshotState) {
+	if len(state.faultCounts) == 0 {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	counts, ok := m.faultCounts[state.GuestMemPath]
+	if !ok {
+		counts = make(map[uint64]uint64)
+		m.faultCounts[state.GuestMemPath] = counts
+	}
+	for offset, n := range state.faultCounts {
+		counts[offset] += n
+	}
+	state.faultCounts = make(map[uint64]uint64)
+}
+
+// workingSetLock returns the lock of the working set stored at workingSetPath.
+func (m *MemoryManager) workingSetLock(workingSetPath string) *sync.RWMutex {
+	m.Lock()
+	defer m.Unlock()
+
+	lock, ok := m.workingSetLocks[workingSetPath]
+	if !ok {
+		lock = new(sync.RWMutex)
+		m.workingSetLocks[workingSetPath] = lock
+	}
+
+	return lock
+}
+
 // DumpUPFPageStats Saves the per VM stats
 func (m *MemoryManager) DumpUPFPageStats(vmID, functionName, metricsOutFilePath string) error {
 	var (
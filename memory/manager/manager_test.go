@@ -28,6 +28,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -161,6 +162,441 @@ func TestPrepareSnapshotLoadPreservesWorkingSetState(t *testing.T) {
 	}
 }
 
+func TestRecordedWorkingSetIsSharedBetweenVMs(t *testing.T) {
+	baseDir := t.TempDir()
+	snapDir := filepath.Join(baseDir, "snapshot")
+	guestMemPath := filepath.Join(snapDir, "mem_file")
+	workingSetPath := filepath.Join(snapDir, "working_set_pages")
+	tracePath := filepath.Join(snapDir, "trace")
+	pageSize := uint64(os.Getpagesize())
+
+	if err := os.MkdirAll(snapDir, 0755); err != nil {
+		t.Fatalf("os.MkdirAll returned error: %v", err)
+	}
+	prepareGuestMemoryFile(t, guestMemPath, 4*int(pageSize))
+
+	recorded := initTrace(tracePath)
+	recorded.AppendRecord(Record{offset: pageSize})
+	recorded.AppendRecord(Record{offset: 2 * pageSize})
+	if err := recorded.ProcessRecord(guestMemPath, workingSetPath, pageSize); err != nil {
+		t.Fatalf("ProcessRecord returned error: %v", err)
+	}
+
+	manager := NewMemoryManager(MemoryManagerCfg{})
+	cfg := SnapshotStateCfg{
+		VMID:           "vm-replay",
+		BaseDir:        filepath.Join(baseDir, "vm-replay"),
+		GuestMemPath:   guestMemPath,
+		WorkingSetPath: workingSetPath,
+		TracePath:      tracePath,
+		GuestMemSize:   4 * int(pageSize),
+	}
+	if err := manager.RegisterVM(cfg); err != nil {
+		t.Fatalf("RegisterVM returned error: %v", err)
+	}
+
+	state := manager.instances[cfg.VMID]
+	if !state.isRecordReady {
+		t.Fatal("VM loaded from a recorded snapshot is not ready to replay")
+	}
+	if !reflect.DeepEqual(state.trace.regions, recorded.regions) {
+		t.Fatalf("regions = %v, want %v", state.trace.regions, recorded.regions)
+	}
+
+	// Loading a snapshot without a recorded working set starts a new record
+	otherDir := filepath.Join(baseDir, "other")
+	nextCfg := cfg
+	nextCfg.WorkingSetPath = filepath.Join(otherDir, "working_set_pages")
+	nextCfg.TracePath = filepath.Join(otherDir, "trace")
+	nextCfg.VMMStatePath = filepath.Join(otherDir, "state")
+	if err := os.MkdirAll(otherDir, 0755); err != nil {
+		t.Fatalf("os.MkdirAll returned error: %v", err)
+	}
+	writeTestFile(t, nextCfg.VMMStatePath, "state")
+
+	if err := manager.PrepareSnapshotLoad(nextCfg); err != nil {
+		t.Fatalf("PrepareSnapshotLoad returned error: %v", err)
+	}
+	if manager.instances[cfg.VMID].isRecordReady {
+		t.Fatal("PrepareSnapshotLoad kept the working set of another snapshot")
+	}
+}
+
+func TestMemoryManagerRecordThenReplayWorkingSet(t *testing.T) {
+	baseDir := t.TempDir()
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+	guestMemPath := filepath.Join(baseDir, "mem_file")
+	vmmStatePath := filepath.Join(baseDir, "snap_file")
+
+	prepareGuestMemoryFile(t, guestMemPath, 4*int(pageSize))
+	writeTestFile(t, vmmStatePath, "state")
+
+	mappings := []GuestRegionUffdMapping{{
+		BaseHostVirtAddr: baseAddr,
+		Size:             4 * pageSize,
+		PageSize:         pageSize,
+	}}
+	newCfg := func(vmID string) SnapshotStateCfg {
+		return SnapshotStateCfg{
+			VMID:           vmID,
+			BaseDir:        filepath.Join(baseDir, vmID),
+			VMMStatePath:   vmmStatePath,
+			GuestMemPath:   guestMemPath,
+			WorkingSetPath: filepath.Join(baseDir, "working_set_pages"),
+			TracePath:      filepath.Join(baseDir, "trace"),
+			GuestMemSize:   4 * int(pageSize),
+		}
+	}
+
+	manager := NewMemoryManager(MemoryManagerCfg{})
+
+	// The first VM records the pages it faults on
+	recordCfg := newCfg("vm-record")
+	if err := manager.RegisterVM(recordCfg); err != nil {
+		t.Fatalf("RegisterVM returned error: %v", err)
+	}
+	if err := manager.FetchState(recordCfg.VMID); err != nil {
+		t.Fatalf("FetchState returned error: %v", err)
+	}
+	state := manager.instances[recordCfg.VMID]
+	uffd := activateWithFakeUffd(t, state, mappings)
+
+	for _, addr := range []uint64{baseAddr + 2*pageSize + 0x10, baseAddr + pageSize} {
+		if err := state.servePageFault(0, addr); err != nil {
+			t.Fatalf("servePageFault(%#x) returned error: %v", addr, err)
+		}
+	}
+	want := []fakeUffdOp{
+		{src: testGuestMemPointer(t, state.guestMem, 2*pageSize), dst: baseAddr + 2*pageSize, length: pageSize},
+		{src: testGuestMemPointer(t, state.guestMem, pageSize), dst: baseAddr + pageSize, length: pageSize},
+	}
+	if !reflect.DeepEqual(uffd.ops, want) {
+		t.Fatalf("record uffd ops = %+v, want %+v", uffd.ops, want)
+	}
+
+	if err := manager.Deactivate(recordCfg.VMID); err != nil {
+		t.Fatalf("Deactivate returned error: %v", err)
+	}
+	if _, err := os.Stat(recordCfg.WorkingSetPath); err != nil {
+		t.Fatalf("working set was not stored: %v", err)
+	}
+
+	// Another VM loaded from the same snapshot installs the working set before waking the first fault
+	replayCfg := newCfg("vm-replay")
+	if err := manager.RegisterVM(replayCfg); err != nil {
+		t.Fatalf("RegisterVM returned error: %v", err)
+	}
+	state = manager.instances[replayCfg.VMID]
+	if !state.isRecordReady {
+		t.Fatal("VM loaded from a recorded snapshot is not ready to replay")
+	}
+	if err := manager.FetchState(replayCfg.VMID); err != nil {
+		t.Fatalf("FetchState returned error: %v", err)
+	}
+	if got, want := len(state.workingSet), int(2*pageSize); got != want {
+		t.Fatalf("working set size = %d, want %d", got, want)
+	}
+	uffd = activateWithFakeUffd(t, state, mappings)
+
+	for _, addr := range []uint64{baseAddr + pageSize + 0x8, baseAddr + 3*pageSize} {
+		if err := state.servePageFault(0, addr); err != nil {
+			t.Fatalf("servePageFault(%#x) returned error: %v", addr, err)
+		}
+	}
+	want = []fakeUffdOp{
+		{src: testGuestMemPointer(t, state.workingSet, 0), dst: baseAddr + pageSize, mode: uffdCopyModeDontWake(), length: 2 * pageSize},
+		{wake: true, dst: baseAddr + pageSize, length: pageSize},
+		{src: testGuestMemPointer(t, state.guestMem, 3*pageSize), dst: baseAddr + 3*pageSize, length: pageSize},
+	}
+	if !reflect.DeepEqual(uffd.ops, want) {
+		t.Fatalf("replay uffd ops = %+v, want %+v", uffd.ops, want)
+	}
+	if got, want := len(state.trace.trace), 2; got != want {
+		t.Fatalf("trace length = %d, want %d", got, want)
+	}
+
+	if err := manager.Deactivate(replayCfg.VMID); err != nil {
+		t.Fatalf("Deactivate returned error: %v", err)
+	}
+}
+
+func TestMemoryManagerMergesMissedPagesIntoWorkingSet(t *testing.T) {
+	baseDir := t.TempDir()
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+	guestMemPath := filepath.Join(baseDir, "mem_file")
+	vmmStatePath := filepath.Join(baseDir, "snap_file")
+	workingSetPath := filepath.Join(baseDir, "working_set_pages")
+	tracePath := filepath.Join(baseDir, "trace")
+
+	prepareGuestMemoryFile(t, guestMemPath, 8*int(pageSize))
+	writeTestFile(t, vmmStatePath, "state")
+
+	recorded := initTrace(tracePath)
+	recorded.AppendRecord(Record{offset: pageSize})
+	recorded.AppendRecord(Record{offset: 2 * pageSize})
+	if err := recorded.ProcessRecord(guestMemPath, workingSetPath, pageSize); err != nil {
+		t.Fatalf("ProcessRecord returned error: %v", err)
+	}
+
+	mappings := []GuestRegionUffdMapping{{
+		BaseHostVirtAddr: baseAddr,
+		Size:             8 * pageSize,
+		PageSize:         pageSize,
+	}}
+	manager := NewMemoryManager(MemoryManagerCfg{RerecordThreshold: 0.5})
+	for _, vmID := range []string{"vm-miss", "vm-reload"} {
+		if err := manager.RegisterVM(SnapshotStateCfg{
+			VMID:           vmID,
+			BaseDir:        filepath.Join(baseDir, vmID),
+			VMMStatePath:   vmmStatePath,
+			GuestMemPath:   guestMemPath,
+			WorkingSetPath: workingSetPath,
+			TracePath:      tracePath,
+			GuestMemSize:   8 * int(pageSize),
+		}); err != nil {
+			t.Fatalf("RegisterVM returned error: %v", err)
+		}
+	}
+
+	// The first VM misses more pages than the threshold allows, which are merged into the working set
+	state := manager.instances["vm-miss"]
+	if err := manager.FetchState(state.VMID); err != nil {
+		t.Fatalf("FetchState returned error: %v", err)
+	}
+	activateWithFakeUffd(t, state, mappings)
+	for _, addr := range []uint64{baseAddr + pageSize, baseAddr + 6*pageSize, baseAddr + 5*pageSize} {
+		if err := state.servePageFault(0, addr); err != nil {
+			t.Fatalf("servePageFault(%#x) returned error: %v", addr, err)
+		}
+	}
+	if got, want := state.missRatio(), 1.0; got != want {
+		t.Fatalf("missRatio() = %v, want %v", got, want)
+	}
+	if err := manager.Deactivate(state.VMID); err != nil {
+		t.Fatalf("Deactivate returned error: %v", err)
+	}
+
+	merged := initTrace(tracePath)
+	if err := merged.readTrace(); err != nil {
+		t.Fatalf("readTrace returned error: %v", err)
+	}
+	var offsets, orders []uint64
+	for _, rec := range merged.trace {
+		offsets = append(offsets, rec.offset/pageSize)
+		orders = append(orders, rec.order)
+	}
+	if want := []uint64{1, 2, 5, 6}; !reflect.DeepEqual(offsets, want) {
+		t.Fatalf("merged trace pages = %v, want %v", offsets, want)
+	}
+	if want := []uint64{0, 1, 3, 2}; !reflect.DeepEqual(orders, want) {
+		t.Fatalf("merged trace orders = %v, want %v", orders, want)
+	}
+
+	// A VM that read the trace before it was regenerated reloads it along with the working set pages
+	state = manager.instances["vm-reload"]
+	if got, want := len(state.trace.trace), 2; got != want {
+		t.Fatalf("trace length before FetchState = %d, want %d", got, want)
+	}
+	if err := manager.FetchState(state.VMID); err != nil {
+		t.Fatalf("FetchState returned error: %v", err)
+	}
+	if got, want := len(state.workingSet), int(4*pageSize); got != want {
+		t.Fatalf("working set size = %d, want %d", got, want)
+	}
+	for i, page := range []int{1, 2, 5, 6} {
+		if got, want := state.workingSet[uint64(i)*pageSize], byte(48+page); got != want {
+			t.Fatalf("working set page %d = %q, want %q", i, got, want)
+		}
+	}
+
+	// Missing fewer pages than the threshold allows leaves the working set untouched
+	activateWithFakeUffd(t, state, mappings)
+	for _, addr := range []uint64{baseAddr + pageSize, baseAddr + 3*pageSize} {
+		if err := state.servePageFault(0, addr); err != nil {
+			t.Fatalf("servePageFault(%#x) returned error: %v", addr, err)
+		}
+	}
+	if err := manager.Deactivate(state.VMID); err != nil {
+		t.Fatalf("Deactivate returned error: %v", err)
+	}
+	info, err := os.Stat(workingSetPath)
+	if err != nil {
+		t.Fatalf("os.Stat returned error: %v", err)
+	}
+	if got, want := info.Size(), int64(4*pageSize); got != want {
+		t.Fatalf("working set file size = %d, want %d", got, want)
+	}
+}
+
+func TestMemoryManagerWritesFaultTraces(t *testing.T) {
+	baseDir := t.TempDir()
+	traceDir := filepath.Join(baseDir, "traces")
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+	guestMemPath := filepath.Join(baseDir, "mem_file")
+	vmmStatePath := filepath.Join(baseDir, "snap_file")
+
+	prepareGuestMemoryFile(t, guestMemPath, 4*int(pageSize))
+	writeTestFile(t, vmmStatePath, "state")
+
+	manager := NewMemoryManager(MemoryManagerCfg{FaultTraceDir: traceDir})
+	cfg := SnapshotStateCfg{
+		VMID:           "vm-trace",
+		VMMStatePath:   vmmStatePath,
+		GuestMemPath:   guestMemPath,
+		WorkingSetPath: filepath.Join(baseDir, "working_set_pages"),
+		TracePath:      filepath.Join(baseDir, "trace"),
+		GuestMemSize:   4 * int(pageSize),
+	}
+	if err := manager.RegisterVM(cfg); err != nil {
+		t.Fatalf("RegisterVM returned error: %v", err)
+	}
+	if err := manager.FetchState(cfg.VMID); err != nil {
+		t.Fatalf("FetchState returned error: %v", err)
+	}
+	state := manager.instances[cfg.VMID]
+	activateWithFakeUffd(t, state, []GuestRegionUffdMapping{{
+		BaseHostVirtAddr: baseAddr,
+		Size:             4 * pageSize,
+		PageSize:         pageSize,
+	}})
+
+	// Faults raised before the VM is resumed have negative timestamps
+	if err := state.servePageFault(0, baseAddr+3*pageSize); err != nil {
+		t.Fatalf("servePageFault returned error: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := manager.StartPrefetch(cfg.VMID); err != nil {
+		t.Fatalf("StartPrefetch returned error: %v", err)
+	}
+	if err := state.servePageFault(0, baseAddr+pageSize); err != nil {
+		t.Fatalf("servePageFault returned error: %v", err)
+	}
+
+	if err := manager.Deactivate(cfg.VMID); err != nil {
+		t.Fatalf("Deactivate returned error: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(traceDir, cfg.VMID+"-*.trace"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("fault traces = %v (%v), want one", files, err)
+	}
+	trace, err := LoadTrace(files[0])
+	if err != nil {
+		t.Fatalf("LoadTrace returned error: %v", err)
+	}
+	if len(trace.trace) != 2 || trace.trace[0].offset != 3*pageSize || trace.trace[1].offset != pageSize {
+		t.Fatalf("fault trace = %+v, want the faults on pages 3 and 1 in order", trace.trace)
+	}
+	if trace.trace[0].timestamp >= 0 || trace.trace[1].timestamp < 0 {
+		t.Fatalf("fault trace = %+v, want timestamps relative to the resume", trace.trace)
+	}
+}
+
+func TestMemoryManagerRecordThenReplayHugePages(t *testing.T) {
+	const hugePageSize = 2 << 20
+	baseDir := t.TempDir()
+	baseAddr := uint64(0x7f0000000000)
+	guestMemPath := filepath.Join(baseDir, "mem_file")
+	vmmStatePath := filepath.Join(baseDir, "snap_file")
+
+	prepareGuestMemoryFile(t, guestMemPath, 4*hugePageSize)
+	writeTestFile(t, vmmStatePath, "state")
+	guestMem, err := os.ReadFile(guestMemPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile returned error: %v", err)
+	}
+
+	mappings := []GuestRegionUffdMapping{{
+		BaseHostVirtAddr: baseAddr,
+		Size:             4 * hugePageSize,
+		PageSize:         hugePageSize,
+	}}
+	newCfg := func(vmID string) SnapshotStateCfg {
+		return SnapshotStateCfg{
+			VMID:           vmID,
+			BaseDir:        filepath.Join(baseDir, vmID),
+			VMMStatePath:   vmmStatePath,
+			GuestMemPath:   guestMemPath,
+			WorkingSetPath: filepath.Join(baseDir, "working_set_pages"),
+			TracePath:      filepath.Join(baseDir, "trace"),
+			GuestMemSize:   4 * hugePageSize,
+		}
+	}
+
+	manager := NewMemoryManager(MemoryManagerCfg{})
+
+	// Faults are aligned to the huge pages, which are recorded as a whole
+	recordCfg := newCfg("vm-record")
+	if err := manager.RegisterVM(recordCfg); err != nil {
+		t.Fatalf("RegisterVM returned error: %v", err)
+	}
+	if err := manager.FetchState(recordCfg.VMID); err != nil {
+		t.Fatalf("FetchState returned error: %v", err)
+	}
+	state := manager.instances[recordCfg.VMID]
+	uffd := activateWithFakeUffd(t, state, mappings)
+
+	for _, addr := range []uint64{baseAddr + 2*hugePageSize + 0x1234, baseAddr + hugePageSize + 0x10} {
+		if err := state.servePageFault(0, addr); err != nil {
+			t.Fatalf("servePageFault(%#x) returned error: %v", addr, err)
+		}
+	}
+	want := []fakeUffdOp{
+		{src: testGuestMemPointer(t, state.guestMem, 2*hugePageSize), dst: baseAddr + 2*hugePageSize, length: hugePageSize},
+		{src: testGuestMemPointer(t, state.guestMem, hugePageSize), dst: baseAddr + hugePageSize, length: hugePageSize},
+	}
+	if !reflect.DeepEqual(uffd.ops, want) {
+		t.Fatalf("record uffd ops = %+v, want %+v", uffd.ops, want)
+	}
+
+	if err := manager.Deactivate(recordCfg.VMID); err != nil {
+		t.Fatalf("Deactivate returned error: %v", err)
+	}
+	workingSet, err := os.ReadFile(recordCfg.WorkingSetPath)
+	if err != nil {
+		t.Fatalf("working set was not stored: %v", err)
+	}
+	if !reflect.DeepEqual(workingSet, guestMem[hugePageSize:3*hugePageSize]) {
+		t.Fatal("working set does not contain the recorded huge pages")
+	}
+
+	// The working set is installed in huge pages before waking the first fault
+	replayCfg := newCfg("vm-replay")
+	if err := manager.RegisterVM(replayCfg); err != nil {
+		t.Fatalf("RegisterVM returned error: %v", err)
+	}
+	state = manager.instances[replayCfg.VMID]
+	if err := manager.FetchState(replayCfg.VMID); err != nil {
+		t.Fatalf("FetchState returned error: %v", err)
+	}
+	if got, want := state.trace.pageSize, uint64(hugePageSize); got != want {
+		t.Fatalf("trace page size = %#x, want %#x", got, want)
+	}
+	uffd = activateWithFakeUffd(t, state, mappings)
+
+	for _, addr := range []uint64{baseAddr + 2*hugePageSize + 0x8, baseAddr + 3*hugePageSize} {
+		if err := state.servePageFault(0, addr); err != nil {
+			t.Fatalf("servePageFault(%#x) returned error: %v", addr, err)
+		}
+	}
+	want = []fakeUffdOp{
+		{src: testGuestMemPointer(t, state.workingSet, 0), dst: baseAddr + hugePageSize, mode: uffdCopyModeDontWake(), length: hugePageSize},
+		{src: testGuestMemPointer(t, state.workingSet, hugePageSize), dst: baseAddr + 2*hugePageSize, mode: uffdCopyModeDontWake(), length: hugePageSize},
+		{wake: true, dst: baseAddr + 2*hugePageSize, length: hugePageSize},
+		{src: testGuestMemPointer(t, state.guestMem, 3*hugePageSize), dst: baseAddr + 3*hugePageSize, length: hugePageSize},
+	}
+	if !reflect.DeepEqual(uffd.ops, want) {
+		t.Fatalf("replay uffd ops = %+v, want %+v", uffd.ops, want)
+	}
+
+	if err := manager.Deactivate(replayCfg.VMID); err != nil {
+		t.Fatalf("Deactivate returned error: %v", err)
+	}
+}
+
 func TestMemoryManagerActivateReceivesFirecrackerMappings(t *testing.T) {
 	baseDir := t.TempDir()
 	vmID := "vm-activate"
@@ -326,3 +762,80 @@ func writeTestFile(t *testing.T, path, content string) {
 		t.Fatalf("os.WriteFile returned error: %v", err)
 	}
 }
+
+type fakeUffdOp struct {
+	wake, zero             bool
+	src, dst, mode, length uint64
+}
+
+// fakeUffd records the operations that resolve page faults instead of issuing the userfaultfd ioctls.
+type fakeUffd struct {
+	sync.Mutex
+	ops []fakeUffdOp
+	// Addresses of the pages that are installed concurrently, at which the copies stop
+	existing map[uint64]bool
+}
+
+func (f *fakeUffd) copyPages(_ int, src, dst, mode, length uint64) (uint64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.ops = append(f.ops, fakeUffdOp{src: src, dst: dst, mode: mode, length: length})
+
+	// Like UFFDIO_COPY, the copy fails with EEXIST if the first page exists, and with EAGAIN if a later page does
+	pageSize := uint64(os.Getpagesize())
+	for copied := uint64(0); copied < length; copied += pageSize {
+		if !f.existing[dst+copied] {
+			continue
+		}
+		if copied == 0 {
+			return 0, unix.EEXIST
+		}
+		return copied, unix.EAGAIN
+	}
+	return length, nil
+}
+
+func (f *fakeUffd) zeroPages(_ int, dst, length uint64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.ops = append(f.ops, fakeUffdOp{zero: true, dst: dst, length: length})
+	return nil
+}
+
+func (f *fakeUffd) wake(_ int, startAddress, length uint64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.ops = append(f.ops, fakeUffdOp{wake: true, dst: startAddress, length: length})
+	return nil
+}
+
+// activateWithFakeUffd activates the state as Activate does, but without a Firecracker connection and poller.
+func activateWithFakeUffd(t *testing.T, state *SnapshotState, mappings []GuestRegionUffdMapping) *fakeUffd {
+	t.Helper()
+
+	if err := state.mapGuestMemory(); err != nil {
+		t.Fatalf("mapGuestMemory returned error: %v", err)
+	}
+
+	uffd := &fakeUffd{}
+	state.uffd = uffd
+	state.guestRegionMappings = mappings
+	state.setupStateOnActivate()
+	close(state.pollDoneCh)
+
+	return uffd
+}
+
+func testGuestMemPointer(t *testing.T, mem []byte, offset uint64) uint64 {
+	t.Helper()
+
+	ptr, err := guestMemPointer(mem, offset, 1)
+	if err != nil {
+		t.Fatalf("guestMemPointer returned error: %v", err)
+	}
+
+	return ptr
+}
@@ -0,0 +1,272 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PrefetchOrder selects the order in which the background prefetcher installs guest memory pages.
+type PrefetchOrder string
+
+const (
+	// PrefetchDisabled turns the background prefetcher off.
+	PrefetchDisabled PrefetchOrder = ""
+	// PrefetchAddressOrder prefetches the pages in the order of their guest memory offsets.
+	PrefetchAddressOrder PrefetchOrder = "address"
+	// PrefetchProbabilityOrder first prefetches the pages that were faulted on most often by the VMs previously
+	// loaded from the same snapshot, and then the remaining pages in the order of their guest memory offsets.
+	PrefetchProbabilityOrder PrefetchOrder = "probability"
+)
+
+const defaultPrefetchBatchSize = 256 << 10
+
+// PrefetchCfg configures the background prefetcher, which installs the guest memory pages that are not in the
+// working set once a VM loaded from a snapshot is resumed, so that they do not have to be served one fault at a time.
+type PrefetchCfg struct {
+	Order PrefetchOrder
+	// Rate limits the number of prefetched bytes per second, unlimited if 0
+	Rate uint64
+	// BatchSize is the maximum number of bytes installed by a single copy, 256KiB by default
+	BatchSize uint64
+}
+
+// ParsePrefetchOrder returns the prefetch order with the given name, where an empty name disables prefetching.
+func ParsePrefetchOrder(name string) (PrefetchOrder, error) {
+	switch order := PrefetchOrder(name); order {
+	case PrefetchDisabled, PrefetchAddressOrder, PrefetchProbabilityOrder:
+		return order, nil
+	default:
+		return PrefetchDisabled, fmt.Errorf("unknown prefetch order %q", name)
+	}
+}
+
+// pageBitmap tracks the guest memory pages that have been installed, indexed by their memory-file offsets.
+type pageBitmap struct {
+	pageSize uint64
+	words    []uint64
+}
+
+// newPageBitmap returns a bitmap covering the memory-file offsets of the mappings.
+func newPageBitmap(mappings []GuestRegionUffdMapping) (*pageBitmap, error) {
+	pageSize, err := guestMappingPageSize(mappings)
+	if err != nil {
+		return nil, err
+	}
+
+	var end uint64
+	for _, region := range mappings {
+		end = max(end, region.Offset+region.Size)
+	}
+	pages := (end + pageSize - 1) / pageSize
+
+	return &pageBitmap{pageSize: pageSize, words: make([]uint64, (pages+63)/64)}, nil
+}
+
+func (b *pageBitmap) set(offset, length uint64) {
+	if b == nil {
+		return
+	}
+	for page := offset / b.pageSize; page*b.pageSize < offset+length; page++ {
+		if page/64 < uint64(len(b.words)) {
+			b.words[page/64] |= 1 << (page % 64)
+		}
+	}
+}
+
+func (b *pageBitmap) clear(offset, length uint64) {
+	if b == nil {
+		return
+	}
+	for page := offset / b.pageSize; page*b.pageSize < offset+length; page++ {
+		if page/64 < uint64(len(b.words)) {
+			b.words[page/64] &^= 1 << (page % 64)
+		}
+	}
+}
+
+func (b *pageBitmap) isSet(offset uint64) bool {
+	if b == nil {
+		return false
+	}
+	page := offset / b.pageSize
+	return page/64 < uint64(len(b.words)) && b.words[page/64]&(1<<(page%64)) != 0
+}
+
+// hottestPages returns the offsets of the pages that were faulted on, in descending order of their fault counts.
+func hottestPages(faultCounts map[uint64]uint64) []uint64 {
+	pages := make([]uint64, 0, len(faultCounts))
+	for offset := range faultCounts {
+		pages = append(pages, offset)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		if faultCounts[pages[i]] != faultCounts[pages[j]] {
+			return faultCounts[pages[i]] > faultCounts[pages[j]]
+		}
+		return pages[i] < pages[j]
+	})
+
+	return pages
+}
+
+// prefetchDelay returns how long to wait before prefetching more pages, so that the bytes prefetched since start
+// do not exceed the rate.
+func prefetchDelay(start time.Time, prefetched, rate uint64) time.Duration {
+	if rate == 0 {
+		return 0
+	}
+
+	return time.Duration(float64(prefetched)/float64(rate)*float64(time.Second)) - time.Since(start)
+}
+
+// startPrefetch starts prefetching the pages that have not been installed in the background, beginning with
+// hotPages.
+func (s *SnapshotState) startPrefetch(fd int, hotPages []uint64) {
+	s.prefetchStopCh = make(chan struct{})
+	s.prefetchDoneCh = make(chan struct{})
+
+	go s.prefetchPages(fd, hotPages)
+}
+
+// stopPrefetch stops the prefetcher and waits until it exits.
+func (s *SnapshotState) stopPrefetch() {
+	if s.prefetchStopCh == nil {
+		return
+	}
+
+	close(s.prefetchStopCh)
+	<-s.prefetchDoneCh
+	s.prefetchStopCh = nil
+	s.prefetchDoneCh = nil
+}
+
+func (s *SnapshotState) prefetchPages(fd int, hotPages []uint64) {
+	logger := log.WithFields(log.Fields{"vmID": s.VMID})
+
+	defer close(s.prefetchDoneCh)
+
+	var (
+		start      = time.Now()
+		prefetched uint64
+		pageSize   = s.installedPages.pageSize
+		batchSize  = max(s.prefetch.BatchSize-s.prefetch.BatchSize%pageSize, pageSize)
+	)
+
+	prefetch := func(offset, length uint64) bool {
+		select {
+		case <-s.prefetchStopCh:
+			return false
+		default:
+		}
+
+		if delay := prefetchDelay(start, prefetched, s.prefetch.Rate); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-s.prefetchStopCh:
+				timer.Stop()
+				return false
+			case <-timer.C:
+			}
+		}
+
+		n, err := s.prefetchRange(fd, offset, length)
+		if err != nil {
+			logger.WithError(err).Debug("Stopping the prefetcher")
+			return false
+		}
+		prefetched += n
+		return true
+	}
+
+	for _, offset := range hotPages {
+		if !prefetch(offset, pageSize) {
+			return
+		}
+	}
+
+	for _, region := range s.guestRegionMappings {
+		for offset := region.Offset; offset < region.Offset+region.Size; offset += batchSize {
+			if !prefetch(offset, min(batchSize, region.Offset+region.Size-offset)) {
+				return
+			}
+		}
+	}
+
+	logger.WithField("bytes", prefetched).Debug("Prefetched the guest memory")
+}
+
+// prefetchRange installs the pages of the range that have not been installed yet, and returns the number of bytes
+// installed. Page faults that are waiting to be served are served first.
+func (s *SnapshotState) prefetchRange(fd int, offset, length uint64) (uint64, error) {
+	for s.pendingFaults.Load() > 0 {
+		runtime.Gosched()
+	}
+
+	s.installMu.Lock()
+	defer s.installMu.Unlock()
+
+	var (
+		pageSize  = s.installedPages.pageSize
+		installed uint64
+		runStart  = offset
+	)
+
+	// Install each run of consecutive pages that have not been installed with a single copy. Zero pages are left to
+	// the page fault handler, since guests rarely touch their free memory
+	for page := offset; page <= offset+length; page += pageSize {
+		if page < offset+length && !s.installedPages.isSet(page) && !s.removedPages.isSet(page) &&
+			!s.isZeroPage(page, pageSize) {
+			continue
+		}
+		for runStart < page {
+			copyArgs, err := pageFaultCopyArgsForGuestOffset(s.guestRegionMappings, runStart, 0)
+			if err != nil {
+				return installed, err
+			}
+			src, err := s.guestMemSource(runStart, page-runStart)
+			if err != nil {
+				return installed, err
+			}
+			copied, err := s.installRange(fd, src, copyArgs.dstAddr, copyArgs.copyMode, page-runStart)
+			if err != nil {
+				return installed, err
+			}
+			installed += copied
+			if copied < page-runStart {
+				// The copy stopped at a page that the page fault handler installed concurrently, the rest of the
+				// run is copied separately
+				copied += pageSize
+			}
+			s.installedPages.set(runStart, copied)
+			runStart += copied
+		}
+		runStart = page + pageSize
+	}
+
+	return installed, nil
+}
@@ -0,0 +1,202 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePrefetchOrder(t *testing.T) {
+	for _, name := range []string{"", "address", "probability"} {
+		order, err := ParsePrefetchOrder(name)
+		if err != nil {
+			t.Fatalf("ParsePrefetchOrder(%q) returned error: %v", name, err)
+		}
+		if string(order) != name {
+			t.Fatalf("ParsePrefetchOrder(%q) = %q", name, order)
+		}
+	}
+
+	if _, err := ParsePrefetchOrder("random"); err == nil {
+		t.Fatal("ParsePrefetchOrder succeeded for an unknown order")
+	}
+}
+
+func TestPrefetchInstallsRemainingPages(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+
+	state, uffd := newReplayState(t, PrefetchCfg{Order: PrefetchAddressOrder, BatchSize: 4 * pageSize}, baseAddr, 8)
+
+	if err := state.servePageFault(0, baseAddr+2*pageSize); err != nil {
+		t.Fatalf("servePageFault returned error: %v", err)
+	}
+
+	state.startPrefetch(0, nil)
+	<-state.prefetchDoneCh
+
+	want := []fakeUffdOp{
+		{src: testGuestMemPointer(t, state.guestMem, 2*pageSize), dst: baseAddr + 2*pageSize, length: pageSize},
+		{src: testGuestMemPointer(t, state.guestMem, 0), dst: baseAddr, length: 2 * pageSize},
+		{src: testGuestMemPointer(t, state.guestMem, 3*pageSize), dst: baseAddr + 3*pageSize, length: pageSize},
+		{src: testGuestMemPointer(t, state.guestMem, 4*pageSize), dst: baseAddr + 4*pageSize, length: 4 * pageSize},
+	}
+	if !reflect.DeepEqual(uffd.ops, want) {
+		t.Fatalf("uffd ops = %+v, want %+v", uffd.ops, want)
+	}
+	if got, want := state.faultCounts, map[uint64]uint64{2 * pageSize: 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("faultCounts = %v, want %v", got, want)
+	}
+}
+
+func TestPrefetchSkipsConcurrentlyInstalledPages(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+
+	t.Run("later page", func(t *testing.T) {
+		state, uffd := newReplayState(t, PrefetchCfg{Order: PrefetchAddressOrder, BatchSize: 8 * pageSize}, baseAddr, 8)
+		uffd.existing = map[uint64]bool{baseAddr + 2*pageSize: true}
+
+		state.startPrefetch(0, nil)
+		<-state.prefetchDoneCh
+
+		// The copy stops at the installed page, and the rest of the run is copied afterwards
+		want := []fakeUffdOp{
+			{src: testGuestMemPointer(t, state.guestMem, 0), dst: baseAddr, length: 8 * pageSize},
+			{src: testGuestMemPointer(t, state.guestMem, 3*pageSize), dst: baseAddr + 3*pageSize, length: 5 * pageSize},
+		}
+		if !reflect.DeepEqual(uffd.ops, want) {
+			t.Fatalf("uffd ops = %+v, want %+v", uffd.ops, want)
+		}
+		checkInstalledPages(t, state, 8)
+	})
+
+	t.Run("first page", func(t *testing.T) {
+		state, uffd := newReplayState(t, PrefetchCfg{Order: PrefetchAddressOrder, BatchSize: 8 * pageSize}, baseAddr, 8)
+		uffd.existing = map[uint64]bool{baseAddr: true, baseAddr + 2*pageSize: true}
+
+		state.startPrefetch(0, nil)
+		<-state.prefetchDoneCh
+
+		// Nothing is copied if the first page of the run is installed, the copy starts over from the next page
+		want := []fakeUffdOp{
+			{src: testGuestMemPointer(t, state.guestMem, 0), dst: baseAddr, length: 8 * pageSize},
+			{wake: true, dst: baseAddr, length: 8 * pageSize},
+			{src: testGuestMemPointer(t, state.guestMem, pageSize), dst: baseAddr + pageSize, length: 7 * pageSize},
+			{src: testGuestMemPointer(t, state.guestMem, 3*pageSize), dst: baseAddr + 3*pageSize, length: 5 * pageSize},
+		}
+		if !reflect.DeepEqual(uffd.ops, want) {
+			t.Fatalf("uffd ops = %+v, want %+v", uffd.ops, want)
+		}
+		checkInstalledPages(t, state, 8)
+	})
+}
+
+// checkInstalledPages fails the test unless the first pages of the guest memory are marked as installed.
+func checkInstalledPages(t *testing.T, state *SnapshotState, pages uint64) {
+	t.Helper()
+
+	pageSize := uint64(os.Getpagesize())
+	for page := uint64(0); page < pages*pageSize; page += pageSize {
+		if !state.installedPages.isSet(page) {
+			t.Fatalf("page %#x is not marked as installed", page)
+		}
+	}
+}
+
+func TestPrefetchStartsWithHottestPages(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+
+	state, uffd := newReplayState(t, PrefetchCfg{Order: PrefetchProbabilityOrder, BatchSize: 8 * pageSize}, baseAddr, 8)
+
+	hotPages := hottestPages(map[uint64]uint64{pageSize: 1, 5 * pageSize: 3, 6 * pageSize: 1})
+	if want := []uint64{5 * pageSize, pageSize, 6 * pageSize}; !reflect.DeepEqual(hotPages, want) {
+		t.Fatalf("hottestPages() = %v, want %v", hotPages, want)
+	}
+
+	state.startPrefetch(0, hotPages)
+	<-state.prefetchDoneCh
+
+	var dsts []uint64
+	for _, op := range uffd.ops {
+		dsts = append(dsts, op.dst)
+	}
+	want := []uint64{
+		baseAddr + 5*pageSize,
+		baseAddr + pageSize,
+		baseAddr + 6*pageSize,
+		baseAddr,
+		baseAddr + 2*pageSize,
+		baseAddr + 7*pageSize,
+	}
+	if !reflect.DeepEqual(dsts, want) {
+		t.Fatalf("prefetched pages = %#x, want %#x", dsts, want)
+	}
+}
+
+func TestPrefetchStopsWhileThrottled(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+
+	state, _ := newReplayState(t, PrefetchCfg{Order: PrefetchAddressOrder, Rate: 1, BatchSize: pageSize}, baseAddr, 8)
+
+	state.startPrefetch(0, nil)
+
+	stopped := make(chan struct{})
+	go func() {
+		state.stopPrefetch()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the throttled prefetcher to stop")
+	}
+}
+
+func TestPrefetchDelay(t *testing.T) {
+	start := time.Now()
+
+	if got := prefetchDelay(start, 1<<30, 0); got != 0 {
+		t.Fatalf("prefetchDelay() without a rate = %v, want 0", got)
+	}
+	if got := prefetchDelay(start, 1<<20, 1<<20); got <= 0 || got > time.Second {
+		t.Fatalf("prefetchDelay() = %v, want at most 1s", got)
+	}
+	if got := prefetchDelay(start.Add(-2*time.Second), 1<<20, 1<<20); got > 0 {
+		t.Fatalf("prefetchDelay() behind the rate = %v, want no delay", got)
+	}
+}
+
+// newReplayState returns an active state that replays a snapshot of the given number of guest memory pages.
+func newReplayState(t *testing.T, cfg PrefetchCfg, baseAddr, pages uint64) (*SnapshotState, *fakeUffd) {
+	t.Helper()
+
+	pageSize := uint64(os.Getpagesize())
+	guestMemPath := filepath.Join(t.TempDir(), "mem_file")
+	prepareGuestMemoryFile(t, guestMemPath, int(pages*pageSize))
+
+	state := NewSnapshotState(SnapshotStateCfg{
+		VMID:         "vm-prefetch",
+		GuestMemPath: guestMemPath,
+		GuestMemSize: int(pages * pageSize),
+		prefetch:     cfg,
+	})
+	state.isRecordReady = true
+
+	uffd := activateWithFakeUffd(t, state, []GuestRegionUffdMapping{{
+		BaseHostVirtAddr: baseAddr,
+		Size:             pages * pageSize,
+		PageSize:         pageSize,
+	}})
+	t.Cleanup(func() {
+		state.stopPrefetch()
+		_ = state.unmapGuestMemory()
+	})
+
+	return state, uffd
+}
@@ -0,0 +1,305 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vhive-serverless/vhive/metrics"
+)
+
+// rpcServiceName is the name of the memory manager service of a standalone memory manager process.
+const rpcServiceName = "MemoryManager"
+
+// StatsArgs are the arguments of the calls that dump the stats of a VM to a file of the memory manager host.
+type StatsArgs struct {
+	VMID, FunctionName, Path string
+}
+
+// Listen listens on the unix socket of a standalone memory manager process, replacing the socket of a previous one.
+func Listen(socketPath string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := removeStaleUffdSocket(socketPath); err != nil {
+		return nil, err
+	}
+
+	return net.Listen("unix", socketPath)
+}
+
+// Serve serves the API of the memory manager to the clients connecting to the listener, e.g., the unix socket of a
+// standalone memory manager process, until the listener is closed.
+func Serve(l net.Listener, m *MemoryManager) error {
+	service := &rpcService{manager: m, activations: make(map[string]chan error)}
+	server := rpc.NewServer()
+	if err := server.RegisterName(rpcServiceName, service); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+// rpcService exposes the methods of a memory manager as RPCs.
+type rpcService struct {
+	manager *MemoryManager
+
+	mu sync.Mutex
+	// results of the activations that have not been waited for, indexed by vmID
+	activations map[string]chan error
+}
+
+func (s *rpcService) RegisterVM(cfg *SnapshotStateCfg, _ *struct{}) error {
+	return s.manager.RegisterVM(*cfg)
+}
+
+func (s *rpcService) PrepareSnapshotLoad(cfg *SnapshotStateCfg, _ *struct{}) error {
+	return s.manager.PrepareSnapshotLoad(*cfg)
+}
+
+func (s *rpcService) DeregisterVM(vmID *string, _ *struct{}) error {
+	return s.manager.DeregisterVM(*vmID)
+}
+
+// Activate starts activating a VM, and returns once Firecracker can connect to its UFFD socket. The result of the
+// activation is returned by WaitActivation.
+func (s *rpcService) Activate(vmID *string, _ *struct{}) error {
+	s.mu.Lock()
+	if _, ok := s.activations[*vmID]; ok {
+		s.mu.Unlock()
+		return errors.New("VM already being activated")
+	}
+	resultCh := make(chan error, 1)
+	s.activations[*vmID] = resultCh
+	s.mu.Unlock()
+
+	socketReadyCh := make(chan struct{}, 1)
+	go func() {
+		resultCh <- s.manager.Activate(*vmID, socketReadyCh)
+	}()
+
+	select {
+	case <-socketReadyCh:
+		return nil
+	case err := <-resultCh:
+		select {
+		case <-socketReadyCh:
+			// Firecracker connected right after the socket was ready
+			resultCh <- err
+			return nil
+		default:
+		}
+
+		s.mu.Lock()
+		delete(s.activations, *vmID)
+		s.mu.Unlock()
+		return err
+	}
+}
+
+// WaitActivation waits until the activation of a VM started by Activate completes, and returns its result.
+func (s *rpcService) WaitActivation(vmID *string, _ *struct{}) error {
+	s.mu.Lock()
+	resultCh, ok := s.activations[*vmID]
+	s.mu.Unlock()
+	if !ok {
+		return errors.New("VM not being activated")
+	}
+
+	err := <-resultCh
+
+	s.mu.Lock()
+	delete(s.activations, *vmID)
+	s.mu.Unlock()
+
+	return err
+}
+
+func (s *rpcService) FetchState(vmID *string, _ *struct{}) error {
+	return s.manager.FetchState(*vmID)
+}
+
+func (s *rpcService) Deactivate(vmID *string, _ *struct{}) error {
+	return s.manager.Deactivate(*vmID)
+}
+
+func (s *rpcService) StartPrefetch(vmID *string, _ *struct{}) error {
+	return s.manager.StartPrefetch(*vmID)
+}
+
+func (s *rpcService) DumpUPFPageStats(args *StatsArgs, _ *struct{}) error {
+	return s.manager.DumpUPFPageStats(args.VMID, args.FunctionName, args.Path)
+}
+
+func (s *rpcService) DumpUPFLatencyStats(args *StatsArgs, _ *struct{}) error {
+	return s.manager.DumpUPFLatencyStats(args.VMID, args.FunctionName, args.Path)
+}
+
+func (s *rpcService) GetUPFLatencyStats(vmID *string, stats *[]*metrics.Metric) error {
+	var err error
+	*stats, err = s.manager.GetUPFLatencyStats(*vmID)
+	return err
+}
+
+// Client calls the memory manager of a standalone process over its unix socket, and has the same API as
+// MemoryManager. It connects on the first call, and again after the connection is lost, e.g., once the memory
+// manager process has been restarted.
+type Client struct {
+	socketPath string
+
+	mu     sync.Mutex
+	client *rpc.Client
+}
+
+// NewClient returns a client of the memory manager serving the unix socket at socketPath.
+func NewClient(socketPath string) *Client {
+	return &Client{socketPath: socketPath}
+}
+
+// Close closes the connection to the memory manager.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
+
+func (c *Client) conn() (*rpc.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		client, err := rpc.Dial("unix", c.socketPath)
+		if err != nil {
+			return nil, err
+		}
+		c.client = client
+	}
+
+	return c.client, nil
+}
+
+func (c *Client) call(method string, args, reply interface{}) error {
+	client, err := c.conn()
+	if err != nil {
+		log.WithError(err).Error("Failed to connect to the memory manager")
+		return err
+	}
+
+	err = client.Call(rpcServiceName+"."+method, args, reply)
+	if err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF {
+		log.WithError(err).Warn("Lost the connection to the memory manager")
+		c.mu.Lock()
+		if c.client == client {
+			_ = client.Close()
+			c.client = nil
+		}
+		c.mu.Unlock()
+	}
+
+	return err
+}
+
+// RegisterVM Registers a VM within the memory manager
+func (c *Client) RegisterVM(cfg SnapshotStateCfg) error {
+	return c.call("RegisterVM", &cfg, &struct{}{})
+}
+
+// PrepareSnapshotLoad creates or refreshes the state used to serve UFFD faults
+// while loading a VM snapshot.
+func (c *Client) PrepareSnapshotLoad(cfg SnapshotStateCfg) error {
+	return c.call("PrepareSnapshotLoad", &cfg, &struct{}{})
+}
+
+// DeregisterVM Deregisters a VM from the memory manager
+func (c *Client) DeregisterVM(vmID string) error {
+	return c.call("DeregisterVM", &vmID, &struct{}{})
+}
+
+// Activate creates an epoller to serve page faults and reports when the UFFD
+// socket listener is ready for Firecracker to connect.
+func (c *Client) Activate(vmID string, socketReadyCh chan<- struct{}) error {
+	if err := c.call("Activate", &vmID, &struct{}{}); err != nil {
+		return err
+	}
+	notifySocketReady(socketReadyCh)
+
+	return c.call("WaitActivation", &vmID, &struct{}{})
+}
+
+// FetchState verifies that snapshot state needed by the memory manager exists.
+func (c *Client) FetchState(vmID string) error {
+	return c.call("FetchState", &vmID, &struct{}{})
+}
+
+// Deactivate Removes the epoller which serves page faults for the VM
+func (c *Client) Deactivate(vmID string) error {
+	return c.call("Deactivate", &vmID, &struct{}{})
+}
+
+// StartPrefetch starts prefetching the guest memory pages of an active VM that are not in its working set in the
+// background, if the prefetcher is enabled.
+func (c *Client) StartPrefetch(vmID string) error {
+	return c.call("StartPrefetch", &vmID, &struct{}{})
+}
+
+// DumpUPFPageStats Saves the per VM stats
+func (c *Client) DumpUPFPageStats(vmID, functionName, metricsOutFilePath string) error {
+	args := StatsArgs{VMID: vmID, FunctionName: functionName, Path: metricsOutFilePath}
+	return c.call("DumpUPFPageStats", &args, &struct{}{})
+}
+
+// DumpUPFLatencyStats Dumps latency stats collected for the VM
+func (c *Client) DumpUPFLatencyStats(vmID, functionName, latencyOutFilePath string) error {
+	args := StatsArgs{VMID: vmID, FunctionName: functionName, Path: latencyOutFilePath}
+	return c.call("DumpUPFLatencyStats", &args, &struct{}{})
+}
+
+// GetUPFLatencyStats Returns the gathered metrics for the VM
+func (c *Client) GetUPFLatencyStats(vmID string) ([]*metrics.Metric, error) {
+	var stats []*metrics.Metric
+	if err := c.call("GetUPFLatencyStats", &vmID, &stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
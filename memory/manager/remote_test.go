@@ -0,0 +1,146 @@
+package manager
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveTestMemoryManager serves a memory manager on a unix socket, and returns a client of it.
+func serveTestMemoryManager(t *testing.T, cfg MemoryManagerCfg) *Client {
+	t.Helper()
+
+	socketPath := filepath.Join(t.TempDir(), "memory-manager.sock")
+	l, err := Listen(socketPath)
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	go func() { _ = Serve(l, NewMemoryManager(cfg)) }()
+
+	client := NewClient(socketPath)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = l.Close()
+	})
+
+	return client
+}
+
+func TestClientActivatesVMInMemoryManagerProcess(t *testing.T) {
+	baseDir := t.TempDir()
+	vmID := "vm-remote"
+	guestMemPath := filepath.Join(baseDir, "guest_mem")
+	vmmStatePath := filepath.Join(baseDir, "state")
+	socketPath := filepath.Join(baseDir, "uffd.sock")
+	guestMemSize := 2 * os.Getpagesize()
+
+	prepareGuestMemoryFile(t, guestMemPath, guestMemSize)
+	writeTestFile(t, vmmStatePath, "state")
+
+	client := serveTestMemoryManager(t, MemoryManagerCfg{MetricsModeOn: true})
+	cfg := SnapshotStateCfg{
+		VMID:             vmID,
+		BaseDir:          baseDir,
+		VMMStatePath:     vmmStatePath,
+		GuestMemPath:     guestMemPath,
+		GuestMemSize:     guestMemSize,
+		InstanceSockAddr: socketPath,
+	}
+	if err := client.RegisterVM(cfg); err != nil {
+		t.Fatalf("RegisterVM returned error: %v", err)
+	}
+	if err := client.RegisterVM(cfg); err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Fatalf("RegisterVM of a registered VM returned %v", err)
+	}
+	if err := client.PrepareSnapshotLoad(cfg); err != nil {
+		t.Fatalf("PrepareSnapshotLoad returned error: %v", err)
+	}
+	if err := client.FetchState(vmID); err != nil {
+		t.Fatalf("FetchState returned error: %v", err)
+	}
+
+	body, err := json.Marshal([]GuestRegionUffdMapping{{
+		BaseHostVirtAddr: 0x100000,
+		Size:             uint64(guestMemSize),
+		PageSize:         uint64(os.Getpagesize()),
+	}})
+	if err != nil {
+		t.Fatalf("json.Marshal returned error: %v", err)
+	}
+
+	uffdStandIn := testEventFD(t)
+	socketReadyCh := make(chan struct{}, 1)
+	activateErrCh := make(chan error, 1)
+	go func() {
+		activateErrCh <- client.Activate(vmID, socketReadyCh)
+	}()
+
+	receiveSocketReady(t, socketReadyCh)
+
+	conn := dialUnixSocketWithRetry(t, socketPath)
+	if err := writeUffdSocketPayload(conn, body, uffdStandIn); err != nil {
+		_ = conn.Close()
+		t.Fatalf("writeUffdSocketPayload returned error: %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("conn.Close returned error: %v", err)
+	}
+
+	if err := receiveActivateResult(t, activateErrCh); err != nil {
+		t.Fatalf("Activate returned error: %v", err)
+	}
+	if err := client.StartPrefetch(vmID); err != nil {
+		t.Fatalf("StartPrefetch returned error: %v", err)
+	}
+
+	if err := client.Deactivate(vmID); err != nil {
+		t.Fatalf("Deactivate returned error: %v", err)
+	}
+	if _, err := client.GetUPFLatencyStats(vmID); err != nil {
+		t.Fatalf("GetUPFLatencyStats returned error: %v", err)
+	}
+	if err := client.DeregisterVM(vmID); err != nil {
+		t.Fatalf("DeregisterVM returned error: %v", err)
+	}
+	if err := client.FetchState(vmID); err == nil {
+		t.Fatal("FetchState succeeded for a deregistered VM")
+	}
+}
+
+func TestClientActivateReturnsErrorBeforeSocketListen(t *testing.T) {
+	client := serveTestMemoryManager(t, MemoryManagerCfg{})
+	socketReadyCh := make(chan struct{}, 1)
+
+	if err := client.Activate("missing-vm", socketReadyCh); err == nil {
+		t.Fatal("Activate returned nil error for an unregistered VM")
+	}
+
+	select {
+	case <-socketReadyCh:
+		t.Fatal("socket readiness was reported for an unregistered VM")
+	default:
+	}
+}
+
+func TestClientConnectsToMemoryManagerStartedLater(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "memory-manager.sock")
+	client := NewClient(socketPath)
+	t.Cleanup(func() { _ = client.Close() })
+
+	if err := client.FetchState("vm"); err == nil {
+		t.Fatal("FetchState succeeded without a memory manager")
+	}
+
+	l, err := Listen(socketPath)
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() { _ = Serve(l, NewMemoryManager(MemoryManagerCfg{})) }()
+
+	if err := client.FetchState("vm"); err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Fatalf("FetchState of an unregistered VM returned %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// snapshotCache shares the read-only guest memory mappings and working set pages between the VMs loaded from the
+// same snapshot, so that concurrent restores do not keep a copy each. The entries are reference counted, and are
+// released when the last VM using them deactivates. A nil cache does not share anything.
+type snapshotCache struct {
+	sync.Mutex
+	guestMems   map[string]*sharedGuestMem   // indexed by the guest memory file
+	workingSets map[string]*sharedWorkingSet // indexed by the working set file
+}
+
+// sharedGuestMem is a read-only mapping of a guest memory file.
+type sharedGuestMem struct {
+	path string
+	refs int
+	// guest memory file when it was mapped, which tells whether it has been replaced since
+	info os.FileInfo
+	mem  []byte
+}
+
+// sharedWorkingSet holds the working set pages of a snapshot, which are read by the first VM that needs them while
+// the others wait.
+type sharedWorkingSet struct {
+	path string
+	refs int
+	// trace that the working set pages were read for, which tells whether they have been regenerated since
+	traceInfo os.FileInfo
+	loaded    chan struct{}
+	err       error
+	pages     []byte
+}
+
+func newSnapshotCache() *snapshotCache {
+	return &snapshotCache{
+		guestMems:   make(map[string]*sharedGuestMem),
+		workingSets: make(map[string]*sharedWorkingSet),
+	}
+}
+
+// sameFile reports whether both file infos describe the same unmodified file.
+func sameFile(a, b os.FileInfo) bool {
+	return a != nil && b != nil && os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// mapGuestMem returns a read-only mapping of at least size bytes of the guest memory file f at path, which is shared
+// with the other VMs that have mapped the same file.
+func (c *snapshotCache) mapGuestMem(path string, f *os.File, size int) (*sharedGuestMem, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if c != nil {
+		c.Lock()
+		defer c.Unlock()
+
+		if shared, ok := c.guestMems[path]; ok && sameFile(shared.info, info) && len(shared.mem) >= size {
+			shared.refs++
+			return shared, nil
+		}
+	}
+
+	mem, err := unix.Mmap(int(f.Fd()), 0, size, unix.PROT_READ, unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+
+	// A replaced file gets a new mapping, while the VMs using the previous one keep it until they release it
+	shared := &sharedGuestMem{path: path, refs: 1, info: info, mem: mem}
+	if c != nil {
+		c.guestMems[path] = shared
+	}
+
+	return shared, nil
+}
+
+// unmapGuestMem releases a guest memory mapping, which is unmapped once no VM uses it.
+func (c *snapshotCache) unmapGuestMem(shared *sharedGuestMem) error {
+	if c != nil {
+		c.Lock()
+		defer c.Unlock()
+	}
+
+	shared.refs--
+	if shared.refs > 0 {
+		return nil
+	}
+	if c != nil && c.guestMems[shared.path] == shared {
+		delete(c.guestMems, shared.path)
+	}
+
+	return unix.Munmap(shared.mem)
+}
+
+// loadWorkingSet returns the size bytes of working set pages at path that were recorded along with the trace read
+// from the file described by traceInfo. The pages are shared with the other VMs replaying the same trace, unless the
+// trace was not read from a file.
+func (c *snapshotCache) loadWorkingSet(path string, traceInfo os.FileInfo, size int) (*sharedWorkingSet, error) {
+	shared := &sharedWorkingSet{path: path, refs: 1, traceInfo: traceInfo, loaded: make(chan struct{})}
+
+	if c != nil && traceInfo != nil {
+		c.Lock()
+		if cached, ok := c.workingSets[path]; ok && sameFile(cached.traceInfo, traceInfo) {
+			cached.refs++
+			c.Unlock()
+
+			<-cached.loaded
+			if cached.err != nil {
+				c.releaseWorkingSet(cached)
+				return nil, cached.err
+			}
+			return cached, nil
+		}
+		c.workingSets[path] = shared
+		c.Unlock()
+	}
+
+	shared.pages, shared.err = readWorkingSetFile(path, size)
+	close(shared.loaded)
+	if shared.err != nil {
+		c.releaseWorkingSet(shared)
+		return nil, shared.err
+	}
+
+	return shared, nil
+}
+
+// releaseWorkingSet releases working set pages, which are dropped once no VM uses them.
+func (c *snapshotCache) releaseWorkingSet(shared *sharedWorkingSet) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	shared.refs--
+	if shared.refs == 0 && c.workingSets[shared.path] == shared {
+		delete(c.workingSets, shared.path)
+	}
+}
+
+// readWorkingSetFile reads the first size bytes of the working set file.
+func readWorkingSetFile(path string, size int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Errorf("Failed to open the working set file: %v\n", err)
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	pages := make([]byte, size)
+	if _, err := io.ReadFull(f, pages); err != nil {
+		log.Errorf("Reading working set file failed: %v\n", err)
+		return nil, err
+	}
+
+	return pages, nil
+}
@@ -0,0 +1,154 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSnapshotCacheSharesGuestMemoryAndWorkingSet(t *testing.T) {
+	baseDir := t.TempDir()
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+	guestMemPath := filepath.Join(baseDir, "mem_file")
+	vmmStatePath := filepath.Join(baseDir, "snap_file")
+	workingSetPath := filepath.Join(baseDir, "working_set_pages")
+	tracePath := filepath.Join(baseDir, "trace")
+
+	prepareGuestMemoryFile(t, guestMemPath, 4*int(pageSize))
+	writeTestFile(t, vmmStatePath, "state")
+
+	recorded := initTrace(tracePath)
+	recorded.AppendRecord(Record{offset: pageSize})
+	if err := recorded.ProcessRecord(guestMemPath, workingSetPath, pageSize); err != nil {
+		t.Fatalf("ProcessRecord returned error: %v", err)
+	}
+
+	mappings := []GuestRegionUffdMapping{{
+		BaseHostVirtAddr: baseAddr,
+		Size:             4 * pageSize,
+		PageSize:         pageSize,
+	}}
+	manager := NewMemoryManager(MemoryManagerCfg{})
+	var states []*SnapshotState
+	for _, vmID := range []string{"vm-1", "vm-2"} {
+		if err := manager.RegisterVM(SnapshotStateCfg{
+			VMID:           vmID,
+			BaseDir:        filepath.Join(baseDir, vmID),
+			VMMStatePath:   vmmStatePath,
+			GuestMemPath:   guestMemPath,
+			WorkingSetPath: workingSetPath,
+			TracePath:      tracePath,
+			GuestMemSize:   4 * int(pageSize),
+		}); err != nil {
+			t.Fatalf("RegisterVM returned error: %v", err)
+		}
+		if err := manager.FetchState(vmID); err != nil {
+			t.Fatalf("FetchState returned error: %v", err)
+		}
+		state := manager.instances[vmID]
+		activateWithFakeUffd(t, state, mappings)
+		states = append(states, state)
+	}
+
+	if &states[0].guestMem[0] != &states[1].guestMem[0] {
+		t.Fatal("VMs loaded from the same snapshot mapped the guest memory file separately")
+	}
+	if &states[0].workingSet[0] != &states[1].workingSet[0] {
+		t.Fatal("VMs loaded from the same snapshot read the working set separately")
+	}
+	if got := manager.snapshotCache.guestMems[guestMemPath].refs; got != 2 {
+		t.Fatalf("guest memory mapping refs = %d, want 2", got)
+	}
+	if got := manager.snapshotCache.workingSets[workingSetPath].refs; got != 2 {
+		t.Fatalf("working set refs = %d, want 2", got)
+	}
+
+	// The mapping outlives the VM that created it
+	if err := manager.Deactivate("vm-1"); err != nil {
+		t.Fatalf("Deactivate returned error: %v", err)
+	}
+	if err := validateGuestMemory(states[1].guestMem); err != nil {
+		t.Fatalf("guest memory of the remaining VM: %v", err)
+	}
+	if got := manager.snapshotCache.guestMems[guestMemPath].refs; got != 1 {
+		t.Fatalf("guest memory mapping refs = %d, want 1", got)
+	}
+
+	if err := manager.Deactivate("vm-2"); err != nil {
+		t.Fatalf("Deactivate returned error: %v", err)
+	}
+	if len(manager.snapshotCache.guestMems) != 0 || len(manager.snapshotCache.workingSets) != 0 {
+		t.Fatalf("snapshot cache not released: %d mappings, %d working sets", len(manager.snapshotCache.guestMems),
+			len(manager.snapshotCache.workingSets))
+	}
+}
+
+func TestSnapshotCacheLoadsWorkingSetOnce(t *testing.T) {
+	baseDir := t.TempDir()
+	workingSetPath := filepath.Join(baseDir, "working_set_pages")
+	tracePath := filepath.Join(baseDir, "trace")
+	writeTestFile(t, workingSetPath, "pages")
+	writeTestFile(t, tracePath, "trace")
+
+	traceInfo, err := os.Stat(tracePath)
+	if err != nil {
+		t.Fatalf("os.Stat returned error: %v", err)
+	}
+
+	cache := newSnapshotCache()
+	loaded := make([]*sharedWorkingSet, 8)
+	var wg sync.WaitGroup
+	for i := range loaded {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shared, err := cache.loadWorkingSet(workingSetPath, traceInfo, len("pages"))
+			if err != nil {
+				t.Errorf("loadWorkingSet returned error: %v", err)
+				return
+			}
+			loaded[i] = shared
+		}(i)
+	}
+	wg.Wait()
+
+	for _, shared := range loaded {
+		if shared != loaded[0] {
+			t.Fatal("concurrent loads of the same working set were not shared")
+		}
+	}
+	if got, want := string(loaded[0].pages), "pages"; got != want {
+		t.Fatalf("working set pages = %q, want %q", got, want)
+	}
+
+	// A regenerated working set is not shared with the VMs still using the previous one
+	if err := os.Remove(tracePath); err != nil {
+		t.Fatalf("os.Remove returned error: %v", err)
+	}
+	writeTestFile(t, tracePath, "regenerated")
+	writeTestFile(t, workingSetPath, "regenerated")
+	traceInfo, err = os.Stat(tracePath)
+	if err != nil {
+		t.Fatalf("os.Stat returned error: %v", err)
+	}
+	regenerated, err := cache.loadWorkingSet(workingSetPath, traceInfo, len("regenerated"))
+	if err != nil {
+		t.Fatalf("loadWorkingSet returned error: %v", err)
+	}
+	if regenerated == loaded[0] {
+		t.Fatal("regenerated working set shared with the previous one")
+	}
+
+	for _, shared := range loaded {
+		cache.releaseWorkingSet(shared)
+	}
+	if cache.workingSets[workingSetPath] != regenerated {
+		t.Fatal("releasing the previous working set dropped the regenerated one")
+	}
+	cache.releaseWorkingSet(regenerated)
+	if len(cache.workingSets) != 0 {
+		t.Fatalf("working sets = %d, want 0", len(cache.workingSets))
+	}
+}
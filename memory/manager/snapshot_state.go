@@ -28,18 +28,33 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/sys/unix"
 
 	"github.com/vhive-serverless/vhive/metrics"
+	"github.com/vhive-serverless/vhive/snapshotting"
 )
 
+// defaultInstallChunkSize is the default maximum size of a single copy when installing the working set, which lets
+// large working sets be spread across the installation workers.
+const defaultInstallChunkSize = 2 << 20
+
 // SnapshotStateCfg Config to initialize SnapshotState
 type SnapshotStateCfg struct {
 	VMID string
 
 	VMMStatePath, GuestMemPath, WorkingSetPath string
+	// Path of the recorded working set trace, which is stored alongside the working set
+	TracePath string
+	// Path of the zero page bitmap of the guest memory file, if the snapshot has one
+	ZeroPagesPath string
+	// Path of the compressed guest memory file, which is used if the snapshot has no guest memory file
+	CompressedGuestMemPath string
+	// Path of the manifest of the guest memory chunks in the page store, which is used if the snapshot has neither
+	// a guest memory file nor a compressed one
+	MemManifestPath string
 
 	InstanceSockAddr string
 	BaseDir          string // base directory for the instance
@@ -47,6 +62,17 @@ type SnapshotStateCfg struct {
 	IsLazyMode       bool
 	GuestMemSize     int
 	metricsModeOn    bool
+
+	installParallelism int
+	faultWorkers       int
+	faultTraceDir      string // directory where the faults of each activation are traced, disabled if empty
+	installChunkSize   uint64 // maximum size of a single copy when installing the working set
+	prefetch           PrefetchCfg
+	// ratio of the pages missing from the working set to its size, above which the pages missed by an activation
+	// are merged into the working set, disabled if 0
+	rerecordThreshold float64
+	// shares the guest memory mapping and the working set pages with the VMs loaded from the same snapshot
+	snapshotCache *snapshotCache
 }
 
 // SnapshotState Stores the state of the snapshot
@@ -55,6 +81,7 @@ type SnapshotState struct {
 	SnapshotStateCfg
 	firstPageFaultOnce  *sync.Once
 	userFaultFD         *os.File
+	uffd                uffdOps
 	guestRegionMappings []GuestRegionUffdMapping
 	trace               *Trace
 	epfd                int
@@ -62,6 +89,12 @@ type SnapshotState struct {
 	quitCh              chan int
 	pollDoneCh          chan struct{}
 
+	// faults of the current activation, traced for offline analysis if enabled
+	faultTrace  *Trace
+	activatedAt time.Time
+	// pages missing from the working set that the current activation faulted on, tracked if re-recording is enabled
+	missedPages *Trace
+
 	// to indicate whether the instance has even been activated. this is to
 	// get around cases where offload is called for the first time
 	isEverActivated bool
@@ -72,6 +105,30 @@ type SnapshotState struct {
 
 	guestMem   []byte
 	workingSet []byte
+	// guest memory mapping and working set pages backing guestMem and workingSet, shared through the snapshot cache
+	sharedGuestMem   *sharedGuestMem
+	sharedWorkingSet *sharedWorkingSet
+	// compressed or deduplicated guest memory, which replaces guestMem if the snapshot has no guest memory file
+	guestMemReader sizedGuestMemFile
+	// buffer of the pages read from guestMemReader to serve a page fault, guarded by installMu
+	guestMemBuf []byte
+	// zeroed buffer from which huge zero pages are copied, since UFFDIO_ZEROPAGE does not support them
+	zeroBuf []byte
+
+	// serializes serving page faults with the background prefetcher, which yields to pending page faults
+	installMu      sync.Mutex
+	pendingFaults  atomic.Int32
+	installedPages *pageBitmap
+	// pages that have been removed or unmapped by the VM, which are served with zero pages
+	removedPages *pageBitmap
+	// pages of the guest memory file that only contain zeros, which are served with zero pages
+	zeroPages *snapshotting.ZeroPageBitmap
+	// guards faultCounts and the metrics, which are updated by concurrent page faults
+	statsMu sync.Mutex
+	// number of faults on each page outside the working set, used to order prefetching for the next loads
+	faultCounts    map[uint64]uint64
+	prefetchStopCh chan struct{}
+	prefetchDoneCh chan struct{}
 
 	// Stats
 	totalPFServed  []float64
@@ -89,8 +146,10 @@ func NewSnapshotState(cfg SnapshotStateCfg) *SnapshotState {
 	s := new(SnapshotState)
 	cfg = normalizeSnapshotStateCfg(cfg)
 	s.SnapshotStateCfg = cfg
+	s.uffd = kernelUffd{}
 
 	s.trace = initTrace(s.getTraceFile())
+	s.loadRecordedWorkingSet()
 	if s.metricsModeOn {
 		s.totalPFServed = make([]float64, 0)
 		s.uniquePFServed = make([]float64, 0)
@@ -105,19 +164,34 @@ func normalizeSnapshotStateCfg(cfg SnapshotStateCfg) SnapshotStateCfg {
 	if cfg.WorkingSetPath == "" && cfg.BaseDir != "" {
 		cfg.WorkingSetPath = filepath.Join(cfg.BaseDir, "working_set_pages")
 	}
+	if cfg.TracePath == "" && cfg.BaseDir != "" {
+		cfg.TracePath = filepath.Join(cfg.BaseDir, "trace")
+	}
+	if cfg.installParallelism <= 0 {
+		cfg.installParallelism = 1
+	}
+	if cfg.faultWorkers <= 0 {
+		cfg.faultWorkers = 1
+	}
+	if cfg.installChunkSize == 0 {
+		cfg.installChunkSize = defaultInstallChunkSize
+	}
+	if cfg.prefetch.BatchSize == 0 {
+		cfg.prefetch.BatchSize = defaultPrefetchBatchSize
+	}
 	return cfg
 }
 
 func (s *SnapshotState) refreshSnapshotLoad(cfg SnapshotStateCfg) {
 	cfg = normalizeSnapshotStateCfg(cfg)
 
+	// The recorded working set belongs to the snapshot, so it is only kept if the same snapshot is loaded again
 	trace := s.trace
-	if trace == nil {
-		trace = initTrace(filepath.Join(cfg.BaseDir, "trace"))
-	} else {
-		trace.traceFileName = filepath.Join(cfg.BaseDir, "trace")
-	}
 	isRecordReady := s.isRecordReady
+	if trace == nil || trace.traceFileName != cfg.TracePath {
+		trace = initTrace(cfg.TracePath)
+		isRecordReady = false
+	}
 	isEverActivated := s.isEverActivated
 	totalPFServed := s.totalPFServed
 	uniquePFServed := s.uniquePFServed
@@ -137,7 +211,12 @@ func (s *SnapshotState) refreshSnapshotLoad(cfg SnapshotStateCfg) {
 	s.isActive = false
 	s.isRecordReady = isRecordReady
 	s.guestMem = nil
-	s.workingSet = nil
+	s.guestMemReader = nil
+	s.releaseWorkingSet()
+	s.installedPages = nil
+	s.removedPages = nil
+	s.zeroPages = nil
+	s.faultCounts = nil
 	s.totalPFServed = totalPFServed
 	s.uniquePFServed = uniquePFServed
 	s.reusedPFServed = reusedPFServed
@@ -146,6 +225,8 @@ func (s *SnapshotState) refreshSnapshotLoad(cfg SnapshotStateCfg) {
 	s.uniqueNum = 0
 	s.currentMetric = nil
 
+	s.loadRecordedWorkingSet()
+
 	if s.metricsModeOn {
 		if s.totalPFServed == nil {
 			s.totalPFServed = make([]float64, 0)
@@ -166,10 +247,31 @@ func (s *SnapshotState) setupStateOnActivate() {
 	s.isActive = true
 	s.isEverActivated = true
 	s.firstPageFaultOnce = new(sync.Once)
+	s.activatedAt = time.Now()
 	s.wakeFD = -1
 	s.quitCh = make(chan int, 1)
 	s.pollDoneCh = make(chan struct{})
 
+	s.installedPages = nil
+	s.removedPages = nil
+	s.faultCounts = nil
+	s.faultTrace = nil
+	s.missedPages = nil
+	if s.rerecordThreshold > 0 && s.isRecordReady && !s.IsLazyMode {
+		s.missedPages = initTrace(s.getTraceFile())
+	}
+	if s.faultTraceDir != "" {
+		s.faultTrace = initTrace(filepath.Join(s.faultTraceDir, fmt.Sprintf("%s-%d.trace", s.VMID, s.activatedAt.UnixNano())))
+	}
+	if s.prefetch.Order != PrefetchDisabled {
+		installedPages, err := newPageBitmap(s.guestRegionMappings)
+		if err != nil {
+			log.WithError(err).Warn("Prefetching is disabled for the VM")
+		}
+		s.installedPages = installedPages
+		s.faultCounts = make(map[uint64]uint64)
+	}
+
 	if s.metricsModeOn {
 		s.uniqueNum = 0
 		s.replayedNum = 0
@@ -179,6 +281,39 @@ func (s *SnapshotState) setupStateOnActivate() {
 	}
 }
 
+// markResumed records that the VM has been resumed, which is the reference of the timestamps of the traced faults.
+func (s *SnapshotState) markResumed() {
+	resumedAfter := time.Since(s.activatedAt)
+	s.trace.setResumedAfter(resumedAfter)
+	if s.faultTrace != nil {
+		s.faultTrace.setResumedAfter(resumedAfter)
+	}
+	if s.missedPages != nil {
+		s.missedPages.setResumedAfter(resumedAfter)
+	}
+}
+
+// writeFaultTrace stores the faults of the activation in the fault trace directory, if enabled.
+func (s *SnapshotState) writeFaultTrace() error {
+	if s.faultTrace == nil {
+		return nil
+	}
+
+	pageSize, err := guestMappingPageSize(s.guestRegionMappings)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.faultTraceDir, 0755); err != nil {
+		return err
+	}
+
+	s.faultTrace.Lock()
+	s.faultTrace.pageSize = pageSize
+	s.faultTrace.Unlock()
+
+	return s.faultTrace.WriteTrace()
+}
+
 func (s *SnapshotState) processMetrics() {
 	if !s.metricsModeOn || s.currentMetric == nil {
 		return
@@ -197,28 +332,200 @@ func (s *SnapshotState) processMetrics() {
 }
 
 func (s *SnapshotState) getTraceFile() string {
-	return filepath.Join(s.BaseDir, "trace")
+	return s.TracePath
 }
 
-func (s *SnapshotState) mapGuestMemory() error {
+// loadRecordedWorkingSet switches to the replay phase if the working set of the snapshot has already been recorded,
+// possibly by another VM loaded from the same snapshot.
+func (s *SnapshotState) loadRecordedWorkingSet() {
+	if s.IsLazyMode || s.isRecordReady {
+		return
+	}
+
+	if _, err := os.Stat(s.WorkingSetPath); err != nil {
+		return
+	}
+
+	trace := initTrace(s.getTraceFile())
+	if err := trace.readTrace(); err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warn("Failed to read the recorded trace, recording the working set again")
+		}
+		return
+	}
+
+	log.WithFields(log.Fields{"vmID": s.VMID}).Debug("Replaying the recorded working set")
+	s.trace = trace
+	s.isRecordReady = true
+}
+
+// reloadRecordedWorkingSet reads the trace again if the working set has been regenerated since it was read, e.g., by
+// another VM loaded from the same snapshot, so that it matches the working set pages.
+func (s *SnapshotState) reloadRecordedWorkingSet() error {
+	info, err := os.Stat(s.getTraceFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if s.trace.isFile(info) {
+		return nil
+	}
+
+	trace := initTrace(s.getTraceFile())
+	if err := trace.readTrace(); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"vmID": s.VMID}).Debug("Reloaded the regenerated working set")
+	s.trace = trace
+	return nil
+}
+
+// missRatio returns the ratio of the pages missing from the working set that the current activation faulted on to
+// the size of the working set.
+func (s *SnapshotState) missRatio() float64 {
+	if s.missedPages == nil {
+		return 0
+	}
+
+	s.missedPages.Lock()
+	missed := len(s.missedPages.trace)
+	s.missedPages.Unlock()
+
+	return float64(missed) / float64(max(len(s.trace.trace), 1))
+}
+
+// mergeMissedPages merges the pages missing from the working set that the current activation faulted on into the
+// recorded working set of the snapshot, and regenerates the working set pages. The pages are merged into the trace
+// as it is stored, which may have been regenerated by other VMs loaded from the same snapshot since it was read.
+func (s *SnapshotState) mergeMissedPages() error {
+	pageSize, err := guestMappingPageSize(s.guestRegionMappings)
+	if err != nil {
+		return err
+	}
+	if pageSize != s.trace.pageSize {
+		return fmt.Errorf("working set recorded with a different page size: %#x", s.trace.pageSize)
+	}
+
+	trace := initTrace(s.getTraceFile())
+	if err := trace.readTrace(); err != nil {
+		return err
+	}
+
+	s.missedPages.Lock()
+	missed := make([]Record, 0, len(s.missedPages.trace))
+	for _, rec := range s.missedPages.trace {
+		// The timestamps of the stored records are relative to the resume of the VM that recorded them
+		rec.timestamp -= s.missedPages.resumedAfter
+		missed = append(missed, rec)
+	}
+	s.missedPages.Unlock()
+
+	merged := trace.mergeRecords(missed)
+
+	guestMem, err := s.openGuestMemFile()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = guestMem.Close() }()
+
+	if err := merged.regenerateRecordFrom(guestMem, s.WorkingSetPath, pageSize); err != nil {
+		return err
+	}
+
+	s.trace = merged
+	return nil
+}
+
+// guestMemFile is the guest memory file of a snapshot, which may be compressed.
+type guestMemFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// sizedGuestMemFile is a guest memory file that is read instead of being mapped.
+type sizedGuestMemFile interface {
+	guestMemFile
+	Size() int64
+}
+
+// openGuestMemFile opens the guest memory file, or its compressed version or manifest if the snapshot only has one
+// of the latter.
+func (s *SnapshotState) openGuestMemFile() (guestMemFile, error) {
 	fd, err := os.OpenFile(s.GuestMemPath, os.O_RDONLY, 0444)
+	if err == nil {
+		return fd, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if s.CompressedGuestMemPath != "" {
+		compressed, err := snapshotting.OpenCompressedMemFile(s.CompressedGuestMemPath, 0)
+		if err == nil {
+			return compressed, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if s.MemManifestPath != "" {
+		deduped, err := snapshotting.OpenDedupedMemFile(s.MemManifestPath)
+		if err == nil {
+			return deduped, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+func (s *SnapshotState) mapGuestMemory() error {
+	f, err := s.openGuestMemFile()
 	if err != nil {
 		log.Errorf("Failed to open guest memory file: %v", err)
 		return err
 	}
+
+	// Compressed and deduplicated guest memory is read on demand instead of being mapped
+	if reader, ok := f.(sizedGuestMemFile); ok {
+		if reader.Size() < int64(s.GuestMemSize) {
+			_ = reader.Close()
+			return fmt.Errorf("guest memory file too small: %#x", reader.Size())
+		}
+		s.guestMemReader = reader
+		return nil
+	}
+
+	fd := f.(*os.File)
 	defer func() { _ = fd.Close() }()
 
-	s.guestMem, err = unix.Mmap(int(fd.Fd()), 0, s.GuestMemSize, unix.PROT_READ, unix.MAP_PRIVATE)
+	shared, err := s.snapshotCache.mapGuestMem(s.GuestMemPath, fd, s.GuestMemSize)
 	if err != nil {
 		log.Errorf("Failed to mmap guest memory file: %v", err)
 		return err
 	}
+	s.sharedGuestMem = shared
+	s.guestMem = shared.mem[:s.GuestMemSize]
 
 	return nil
 }
 
 func (s *SnapshotState) unmapGuestMemory() error {
-	if err := unix.Munmap(s.guestMem); err != nil {
+	if s.guestMemReader != nil {
+		err := s.guestMemReader.Close()
+		s.guestMemReader = nil
+		return err
+	}
+
+	if s.sharedGuestMem == nil {
+		return nil
+	}
+
+	err := s.snapshotCache.unmapGuestMem(s.sharedGuestMem)
+	s.sharedGuestMem = nil
+	if err != nil {
 		log.Errorf("Failed to munmap guest memory file: %v", err)
 		return err
 	}
@@ -233,13 +540,47 @@ func (s *SnapshotState) fetchState() error {
 		return err
 	}
 
+	if err := s.fetchZeroPages(); err != nil {
+		return err
+	}
+
 	if s.isRecordReady && !s.IsLazyMode {
+		if err := s.reloadRecordedWorkingSet(); err != nil {
+			log.Errorf("Failed to reload the regenerated trace: %v\n", err)
+			return err
+		}
 		return s.fetchWorkingSet()
 	}
 
 	return nil
 }
 
+// fetchZeroPages loads the zero page bitmap of the guest memory file. Snapshots committed without zero page
+// detection have no bitmap, in which case all pages are read from the guest memory file.
+func (s *SnapshotState) fetchZeroPages() error {
+	if s.zeroPages != nil || s.ZeroPagesPath == "" {
+		return nil
+	}
+
+	zeroPages, err := snapshotting.ReadZeroPageBitmap(s.ZeroPagesPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Errorf("Failed to fetch the zero page bitmap: %v\n", err)
+		return err
+	}
+
+	s.zeroPages = zeroPages
+	return nil
+}
+
+// isZeroPage reports whether the guest memory page at the memory file offset only contains zeros. A huge page only
+// contains zeros if all the pages of the bitmap that it spans do.
+func (s *SnapshotState) isZeroPage(offset, length uint64) bool {
+	return s.zeroPages != nil && length%uint64(s.zeroPages.PageSize) == 0 &&
+		s.zeroPages.IsZero(int64(offset), int64(length))
+}
+
 func (s *SnapshotState) fetchWorkingSet() error {
 	pageSize := s.trace.pageSize
 	if pageSize == 0 {
@@ -250,28 +591,27 @@ func (s *SnapshotState) fetchWorkingSet() error {
 	if size > uint64(int(^uint(0)>>1)) {
 		return fmt.Errorf("working set too large: %#x", size)
 	}
+	s.releaseWorkingSet()
 	if size == 0 {
-		s.workingSet = nil
 		return nil
 	}
 
-	f, err := os.Open(s.WorkingSetPath)
+	shared, err := s.snapshotCache.loadWorkingSet(s.WorkingSetPath, s.trace.fileInfo, int(size))
 	if err != nil {
-		log.Errorf("Failed to open the working set file: %v\n", err)
 		return err
 	}
-	defer func() { _ = f.Close() }()
-
-	s.workingSet = make([]byte, int(size))
-	n, err := io.ReadFull(f, s.workingSet)
-	if err != nil {
-		log.Errorf("Reading working set file failed: %v\n", err)
-		return err
-	}
-	if n != len(s.workingSet) {
-		return io.ErrUnexpectedEOF
-	}
+	s.sharedWorkingSet = shared
+	s.workingSet = shared.pages
 
 	log.Debug("Fetched the entire working set")
 	return nil
 }
+
+// releaseWorkingSet releases the working set pages fetched for the VM.
+func (s *SnapshotState) releaseWorkingSet() {
+	if s.sharedWorkingSet != nil {
+		s.snapshotCache.releaseWorkingSet(s.sharedWorkingSet)
+		s.sharedWorkingSet = nil
+	}
+	s.workingSet = nil
+}
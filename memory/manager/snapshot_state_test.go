@@ -1,6 +1,7 @@
 package manager
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,10 +10,14 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
 	"testing"
 	"time"
 
 	"golang.org/x/sys/unix"
+
+	"github.com/vhive-serverless/vhive/snapshotting"
 )
 
 func TestPageAlignFaultAddress(t *testing.T) {
@@ -124,6 +129,22 @@ func TestPageFaultCopyArgsForFault(t *testing.T) {
 				copyMode:  0,
 			},
 		},
+		{
+			name: "huge pages",
+			regions: []GuestRegionUffdMapping{{
+				BaseHostVirtAddr: 0x7f0000000000,
+				Size:             0x800000,
+				Offset:           0x200000,
+				PageSize:         0x200000,
+			}},
+			fault: 0x7f0000345678,
+			want: pageFaultCopyArgs{
+				srcOffset: 0x400000,
+				dstAddr:   0x7f0000200000,
+				copyLen:   0x200000,
+				copyMode:  0,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -495,3 +516,695 @@ func tempFileWithContent(t *testing.T, content string) *os.File {
 
 	return file
 }
+
+func TestTraceProcessRecordKeepsExistingWorkingSet(t *testing.T) {
+	baseDir := t.TempDir()
+	guestMemPath := filepath.Join(baseDir, "guest_mem")
+	workingSetPath := filepath.Join(baseDir, "working_set_pages")
+	tracePath := filepath.Join(baseDir, "trace")
+	pageSize := uint64(os.Getpagesize())
+
+	prepareGuestMemoryFile(t, guestMemPath, 4*int(pageSize))
+
+	first := initTrace(tracePath)
+	first.AppendRecord(Record{offset: 0})
+	if err := first.ProcessRecord(guestMemPath, workingSetPath, pageSize); err != nil {
+		t.Fatalf("ProcessRecord returned error: %v", err)
+	}
+	want, err := os.ReadFile(workingSetPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile working set returned error: %v", err)
+	}
+
+	second := initTrace(tracePath)
+	second.AppendRecord(Record{offset: 2 * pageSize})
+	second.AppendRecord(Record{offset: 3 * pageSize})
+	if err := second.ProcessRecord(guestMemPath, workingSetPath, pageSize); err != nil {
+		t.Fatalf("ProcessRecord returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(workingSetPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile working set returned error: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("ProcessRecord overwrote the existing working set")
+	}
+
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		t.Fatalf("os.ReadDir returned error: %v", err)
+	}
+	if got, want := len(entries), 3; got != want {
+		t.Fatalf("number of files = %d, want %d", got, want)
+	}
+}
+
+func TestTraceReadTraceRoundTrip(t *testing.T) {
+	baseDir := t.TempDir()
+	guestMemPath := filepath.Join(baseDir, "guest_mem")
+	workingSetPath := filepath.Join(baseDir, "working_set_pages")
+	tracePath := filepath.Join(baseDir, "trace")
+	pageSize := uint64(os.Getpagesize())
+
+	prepareGuestMemoryFile(t, guestMemPath, 6*int(pageSize))
+
+	recorded := initTrace(tracePath)
+	for _, page := range []uint64{5, 1, 2, 4} {
+		recorded.AppendRecord(Record{offset: page * pageSize})
+	}
+	if err := recorded.ProcessRecord(guestMemPath, workingSetPath, pageSize); err != nil {
+		t.Fatalf("ProcessRecord returned error: %v", err)
+	}
+
+	replayed := initTrace(tracePath)
+	if err := replayed.readTrace(); err != nil {
+		t.Fatalf("readTrace returned error: %v", err)
+	}
+
+	if replayed.pageSize != pageSize {
+		t.Fatalf("pageSize = %#x, want %#x", replayed.pageSize, pageSize)
+	}
+	if !reflect.DeepEqual(replayed.trace, recorded.trace) {
+		t.Fatalf("trace = %v, want %v", replayed.trace, recorded.trace)
+	}
+	if !reflect.DeepEqual(replayed.regions, recorded.regions) {
+		t.Fatalf("regions = %v, want %v", replayed.regions, recorded.regions)
+	}
+}
+
+func TestTraceFileKeepsFaultDetails(t *testing.T) {
+	tracePath := filepath.Join(t.TempDir(), "trace")
+	pageSize := uint64(os.Getpagesize())
+
+	trace := initTrace(tracePath)
+	trace.pageSize = pageSize
+	trace.AppendRecord(Record{offset: 3 * pageSize, timestamp: 5 * time.Millisecond})
+	trace.AppendRecord(Record{offset: pageSize, timestamp: 20 * time.Millisecond, fromWorkingSet: true})
+	trace.setResumedAfter(10 * time.Millisecond)
+	if err := trace.WriteTrace(); err != nil {
+		t.Fatalf("WriteTrace returned error: %v", err)
+	}
+
+	loaded, err := LoadTrace(tracePath)
+	if err != nil {
+		t.Fatalf("LoadTrace returned error: %v", err)
+	}
+	want := []Record{
+		{offset: 3 * pageSize, order: 0, timestamp: -5 * time.Millisecond},
+		{offset: pageSize, order: 1, timestamp: 10 * time.Millisecond, fromWorkingSet: true},
+	}
+	if !reflect.DeepEqual(loaded.trace, want) {
+		t.Fatalf("trace = %+v, want %+v", loaded.trace, want)
+	}
+	if loaded.pageSize != pageSize {
+		t.Fatalf("pageSize = %#x, want %#x", loaded.pageSize, pageSize)
+	}
+}
+
+func TestTraceReadsLegacyCSVTrace(t *testing.T) {
+	tracePath := filepath.Join(t.TempDir(), "trace")
+	writeTestFile(t, tracePath, "pageSize,1000\n3000\n1000\n")
+
+	trace, err := LoadTrace(tracePath)
+	if err != nil {
+		t.Fatalf("LoadTrace returned error: %v", err)
+	}
+	if trace.pageSize != 0x1000 {
+		t.Fatalf("pageSize = %#x, want %#x", trace.pageSize, 0x1000)
+	}
+	want := []Record{{offset: 0x3000, order: 0}, {offset: 0x1000, order: 1}}
+	if !reflect.DeepEqual(trace.trace, want) {
+		t.Fatalf("trace = %+v, want %+v", trace.trace, want)
+	}
+}
+
+func TestTraceRejectsUnsupportedVersion(t *testing.T) {
+	tracePath := filepath.Join(t.TempDir(), "trace")
+
+	trace := initTrace(tracePath)
+	trace.pageSize = uint64(os.Getpagesize())
+	if err := trace.WriteTrace(); err != nil {
+		t.Fatalf("WriteTrace returned error: %v", err)
+	}
+	data, err := os.ReadFile(tracePath)
+	if err != nil {
+		t.Fatalf("os.ReadFile returned error: %v", err)
+	}
+	binary.LittleEndian.PutUint32(data[len(traceMagic):], traceVersion+1)
+	if err := os.WriteFile(tracePath, data, 0644); err != nil {
+		t.Fatalf("os.WriteFile returned error: %v", err)
+	}
+
+	if _, err := LoadTrace(tracePath); err == nil {
+		t.Fatal("LoadTrace succeeded for a trace with an unsupported version")
+	}
+}
+
+func TestTraceReadTraceRequiresPageSizeHeader(t *testing.T) {
+	tracePath := filepath.Join(t.TempDir(), "trace")
+	writeTestFile(t, tracePath, "1000\n2000\n")
+
+	if err := initTrace(tracePath).readTrace(); err == nil {
+		t.Fatal("readTrace succeeded for a trace without a page size header")
+	}
+}
+
+func TestPlanWorkingSetCopies(t *testing.T) {
+	const pageSize = 0x1000
+
+	mappings := []GuestRegionUffdMapping{
+		{BaseHostVirtAddr: 0x100000, Size: 0x4000, Offset: 0, PageSize: pageSize},
+		{BaseHostVirtAddr: 0x200000, Size: 0x4000, Offset: 0x4000, PageSize: pageSize},
+	}
+
+	tests := []struct {
+		name       string
+		regions    map[uint64]int
+		maxCopyLen uint64
+		want       []pageFaultCopyArgs
+	}{
+		{
+			name:       "contiguous region",
+			regions:    map[uint64]int{0x1000: 3},
+			maxCopyLen: 0x10000,
+			want: []pageFaultCopyArgs{
+				{srcOffset: 0, dstAddr: 0x101000, copyLen: 0x3000, copyMode: 1},
+			},
+		},
+		{
+			name:       "regions in working set order",
+			regions:    map[uint64]int{0x5000: 1, 0x1000: 2},
+			maxCopyLen: 0x10000,
+			want: []pageFaultCopyArgs{
+				{srcOffset: 0, dstAddr: 0x101000, copyLen: 0x2000, copyMode: 1},
+				{srcOffset: 0x2000, dstAddr: 0x201000, copyLen: 0x1000, copyMode: 1},
+			},
+		},
+		{
+			name:       "region split at max copy length",
+			regions:    map[uint64]int{0: 3},
+			maxCopyLen: 0x2800,
+			want: []pageFaultCopyArgs{
+				{srcOffset: 0, dstAddr: 0x100000, copyLen: 0x2000, copyMode: 1},
+				{srcOffset: 0x2000, dstAddr: 0x102000, copyLen: 0x1000, copyMode: 1},
+			},
+		},
+		{
+			name:       "region split at mapping boundary",
+			regions:    map[uint64]int{0x3000: 2},
+			maxCopyLen: 0x10000,
+			want: []pageFaultCopyArgs{
+				{srcOffset: 0, dstAddr: 0x103000, copyLen: 0x1000, copyMode: 1},
+				{srcOffset: 0x1000, dstAddr: 0x200000, copyLen: 0x1000, copyMode: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := planWorkingSetCopies(mappings, tt.regions, pageSize, tt.maxCopyLen, 1)
+			if err != nil {
+				t.Fatalf("planWorkingSetCopies returned error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("planWorkingSetCopies() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanWorkingSetCopiesOutsideAllRegions(t *testing.T) {
+	mappings := []GuestRegionUffdMapping{{BaseHostVirtAddr: 0x100000, Size: 0x2000, PageSize: 0x1000}}
+
+	_, err := planWorkingSetCopies(mappings, map[uint64]int{0x1000: 2}, 0x1000, 0x10000, 0)
+	if !errors.Is(err, errGuestRegionNotFound) {
+		t.Fatalf("planWorkingSetCopies() error = %v, want %v", err, errGuestRegionNotFound)
+	}
+}
+
+func TestInstallWorkingSetPagesInParallel(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+	pages := uint64(64)
+
+	state, uffd := newWorkingSetState(pageSize, baseAddr, pages, 8)
+	state.installParallelism = 4
+	state.installChunkSize = 4 * pageSize
+
+	if err := state.installWorkingSetPages(0, baseAddr, pageSize); err != nil {
+		t.Fatalf("installWorkingSetPages returned error: %v", err)
+	}
+
+	if len(uffd.ops) == 0 || !uffd.ops[len(uffd.ops)-1].wake {
+		t.Fatal("the faulting page was not woken after the working set was installed")
+	}
+
+	copies := uffd.ops[:len(uffd.ops)-1]
+	if got, want := len(copies), int(pages/2/4); got != want {
+		t.Fatalf("number of copies = %d, want %d", got, want)
+	}
+
+	var installed uint64
+	for _, op := range copies {
+		if op.wake || op.mode != uffdCopyModeDontWake() || op.length != 4*pageSize {
+			t.Fatalf("unexpected uffd op %+v", op)
+		}
+		installed += op.length
+	}
+	if got, want := installed, uint64(len(state.workingSet)); got != want {
+		t.Fatalf("installed bytes = %d, want %d", got, want)
+	}
+}
+
+func TestInstallWorkingSetPagesSkipsInstalledPages(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+	pages := uint64(16)
+
+	// The working set consists of the regions of pages 0-3 and 8-11, each installed with a single copy
+	state, uffd := newWorkingSetState(pageSize, baseAddr, pages, 4)
+	installedPages, err := newPageBitmap(state.guestRegionMappings)
+	if err != nil {
+		t.Fatalf("newPageBitmap returned error: %v", err)
+	}
+	state.installedPages = installedPages
+	uffd.existing = map[uint64]bool{baseAddr + 2*pageSize: true, baseAddr + 8*pageSize: true}
+
+	if err := state.installWorkingSetPages(0, baseAddr, pageSize); err != nil {
+		t.Fatalf("installWorkingSetPages returned error: %v", err)
+	}
+
+	var dsts []uint64
+	for _, op := range uffd.ops {
+		if !op.wake {
+			dsts = append(dsts, op.dst)
+		}
+	}
+	sort.Slice(dsts, func(i, j int) bool { return dsts[i] < dsts[j] })
+	want := []uint64{baseAddr, baseAddr + 3*pageSize, baseAddr + 8*pageSize, baseAddr + 9*pageSize}
+	if !reflect.DeepEqual(dsts, want) {
+		t.Fatalf("copied pages = %#x, want %#x", dsts, want)
+	}
+
+	for page := uint64(0); page < pages; page++ {
+		inWorkingSet := page < 4 || (page >= 8 && page < 12)
+		if got := state.installedPages.isSet(page * pageSize); got != inWorkingSet {
+			t.Fatalf("page %d marked as installed = %v, want %v", page, got, inWorkingSet)
+		}
+	}
+}
+
+func BenchmarkInstallWorkingSetPages(b *testing.B) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+	pages := uint64(25600) // 100 MiB with 4 KiB pages, half of which are in the working set
+	regionPages := uint64(16)
+
+	for _, bm := range []struct {
+		name        string
+		parallelism int
+		chunkSize   uint64
+	}{
+		// Mirrors the previous installation of the working set with one copy per page
+		{name: "PerPage", parallelism: 1, chunkSize: pageSize},
+		{name: "Batched", parallelism: runtime.NumCPU(), chunkSize: defaultInstallChunkSize},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			state, _ := newWorkingSetState(pageSize, baseAddr, pages, regionPages)
+			state.uffd = syscallUffd{}
+			state.installParallelism = bm.parallelism
+			state.installChunkSize = bm.chunkSize
+
+			for i := 0; i < b.N; i++ {
+				if err := state.installWorkingSetPages(0, baseAddr, pageSize); err != nil {
+					b.Fatalf("installWorkingSetPages returned error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// newWorkingSetState returns a state that is ready to replay a working set made of every other run of regionPages
+// guest memory pages.
+func newWorkingSetState(pageSize, baseAddr, pages, regionPages uint64) (*SnapshotState, *fakeUffd) {
+	uffd := &fakeUffd{}
+	state := NewSnapshotState(SnapshotStateCfg{VMID: "vm-install"})
+	state.uffd = uffd
+	state.guestRegionMappings = []GuestRegionUffdMapping{{
+		BaseHostVirtAddr: baseAddr,
+		Size:             pages * pageSize,
+		PageSize:         pageSize,
+	}}
+	state.trace.pageSize = pageSize
+	for page := uint64(0); page < pages; page += 2 * regionPages {
+		state.trace.regions[page*pageSize] = int(regionPages)
+	}
+	state.workingSet = make([]byte, pages/2*pageSize)
+
+	return state, uffd
+}
+
+// syscallUffd issues a cheap syscall per operation to account for the cost of the userfaultfd ioctls.
+type syscallUffd struct{}
+
+func (syscallUffd) copyPages(_ int, _, _, _, length uint64) (uint64, error) {
+	_ = unix.Getppid()
+	return length, nil
+}
+
+func (syscallUffd) zeroPages(int, uint64, uint64) error {
+	_ = unix.Getppid()
+	return nil
+}
+
+func (syscallUffd) wake(int, uint64, uint64) error {
+	_ = unix.Getppid()
+	return nil
+}
+
+func TestHandleUffdMsgServesRemovedRangesWithZeroPages(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+
+	for _, event := range []uint8{uffdEventRemove(), uffdEventUnmap()} {
+		t.Run(fmt.Sprintf("event %#x", event), func(t *testing.T) {
+			state, uffd := newReplayState(t, PrefetchCfg{}, baseAddr, 4)
+
+			msgs := [][]byte{
+				uffdPageFaultMsg(baseAddr + pageSize),
+				uffdRangeMsg(event, baseAddr+pageSize, baseAddr+3*pageSize),
+				uffdPageFaultMsg(baseAddr + pageSize + 0x10),
+				uffdPageFaultMsg(baseAddr + 3*pageSize),
+			}
+			for _, msg := range msgs {
+				if err := state.handleUffdMsg(0, msg); err != nil {
+					t.Fatalf("handleUffdMsg returned error: %v", err)
+				}
+			}
+
+			want := []fakeUffdOp{
+				{src: testGuestMemPointer(t, state.guestMem, pageSize), dst: baseAddr + pageSize, length: pageSize},
+				{zero: true, dst: baseAddr + pageSize, length: pageSize},
+				{src: testGuestMemPointer(t, state.guestMem, 3*pageSize), dst: baseAddr + 3*pageSize, length: pageSize},
+			}
+			if !reflect.DeepEqual(uffd.ops, want) {
+				t.Fatalf("uffd ops = %+v, want %+v", uffd.ops, want)
+			}
+		})
+	}
+}
+
+func TestHandleUffdMsgIgnoresUnsupportedEvents(t *testing.T) {
+	state, uffd := newReplayState(t, PrefetchCfg{}, 0x7f0000000000, 4)
+
+	msg := make([]byte, sizeOfUFFDMsg())
+	msg[0] = 0xff
+	if err := state.handleUffdMsg(0, msg); err != nil {
+		t.Fatalf("handleUffdMsg returned error: %v", err)
+	}
+	if len(uffd.ops) != 0 {
+		t.Fatalf("uffd ops = %+v, want none", uffd.ops)
+	}
+
+	if err := state.handleUffdMsg(0, msg[:8]); err == nil {
+		t.Fatal("handleUffdMsg succeeded for a truncated uffd_msg")
+	}
+}
+
+func TestPrefetchSkipsRemovedPages(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+
+	state, uffd := newReplayState(t, PrefetchCfg{Order: PrefetchAddressOrder, BatchSize: 4 * pageSize}, baseAddr, 4)
+
+	if err := state.handleUffdMsg(0, uffdRangeMsg(uffdEventRemove(), baseAddr+pageSize, baseAddr+2*pageSize)); err != nil {
+		t.Fatalf("handleUffdMsg returned error: %v", err)
+	}
+
+	state.startPrefetch(0, nil)
+	<-state.prefetchDoneCh
+
+	want := []fakeUffdOp{
+		{src: testGuestMemPointer(t, state.guestMem, 0), dst: baseAddr, length: pageSize},
+		{src: testGuestMemPointer(t, state.guestMem, 2*pageSize), dst: baseAddr + 2*pageSize, length: 2 * pageSize},
+	}
+	if !reflect.DeepEqual(uffd.ops, want) {
+		t.Fatalf("uffd ops = %+v, want %+v", uffd.ops, want)
+	}
+}
+
+func TestZeroPagesAreServedWithoutCopies(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+
+	state, uffd := newReplayState(t, PrefetchCfg{Order: PrefetchAddressOrder, BatchSize: 4 * pageSize}, baseAddr, 4)
+
+	// Pages 1 and 2 only contain zeros
+	zeroPages := &snapshotting.ZeroPageBitmap{PageSize: int64(pageSize), Size: int64(4 * pageSize), Bits: []byte{0b0110}}
+	state.ZeroPagesPath = filepath.Join(t.TempDir(), "zero_pages")
+	if err := zeroPages.WriteFile(state.ZeroPagesPath); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	if err := state.fetchZeroPages(); err != nil {
+		t.Fatalf("fetchZeroPages returned error: %v", err)
+	}
+
+	for _, offset := range []uint64{pageSize, 0} {
+		if err := state.servePageFault(0, baseAddr+offset); err != nil {
+			t.Fatalf("servePageFault returned error: %v", err)
+		}
+	}
+
+	state.startPrefetch(0, nil)
+	<-state.prefetchDoneCh
+
+	want := []fakeUffdOp{
+		{zero: true, dst: baseAddr + pageSize, length: pageSize},
+		{src: testGuestMemPointer(t, state.guestMem, 0), dst: baseAddr, length: pageSize},
+		{src: testGuestMemPointer(t, state.guestMem, 3*pageSize), dst: baseAddr + 3*pageSize, length: pageSize},
+	}
+	if !reflect.DeepEqual(uffd.ops, want) {
+		t.Fatalf("uffd ops = %+v, want %+v", uffd.ops, want)
+	}
+	if got, want := state.faultCounts, map[uint64]uint64{0: 1, pageSize: 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("faultCounts = %v, want %v", got, want)
+	}
+}
+
+func TestHugeZeroPagesAreCopiedFromZeroBuffer(t *testing.T) {
+	const hugePageSize = 2 << 20
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+
+	state, uffd := newReplayState(t, PrefetchCfg{}, baseAddr, 4*hugePageSize/pageSize)
+	state.guestRegionMappings[0].PageSize = hugePageSize
+
+	// Huge page 1 only contains zeros, while huge page 2 also spans a page with data
+	zeroPages := &snapshotting.ZeroPageBitmap{
+		PageSize: int64(pageSize),
+		Size:     4 * hugePageSize,
+		Bits:     make([]byte, 4*hugePageSize/pageSize/8),
+	}
+	for page := hugePageSize / pageSize; page < 3*hugePageSize/pageSize-1; page++ {
+		zeroPages.Bits[page/8] |= 1 << (page % 8)
+	}
+	state.zeroPages = zeroPages
+
+	if err := state.handleUffdMsg(0, uffdRangeMsg(uffdEventRemove(), baseAddr+3*hugePageSize, baseAddr+4*hugePageSize)); err != nil {
+		t.Fatalf("handleUffdMsg returned error: %v", err)
+	}
+	for _, offset := range []uint64{hugePageSize + 0x10, 2 * hugePageSize, 3 * hugePageSize} {
+		if err := state.servePageFault(0, baseAddr+offset); err != nil {
+			t.Fatalf("servePageFault returned error: %v", err)
+		}
+	}
+
+	want := []fakeUffdOp{
+		{src: testGuestMemPointer(t, state.zeroBuf, 0), dst: baseAddr + hugePageSize, length: hugePageSize},
+		{src: testGuestMemPointer(t, state.guestMem, 2*hugePageSize), dst: baseAddr + 2*hugePageSize, length: hugePageSize},
+		{src: testGuestMemPointer(t, state.zeroBuf, 0), dst: baseAddr + 3*hugePageSize, length: hugePageSize},
+	}
+	if !reflect.DeepEqual(uffd.ops, want) {
+		t.Fatalf("uffd ops = %+v, want %+v", uffd.ops, want)
+	}
+	if len(state.zeroBuf) != hugePageSize || !reflect.DeepEqual(state.zeroBuf, make([]byte, hugePageSize)) {
+		t.Fatal("huge zero pages were not copied from a zeroed buffer")
+	}
+}
+
+func TestWorkingSetWithDifferentPageSizeIsNotInstalled(t *testing.T) {
+	const hugePageSize = 2 << 20
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+
+	state, uffd := newReplayState(t, PrefetchCfg{}, baseAddr, 2*hugePageSize/pageSize)
+	state.guestRegionMappings[0].PageSize = hugePageSize
+	state.trace.AppendRecord(Record{offset: 0})
+	state.trace.pageSize = pageSize
+	state.trace.buildRegionsLocked()
+	state.workingSet = make([]byte, pageSize)
+
+	if err := state.servePageFault(0, baseAddr); err != nil {
+		t.Fatalf("servePageFault returned error: %v", err)
+	}
+
+	want := []fakeUffdOp{
+		{src: testGuestMemPointer(t, state.guestMem, 0), dst: baseAddr, length: hugePageSize},
+	}
+	if !reflect.DeepEqual(uffd.ops, want) {
+		t.Fatalf("uffd ops = %+v, want %+v", uffd.ops, want)
+	}
+}
+
+func TestFetchZeroPagesWithoutBitmap(t *testing.T) {
+	state := NewSnapshotState(SnapshotStateCfg{ZeroPagesPath: filepath.Join(t.TempDir(), "zero_pages")})
+	if err := state.fetchZeroPages(); err != nil {
+		t.Fatalf("fetchZeroPages returned error: %v", err)
+	}
+	if state.isZeroPage(0, uint64(os.Getpagesize())) {
+		t.Fatal("isZeroPage reported a zero page without a bitmap")
+	}
+}
+
+func TestCompressedGuestMemoryIsDecompressedOnFaults(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+	pages := uint64(8)
+
+	dir := t.TempDir()
+	guestMemPath := filepath.Join(dir, "mem_file")
+	compressedPath := filepath.Join(dir, "mem_file.zst")
+	prepareGuestMemoryFile(t, guestMemPath, int(pages*pageSize))
+	guestMem, err := os.ReadFile(guestMemPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile returned error: %v", err)
+	}
+	if err := snapshotting.CompressMemFile(guestMemPath, compressedPath, snapshotting.CompressionCfg{ChunkSize: int64(3 * pageSize)}); err != nil {
+		t.Fatalf("CompressMemFile returned error: %v", err)
+	}
+	if err := os.Remove(guestMemPath); err != nil {
+		t.Fatalf("os.Remove returned error: %v", err)
+	}
+
+	state := NewSnapshotState(SnapshotStateCfg{
+		VMID:                   "vm-compressed",
+		GuestMemPath:           guestMemPath,
+		CompressedGuestMemPath: compressedPath,
+		GuestMemSize:           int(pages * pageSize),
+		WorkingSetPath:         filepath.Join(dir, "working_set_pages"),
+		TracePath:              filepath.Join(dir, "trace"),
+	})
+	uffd := activateWithFakeUffd(t, state, []GuestRegionUffdMapping{{
+		BaseHostVirtAddr: baseAddr,
+		Size:             pages * pageSize,
+		PageSize:         pageSize,
+	}})
+	if state.guestMemReader == nil {
+		t.Fatal("compressed guest memory file was not opened")
+	}
+
+	// Pages 2 and 3 belong to different chunks
+	for _, page := range []uint64{2, 3} {
+		if err := state.servePageFault(0, baseAddr+page*pageSize); err != nil {
+			t.Fatalf("servePageFault returned error: %v", err)
+		}
+
+		op := uffd.ops[len(uffd.ops)-1]
+		if op.src != testGuestMemPointer(t, state.guestMemBuf, 0) || op.dst != baseAddr+page*pageSize {
+			t.Fatalf("uffd op = %+v, want a copy of page %d from the decompression buffer", op, page)
+		}
+		if got, want := state.guestMemBuf[:pageSize], guestMem[page*pageSize:(page+1)*pageSize]; !reflect.DeepEqual(got, want) {
+			t.Fatalf("decompressed page %d does not match the guest memory", page)
+		}
+	}
+
+	if err := state.unmapGuestMemory(); err != nil {
+		t.Fatalf("unmapGuestMemory returned error: %v", err)
+	}
+
+	// The working set is read from the compressed guest memory file as well
+	src, err := state.openGuestMemFile()
+	if err != nil {
+		t.Fatalf("openGuestMemFile returned error: %v", err)
+	}
+	defer func() { _ = src.Close() }()
+	if err := state.trace.processRecordFrom(src, state.WorkingSetPath, pageSize); err != nil {
+		t.Fatalf("processRecordFrom returned error: %v", err)
+	}
+	workingSet, err := os.ReadFile(state.WorkingSetPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile returned error: %v", err)
+	}
+	if !reflect.DeepEqual(workingSet, guestMem[2*pageSize:4*pageSize]) {
+		t.Fatal("working set does not match the guest memory")
+	}
+}
+
+func TestDedupedGuestMemoryIsReadFromPageStore(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	baseAddr := uint64(0x7f0000000000)
+	pages := uint64(8)
+
+	dir := t.TempDir()
+	snap := snapshotting.NewSnapshot("rev", dir, "")
+	if err := os.MkdirAll(filepath.Dir(snap.GetMemFilePath()), 0755); err != nil {
+		t.Fatalf("os.MkdirAll returned error: %v", err)
+	}
+	prepareGuestMemoryFile(t, snap.GetMemFilePath(), int(pages*pageSize))
+	guestMem, err := os.ReadFile(snap.GetMemFilePath())
+	if err != nil {
+		t.Fatalf("os.ReadFile returned error: %v", err)
+	}
+	pageStore, err := snapshotting.NewPageStore(filepath.Join(dir, "pages"))
+	if err != nil {
+		t.Fatalf("NewPageStore returned error: %v", err)
+	}
+	if err := snap.DedupMemFile(pageStore, int64(pageSize)); err != nil {
+		t.Fatalf("DedupMemFile returned error: %v", err)
+	}
+
+	state := NewSnapshotState(SnapshotStateCfg{
+		VMID:            "vm-deduped",
+		GuestMemPath:    snap.GetMemFilePath(),
+		MemManifestPath: snap.GetMemManifestFilePath(),
+		GuestMemSize:    int(pages * pageSize),
+	})
+	uffd := activateWithFakeUffd(t, state, []GuestRegionUffdMapping{{
+		BaseHostVirtAddr: baseAddr,
+		Size:             pages * pageSize,
+		PageSize:         pageSize,
+	}})
+	t.Cleanup(func() { _ = state.unmapGuestMemory() })
+	if state.guestMemReader == nil {
+		t.Fatal("guest memory manifest was not opened")
+	}
+
+	if err := state.servePageFault(0, baseAddr+5*pageSize); err != nil {
+		t.Fatalf("servePageFault returned error: %v", err)
+	}
+	op := uffd.ops[len(uffd.ops)-1]
+	if op.src != testGuestMemPointer(t, state.guestMemBuf, 0) || op.dst != baseAddr+5*pageSize {
+		t.Fatalf("uffd op = %+v, want a copy of page 5 from the page store buffer", op)
+	}
+	if got, want := state.guestMemBuf[:pageSize], guestMem[5*pageSize:6*pageSize]; !reflect.DeepEqual(got, want) {
+		t.Fatal("page read from the page store does not match the guest memory")
+	}
+}
+
+// uffdPageFaultMsg returns a uffd_msg reporting a page fault at address.
+func uffdPageFaultMsg(address uint64) []byte {
+	msg := make([]byte, sizeOfUFFDMsg())
+	msg[0] = uffdPageFault()
+	binary.LittleEndian.PutUint64(msg[16:], address)
+	return msg
+}
+
+// uffdRangeMsg returns a uffd_msg reporting that the [start, end) range has been removed or unmapped.
+func uffdRangeMsg(event uint8, start, end uint64) []byte {
+	msg := make([]byte, sizeOfUFFDMsg())
+	msg[0] = event
+	binary.LittleEndian.PutUint64(msg[8:], start)
+	binary.LittleEndian.PutUint64(msg[16:], end)
+	return msg
+}
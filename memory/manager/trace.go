@@ -23,19 +23,59 @@
 package manager
 
 import (
+	"bufio"
+	"encoding/binary"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"sync"
+	"time"
 )
 
-// Record identifies one guest memory page by its offset in the full memory file.
+// Record identifies one guest memory page by its offset in the full memory file, and describes the page fault that
+// brought it in.
 type Record struct {
 	offset uint64
+	// position of the fault among the faults of the trace
+	order uint64
+	// time of the fault, relative to the activation of the VM until the trace is written, and relative to the
+	// resume of the VM in trace files
+	timestamp time.Duration
+	// whether the page was part of the recorded working set of the snapshot
+	fromWorkingSet bool
+}
+
+const (
+	// pageSizeHeader starts the header of the legacy CSV trace files, which only store the page offsets
+	pageSizeHeader = "pageSize"
+
+	traceMagic   = "VHTR"
+	traceVersion = 1
+
+	traceFlagFromWorkingSet = 1 << 0
+)
+
+// traceFileHeader starts a binary trace file, and is followed by one traceFileRecord per record. All fields are
+// little-endian.
+type traceFileHeader struct {
+	Magic    [4]byte
+	Version  uint32
+	PageSize uint64
+	Records  uint64
+}
+
+type traceFileRecord struct {
+	Offset uint64
+	Order  uint64
+	// Nanoseconds since the resume of the VM, negative for faults raised while the snapshot was being loaded
+	Timestamp int64
+	Flags     uint8
+	_         [7]byte
 }
 
 // Trace stores recorded guest memory page offsets and replay regions.
@@ -43,10 +83,15 @@ type Trace struct {
 	sync.Mutex
 	traceFileName string
 
-	pageSize         uint64
+	pageSize uint64
+	// time from the activation of the VM until it was resumed, which is subtracted from the fault timestamps when
+	// the trace is written
+	resumedAfter     time.Duration
 	containedOffsets map[uint64]struct{}
 	trace            []Record
 	regions          map[uint64]int
+	// trace file when it was read, which tells whether the working set has been regenerated since
+	fileInfo os.FileInfo
 }
 
 func initTrace(traceFileName string) *Trace {
@@ -58,10 +103,16 @@ func initTrace(traceFileName string) *Trace {
 	}
 }
 
+// AppendRecord appends the record of a page that has not been recorded yet, in the order of the faults.
 func (t *Trace) AppendRecord(r Record) {
 	t.Lock()
 	defer t.Unlock()
 
+	r.order = uint64(len(t.trace))
+	t.appendRecordLocked(r)
+}
+
+func (t *Trace) appendRecordLocked(r Record) {
 	if _, ok := t.containedOffsets[r.offset]; ok {
 		return
 	}
@@ -69,27 +120,56 @@ func (t *Trace) AppendRecord(r Record) {
 	t.containedOffsets[r.offset] = struct{}{}
 }
 
+// setResumedAfter sets the time from the activation of the VM until it was resumed.
+func (t *Trace) setResumedAfter(d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.resumedAfter = d
+}
+
+// WriteTrace stores the page size and the records in the trace file.
 func (t *Trace) WriteTrace() error {
 	t.Lock()
 	defer t.Unlock()
 
-	file, err := os.Create(t.traceFileName)
+	return t.writeTraceLocked(t.traceFileName)
+}
+
+func (t *Trace) writeTraceLocked(path string) error {
+	file, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = file.Close() }()
 
-	writer := csv.NewWriter(file)
+	writer := bufio.NewWriter(file)
+	header := traceFileHeader{Version: traceVersion, PageSize: t.pageSize, Records: uint64(len(t.trace))}
+	copy(header.Magic[:], traceMagic)
+	if err := binary.Write(writer, binary.LittleEndian, &header); err != nil {
+		return err
+	}
 	for _, rec := range t.trace {
-		if err := writer.Write([]string{strconv.FormatUint(rec.offset, 16)}); err != nil {
+		entry := traceFileRecord{
+			Offset:    rec.offset,
+			Order:     rec.order,
+			Timestamp: int64(rec.timestamp - t.resumedAfter),
+		}
+		if rec.fromWorkingSet {
+			entry.Flags |= traceFlagFromWorkingSet
+		}
+		if err := binary.Write(writer, binary.LittleEndian, &entry); err != nil {
 			return err
 		}
 	}
-	writer.Flush()
-	return writer.Error()
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	return file.Sync()
 }
 
-//nolint:unused
+// readTrace loads a trace written by WriteTrace, or a legacy CSV trace, and rebuilds its regions.
 func (t *Trace) readTrace() error {
 	f, err := os.Open(t.traceFileName)
 	if err != nil {
@@ -97,22 +177,90 @@ func (t *Trace) readTrace() error {
 	}
 	defer func() { _ = f.Close() }()
 
-	lines, err := csv.NewReader(f).ReadAll()
+	info, err := f.Stat()
 	if err != nil {
 		return err
 	}
+	t.fileInfo = info
+
+	reader := bufio.NewReader(f)
+	if magic, err := reader.Peek(len(traceMagic)); err == nil && string(magic) == traceMagic {
+		return t.readBinaryTrace(reader)
+	}
 
-	for _, line := range lines {
+	return t.readCSVTrace(reader)
+}
+
+func (t *Trace) readBinaryTrace(reader io.Reader) error {
+	var header traceFileHeader
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("reading trace header: %w", err)
+	}
+	if header.Version == 0 || header.Version > traceVersion {
+		return fmt.Errorf("unsupported trace version %d", header.Version)
+	}
+	if header.PageSize == 0 {
+		return errInvalidGuestRegionPageSize
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	for i := uint64(0); i < header.Records; i++ {
+		var entry traceFileRecord
+		if err := binary.Read(reader, binary.LittleEndian, &entry); err != nil {
+			return fmt.Errorf("reading trace record %d: %w", i, err)
+		}
+		t.appendRecordLocked(Record{
+			offset:         entry.Offset,
+			order:          entry.Order,
+			timestamp:      time.Duration(entry.Timestamp),
+			fromWorkingSet: entry.Flags&traceFlagFromWorkingSet != 0,
+		})
+	}
+
+	t.pageSize = header.PageSize
+	t.buildRegionsLocked()
+
+	return nil
+}
+
+func (t *Trace) readCSVTrace(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	lines, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	if len(lines) == 0 || len(lines[0]) != 2 || lines[0][0] != pageSizeHeader {
+		return errors.New("trace file has no page size header")
+	}
+	pageSize, err := strconv.ParseUint(lines[0][1], 16, 64)
+	if err != nil {
+		return err
+	}
+	if pageSize == 0 {
+		return errInvalidGuestRegionPageSize
+	}
+
+	for _, line := range lines[1:] {
 		rec, err := readRecord(line)
 		if err != nil {
 			return err
 		}
 		t.AppendRecord(rec)
 	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.pageSize = pageSize
+	t.buildRegionsLocked()
+
 	return nil
 }
 
-//nolint:unused
 func readRecord(line []string) (Record, error) {
 	if len(line) == 0 {
 		return Record{}, errors.New("empty trace record")
@@ -125,12 +273,55 @@ func readRecord(line []string) (Record, error) {
 	return Record{offset: offset}, nil
 }
 
+// isFile reports whether the trace was read from the file described by info. Regenerated traces replace the file, so
+// they are different files even if their modification times are equal at the granularity of the file system.
+func (t *Trace) isFile(info os.FileInfo) bool {
+	return sameFile(t.fileInfo, info)
+}
+
 func (t *Trace) containsRecord(rec Record) bool {
+	t.Lock()
+	defer t.Unlock()
+
 	_, ok := t.containedOffsets[rec.offset]
 	return ok
 }
 
+// ProcessRecord groups the recorded pages into contiguous regions, and stores the working set pages and the trace
+// next to each other. The working set file is written last, so its presence marks a complete record. If the working
+// set has already been recorded, e.g., by another VM loaded from the same snapshot, the files are left untouched.
 func (t *Trace) ProcessRecord(guestMemPath, workingSetPath string, pageSize uint64) error {
+	guestMem, err := os.Open(guestMemPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = guestMem.Close() }()
+
+	return t.processRecordFrom(guestMem, workingSetPath, pageSize)
+}
+
+// processRecordFrom is ProcessRecord with the working set pages read from guestMem, e.g., a compressed guest memory
+// file.
+func (t *Trace) processRecordFrom(guestMem io.ReaderAt, workingSetPath string, pageSize uint64) error {
+	if pageSize == 0 {
+		return errInvalidGuestRegionPageSize
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.sortRecordsLocked(pageSize)
+
+	if _, err := os.Stat(workingSetPath); err == nil {
+		return nil
+	}
+
+	return t.writeRecordLocked(guestMem, workingSetPath, pageSize)
+}
+
+// regenerateRecordFrom is processRecordFrom that replaces the working set pages and the trace if they have already
+// been recorded.
+func (t *Trace) regenerateRecordFrom(guestMem io.ReaderAt, workingSetPath string, pageSize uint64) error {
 	if pageSize == 0 {
 		return errInvalidGuestRegionPageSize
 	}
@@ -138,18 +329,75 @@ func (t *Trace) ProcessRecord(guestMemPath, workingSetPath string, pageSize uint
 	t.Lock()
 	defer t.Unlock()
 
+	t.sortRecordsLocked(pageSize)
+
+	return t.writeRecordLocked(guestMem, workingSetPath, pageSize)
+}
+
+// mergeRecords returns a trace of the same file with the records of the trace, followed by the records that it does
+// not contain in their order.
+func (t *Trace) mergeRecords(records []Record) *Trace {
+	t.Lock()
+	defer t.Unlock()
+
+	merged := initTrace(t.traceFileName)
+	merged.pageSize = t.pageSize
+	for _, rec := range t.trace {
+		merged.appendRecordLocked(rec)
+	}
+	for _, rec := range records {
+		rec.order = uint64(len(merged.trace))
+		merged.appendRecordLocked(rec)
+	}
+
+	return merged
+}
+
+// sortRecordsLocked sorts the records by their offsets and groups them into regions of pages of the given size.
+func (t *Trace) sortRecordsLocked(pageSize uint64) {
 	t.pageSize = pageSize
 	sort.Slice(t.trace, func(i, j int) bool {
 		return t.trace[i].offset < t.trace[j].offset
 	})
+	t.buildRegionsLocked()
+}
 
+// writeRecordLocked atomically replaces the trace file and the working set pages, the latter being renamed last.
+func (t *Trace) writeRecordLocked(guestMem io.ReaderAt, workingSetPath string, pageSize uint64) error {
+	tmpTrace, err := tempPath(t.traceFileName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmpTrace) }()
+
+	tmpWorkingSet, err := tempPath(workingSetPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmpWorkingSet) }()
+
+	if err := t.writeTraceLocked(tmpTrace); err != nil {
+		return err
+	}
+	if err := t.writeWorkingSetPagesToFileLocked(guestMem, tmpWorkingSet, pageSize); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpTrace, t.traceFileName); err != nil {
+		return err
+	}
+	return os.Rename(tmpWorkingSet, workingSetPath)
+}
+
+// buildRegionsLocked groups the sorted trace into regions of contiguous pages.
+func (t *Trace) buildRegionsLocked() {
 	t.regions = make(map[uint64]int)
 	var (
 		last        uint64
 		regionStart uint64
 	)
 	for i, rec := range t.trace {
-		if i == 0 || rec.offset != last+pageSize {
+		if i == 0 || rec.offset != last+t.pageSize {
 			regionStart = rec.offset
 			t.regions[regionStart] = 1
 		} else {
@@ -157,17 +405,19 @@ func (t *Trace) ProcessRecord(guestMemPath, workingSetPath string, pageSize uint
 		}
 		last = rec.offset
 	}
-
-	return t.writeWorkingSetPagesToFileLocked(guestMemPath, workingSetPath, pageSize)
 }
 
-func (t *Trace) writeWorkingSetPagesToFileLocked(guestMemPath, workingSetPath string, pageSize uint64) error {
-	fSrc, err := os.Open(guestMemPath)
+// tempPath returns the path of a new temporary file next to path.
+func tempPath(path string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer func() { _ = fSrc.Close() }()
 
+	return f.Name(), f.Close()
+}
+
+func (t *Trace) writeWorkingSetPagesToFileLocked(fSrc io.ReaderAt, workingSetPath string, pageSize uint64) error {
 	fDst, err := os.Create(workingSetPath)
 	if err != nil {
 		return err
@@ -0,0 +1,191 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// HistogramBucket Number of values in the [Min, Max] range of a histogram with power-of-two buckets
+type HistogramBucket struct {
+	Min, Max uint64
+	Count    int
+}
+
+// TraceStats Summary of the page faults of a trace
+type TraceStats struct {
+	PageSize uint64
+	// Number of distinct pages faulted on
+	Pages int
+	// Size of the faulted pages, i.e., the working set size for working set traces
+	Bytes uint64
+	// Number of faults on pages of the recorded working set of the snapshot
+	FromWorkingSet int
+	// Time between the first and the last fault
+	Duration time.Duration
+	// Fraction of the faults, after the first one, on the page that follows the page of the previous fault
+	Sequential float64
+	// Distances in pages between the pages of consecutive faults
+	StrideHistogram []HistogramBucket
+	// Lengths in pages of the regions of contiguous pages
+	RegionHistogram []HistogramBucket
+}
+
+// TraceDiff Pages faulted on in two traces, e.g., of invocations of a function with different inputs
+type TraceDiff struct {
+	PageSize uint64
+	// Number of pages in both traces, only in the first trace, and only in the second trace
+	Common, OnlyFirst, OnlySecond int
+}
+
+// LoadTrace reads a trace file written by the memory manager, i.e., the working set trace of a snapshot or the
+// fault trace of a VM activation.
+func LoadTrace(path string) (*Trace, error) {
+	t := initTrace(path)
+	if err := t.readTrace(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Stats summarizes the faults of the trace.
+func (t *Trace) Stats() TraceStats {
+	t.Lock()
+	defer t.Unlock()
+
+	stats := TraceStats{
+		PageSize: t.pageSize,
+		Pages:    len(t.trace),
+		Bytes:    uint64(len(t.trace)) * t.pageSize,
+	}
+	if len(t.trace) == 0 || t.pageSize == 0 {
+		return stats
+	}
+
+	// The records of working set traces are sorted by offset, so they are put back in the order of the faults
+	records := make([]Record, len(t.trace))
+	copy(records, t.trace)
+	sort.Slice(records, func(i, j int) bool { return records[i].order < records[j].order })
+
+	var (
+		sequential int
+		strides    []uint64
+		first      = records[0].timestamp
+		last       = records[0].timestamp
+	)
+	for i, rec := range records {
+		if rec.fromWorkingSet {
+			stats.FromWorkingSet++
+		}
+		first = min(first, rec.timestamp)
+		last = max(last, rec.timestamp)
+		if i == 0 {
+			continue
+		}
+
+		prev := records[i-1].offset
+		if rec.offset == prev+t.pageSize {
+			sequential++
+		}
+		stride := max(rec.offset, prev) - min(rec.offset, prev)
+		strides = append(strides, stride/t.pageSize)
+	}
+	stats.Duration = last - first
+	if len(records) > 1 {
+		stats.Sequential = float64(sequential) / float64(len(records)-1)
+	}
+	stats.StrideHistogram = histogram(strides)
+
+	// Fault traces are in the order of the faults, so the regions are rebuilt from the sorted offsets
+	sort.Slice(records, func(i, j int) bool { return records[i].offset < records[j].offset })
+	var regions []uint64
+	for i, rec := range records {
+		if i == 0 || rec.offset != records[i-1].offset+t.pageSize {
+			regions = append(regions, 0)
+		}
+		regions[len(regions)-1]++
+	}
+	stats.RegionHistogram = histogram(regions)
+
+	return stats
+}
+
+// DiffTraces compares the pages faulted on in two traces with the same page size.
+func DiffTraces(first, second *Trace) (TraceDiff, error) {
+	first.Lock()
+	defer first.Unlock()
+	second.Lock()
+	defer second.Unlock()
+
+	if first.pageSize != second.pageSize {
+		return TraceDiff{}, fmt.Errorf("traces have different page sizes: %#x and %#x", first.pageSize, second.pageSize)
+	}
+
+	diff := TraceDiff{PageSize: first.pageSize}
+	for offset := range first.containedOffsets {
+		if _, ok := second.containedOffsets[offset]; ok {
+			diff.Common++
+		} else {
+			diff.OnlyFirst++
+		}
+	}
+	diff.OnlySecond = len(second.containedOffsets) - diff.Common
+
+	return diff, nil
+}
+
+// Similarity returns the Jaccard similarity of the pages of the traces, i.e., the fraction of all the pages that are
+// in both traces.
+func (d TraceDiff) Similarity() float64 {
+	total := d.Common + d.OnlyFirst + d.OnlySecond
+	if total == 0 {
+		return 1
+	}
+
+	return float64(d.Common) / float64(total)
+}
+
+// histogram counts the values in power-of-two buckets, i.e., 0, 1, 2-3, 4-7 and so on, omitting the empty buckets.
+func histogram(values []uint64) []HistogramBucket {
+	counts := make(map[int]int)
+	for _, v := range values {
+		counts[bits.Len64(v)]++
+	}
+
+	buckets := make([]HistogramBucket, 0, len(counts))
+	for n, count := range counts {
+		bucket := HistogramBucket{Count: count}
+		if n > 0 {
+			bucket.Min = 1 << (n - 1)
+			bucket.Max = 1<<n - 1
+		}
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Min < buckets[j].Min })
+
+	return buckets
+}
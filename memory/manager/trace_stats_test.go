@@ -0,0 +1,71 @@
+package manager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTraceStats(t *testing.T) {
+	const pageSize = 0x1000
+
+	trace := initTrace("")
+	trace.pageSize = pageSize
+	// Pages 4-6 are faulted on sequentially, then page 1 and page 9
+	for i, page := range []uint64{4, 5, 6, 1, 9} {
+		trace.AppendRecord(Record{
+			offset:         page * pageSize,
+			timestamp:      time.Duration(i) * time.Millisecond,
+			fromWorkingSet: page >= 4 && page <= 6,
+		})
+	}
+	stats := trace.Stats()
+
+	if stats.Pages != 5 || stats.Bytes != 5*pageSize || stats.FromWorkingSet != 3 {
+		t.Fatalf("stats = %+v, want 5 pages of which 3 from the working set", stats)
+	}
+	if stats.Duration != 4*time.Millisecond {
+		t.Fatalf("Duration = %v, want 4ms", stats.Duration)
+	}
+	if stats.Sequential != 0.5 {
+		t.Fatalf("Sequential = %v, want 0.5", stats.Sequential)
+	}
+	wantStrides := []HistogramBucket{{Min: 1, Max: 1, Count: 2}, {Min: 4, Max: 7, Count: 1}, {Min: 8, Max: 15, Count: 1}}
+	if !reflect.DeepEqual(stats.StrideHistogram, wantStrides) {
+		t.Fatalf("StrideHistogram = %+v, want %+v", stats.StrideHistogram, wantStrides)
+	}
+	wantRegions := []HistogramBucket{{Min: 1, Max: 1, Count: 2}, {Min: 2, Max: 3, Count: 1}}
+	if !reflect.DeepEqual(stats.RegionHistogram, wantRegions) {
+		t.Fatalf("RegionHistogram = %+v, want %+v", stats.RegionHistogram, wantRegions)
+	}
+}
+
+func TestDiffTraces(t *testing.T) {
+	const pageSize = 0x1000
+
+	newTrace := func(pages ...uint64) *Trace {
+		trace := initTrace("")
+		trace.pageSize = pageSize
+		for _, page := range pages {
+			trace.AppendRecord(Record{offset: page * pageSize})
+		}
+		return trace
+	}
+
+	diff, err := DiffTraces(newTrace(1, 2, 3, 4), newTrace(3, 4, 5))
+	if err != nil {
+		t.Fatalf("DiffTraces returned error: %v", err)
+	}
+	if want := (TraceDiff{PageSize: pageSize, Common: 2, OnlyFirst: 2, OnlySecond: 1}); diff != want {
+		t.Fatalf("DiffTraces() = %+v, want %+v", diff, want)
+	}
+	if got := diff.Similarity(); got != 0.4 {
+		t.Fatalf("Similarity() = %v, want 0.4", got)
+	}
+
+	other := newTrace(1)
+	other.pageSize = 2 << 20
+	if _, err := DiffTraces(newTrace(1), other); err == nil {
+		t.Fatal("DiffTraces succeeded for traces with different page sizes")
+	}
+}
@@ -42,6 +42,7 @@ import (
 	"unsafe"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/sys/unix"
 
 	"github.com/vhive-serverless/vhive/metrics"
@@ -70,6 +71,31 @@ type GuestRegionUffdMapping struct {
 	PageSize         uint64 `json:"page_size"`
 }
 
+// uffdOps resolves page faults on a userfaultfd. It is replaced with a fake in tests, so that the record and
+// replay phases can be driven without KVM.
+type uffdOps interface {
+	// copyPages returns the number of bytes copied and the error of UFFDIO_COPY, which is EAGAIN if the copy stopped
+	// at a page that had already been installed after copying some bytes, or EEXIST if the first page had
+	copyPages(fd int, src, dst, mode, length uint64) (uint64, error)
+	zeroPages(fd int, dst, length uint64) error
+	wake(fd int, startAddress, length uint64) error
+}
+
+// kernelUffd resolves page faults with the userfaultfd ioctls.
+type kernelUffd struct{}
+
+func (kernelUffd) copyPages(fd int, src, dst, mode, length uint64) (uint64, error) {
+	return installRegionBytes(fd, src, dst, mode, length)
+}
+
+func (kernelUffd) zeroPages(fd int, dst, length uint64) error {
+	return installZeroPages(fd, dst, length)
+}
+
+func (kernelUffd) wake(fd int, startAddress, length uint64) error {
+	return wake(fd, startAddress, length)
+}
+
 // pageFaultCopyArgs describes one UFFDIO_COPY operation.
 type pageFaultCopyArgs struct {
 	srcOffset uint64
@@ -104,6 +130,17 @@ func guestMemoryOffsetForFaultPage(region GuestRegionUffdMapping, faultPageAddr
 	return region.Offset + regionOffset, nil
 }
 
+// guestMemoryOffsetForAddress translates a guest page address to its memory-file offset.
+func guestMemoryOffsetForAddress(regions []GuestRegionUffdMapping, pageAddr uint64) (uint64, error) {
+	for _, region := range regions {
+		if regionContainsFaultPage(region, pageAddr) {
+			return guestMemoryOffsetForFaultPage(region, pageAddr)
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %#x", errGuestRegionNotFound, pageAddr)
+}
+
 // guestAddressForMemoryOffset translates a memory-file offset to a guest address.
 func guestAddressForMemoryOffset(region GuestRegionUffdMapping, offset uint64) (uint64, error) {
 	if region.PageSize == 0 {
@@ -373,6 +410,13 @@ func (s *SnapshotState) pollUserPageFaults(readyCh chan error) {
 
 	defer func() { _ = syscall.Close(s.epfd) }()
 
+	var dispatcher *faultDispatcher
+	if s.faultWorkers > 1 {
+		dispatcher = newFaultDispatcher(s, int(s.userFaultFD.Fd()), s.faultWorkers)
+		defer dispatcher.stop()
+	}
+	msgs := make([]byte, uffdMsgBatchSize*sizeOfUFFDMsg())
+
 	readyCh <- nil
 
 	for {
@@ -424,9 +468,7 @@ func (s *SnapshotState) pollUserPageFaults(readyCh chan error) {
 					return
 				}
 
-				goMsg := make([]byte, sizeOfUFFDMsg())
-
-				nread, err := syscall.Read(fd, goMsg)
+				nread, err := syscall.Read(fd, msgs)
 				if err != nil {
 					if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
 						continue
@@ -438,23 +480,9 @@ func (s *SnapshotState) pollUserPageFaults(readyCh chan error) {
 					logger.WithError(err).Error("Read uffd_msg failed")
 					return
 				}
-				if nread != len(goMsg) {
-					logger.WithFields(log.Fields{
-						"read": nread,
-						"want": len(goMsg),
-					}).Error("Read incomplete uffd_msg")
-					return
-				}
 
-				if event := uint8(goMsg[0]); event != uffdPageFault() {
-					logger.WithField("event", event).Warn("Ignoring unsupported UFFD event")
-					continue
-				}
-
-				address := binary.LittleEndian.Uint64(goMsg[16:])
-
-				if err := s.servePageFault(fd, address); err != nil {
-					logger.WithError(err).WithField("address", fmt.Sprintf("%#x", address)).Error("Failed to serve page fault")
+				if err := s.handleUffdMsgs(fd, msgs[:nread], dispatcher); err != nil {
+					logger.WithError(err).Error("Failed to handle UFFD event")
 					return
 				}
 			}
@@ -552,34 +580,116 @@ func (s *SnapshotState) closeWakeFD() {
 	}
 }
 
-// servePageFault copies the requested guest page or installs the recorded working set.
-func (s *SnapshotState) servePageFault(fd int, address uint64) error {
+// handleUffdMsg handles a uffd_msg read from the userfaultfd. Page faults are served, while the ranges that are
+// removed (e.g., on balloon inflation or madvise(MADV_DONTNEED)) or unmapped are served with zero pages afterward,
+// since their contents in the snapshot are stale.
+func (s *SnapshotState) handleUffdMsg(fd int, msg []byte) error {
+	if len(msg) < sizeOfUFFDMsg() {
+		return fmt.Errorf("uffd_msg is too short: %d bytes", len(msg))
+	}
+
+	switch event := msg[0]; event {
+	case uffdPageFault():
+		address := binary.LittleEndian.Uint64(msg[16:])
+		if err := s.servePageFault(fd, address); err != nil {
+			return fmt.Errorf("serving page fault at %#x: %w", address, err)
+		}
+	case uffdEventRemove(), uffdEventUnmap():
+		start := binary.LittleEndian.Uint64(msg[8:])
+		end := binary.LittleEndian.Uint64(msg[16:])
+		s.removeRange(start, end)
+	default:
+		log.WithFields(log.Fields{"vmID": s.VMID, "event": event}).Warn("Ignoring unsupported UFFD event")
+	}
+
+	return nil
+}
+
+// removeRange records that the guest memory in the [start, end) address range has been dropped.
+func (s *SnapshotState) removeRange(start, end uint64) {
+	s.installMu.Lock()
+	defer s.installMu.Unlock()
+
+	if s.removedPages == nil {
+		removedPages, err := newPageBitmap(s.guestRegionMappings)
+		if err != nil {
+			log.WithError(err).Warn("Failed to track removed guest memory")
+			return
+		}
+		s.removedPages = removedPages
+	}
+
+	for _, region := range s.guestRegionMappings {
+		lo := max(start, region.BaseHostVirtAddr)
+		hi := min(end, region.BaseHostVirtAddr+region.Size)
+		if lo >= hi {
+			continue
+		}
+
+		offset := region.Offset + lo - region.BaseHostVirtAddr
+		s.removedPages.set(offset, hi-lo)
+		s.installedPages.clear(offset, hi-lo)
+	}
+}
+
+// servePageFault copies the requested guest page or installs the recorded working set. It may be called
+// concurrently for different pages: faults raised while the working set is being installed wait for it, and pages
+// of the mapped guest memory file are copied without holding installMu.
+func (s *SnapshotState) servePageFault(fd int, address uint64) (err error) {
 	var (
 		tStart              time.Time
+		tFault              time.Time
+		firstFault          bool
 		workingSetInstalled bool
 	)
 
+	if s.metricsModeOn {
+		tFault = time.Now()
+		defer func() {
+			if firstFault && err == nil {
+				s.statsMu.Lock()
+				s.currentMetric.MetricMap[firstWakeMetric] = metrics.ToUS(time.Since(tFault))
+				s.statsMu.Unlock()
+			}
+		}()
+	}
+
 	copyArgs, err := pageFaultCopyArgsForFault(s.guestRegionMappings, address)
 	if err != nil {
 		return err
 	}
 
-	rec := Record{offset: copyArgs.srcOffset}
+	rec := Record{offset: copyArgs.srcOffset, timestamp: time.Since(s.activatedAt)}
 	if s.firstPageFaultOnce != nil {
 		s.firstPageFaultOnce.Do(func() {
+			firstFault = true
 			if !s.isRecordReady || s.IsLazyMode {
 				return
 			}
+			// The working set of a snapshot can only be installed into guest memory backed by pages of the size
+			// that it was recorded with, so the pages are served one fault at a time otherwise
+			if s.trace.pageSize != 0 && s.trace.pageSize != copyArgs.copyLen {
+				log.WithFields(log.Fields{
+					"vmID":               s.VMID,
+					"workingSetPageSize": s.trace.pageSize,
+					"guestPageSize":      copyArgs.copyLen,
+				}).Warn("Not installing a working set recorded with a different page size")
+				return
+			}
 
 			if s.metricsModeOn {
 				tStart = time.Now()
 			}
+			s.lockInstall()
 			err = s.installWorkingSetPages(fd, copyArgs.dstAddr, copyArgs.copyLen)
+			s.installMu.Unlock()
 			if err != nil {
 				return
 			}
 			if s.metricsModeOn {
+				s.statsMu.Lock()
 				s.currentMetric.MetricMap[installWSMetric] = metrics.ToUS(time.Since(tStart))
+				s.statsMu.Unlock()
 			}
 			workingSetInstalled = true
 		})
@@ -588,89 +698,285 @@ func (s *SnapshotState) servePageFault(fd int, address uint64) error {
 		}
 	}
 
+	s.traceFault(rec)
+
+	s.lockInstall()
+	if s.removedPages.isSet(copyArgs.srcOffset) {
+		err = s.installZeroPages(fd, copyArgs.dstAddr, copyArgs.copyLen)
+		if err == nil {
+			s.installedPages.set(copyArgs.srcOffset, copyArgs.copyLen)
+		}
+		s.installMu.Unlock()
+		return err
+	}
+	s.installMu.Unlock()
+
 	if workingSetInstalled && s.trace.containsRecord(rec) {
 		return nil
 	}
 
-	src, err := guestMemPointer(s.guestMem, copyArgs.srcOffset, copyArgs.copyLen)
-	if err != nil {
-		return err
+	s.recordFault(rec)
+
+	if s.metricsModeOn {
+		tStart = time.Now()
+	}
+
+	err = s.installFaultingPage(fd, copyArgs)
+
+	if s.metricsModeOn {
+		s.statsMu.Lock()
+		s.currentMetric.MetricMap[serveUniqueMetric] += metrics.ToUS(time.Since(tStart))
+		s.statsMu.Unlock()
 	}
 
+	return err
+}
+
+// lockInstall acquires installMu on behalf of a page fault, which makes the prefetcher yield.
+func (s *SnapshotState) lockInstall() {
+	s.pendingFaults.Add(1)
+	s.installMu.Lock()
+	s.pendingFaults.Add(-1)
+}
+
+// traceFault appends a fault to the trace of the faults of the activation, if enabled.
+func (s *SnapshotState) traceFault(rec Record) {
+	if s.faultTrace == nil {
+		return
+	}
+
+	rec.fromWorkingSet = s.isRecordReady && s.trace.containsRecord(rec)
+	s.faultTrace.AppendRecord(rec)
+}
+
+// recordFault appends a page that is being served to the trace while the working set is recorded, and counts the
+// faults on pages outside of the working set otherwise.
+func (s *SnapshotState) recordFault(rec Record) {
 	if !s.isRecordReady {
 		s.trace.AppendRecord(rec)
 	} else {
 		log.Debug("Serving a page that is missing from the working set")
+		if s.missedPages != nil && !s.trace.containsRecord(rec) {
+			s.missedPages.AppendRecord(rec)
+		}
 	}
 
-	if s.metricsModeOn {
-		if s.isRecordReady {
-			if s.IsLazyMode {
-				if !s.trace.containsRecord(rec) {
-					s.uniqueNum++
-				}
-				s.replayedNum++
-			} else {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	if s.isRecordReady && s.faultCounts != nil {
+		s.faultCounts[rec.offset]++
+	}
+
+	if s.metricsModeOn && s.isRecordReady {
+		if s.IsLazyMode {
+			if !s.trace.containsRecord(rec) {
 				s.uniqueNum++
 			}
+			s.replayedNum++
+		} else {
+			s.uniqueNum++
 		}
-		tStart = time.Now()
 	}
+}
 
-	err = installRegionBytes(fd, src, copyArgs.dstAddr, copyArgs.copyMode, copyArgs.copyLen)
+// installRange copies the pages of a range, and returns the number of bytes copied. If the copy stops at a page that
+// has already been installed, e.g., by the prefetcher or the handler of another fault, fewer bytes than the length
+// of the range are returned without an error, and the page that stopped the copy is installed.
+func (s *SnapshotState) installRange(fd int, src, dst, mode, length uint64) (uint64, error) {
+	copied, err := s.uffd.copyPages(fd, src, dst, mode, length)
+	switch {
+	case err == nil:
+		return copied, nil
+	case errors.Is(err, unix.EAGAIN) && copied > 0:
+		return copied, nil
+	case errors.Is(err, unix.EEXIST):
+		// The faulting thread is not woken if the page has been installed concurrently
+		if mode&uffdCopyModeDontWake() == 0 {
+			return 0, s.uffd.wake(fd, dst, length)
+		}
+		return 0, nil
+	default:
+		return copied, err
+	}
+}
 
-	if s.metricsModeOn {
-		s.currentMetric.MetricMap[serveUniqueMetric] += metrics.ToUS(time.Since(tStart))
+// installFaultingPage installs a faulting page. Pages of the mapped guest memory file are copied without holding
+// installMu, so that faults on different pages are served concurrently, while zero pages and pages read from
+// compressed or deduplicated guest memory use buffers shared with the prefetcher and are installed with installMu
+// held.
+func (s *SnapshotState) installFaultingPage(fd int, copyArgs pageFaultCopyArgs) error {
+	if s.guestMemReader == nil && !s.isZeroPage(copyArgs.srcOffset, copyArgs.copyLen) {
+		src, err := guestMemPointer(s.guestMem, copyArgs.srcOffset, copyArgs.copyLen)
+		if err != nil {
+			return err
+		}
+		if _, err := s.installRange(fd, src, copyArgs.dstAddr, copyArgs.copyMode, copyArgs.copyLen); err != nil {
+			return err
+		}
+
+		s.lockInstall()
+		s.installedPages.set(copyArgs.srcOffset, copyArgs.copyLen)
+		s.installMu.Unlock()
+		return nil
+	}
+
+	s.lockInstall()
+	defer s.installMu.Unlock()
+
+	var err error
+	if s.isZeroPage(copyArgs.srcOffset, copyArgs.copyLen) {
+		err = s.installZeroPages(fd, copyArgs.dstAddr, copyArgs.copyLen)
+	} else {
+		var src uint64
+		src, err = s.guestMemSource(copyArgs.srcOffset, copyArgs.copyLen)
+		if err != nil {
+			return err
+		}
+		_, err = s.installRange(fd, src, copyArgs.dstAddr, copyArgs.copyMode, copyArgs.copyLen)
+	}
+	if err == nil {
+		s.installedPages.set(copyArgs.srcOffset, copyArgs.copyLen)
 	}
 
 	return err
 }
 
-// installWorkingSetPages copies recorded pages before waking the first fault.
+// installWorkingSetPages copies recorded pages before waking the first fault. Each contiguous region is installed
+// with as few UFFDIO_COPY calls as possible, and the copies are spread across a bounded pool of workers.
 func (s *SnapshotState) installWorkingSetPages(fd int, faultPageAddr, pageSize uint64) error {
 	if len(s.workingSet) == 0 || len(s.trace.regions) == 0 {
 		return nil
 	}
-	if s.trace.pageSize != 0 {
-		pageSize = s.trace.pageSize
+	copies, err := planWorkingSetCopies(
+		s.guestRegionMappings,
+		s.trace.regions,
+		pageSize,
+		s.installChunkSize,
+		uffdCopyModeDontWake(),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Bytes installed by each copy, which are marked once all copies have returned
+	installed := make([]uint64, len(copies))
+
+	var g errgroup.Group
+	g.SetLimit(s.installParallelism)
+	for i, copyArgs := range copies {
+		g.Go(func() error {
+			var err error
+			installed[i], err = s.installWorkingSetCopy(fd, copyArgs, pageSize)
+			return err
+		})
+	}
+	err = g.Wait()
+	for i, copyArgs := range copies {
+		offset, offsetErr := guestMemoryOffsetForAddress(s.guestRegionMappings, copyArgs.dstAddr)
+		if offsetErr != nil {
+			return offsetErr
+		}
+		s.installedPages.set(offset, installed[i])
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.uffd.wake(fd, faultPageAddr, pageSize)
+}
+
+// installWorkingSetCopy copies the working set pages of a copy, and returns the number of bytes at the start of the
+// copy that are installed. The pages that have already been installed, e.g., by the prefetcher or the handler of
+// another fault, are skipped, and the copy continues after each of them.
+func (s *SnapshotState) installWorkingSetCopy(fd int, copyArgs pageFaultCopyArgs, pageSize uint64) (uint64, error) {
+	var done uint64
+	for done < copyArgs.copyLen {
+		src, err := guestMemPointer(s.workingSet, copyArgs.srcOffset+done, copyArgs.copyLen-done)
+		if err != nil {
+			return done, err
+		}
+		copied, err := s.installRange(fd, src, copyArgs.dstAddr+done, copyArgs.copyMode, copyArgs.copyLen-done)
+		done += copied
+		if err != nil {
+			return done, err
+		}
+		if done < copyArgs.copyLen {
+			// The copy stopped at a page that has already been installed
+			done += pageSize
+		}
+	}
+
+	return done, nil
+}
+
+// planWorkingSetCopies splits the recorded regions into copies of at most maxCopyLen bytes that do not cross guest
+// memory mappings. The source offsets of the returned copies are offsets in the working set file, where the pages
+// of the regions are stored back to back in the order of their guest memory offsets.
+func planWorkingSetCopies(mappings []GuestRegionUffdMapping, regions map[uint64]int, pageSize, maxCopyLen, mode uint64) ([]pageFaultCopyArgs, error) {
+	if pageSize == 0 {
+		return nil, errInvalidGuestRegionPageSize
+	}
+	maxCopyLen -= maxCopyLen % pageSize
+	if maxCopyLen == 0 {
+		maxCopyLen = pageSize
 	}
 
-	keys := make([]uint64, 0, len(s.trace.regions))
-	for offset := range s.trace.regions {
+	keys := make([]uint64, 0, len(regions))
+	for offset := range regions {
 		keys = append(keys, offset)
 	}
 	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
 
-	var workingSetOffset uint64
+	var (
+		copies           []pageFaultCopyArgs
+		workingSetOffset uint64
+	)
 	for _, regionOffset := range keys {
-		regLength := s.trace.regions[regionOffset]
-		for i := 0; i < regLength; i++ {
-			pageOffset := regionOffset + uint64(i)*pageSize
-			copyArgs, err := pageFaultCopyArgsForGuestOffset(
-				s.guestRegionMappings,
-				pageOffset,
-				uint64(C.const_UFFDIO_COPY_MODE_DONTWAKE),
-			)
+		offset := regionOffset
+		remaining := uint64(regions[regionOffset]) * pageSize
+		for remaining > 0 {
+			copyArgs, err := pageFaultCopyArgsForGuestOffset(mappings, offset, mode)
 			if err != nil {
-				return err
+				return nil, err
 			}
+			mapping, _ := guestRegionForMemoryOffset(mappings, offset)
 
-			src, err := guestMemPointer(s.workingSet, workingSetOffset, copyArgs.copyLen)
-			if err != nil {
-				return err
-			}
-			if err := installRegionBytes(fd, src, copyArgs.dstAddr, copyArgs.copyMode, copyArgs.copyLen); err != nil {
-				return err
+			length := min(remaining, maxCopyLen, mapping.Offset+mapping.Size-offset)
+			length -= length % pageSize
+			if length == 0 {
+				return nil, fmt.Errorf("guest memory mapping at %#x is not aligned to the working set page size", offset)
 			}
-			workingSetOffset += copyArgs.copyLen
+
+			copies = append(copies, pageFaultCopyArgs{
+				srcOffset: workingSetOffset,
+				dstAddr:   copyArgs.dstAddr,
+				copyLen:   length,
+				copyMode:  mode,
+			})
+			offset += length
+			workingSetOffset += length
+			remaining -= length
+		}
+	}
+
+	return copies, nil
+}
+
+// guestRegionForMemoryOffset returns the mapping that contains a memory-file offset.
+func guestRegionForMemoryOffset(regions []GuestRegionUffdMapping, offset uint64) (GuestRegionUffdMapping, bool) {
+	for _, region := range regions {
+		if regionContainsGuestMemoryOffset(region, offset) {
+			return region, true
 		}
 	}
 
-	return wake(fd, faultPageAddr, pageSize)
+	return GuestRegionUffdMapping{}, false
 }
 
-// installRegionBytes resolves missing pages with UFFDIO_COPY.
-func installRegionBytes(fd int, src, dst, mode, length uint64) error {
+// installRegionBytes resolves missing pages with UFFDIO_COPY, and returns the number of bytes copied along with the
+// error of the ioctl. If some of the pages have already been resolved, the copy stops at the first of them.
+func installRegionBytes(fd int, src, dst, mode, length uint64) (uint64, error) {
 	cUC := C.struct_uffdio_copy{
 		mode: C.ulonglong(mode),
 		copy: 0,
@@ -680,9 +986,32 @@ func installRegionBytes(fd int, src, dst, mode, length uint64) error {
 	}
 
 	err := ioctl(uintptr(fd), int(C.const_UFFDIO_COPY), unsafe.Pointer(&cUC))
+	if err != nil {
+		// The kernel reports the error instead of the copied bytes if no page was copied
+		if cUC.copy > 0 {
+			return uint64(cUC.copy), err
+		}
+		return 0, err
+	}
+
+	return length, nil
+}
+
+// installZeroPages resolves missing pages with zero pages using UFFDIO_ZEROPAGE.
+func installZeroPages(fd int, dst, length uint64) error {
+	cUZ := C.struct_uffdio_zeropage{
+		_range: C.struct_uffdio_range{
+			start: C.ulonglong(dst),
+			len:   C.ulonglong(length),
+		},
+		mode:     0,
+		zeropage: 0,
+	}
+
+	err := ioctl(uintptr(fd), int(C.const_UFFDIO_ZEROPAGE), unsafe.Pointer(&cUZ))
 	if err != nil {
 		if errors.Is(err, unix.EEXIST) {
-			return nil
+			return wake(fd, dst, length)
 		}
 		return err
 	}
@@ -690,6 +1019,25 @@ func installRegionBytes(fd int, src, dst, mode, length uint64) error {
 	return nil
 }
 
+// installZeroPages resolves missing pages with zero pages. Huge pages are copied from a zeroed buffer instead, since
+// UFFDIO_ZEROPAGE only supports base pages.
+func (s *SnapshotState) installZeroPages(fd int, dst, length uint64) error {
+	if length <= uint64(os.Getpagesize()) {
+		return s.uffd.zeroPages(fd, dst, length)
+	}
+
+	if uint64(len(s.zeroBuf)) < length {
+		s.zeroBuf = make([]byte, length)
+	}
+	src, err := guestMemPointer(s.zeroBuf, 0, length)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.installRange(fd, src, dst, 0, length)
+	return err
+}
+
 // guestMemPointer returns a checked pointer into a mapped memory buffer.
 func guestMemPointer(guestMem []byte, offset, length uint64) (uint64, error) {
 	if length == 0 {
@@ -702,6 +1050,25 @@ func guestMemPointer(guestMem []byte, offset, length uint64) (uint64, error) {
 	return uint64(uintptr(unsafe.Pointer(&guestMem[int(offset)]))), nil
 }
 
+// guestMemSource returns a pointer to the guest memory at the memory-file offset, from which the pages are copied.
+// Pages of a compressed or deduplicated guest memory file are read into a buffer that is reused by the next call,
+// so the pointer must only be used while installMu is held.
+func (s *SnapshotState) guestMemSource(offset, length uint64) (uint64, error) {
+	if s.guestMemReader == nil {
+		return guestMemPointer(s.guestMem, offset, length)
+	}
+
+	if uint64(cap(s.guestMemBuf)) < length {
+		s.guestMemBuf = make([]byte, length)
+	}
+	buf := s.guestMemBuf[:length]
+	if _, err := s.guestMemReader.ReadAt(buf, int64(offset)); err != nil {
+		return 0, fmt.Errorf("reading guest memory: offset=%#x len=%#x: %w", offset, length, err)
+	}
+
+	return guestMemPointer(buf, 0, length)
+}
+
 // ioctl invokes an ioctl and converts errno to a Go error.
 func ioctl(fd uintptr, request int, argp unsafe.Pointer) error {
 	_, _, errno := unix.Syscall(
@@ -739,3 +1106,18 @@ func sizeOfUFFDMsg() int {
 func uffdPageFault() uint8 {
 	return uint8(C.const_UFFD_EVENT_PAGEFAULT)
 }
+
+// uffdEventRemove returns the platform identifier of the event for removed ranges.
+func uffdEventRemove() uint8 {
+	return uint8(C.const_UFFD_EVENT_REMOVE)
+}
+
+// uffdEventUnmap returns the platform identifier of the event for unmapped ranges.
+func uffdEventUnmap() uint8 {
+	return uint8(C.const_UFFD_EVENT_UNMAP)
+}
+
+// uffdCopyModeDontWake returns the UFFDIO_COPY mode that resolves a page without waking the faulting thread.
+func uffdCopyModeDontWake() uint64 {
+	return uint64(C.const_UFFDIO_COPY_MODE_DONTWAKE)
+}
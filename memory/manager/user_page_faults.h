@@ -29,4 +29,7 @@
 int const_UFFDIO_WAKE = UFFDIO_WAKE;
 int const_UFFDIO_COPY = UFFDIO_COPY;
 int const_UFFD_EVENT_PAGEFAULT = UFFD_EVENT_PAGEFAULT;
+int const_UFFD_EVENT_REMOVE = UFFD_EVENT_REMOVE;
+int const_UFFD_EVENT_UNMAP = UFFD_EVENT_UNMAP;
+int const_UFFDIO_ZEROPAGE = UFFDIO_ZEROPAGE;
 int const_UFFDIO_COPY_MODE_DONTWAKE = UFFDIO_COPY_MODE_DONTWAKE;
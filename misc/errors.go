@@ -32,3 +32,43 @@ type NonExistErr string
 func (e NonExistErr) Error() string {
 	return fmt.Sprintf("%v does not exist", string(e))
 }
+
+// BootErr VM could not be started, or its function could not be reached.
+type BootErr struct {
+	VMID string
+	Err  error
+}
+
+func (e *BootErr) Error() string {
+	return fmt.Sprintf("failed to boot VM %s: %v", e.VMID, e.Err)
+}
+
+func (e *BootErr) Unwrap() error {
+	return e.Err
+}
+
+// SnapshotOp Operation on a VM snapshot.
+type SnapshotOp string
+
+const (
+	// SnapshotCreate Snapshot of a running VM is created.
+	SnapshotCreate SnapshotOp = "create"
+	// SnapshotLoad VM is loaded from a snapshot.
+	SnapshotLoad SnapshotOp = "load"
+)
+
+// SnapshotErr Snapshot of a VM could not be created, or a VM could not be loaded from a snapshot.
+type SnapshotErr struct {
+	Op       SnapshotOp
+	VMID     string
+	Revision string
+	Err      error
+}
+
+func (e *SnapshotErr) Error() string {
+	return fmt.Sprintf("failed to %s snapshot %s of VM %s: %v", e.Op, e.Revision, e.VMID, e.Err)
+}
+
+func (e *SnapshotErr) Unwrap() error {
+	return e.Err
+}
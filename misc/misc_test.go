@@ -95,3 +95,16 @@ func TestAllocateFreeVMsParallel(t *testing.T) {
 
 	vmPool.CleanupNetwork()
 }
+
+func TestVMIDFromContainerSnapKey(t *testing.T) {
+	for _, vmID := range []string{"1", "test-vm_2"} {
+		found, ok := VMIDFromContainerSnapKey(NewVM(vmID).ContainerSnapKey)
+		require.True(t, ok, "Failed to parse container snapshot key")
+		require.Equal(t, vmID, found, "Wrong VM ID")
+	}
+
+	for _, snapKey := range []string{"", "sha256:0123456789abcdef", "vm1-containersnap-"} {
+		_, ok := VMIDFromContainerSnapKey(snapKey)
+		require.False(t, ok, "Parsed invalid container snapshot key %q", snapKey)
+	}
+}
@@ -25,6 +25,7 @@ package misc
 import (
 	"fmt"
 	"github.com/google/uuid"
+	"regexp"
 	"sync"
 
 	"github.com/containerd/containerd"
@@ -60,6 +61,17 @@ func NewVM(vmID string) *VM {
 	return vm
 }
 
+var containerSnapKeyRegexp = regexp.MustCompile(`^vm(.+)-containersnap-[0-9a-f-]{16}$`)
+
+// VMIDFromContainerSnapKey Returns the ID of the VM that a container snapshot key was generated for by NewVM
+func VMIDFromContainerSnapKey(snapKey string) (string, bool) {
+	match := containerSnapKeyRegexp.FindStringSubmatch(snapKey)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
 // GetIP returns the IP at which the VM is reachable
 func (vm *VM) GetIP() string {
 	return vm.NetConfig.GetCloneIP()
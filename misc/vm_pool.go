@@ -23,6 +23,8 @@
 package misc
 
 import (
+	"fmt"
+
 	log "github.com/sirupsen/logrus"
 
 	"github.com/vhive-serverless/vhive/networking"
@@ -88,6 +90,29 @@ func (p *VMPool) Free(vmID string) error {
 	return nil
 }
 
+// Adopt Adds a VM that was started by a previous VM pool, e.g., before vHive crashed, and is still connected to the
+// network with the given ID
+func (p *VMPool) Adopt(vm *VM, networkID int) error {
+	logger := log.WithFields(log.Fields{"vmID": vm.ID})
+
+	logger.Debug("Adopting a VM instance")
+
+	if _, isPresent := p.vmMap.Load(vm.ID); isPresent {
+		return fmt.Errorf("VM %s exists in the map", vm.ID)
+	}
+
+	var err error
+	vm.NetConfig, err = p.networkManager.AdoptNetwork(vm.ID, networkID)
+	if err != nil {
+		logger.Warn("VM network adoption failed")
+		return err
+	}
+
+	p.vmMap.Store(vm.ID, vm)
+
+	return nil
+}
+
 // GetVMMap Returns a copy of vmMap as a regular concurrency-unsafe map
 func (p *VMPool) GetVMMap() map[string]*VM {
 	m := make(map[string]*VM)
@@ -116,3 +141,13 @@ func (p *VMPool) CleanupNetwork() {
 		log.Warn(err)
 	}
 }
+
+// StaleNetworks Returns the IDs of the networks left behind by a previous VM pool
+func (p *VMPool) StaleNetworks() ([]int, error) {
+	return p.networkManager.StaleNetworks()
+}
+
+// RemoveStaleNetwork Removes a network left behind by a previous VM pool
+func (p *VMPool) RemoveStaleNetwork(networkID int) error {
+	return p.networkManager.RemoveStaleNetwork(networkID)
+}
@@ -24,9 +24,12 @@
 package networking
 
 import (
+	"os"
 	"sync"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
 )
 
 // NetworkManager manages the in use network configurations along with a pool of free network configurations
@@ -287,3 +290,92 @@ func (mgr *NetworkManager) Cleanup() error {
 
 	return nil
 }
+
+// AdoptNetwork assigns the network config with the given id, which was created by a previous network manager, e.g.,
+// before vHive crashed, to the function instance identified by funcID that is still connected to it.
+func (mgr *NetworkManager) AdoptNetwork(funcID string, id int) (*NetworkConfig, error) {
+	logger := log.WithFields(log.Fields{"funcID": funcID, "id": id})
+	logger.Debug("Adopting network config of function instance")
+
+	netCfg := NewNetworkConfig(id, mgr.hostIfaceName, mgr.experimentIfaceName, mgr.vethPrefix, mgr.clonePrefix)
+	if _, err := os.Stat(netCfg.GetNamespacePath()); err != nil {
+		return nil, errors.Wrapf(err, "network namespace of network config %d", id)
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	if _, ok := mgr.netConfigs[funcID]; ok {
+		return nil, errors.Errorf("network config already assigned to function instance %s", funcID)
+	}
+	for _, config := range mgr.netConfigs {
+		if config.id == id {
+			return nil, errors.Errorf("network config %d already assigned to another function instance", id)
+		}
+	}
+	mgr.netConfigs[funcID] = netCfg
+
+	return netCfg, nil
+}
+
+// StaleNetworks returns the ids of the uVM network namespaces on the host that are neither in use nor in the network
+// pool, i.e., that were left behind by a previous network manager.
+func (mgr *NetworkManager) StaleNetworks() ([]int, error) {
+	ids, err := getNetworkIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	// Wait till all network configs still in creation are added
+	mgr.inCreation.Wait()
+
+	managed := make(map[int]bool)
+	for _, config := range mgr.netConfigs {
+		managed[config.id] = true
+	}
+	mgr.poolCond.L.Lock()
+	for _, config := range mgr.networkPool {
+		managed[config.id] = true
+	}
+	mgr.poolCond.L.Unlock()
+
+	var stale []int
+	for _, id := range ids {
+		if !managed[id] {
+			stale = append(stale, id)
+		}
+	}
+
+	return stale, nil
+}
+
+// RemoveStaleNetwork removes the network with the given id returned by StaleNetworks. The network may only be partially
+// set up, so its namespace is deleted even if some of its devices, routes or filter rules cannot be removed.
+func (mgr *NetworkManager) RemoveStaleNetwork(id int) error {
+	logger := log.WithFields(log.Fields{"id": id})
+	logger.Debug("Removing stale network")
+
+	netCfg := NewNetworkConfig(id, mgr.hostIfaceName, mgr.experimentIfaceName, mgr.vethPrefix, mgr.clonePrefix)
+
+	// RemoveNetwork may fail while in the namespace of the uVM, in which case its locked OS thread is discarded when
+	// the goroutine exits
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- netCfg.RemoveNetwork()
+	}()
+	err := <-errCh
+	if err == nil {
+		return nil
+	}
+
+	if _, statErr := os.Stat(netCfg.GetNamespacePath()); statErr == nil {
+		if delErr := netns.DeleteNamed(netCfg.getNamespaceName()); delErr != nil {
+			logger.WithError(delErr).Warn("failed to delete network namespace")
+		}
+	}
+
+	return errors.Wrapf(err, "removing stale network %d", id)
+}
@@ -74,6 +74,11 @@ func NewNetworkConfig(id int, hostIfaceName string, experimentIfaceName string,
 	}
 }
 
+// GetID returns the id of the network config
+func (cfg *NetworkConfig) GetID() int {
+	return cfg.id
+}
+
 // GetMacAddress returns the mac address used for the uVM
 func (cfg *NetworkConfig) GetMacAddress() string {
 	return cfg.containerMac
@@ -633,27 +633,42 @@ func deleteRoute(destIp, gatewayIp string) error {
 
 // getNetworkStartID fetches the
 func getNetworkStartID() (int, error) {
-	entries, err := os.ReadDir("/run/netns")
+	ids, err := getNetworkIDs()
 	if err != nil {
-		return 0, errors.Wrapf(err, "Couldn't read network namespace dir")
+		return 0, err
 	}
 
 	maxId := 0
+	for _, id := range ids {
+		if id > maxId {
+			maxId = id
+		}
+	}
+
+	return maxId + 1, nil
+}
+
+// getNetworkIDs returns the ids of the uVM network namespaces on the host
+func getNetworkIDs() ([]int, error) {
+	entries, err := os.ReadDir("/run/netns")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't read network namespace dir")
+	}
+
+	var ids []int
+	re := regexp.MustCompile(`^uvmns([0-9]+)$`)
 	for _, entry := range entries {
 		if !entry.IsDir() {
-			netnsName := entry.Name()
-
-			re := regexp.MustCompile(`^uvmns([0-9]+)$`)
-			regres := re.FindStringSubmatch(netnsName)
+			regres := re.FindStringSubmatch(entry.Name())
 
 			if len(regres) > 1 {
 				id, err := strconv.Atoi(regres[1])
-				if err == nil && id > maxId {
-					maxId = id
+				if err == nil {
+					ids = append(ids, id)
 				}
 			}
 		}
 	}
 
-	return maxId + 1, nil
+	return ids, nil
 }
@@ -92,7 +92,7 @@ func TestProfileIncrementConfiguration(t *testing.T) {
 		idx, rps      int
 		pinnedFuncNum int
 		startVMID     int
-		servedTh      uint64
+		keepAlive     = NewNeverEvict()
 		isSyncOffload = true
 		metrFile      = "bench.csv"
 		images        = getImages(t)
@@ -104,7 +104,7 @@ func TestProfileIncrementConfiguration(t *testing.T) {
 
 	createResultsDir()
 
-	funcPool = NewFuncPool(!isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, !isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	cores, err := cpuNum()
 	require.NoError(t, err, "Cannot get the number of CPU")
@@ -137,7 +137,7 @@ func TestProfileSingleConfiguration(t *testing.T) {
 	t.Skip("Skipping TestProfileSingleConfiguration")
 
 	var (
-		servedTh      uint64
+		keepAlive     = NewNeverEvict()
 		pinnedFuncNum int
 		isSyncOffload = true
 		images        = getImages(t)
@@ -149,7 +149,7 @@ func TestProfileSingleConfiguration(t *testing.T) {
 
 	createResultsDir()
 
-	funcPool = NewFuncPool(!isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, !isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	bootVMs(t, images, 0, *vmNum)
 
@@ -163,8 +163,10 @@ func TestProfileSingleConfiguration(t *testing.T) {
 // TestColocateVMsOnSameCPU measures the differences between 2 VMs on the same core and 2VMs on different cores,
 // controlled by *profileCoreID
 func TestColocateVMsOnSameCPU(t *testing.T) {
+	requireRealOrch(t)
+
 	var (
-		servedTh      uint64
+		keepAlive     = NewNeverEvict()
 		pinnedFuncNum int
 		isSyncOffload = true
 		metrFile      = "bench.csv"
@@ -178,7 +180,7 @@ func TestColocateVMsOnSameCPU(t *testing.T) {
 
 	createResultsDir()
 
-	funcPool = NewFuncPool(!isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, !isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	bootVMs(t, images, 0, 2)
 
@@ -211,9 +213,11 @@ func TestColocateVMsOnSameCPU(t *testing.T) {
 }
 
 func TestBindSocket(t *testing.T) {
+	requireRealOrch(t)
+
 	var (
 		procStr, sep  string
-		servedTh      uint64
+		keepAlive     = NewNeverEvict()
 		pinnedFuncNum int
 		isSyncOffload = true
 		testImage     = []string{"ghcr.io/ease-lab/helloworld:var_workload"}
@@ -242,7 +246,7 @@ func TestBindSocket(t *testing.T) {
 		{vmNum: 4, expected: []string{strconv.Itoa(*profileCPUID), procStr}},
 	}
 
-	funcPool = NewFuncPool(!isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, !isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	for _, tCase := range cases {
 		testName := fmt.Sprintf("vmNum=%d", tCase.vmNum)
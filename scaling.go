@@ -0,0 +1,303 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Plamen Petrov and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	hpb "github.com/vhive-serverless/vhive/examples/protobuf/helloworld"
+	"github.com/vhive-serverless/vhive/metrics"
+	"github.com/vhive-serverless/vhive/snapshotting"
+	"google.golang.org/grpc"
+)
+
+// ScalingCfg Configuration of the instances of a function
+type ScalingCfg struct {
+	// MaxInstances is the number of instances that a function can scale out to
+	MaxInstances int
+	// InstanceConcurrency is the number of requests that an instance serves concurrently, 0 is unlimited. The
+	// requests that exceed the concurrency of all instances are queued.
+	InstanceConcurrency int
+}
+
+// DefaultScalingCfg Returns the configuration of functions with a single instance that serves all their requests
+func DefaultScalingCfg() ScalingCfg {
+	return ScalingCfg{
+		MaxInstances:        1,
+		InstanceConcurrency: 0,
+	}
+}
+
+// Validate Returns an error if the configuration is invalid
+func (cfg ScalingCfg) Validate() error {
+	if cfg.MaxInstances < 1 {
+		return fmt.Errorf("the maximum number of instances must be at least 1, got %d", cfg.MaxInstances)
+	}
+	if cfg.InstanceConcurrency < 0 {
+		return fmt.Errorf("the concurrency of instances must not be negative, got %d", cfg.InstanceConcurrency)
+	}
+
+	return nil
+}
+
+// instance Instance (VM) of a function
+type instance struct {
+	vmID       string
+	conn       *grpc.ClientConn
+	funcClient hpb.GreeterClient
+	inFlight   int       // number of requests being served by the instance
+	idleSince  time.Time // when the instance served its last request, if it serves none
+	isRemoved  bool      // if removed, the instance does not serve new requests and is stopped once it is idle
+	// Snapshot the instance was loaded from, which is in use until the instance is stopped
+	snap *snapshotting.Snapshot
+}
+
+// dispatch Instance that serves a queued request, or why no instance could be added to serve it
+type dispatch struct {
+	inst        *instance
+	isColdStart bool
+	metr        *metrics.Metric // metrics of adding the instance, if the request is a cold start
+	err         error
+}
+
+// waiter Request queued until an instance can serve it
+type waiter struct {
+	ready chan dispatch
+}
+
+// acquireInstance Returns the least loaded instance of the function that can serve another request. If there is none,
+// the request is queued until an instance can serve it, and instances are added if the queued requests exceed the
+// concurrency of the instances being added.
+func (f *Function) acquireInstance(ctx context.Context, serveMetric *metrics.Metric) (*instance, bool, error) {
+	f.Lock()
+	if inst := f.leastLoaded(); inst != nil {
+		inst.inFlight++
+		f.Unlock()
+		return inst, false, nil
+	}
+
+	w := &waiter{ready: make(chan dispatch, 1)}
+	f.queue = append(f.queue, w)
+	f.scaleUp()
+	f.Unlock()
+
+	select {
+	case d := <-w.ready:
+		if d.metr != nil {
+			for k, v := range d.metr.MetricMap {
+				serveMetric.MetricMap[k] = v
+			}
+		}
+		return d.inst, d.isColdStart, d.err
+	case <-ctx.Done():
+	}
+
+	f.Lock()
+	isQueued := f.dequeue(w)
+	f.Unlock()
+
+	// Otherwise, an instance was dispatched to the request meanwhile
+	if !isQueued {
+		if d := <-w.ready; d.err == nil {
+			f.releaseInstance(d.inst)
+		}
+	}
+
+	return nil, false, ctx.Err()
+}
+
+// releaseInstance Returns the instance after it served a request. The instance serves the next queued request if
+// there is one, and is stopped once it is idle if it was removed.
+func (f *Function) releaseInstance(inst *instance) {
+	f.Lock()
+	defer f.Unlock()
+
+	inst.inFlight--
+
+	if !inst.isRemoved {
+		if len(f.queue) > 0 {
+			w := f.queue[0]
+			f.queue = f.queue[1:]
+			inst.inFlight++
+			w.ready <- dispatch{inst: inst}
+			return
+		}
+
+		if inst.inFlight == 0 {
+			inst.idleSince = f.clock.Now()
+		}
+		return
+	}
+
+	if inst.inFlight == 0 {
+		go f.stopInstance(inst)
+	}
+}
+
+// leastLoaded Returns the instance that serves the fewest requests among those that can serve another request, or nil.
+// It is called with the lock held.
+func (f *Function) leastLoaded() *instance {
+	var least *instance
+	for _, inst := range f.instances {
+		if f.scaling.InstanceConcurrency > 0 && inst.inFlight >= f.scaling.InstanceConcurrency {
+			continue
+		}
+		if least == nil || inst.inFlight < least.inFlight {
+			least = inst
+		}
+	}
+
+	return least
+}
+
+// scaleDown Detaches the instances that have been idle beyond the keep-alive window at the time, except for the last
+// instance of the function, and returns them, which have to be stopped by the caller. It is called with the lock held.
+func (f *Function) scaleDown(now time.Time, window KeepAliveWindow) []*instance {
+	instances := append([]*instance(nil), f.instances...)
+
+	var idleInstances []*instance
+	for _, inst := range instances {
+		if len(f.instances) == 1 {
+			break
+		}
+		if inst.inFlight > 0 || !window.expired(now.Sub(inst.idleSince)) {
+			continue
+		}
+
+		f.detachInstance(inst)
+		idleInstances = append(idleInstances, inst)
+	}
+
+	return idleInstances
+}
+
+// scaleUp Adds instances in the background while the queued requests exceed the concurrency of the instances being
+// added, up to the maximum number of instances, which includes the instances being stopped. It is called with the
+// lock held.
+func (f *Function) scaleUp() {
+	for len(f.instances)+f.starting+f.stopping < f.scaling.MaxInstances && len(f.queue) > 0 {
+		if f.starting > 0 && (f.scaling.InstanceConcurrency == 0 || len(f.queue) <= f.starting*f.scaling.InstanceConcurrency) {
+			return
+		}
+
+		vmID := f.newVMID()
+		f.starting++
+
+		go func() {
+			tStart := time.Now()
+			inst, metr, err := f.bootInstance(vmID)
+			if err == nil {
+				if metr == nil {
+					metr = metrics.NewMetric()
+				}
+				metr.MetricMap[metrics.AddInstance] = metrics.ToUS(time.Since(tStart))
+			}
+
+			f.Lock()
+			defer f.Unlock()
+
+			f.instanceAdded(inst, metr, err)
+		}()
+	}
+}
+
+// instanceAdded Dispatches the queued requests to the instance that was added, or fails them with the error if the
+// instance could not be added and the function has no other instances. It is called with the lock held.
+func (f *Function) instanceAdded(inst *instance, metr *metrics.Metric, err error) {
+	f.starting--
+
+	if err != nil {
+		log.WithFields(log.Fields{"fID": f.fID}).WithError(err).Error("Failed to add instance")
+
+		// Otherwise, the queued requests are served by the other instances
+		if len(f.instances) == 0 && f.starting == 0 {
+			for _, w := range f.queue {
+				w.ready <- dispatch{isColdStart: true, err: err}
+			}
+			f.queue = nil
+		}
+		return
+	}
+
+	f.instances = append(f.instances, inst)
+	f.stats.IncStarted(f.fID)
+	inst.idleSince = f.clock.Now()
+
+	isColdStart := true
+	for len(f.queue) > 0 && (f.scaling.InstanceConcurrency == 0 || inst.inFlight < f.scaling.InstanceConcurrency) {
+		w := f.queue[0]
+		f.queue = f.queue[1:]
+		inst.inFlight++
+
+		d := dispatch{inst: inst}
+		if isColdStart {
+			d.isColdStart, d.metr = true, metr
+			isColdStart = false
+		}
+		w.ready <- d
+	}
+}
+
+// dequeue Removes the request from the queue, and reports whether it was queued. It is called with the lock held.
+func (f *Function) dequeue(w *waiter) bool {
+	for i, queued := range f.queue {
+		if queued == w {
+			f.queue = append(f.queue[:i], f.queue[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// detachInstance Removes the instance from the instances of the function, so that it does not serve new requests.
+// The instance counts towards the maximum number of instances until it is stopped. It is called with the lock held.
+func (f *Function) detachInstance(inst *instance) {
+	inst.isRemoved = true
+	f.stopping++
+
+	for i, other := range f.instances {
+		if other == inst {
+			f.instances = append(f.instances[:i], f.instances[i+1:]...)
+			break
+		}
+	}
+}
+
+// stopInstance Stops the instance that was detached, and adds instances for the queued requests in its place
+func (f *Function) stopInstance(inst *instance) error {
+	err := f.removeVM(inst)
+	if err != nil {
+		log.WithFields(log.Fields{"fID": f.fID, "vmID": inst.vmID}).WithError(err).Warn("Failed to stop instance")
+	}
+
+	f.Lock()
+	f.stopping--
+	f.scaleUp()
+	f.Unlock()
+
+	return err
+}
@@ -0,0 +1,270 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Plamen Petrov and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/ctriface/fake"
+	hpb "github.com/vhive-serverless/vhive/examples/protobuf/helloworld"
+	"google.golang.org/grpc"
+)
+
+// blockingGreeter Serves the functions in fake VMs, holding each request until it is released
+type blockingGreeter struct {
+	hpb.UnimplementedGreeterServer
+	arrived chan struct{}
+	release chan struct{}
+}
+
+func newBlockingGreeter() *blockingGreeter {
+	return &blockingGreeter{
+		arrived: make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (g *blockingGreeter) SayHello(ctx context.Context, req *hpb.HelloRequest) (*hpb.HelloReply, error) {
+	g.arrived <- struct{}{}
+	<-g.release
+	return &hpb.HelloReply{Message: "Hello, " + req.GetName() + "!"}, nil
+}
+
+func (g *blockingGreeter) guestServices() fake.Option {
+	return fake.WithGuestServices(func(s *grpc.Server) {
+		hpb.RegisterGreeterServer(s, g)
+	})
+}
+
+// waitArrived Waits until n requests arrived at the instances
+func (g *blockingGreeter) waitArrived(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-g.arrived:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d of %d requests arrived", i, n)
+		}
+	}
+}
+
+type serveResult struct {
+	resp *hpb.FwdHelloResp
+	err  error
+}
+
+// serveAsync Serves the requests to the function in the background
+func serveAsync(p *FuncPool, fID string, n int) chan serveResult {
+	results := make(chan serveResult, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			resp, _, err := p.Serve(context.Background(), fID, testImageName, "world")
+			results <- serveResult{resp: resp, err: err}
+		}()
+	}
+
+	return results
+}
+
+// queueLen Returns the number of queued requests to the function
+func queueLen(f *Function) int {
+	f.Lock()
+	defer f.Unlock()
+
+	return len(f.queue)
+}
+
+func TestScalingCfgValidate(t *testing.T) {
+	require.NoError(t, DefaultScalingCfg().Validate())
+	require.NoError(t, ScalingCfg{MaxInstances: 4, InstanceConcurrency: 2}.Validate())
+	require.Error(t, ScalingCfg{MaxInstances: 0}.Validate(), "Function without instances is valid")
+	require.Error(t, ScalingCfg{MaxInstances: 1, InstanceConcurrency: -1}.Validate(), "Negative concurrency is valid")
+}
+
+func TestScaleOut(t *testing.T) {
+	fID := "scale-out"
+	g := newBlockingGreeter()
+	p, vmc := newFakeFuncPool(t, false, g.guestServices())
+	p.scaling = ScalingCfg{MaxInstances: 3, InstanceConcurrency: 2}
+
+	results := serveAsync(p, fID, 7)
+
+	// The requests that exceed the concurrency of the maximum number of instances are queued
+	g.waitArrived(t, 6)
+	f := p.getFunction(fID, testImageName)
+	require.Eventually(t, func() bool { return queueLen(f) == 1 }, 10*time.Second, time.Millisecond)
+	require.Equal(t, 3, vmc.CallCount(fake.StartVM))
+
+	f.Lock()
+	for _, inst := range f.instances {
+		require.Equal(t, 2, inst.inFlight, "Requests were not dispatched to the least loaded instance")
+	}
+	f.Unlock()
+
+	close(g.release)
+
+	var coldStarts int
+	for i := 0; i < 7; i++ {
+		res := <-results
+		require.NoError(t, res.err, "Function returned error")
+		require.Equal(t, "Hello, world!", res.resp.Payload)
+		if res.resp.IsColdStart {
+			coldStarts++
+		}
+	}
+	require.Equal(t, 3, coldStarts, "Each instance that was added served a cold start")
+	require.Equal(t, 7, int(p.stats.statMap[fID].served), "Cold start (served) stats are wrong")
+	require.Equal(t, 3, int(p.stats.statMap[fID].started), "Cold start (starts) stats are wrong")
+
+	// The idle instances of the pinned function are kept once the queue is empty
+	require.Len(t, vmc.VMs(), 3)
+	require.Equal(t, 0, vmc.CallCount(fake.StopSingleVM))
+
+	message, err := p.RemoveInstance(fID, testImageName, true)
+	require.NoError(t, err, "Function returned error, "+message)
+	require.Empty(t, vmc.VMs())
+}
+
+func TestScaleOutFromSnapshot(t *testing.T) {
+	fID := "scale-out-snapshot"
+	g := newBlockingGreeter()
+	p, vmc := newFakeFuncPool(t, true, g.guestServices())
+	p.scaling = ScalingCfg{MaxInstances: 2, InstanceConcurrency: 1}
+
+	// The first request creates the snapshot
+	results := serveAsync(p, fID, 1)
+	g.waitArrived(t, 1)
+	g.release <- struct{}{}
+	require.NoError(t, (<-results).err, "Function returned error")
+	require.Equal(t, 1, vmc.CallCount(fake.CreateSnapshot))
+
+	// The instance that is added for the concurrent request is loaded from the snapshot
+	results = serveAsync(p, fID, 2)
+	g.waitArrived(t, 2)
+	for i := 0; i < 2; i++ {
+		g.release <- struct{}{}
+	}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, (<-results).err, "Function returned error")
+	}
+
+	require.Equal(t, 1, vmc.CallCount(fake.StartVM))
+	require.Equal(t, 1, vmc.CallCount(fake.LoadSnapshot))
+	require.Equal(t, 1, vmc.CallCount(fake.CreateSnapshot))
+
+	message, err := p.RemoveInstance(fID, testImageName, true)
+	require.NoError(t, err, "Function returned error, "+message)
+	require.Empty(t, vmc.VMs())
+}
+
+func TestScaleDown(t *testing.T) {
+	fID := "12"
+	g := newBlockingGreeter()
+	p, vmc, clock := newKeepAliveFuncPool(t, NewFixedKeepAlive(time.Minute), g.guestServices())
+	p.scaling = ScalingCfg{MaxInstances: 2, InstanceConcurrency: 1}
+
+	serve := func(n int) {
+		results := serveAsync(p, fID, n)
+		g.waitArrived(t, n)
+		for i := 0; i < n; i++ {
+			g.release <- struct{}{}
+		}
+		for i := 0; i < n; i++ {
+			require.NoError(t, (<-results).err, "Function returned error")
+		}
+	}
+
+	// The instances are kept while single requests alternate with parallel requests within the keep-alive window
+	for i := 0; i < 3; i++ {
+		serve(2)
+		clock.Advance(20 * time.Second)
+		p.reapIdleInstances(clock.Now())
+		serve(1)
+		clock.Advance(20 * time.Second)
+		p.reapIdleInstances(clock.Now())
+	}
+	require.Equal(t, 2, vmc.CallCount(fake.StartVM), "Instances were restarted")
+	require.Equal(t, 0, vmc.CallCount(fake.StopSingleVM), "Instance was stopped within its keep-alive window")
+
+	// The instance that is not needed by the single requests is stopped once it has been idle beyond the window
+	for i := 0; i < 3; i++ {
+		serve(1)
+		clock.Advance(20 * time.Second)
+		p.reapIdleInstances(clock.Now())
+	}
+	require.Equal(t, 1, vmc.CallCount(fake.StopSingleVM), "Idle instance was not scaled down")
+	require.Len(t, vmc.VMs(), 1)
+
+	message, err := p.RemoveInstance(fID, testImageName, true)
+	require.NoError(t, err, "Function returned error, "+message)
+}
+
+func TestScaleUpWhileStopping(t *testing.T) {
+	fID := "scale-up-stopping"
+	p, vmc := newFakeFuncPool(t, false, fake.WithLatency(fake.StopSingleVM, 500*time.Millisecond))
+
+	_, _, err := p.Serve(context.Background(), fID, testImageName, "world")
+	require.NoError(t, err, "Function returned error")
+
+	// The request waits until the instance being stopped makes room for a new one
+	message, err := p.RemoveInstance(fID, testImageName, false)
+	require.NoError(t, err, "Function returned error, "+message)
+	results := serveAsync(p, fID, 1)
+	require.Eventually(t, func() bool { return queueLen(p.getFunction(fID, testImageName)) == 1 }, 10*time.Second, time.Millisecond)
+	require.Equal(t, 1, vmc.CallCount(fake.StartVM), "Instance was added beyond the maximum number of instances")
+
+	res := <-results
+	require.NoError(t, res.err, "Function returned error")
+	require.True(t, res.resp.IsColdStart)
+	require.Equal(t, 2, vmc.CallCount(fake.StartVM))
+	require.Len(t, vmc.VMs(), 1)
+
+	message, err = p.RemoveInstance(fID, testImageName, true)
+	require.NoError(t, err, "Function returned error, "+message)
+}
+
+func TestServeQueuedCancel(t *testing.T) {
+	fID := "queued-cancel"
+	g := newBlockingGreeter()
+	p, vmc := newFakeFuncPool(t, false, g.guestServices())
+	p.scaling = ScalingCfg{MaxInstances: 1, InstanceConcurrency: 1}
+
+	results := serveAsync(p, fID, 1)
+	g.waitArrived(t, 1)
+
+	// The request that is queued behind the busy instance gives up once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := p.Serve(ctx, fID, testImageName, "world")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Zero(t, queueLen(p.getFunction(fID, testImageName)), "Cancelled request is queued")
+
+	g.release <- struct{}{}
+	require.NoError(t, (<-results).err, "Function returned error")
+	require.Equal(t, 1, vmc.CallCount(fake.StartVM))
+
+	message, err := p.RemoveInstance(fID, testImageName, true)
+	require.NoError(t, err, "Function returned error, "+message)
+}
@@ -0,0 +1,322 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// DefaultCompressionChunkSize is the default size of the independently compressed chunks of the guest memory
+	// file, which bounds the amount of data decompressed to serve a page fault.
+	DefaultCompressionChunkSize = 128 << 10
+	// defaultCachedChunks is the default number of decompressed chunks cached by a CompressedMemFile.
+	defaultCachedChunks = 32
+
+	// compressedMemMagic starts every compressed guest memory file
+	compressedMemMagic = "VHMEMZ01"
+)
+
+// CompressionCfg Configuration of the guest memory file compression, which replaces the guest memory file of a
+// committed snapshot with a chunked zstd file that can be decompressed one chunk at a time.
+type CompressionCfg struct {
+	// Size of the independently compressed chunks, DefaultCompressionChunkSize by default
+	ChunkSize int64
+	// Number of chunks compressed concurrently, the number of CPUs by default
+	Parallelism int
+}
+
+// compressedMemIndex Offset index of a compressed guest memory file, which is stored at the end of the file
+// followed by its own offset.
+type compressedMemIndex struct {
+	// Size of the uncompressed guest memory file
+	Size      int64
+	ChunkSize int64
+	// Offsets of the compressed chunks in the file, followed by the offset of the index
+	Offsets []int64
+}
+
+// CompressMemFile compresses the guest memory file at srcPath into dstPath.
+func CompressMemFile(srcPath, dstPath string, cfg CompressionCfg) error {
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = DefaultCompressionChunkSize
+	}
+	if cfg.Parallelism <= 0 {
+		cfg.Parallelism = runtime.NumCPU()
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dst.Close() }()
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = encoder.Close() }()
+
+	index := compressedMemIndex{Size: info.Size(), ChunkSize: cfg.ChunkSize}
+	numChunks := int((info.Size() + cfg.ChunkSize - 1) / cfg.ChunkSize)
+
+	if _, err := dst.WriteString(compressedMemMagic); err != nil {
+		return err
+	}
+	offset := int64(len(compressedMemMagic))
+
+	// Chunks are compressed in batches, so that only a few of them are kept in memory before being written
+	batchSize := 4 * cfg.Parallelism
+	for first := 0; first < numChunks; first += batchSize {
+		compressed := make([][]byte, min(batchSize, numChunks-first))
+
+		var g errgroup.Group
+		g.SetLimit(cfg.Parallelism)
+		for i := range compressed {
+			g.Go(func() error {
+				chunkOffset := int64(first+i) * cfg.ChunkSize
+				buf := make([]byte, min(cfg.ChunkSize, info.Size()-chunkOffset))
+				if _, err := src.ReadAt(buf, chunkOffset); err != nil {
+					return errors.Wrapf(err, "reading chunk %d of %s", first+i, srcPath)
+				}
+				compressed[i] = encoder.EncodeAll(buf, nil)
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+
+		for _, chunk := range compressed {
+			if _, err := dst.Write(chunk); err != nil {
+				return err
+			}
+			index.Offsets = append(index.Offsets, offset)
+			offset += int64(len(chunk))
+		}
+	}
+	index.Offsets = append(index.Offsets, offset)
+
+	if err := gob.NewEncoder(dst).Encode(&index); err != nil {
+		return errors.Wrapf(err, "encoding the index of %s", dstPath)
+	}
+	if err := binary.Write(dst, binary.LittleEndian, offset); err != nil {
+		return err
+	}
+
+	return dst.Sync()
+}
+
+// CompressedMemFile Reader of a compressed guest memory file, which decompresses the chunks containing the
+// requested data and keeps the most recently used ones in a cache. It is safe for concurrent use.
+type CompressedMemFile struct {
+	sync.Mutex
+	file    *os.File
+	index   compressedMemIndex
+	decoder *zstd.Decoder
+
+	// Decompressed chunks, from the least to the most recently used
+	cache       []cachedChunk
+	cachedLimit int
+}
+
+type cachedChunk struct {
+	chunk int
+	data  []byte
+}
+
+// OpenCompressedMemFile opens a guest memory file compressed with CompressMemFile, caching up to cachedChunks
+// decompressed chunks (32 if not positive).
+func OpenCompressedMemFile(path string, cachedChunks int) (*CompressedMemFile, error) {
+	if cachedChunks <= 0 {
+		cachedChunks = defaultCachedChunks
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := readCompressedMemIndex(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, errors.Wrapf(err, "reading the index of %s", path)
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &CompressedMemFile{file: file, index: index, decoder: decoder, cachedLimit: cachedChunks}, nil
+}
+
+func readCompressedMemIndex(file *os.File) (compressedMemIndex, error) {
+	var index compressedMemIndex
+
+	info, err := file.Stat()
+	if err != nil {
+		return index, err
+	}
+
+	magic := make([]byte, len(compressedMemMagic))
+	if _, err := file.ReadAt(magic, 0); err != nil || string(magic) != compressedMemMagic {
+		return index, errors.New("not a compressed guest memory file")
+	}
+
+	var indexOffset int64
+	footer := io.NewSectionReader(file, info.Size()-8, 8)
+	if err := binary.Read(footer, binary.LittleEndian, &indexOffset); err != nil {
+		return index, err
+	}
+	if indexOffset < int64(len(compressedMemMagic)) || indexOffset > info.Size()-8 {
+		return index, errors.New("invalid index offset")
+	}
+
+	if err := gob.NewDecoder(io.NewSectionReader(file, indexOffset, info.Size()-8-indexOffset)).Decode(&index); err != nil {
+		return index, err
+	}
+
+	numChunks := (index.Size + index.ChunkSize - 1) / max(index.ChunkSize, 1)
+	if index.ChunkSize <= 0 || int64(len(index.Offsets)) != numChunks+1 || index.Offsets[numChunks] != indexOffset {
+		return index, errors.New("invalid index")
+	}
+
+	return index, nil
+}
+
+// Size returns the size of the uncompressed guest memory file.
+func (f *CompressedMemFile) Size() int64 {
+	return f.index.Size
+}
+
+// ReadAt reads the uncompressed guest memory file at offset, decompressing the chunks that are not cached.
+func (f *CompressedMemFile) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.New(fmt.Sprintf("negative offset %d", offset))
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	var n int
+	for n < len(p) && offset+int64(n) < f.index.Size {
+		pos := offset + int64(n)
+		data, err := f.chunkLocked(int(pos / f.index.ChunkSize))
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[pos%f.index.ChunkSize:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// chunkLocked returns the decompressed chunk, from the cache if possible. Must be called with the lock held.
+func (f *CompressedMemFile) chunkLocked(chunk int) ([]byte, error) {
+	for i, cached := range f.cache {
+		if cached.chunk == chunk {
+			copy(f.cache[i:], f.cache[i+1:])
+			f.cache[len(f.cache)-1] = cached
+			return cached.data, nil
+		}
+	}
+
+	compressed := make([]byte, f.index.Offsets[chunk+1]-f.index.Offsets[chunk])
+	if _, err := f.file.ReadAt(compressed, f.index.Offsets[chunk]); err != nil {
+		return nil, errors.Wrapf(err, "reading chunk %d", chunk)
+	}
+
+	// Reuse the buffer of the evicted chunk
+	var buf []byte
+	if len(f.cache) == f.cachedLimit {
+		buf = f.cache[0].data[:0]
+		f.cache = f.cache[1:]
+	}
+
+	data, err := f.decoder.DecodeAll(compressed, buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decompressing chunk %d", chunk)
+	}
+	if want := min(f.index.ChunkSize, f.index.Size-int64(chunk)*f.index.ChunkSize); int64(len(data)) != want {
+		return nil, errors.New(fmt.Sprintf("chunk %d has %d bytes, expected %d", chunk, len(data), want))
+	}
+
+	f.cache = append(f.cache, cachedChunk{chunk: chunk, data: data})
+
+	return data, nil
+}
+
+// Close closes the compressed guest memory file.
+func (f *CompressedMemFile) Close() error {
+	f.decoder.Close()
+	return f.file.Close()
+}
+
+// GetCompressedMemFilePath returns the path of the compressed guest memory file, which replaces the guest memory
+// file if compression was enabled when the snapshot was committed.
+func (snp *Snapshot) GetCompressedMemFilePath() string {
+	return filepath.Join(snp.snapDir, "mem_file.zst")
+}
+
+// CompressMemFile replaces the guest memory file with its compressed version.
+func (snp *Snapshot) CompressMemFile(cfg CompressionCfg) error {
+	tmpPath := snp.GetCompressedMemFilePath() + ".tmp"
+	if err := CompressMemFile(snp.GetMemFilePath(), tmpPath, cfg); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, snp.GetCompressedMemFilePath()); err != nil {
+		return err
+	}
+
+	return os.Remove(snp.GetMemFilePath())
+}
@@ -0,0 +1,123 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting_test
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+// testMemFileData returns guest memory of the given size alternating random and zero pages.
+func testMemFileData(size int) []byte {
+	data := make([]byte, size)
+	rng := rand.New(rand.NewSource(1))
+	for offset := 0; offset < size; offset += 2 * zeroTestPageSize {
+		rng.Read(data[offset:min(offset+zeroTestPageSize, size)])
+	}
+	return data
+}
+
+func TestCompressedMemFile(t *testing.T) {
+	dir := t.TempDir()
+	memFilePath := filepath.Join(dir, "mem_file")
+	compressedPath := filepath.Join(dir, "mem_file.zst")
+
+	// Ends with a partial chunk
+	data := testMemFileData(10*zeroTestPageSize + 100)
+	require.NoError(t, os.WriteFile(memFilePath, data, 0644), "Failed to write memory file")
+	require.NoError(t, snapshotting.CompressMemFile(memFilePath, compressedPath, snapshotting.CompressionCfg{
+		ChunkSize:   3 * zeroTestPageSize,
+		Parallelism: 2,
+	}), "Failed to compress memory file")
+
+	compressed, err := snapshotting.OpenCompressedMemFile(compressedPath, 2)
+	require.NoError(t, err, "Failed to open compressed memory file")
+	defer func() { _ = compressed.Close() }()
+	require.Equal(t, int64(len(data)), compressed.Size())
+
+	// Reads within a chunk, across chunks and of the whole file, so that chunks are evicted from the cache
+	for _, r := range []struct{ offset, length int }{
+		{zeroTestPageSize, zeroTestPageSize},
+		{2 * zeroTestPageSize, 5 * zeroTestPageSize},
+		{0, len(data)},
+		{zeroTestPageSize, zeroTestPageSize},
+		{9 * zeroTestPageSize, zeroTestPageSize + 100},
+	} {
+		buf := make([]byte, r.length)
+		n, err := compressed.ReadAt(buf, int64(r.offset))
+		require.NoError(t, err, "Failed to read compressed memory file")
+		require.Equal(t, r.length, n)
+		require.Equal(t, data[r.offset:r.offset+r.length], buf)
+	}
+
+	buf := make([]byte, zeroTestPageSize)
+	n, err := compressed.ReadAt(buf, int64(len(data)-100))
+	require.Equal(t, io.EOF, err, "Reads beyond the end of the memory file should fail")
+	require.Equal(t, 100, n)
+	require.Equal(t, data[len(data)-100:], buf[:n])
+
+	_, err = snapshotting.OpenCompressedMemFile(memFilePath, 0)
+	require.Error(t, err, "Uncompressed memory file should be rejected")
+}
+
+func TestSnapshotManagerCompression(t *testing.T) {
+	store, err := snapshotting.NewLocalSnapshotStore(t.TempDir())
+	require.NoError(t, err, "Failed to create snapshot store")
+
+	producer := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithSnapshotStore(store),
+		snapshotting.WithCompression(snapshotting.CompressionCfg{}),
+		snapshotting.WithIntegrityCheck(snapshotting.IntegrityCfg{Verify: snapshotting.VerifyFull}))
+	snap, err := producer.InitSnapshot("compressed-rev", "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	for _, path := range []string{snap.GetSnapshotFilePath(), snap.GetPatchFilePath()} {
+		require.NoError(t, os.WriteFile(path, []byte(path), 0644), "Failed to write snapshot file")
+	}
+	data := testMemFileData(64 * zeroTestPageSize)
+	require.NoError(t, os.WriteFile(snap.GetMemFilePath(), data, 0644), "Failed to write memory file")
+	require.NoError(t, snap.SerializeSnapInfo(), "Failed to serialize snapshot info")
+	require.NoError(t, producer.CommitSnapshot("compressed-rev"), "Failed to commit snapshot")
+
+	_, err = os.Stat(snap.GetMemFilePath())
+	require.True(t, os.IsNotExist(err), "Memory file should be replaced by its compressed version")
+	require.Contains(t, snap.Checksums, "mem_file.zst", "Checksum of the compressed memory file should be recorded")
+	require.Less(t, snap.GetSize(), int64(len(data)), "Compressed snapshot should be smaller")
+
+	// The compressed memory file is shared through the snapshot store
+	consumer := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithSnapshotStore(store))
+	fetched, err := consumer.AcquireSnapshot("compressed-rev")
+	require.NoError(t, err, "Failed to fetch snapshot from the store")
+
+	compressed, err := snapshotting.OpenCompressedMemFile(fetched.GetCompressedMemFilePath(), 0)
+	require.NoError(t, err, "Failed to open compressed memory file")
+	defer func() { _ = compressed.Close() }()
+	buf := make([]byte, len(data))
+	_, err = compressed.ReadAt(buf, 0)
+	require.NoError(t, err, "Failed to read compressed memory file")
+	require.Equal(t, data, buf)
+}
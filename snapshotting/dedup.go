@@ -0,0 +1,182 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// DedupReport Potential deduplication of the guest memory files of the snapshots in a snapshots folder.
+type DedupReport struct {
+	ChunkSize int64
+	Snapshots []SnapshotDedup
+	// Total size of the guest memory files
+	TotalBytes int64
+	// Bytes in chunks that only contain zeros, which need not be stored
+	ZeroBytes int64
+	// Bytes in distinct non-zero chunks, i.e., the size of a page store holding all snapshots
+	UniqueBytes int64
+}
+
+// SnapshotDedup Deduplication of the guest memory file of a single snapshot.
+type SnapshotDedup struct {
+	Revision   string
+	Generation uint64
+	TotalBytes int64
+	ZeroBytes  int64
+	// Bytes in non-zero chunks that are not found in the guest memory file of any other snapshot
+	ExclusiveBytes int64
+}
+
+// Ratio returns the ratio of the total size of the guest memory files to the size of their distinct non-zero chunks.
+func (r *DedupReport) Ratio() float64 {
+	if r.UniqueBytes == 0 {
+		return 0
+	}
+
+	return float64(r.TotalBytes) / float64(r.UniqueBytes)
+}
+
+// AnalyzeDedup reports how much the guest memory files of the snapshots in snapshotsDir would shrink if their chunks
+// of chunkSize bytes were deduplicated. Guest memory files that are compressed or already deduplicated are analyzed
+// as well.
+func AnalyzeDedup(snapshotsDir string, chunkSize int64) (*DedupReport, error) {
+	if chunkSize <= 0 {
+		return nil, errors.New("chunk size must be positive")
+	}
+
+	type chunkInfo struct {
+		size int64
+		// Index of the first snapshot containing the chunk, or -1 if several snapshots contain it
+		owner int
+	}
+
+	report := &DedupReport{ChunkSize: chunkSize}
+	chunks := make(map[ChunkDigest]*chunkInfo)
+
+	revisions, err := os.ReadDir(snapshotsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, chunkSize)
+	for _, revision := range revisions {
+		generations, err := os.ReadDir(filepath.Join(snapshotsDir, revision.Name()))
+		if err != nil {
+			continue
+		}
+
+		for _, genEntry := range generations {
+			snapDir := filepath.Join(snapshotsDir, revision.Name(), genEntry.Name())
+			generation, err := strconv.ParseUint(genEntry.Name(), 10, 64)
+			if err != nil || !IsSnapshotDir(snapDir) {
+				continue
+			}
+
+			mem, size, err := openSnapshotGuestMem(snapDir)
+			if os.IsNotExist(errors.Cause(err)) {
+				continue
+			} else if err != nil {
+				return nil, errors.Wrapf(err, "opening the guest memory of %s", snapDir)
+			}
+
+			index := len(report.Snapshots)
+			snap := SnapshotDedup{Revision: revision.Name(), Generation: generation, TotalBytes: size}
+			for offset := int64(0); offset < size; offset += chunkSize {
+				chunk := buf[:min(chunkSize, size-offset)]
+				if _, err := mem.ReadAt(chunk, offset); err != nil && err != io.EOF {
+					_ = mem.Close()
+					return nil, errors.Wrapf(err, "reading the guest memory of %s", snapDir)
+				}
+
+				if isZero(chunk) {
+					snap.ZeroBytes += int64(len(chunk))
+					continue
+				}
+
+				digest := ChunkDigest(sha256.Sum256(chunk))
+				if info, ok := chunks[digest]; !ok {
+					chunks[digest] = &chunkInfo{size: int64(len(chunk)), owner: index}
+				} else if info.owner != index {
+					info.owner = -1
+				}
+			}
+			_ = mem.Close()
+
+			report.Snapshots = append(report.Snapshots, snap)
+			report.TotalBytes += snap.TotalBytes
+			report.ZeroBytes += snap.ZeroBytes
+		}
+	}
+
+	for _, info := range chunks {
+		report.UniqueBytes += info.size
+		if info.owner >= 0 {
+			report.Snapshots[info.owner].ExclusiveBytes += info.size
+		}
+	}
+
+	sort.Slice(report.Snapshots, func(i, j int) bool {
+		if report.Snapshots[i].Revision != report.Snapshots[j].Revision {
+			return report.Snapshots[i].Revision < report.Snapshots[j].Revision
+		}
+		return report.Snapshots[i].Generation < report.Snapshots[j].Generation
+	})
+
+	return report, nil
+}
+
+// openSnapshotGuestMem opens the guest memory of the snapshot in snapDir, whether it is stored as a plain,
+// compressed or deduplicated guest memory file.
+func openSnapshotGuestMem(snapDir string) (interface {
+	io.ReaderAt
+	io.Closer
+}, int64, error) {
+	if f, err := os.Open(filepath.Join(snapDir, "mem_file")); err == nil {
+		info, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, 0, err
+		}
+		return f, info.Size(), nil
+	}
+
+	if compressed, err := OpenCompressedMemFile(filepath.Join(snapDir, "mem_file.zst"), 0); err == nil {
+		return compressed, compressed.Size(), nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return nil, 0, err
+	}
+
+	deduped, err := OpenDedupedMemFile(filepath.Join(snapDir, "mem_manifest"))
+	if err != nil {
+		return nil, 0, err
+	}
+	return deduped, deduped.Size(), nil
+}
@@ -0,0 +1,101 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	LRUPolicy          = "lru"
+	LFUPolicy          = "lfu"
+	SizeWeightedPolicy = "size"
+)
+
+// EvictionPolicy selects which snapshot to remove when the snapshot manager exceeds its capacity.
+type EvictionPolicy interface {
+	// Victim returns the snapshot to evict. All candidates are committed and not in use.
+	Victim(candidates []*Snapshot) *Snapshot
+}
+
+// NewEvictionPolicy returns the eviction policy with the given name.
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case LRUPolicy:
+		return LRU{}, nil
+	case LFUPolicy:
+		return LFU{}, nil
+	case SizeWeightedPolicy:
+		return SizeWeighted{}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown snapshot eviction policy %s", name))
+	}
+}
+
+// LRU evicts the snapshot that was acquired least recently.
+type LRU struct{}
+
+func (LRU) Victim(candidates []*Snapshot) *Snapshot {
+	var victim *Snapshot
+	for _, snap := range candidates {
+		if victim == nil || snap.GetLastUsed().Before(victim.GetLastUsed()) {
+			victim = snap
+		}
+	}
+	return victim
+}
+
+// LFU evicts the snapshot that was acquired the fewest times. Ties are broken by recency.
+type LFU struct{}
+
+func (LFU) Victim(candidates []*Snapshot) *Snapshot {
+	var victim *Snapshot
+	for _, snap := range candidates {
+		if victim == nil || snap.GetUseCount() < victim.GetUseCount() ||
+			(snap.GetUseCount() == victim.GetUseCount() && snap.GetLastUsed().Before(victim.GetLastUsed())) {
+			victim = snap
+		}
+	}
+	return victim
+}
+
+// SizeWeighted evicts the snapshot with the largest disk footprint per use, so that large and rarely used
+// snapshots are removed first. Ties are broken by recency.
+type SizeWeighted struct{}
+
+func (SizeWeighted) Victim(candidates []*Snapshot) *Snapshot {
+	var (
+		victim      *Snapshot
+		victimScore float64
+	)
+	for _, snap := range candidates {
+		score := float64(snap.GetSize()) / float64(snap.GetUseCount()+1)
+		if victim == nil || score > victimScore ||
+			(score == victimScore && snap.GetLastUsed().Before(victim.GetLastUsed())) {
+			victim, victimScore = snap, score
+		}
+	}
+	return victim
+}
@@ -0,0 +1,200 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// VerifyFull verifies all chunks of the snapshot files the first time a snapshot is acquired.
+	VerifyFull = "full"
+	// VerifySampled verifies the sizes and a random sample of chunks of the snapshot files every time a snapshot
+	// is acquired.
+	VerifySampled = "sampled"
+)
+
+// ErrSnapshotCorrupted is returned when the snapshot files do not match the checksums recorded on commit.
+var ErrSnapshotCorrupted = errors.New("snapshot files do not match their checksums")
+
+// IntegrityCfg Config of snapshot integrity checks
+type IntegrityCfg struct {
+	// Verification mode, VerifyFull or VerifySampled
+	Verify string
+	// Size of the chunks that are hashed independently, zero hashes each file as a whole
+	ChunkSize int64
+	// Maximum number of chunks hashed concurrently, NumCPU by default
+	Parallelism int
+	// Number of chunks verified per file in the sampled mode, 4 by default
+	SampledChunks int
+	// Directory to which corrupt snapshots are moved, <snapshots dir>-quarantine by default
+	QuarantineDir string
+}
+
+// FileChecksum Size and SHA-256 digests of a snapshot file. The file is split into chunks of ChunkSize bytes,
+// each one having its own digest, or hashed as a whole if ChunkSize is zero.
+type FileChecksum struct {
+	Size      int64
+	ChunkSize int64
+	Digests   [][]byte
+}
+
+// ComputeChecksums records the checksums of the snapshot files, which are serialized with the snapshot info.
+func (snp *Snapshot) ComputeChecksums(chunkSize int64, parallelism int) error {
+	checksums := make(map[string]FileChecksum)
+	for _, name := range []string{"snap_file", "mem_file", "patch_file", "mem_file.zst", "mem_manifest", "zero_pages"} {
+		path := filepath.Join(snp.snapDir, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		checksum, err := checksumFile(path, chunkSize, parallelism)
+		if err != nil {
+			return errors.Wrapf(err, "computing checksum of %s", path)
+		}
+		checksums[name] = checksum
+	}
+
+	snp.Checksums = checksums
+
+	return nil
+}
+
+// VerifyChecksums checks the snapshot files against the checksums recorded on commit. Only the file sizes and
+// sampledChunks random chunks of each file are checked if sampledChunks is positive. Snapshots committed without
+// checksums are not verified.
+func (snp *Snapshot) VerifyChecksums(sampledChunks, parallelism int) error {
+	for name, expected := range snp.Checksums {
+		path := filepath.Join(snp.snapDir, name)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return errors.Wrapf(ErrSnapshotCorrupted, "%s: %v", name, err)
+		}
+		if info.Size() != expected.Size {
+			return errors.Wrapf(ErrSnapshotCorrupted, "%s: expected %d bytes, found %d", name, expected.Size, info.Size())
+		}
+
+		chunks := make([]int, len(expected.Digests))
+		for i := range chunks {
+			chunks[i] = i
+		}
+		if sampledChunks > 0 && sampledChunks < len(chunks) {
+			chunks = rand.Perm(len(chunks))[:sampledChunks]
+		}
+
+		digests, err := hashChunks(path, expected.Size, expected.ChunkSize, chunks, parallelism)
+		if err != nil {
+			return errors.Wrapf(err, "verifying %s", path)
+		}
+
+		for i, chunk := range chunks {
+			if !bytes.Equal(digests[i], expected.Digests[chunk]) {
+				return errors.Wrapf(ErrSnapshotCorrupted, "%s: digest mismatch in chunk %d", name, chunk)
+			}
+		}
+	}
+
+	return nil
+}
+
+func checksumFile(path string, chunkSize int64, parallelism int) (FileChecksum, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+
+	checksum := FileChecksum{Size: info.Size(), ChunkSize: chunkSize}
+
+	numChunks := 1
+	if chunkSize > 0 && info.Size() > chunkSize {
+		numChunks = int((info.Size() + chunkSize - 1) / chunkSize)
+	}
+
+	chunks := make([]int, numChunks)
+	for i := range chunks {
+		chunks[i] = i
+	}
+
+	checksum.Digests, err = hashChunks(path, info.Size(), chunkSize, chunks, parallelism)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+
+	return checksum, nil
+}
+
+// hashChunks computes the SHA-256 digests of the given chunks of a file, hashing up to parallelism chunks
+// concurrently.
+func hashChunks(path string, size, chunkSize int64, chunks []int, parallelism int) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	if chunkSize <= 0 {
+		chunkSize = size
+	}
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+
+	digests := make([][]byte, len(chunks))
+
+	var g errgroup.Group
+	g.SetLimit(parallelism)
+	for i, chunk := range chunks {
+		i, chunk := i, chunk
+		g.Go(func() error {
+			offset := int64(chunk) * chunkSize
+			if offset > size {
+				return errors.New(fmt.Sprintf("chunk %d is out of bounds", chunk))
+			}
+
+			hash := sha256.New()
+			if _, err := io.Copy(hash, io.NewSectionReader(file, offset, min(chunkSize, size-offset))); err != nil {
+				return err
+			}
+			digests[i] = hash.Sum(nil)
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return digests, nil
+}
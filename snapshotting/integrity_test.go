@@ -0,0 +1,128 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+func TestSnapshotIntegrityFull(t *testing.T) {
+	baseFolder := filepath.Join(t.TempDir(), "snapshots")
+	quarantineDir := filepath.Join(t.TempDir(), "quarantine")
+	integrity := snapshotting.WithIntegrityCheck(snapshotting.IntegrityCfg{
+		Verify:        snapshotting.VerifyFull,
+		ChunkSize:     4,
+		QuarantineDir: quarantineDir,
+	})
+
+	mgr := snapshotting.NewSnapshotManager(baseFolder, integrity)
+	snap := createStoredSnapshot(t, mgr, "intact-rev")
+	require.Contains(t, snap.Checksums, "mem_file", "Checksum of the memory file should be recorded")
+	require.Greater(t, len(snap.Checksums["mem_file"].Digests), 1, "Memory file should be hashed in chunks")
+
+	corrupt := createStoredSnapshot(t, mgr, "corrupt-rev")
+
+	// Checksums are persisted, so that recovered snapshots are verified as well
+	mgr = snapshotting.NewSnapshotManager(baseFolder, integrity)
+
+	_, err := mgr.AcquireSnapshot("intact-rev")
+	require.NoError(t, err, "Intact snapshot should pass verification")
+
+	memFilePath := corrupt.GetMemFilePath()
+	data, err := os.ReadFile(memFilePath)
+	require.NoError(t, err, "Failed to read memory file")
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(memFilePath, data, 0644), "Failed to corrupt memory file")
+
+	_, err = mgr.AcquireSnapshot("corrupt-rev")
+	require.True(t, errors.Is(err, snapshotting.ErrSnapshotCorrupted), "Corrupt snapshot should fail verification")
+
+	_, err = os.Stat(filepath.Dir(memFilePath))
+	require.True(t, os.IsNotExist(err), "Corrupt snapshot should be moved out of the snapshots folder")
+	quarantined, err := os.ReadDir(quarantineDir)
+	require.NoError(t, err, "Failed to read quarantine dir")
+	require.Len(t, quarantined, 1, "Corrupt snapshot should be quarantined")
+
+	// Corrupt snapshot is no longer available, so the function instance boots from scratch
+	_, err = mgr.AcquireSnapshot("corrupt-rev")
+	require.Error(t, err, "Quarantined snapshot should not be acquired")
+}
+
+func TestSnapshotIntegritySampled(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithIntegrityCheck(snapshotting.IntegrityCfg{
+		Verify:        snapshotting.VerifySampled,
+		ChunkSize:     4,
+		SampledChunks: 1,
+		QuarantineDir: filepath.Join(t.TempDir(), "quarantine"),
+	}))
+
+	snap := createStoredSnapshot(t, mgr, "truncated-rev")
+	acquired, err := mgr.AcquireSnapshot("truncated-rev")
+	require.NoError(t, err, "Intact snapshot should pass verification")
+	require.NoError(t, mgr.ReleaseSnapshot(acquired), "Failed to release snapshot")
+
+	// Sizes are always checked, so truncation is detected regardless of the sampled chunks
+	require.NoError(t, os.Truncate(snap.GetSnapshotFilePath(), 2), "Failed to truncate snapshot file")
+	_, err = mgr.AcquireSnapshot("truncated-rev")
+	require.True(t, errors.Is(err, snapshotting.ErrSnapshotCorrupted), "Truncated snapshot should fail verification")
+}
+
+func TestSnapshotIntegrityQuarantineInUse(t *testing.T) {
+	quarantineDir := filepath.Join(t.TempDir(), "quarantine")
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithIntegrityCheck(snapshotting.IntegrityCfg{
+		Verify:        snapshotting.VerifySampled,
+		ChunkSize:     4,
+		SampledChunks: 1,
+		QuarantineDir: quarantineDir,
+	}))
+
+	snap := createStoredSnapshot(t, mgr, "in-use-rev")
+	acquired, err := mgr.AcquireSnapshot("in-use-rev")
+	require.NoError(t, err, "Intact snapshot should pass verification")
+
+	require.NoError(t, os.Truncate(snap.GetSnapshotFilePath(), 2), "Failed to truncate snapshot file")
+	_, err = mgr.AcquireSnapshot("in-use-rev")
+	require.True(t, errors.Is(err, snapshotting.ErrSnapshotCorrupted), "Truncated snapshot should fail verification")
+
+	// The snapshot is kept while it is in use, but no longer handed out
+	_, err = os.Stat(snap.GetMemFilePath())
+	require.NoError(t, err, "Corrupt snapshot in use must be kept")
+	_, err = mgr.AcquireSnapshot("in-use-rev")
+	require.Error(t, err, "Corrupt snapshot should not be acquired")
+
+	// The failed acquire does not hold the snapshot, so it is quarantined once its last user releases it
+	require.NoError(t, mgr.ReleaseSnapshot(acquired), "Failed to release snapshot")
+	require.Error(t, mgr.ReleaseSnapshot(acquired), "Release should fail when the snapshot is not in use")
+
+	_, err = os.Stat(snap.GetMemFilePath())
+	require.True(t, os.IsNotExist(err), "Corrupt snapshot should be moved out of the snapshots folder")
+	quarantined, err := os.ReadDir(quarantineDir)
+	require.NoError(t, err, "Failed to read quarantine dir")
+	require.Len(t, quarantined, 1, "Corrupt snapshot should be quarantined")
+}
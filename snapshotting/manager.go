@@ -23,14 +23,42 @@
 package snapshotting
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// functionsDir is the subdirectory of the snapshots dir of the orchestrator in which the snapshots of the
+	// functions are kept, next to the base dirs of the VMs
+	functionsDir = "functions"
+	// Suffixes of the default quarantine dir and page store dir, which are next to the base folder of the manager
+	quarantineSuffix = "-quarantine"
+	pagesSuffix      = "-pages"
+)
+
+// FunctionSnapshotsDir returns the base folder of the snapshot manager of the functions, which is a subdirectory of
+// the snapshots dir of the orchestrator so that the snapshots and the base dirs of the VMs do not get in each other's
+// way.
+func FunctionSnapshotsDir(snapshotsDir string) string {
+	return filepath.Join(snapshotsDir, functionsDir)
+}
+
+// IsFunctionSnapshotsEntry reports whether the entry of the snapshots dir of the orchestrator belongs to the snapshot
+// manager of the functions, i.e., is its base folder, or its default quarantine dir or page store dir.
+func IsFunctionSnapshotsEntry(name string) bool {
+	return name == functionsDir || name == functionsDir+quarantineSuffix || name == functionsDir+pagesSuffix
+}
+
 // SnapshotManager manages snapshots stored on the node.
 type SnapshotManager struct {
 	sync.Mutex
@@ -38,84 +66,743 @@ type SnapshotManager struct {
 	// variable of knative).
 	snapshots  map[string]*Snapshot
 	baseFolder string
+	// Snapshots that are being created or downloaded. A revision can have a pending snapshot alongside a committed
+	// one, in which case the pending snapshot replaces the committed one once it is committed.
+	pending map[string]*Snapshot
+
+	// Capacity of the snapshot store, zero means unlimited
+	capacityBytes int64
+	capacityCount int
+	policy        EvictionPolicy
+
+	// Optional remote store used to share snapshots between nodes
+	store SnapshotStore
+
+	// Integrity checks, disabled if nil
+	integrity *IntegrityCfg
+
+	// Zero page detection, disabled if nil
+	zeroPages *ZeroPageCfg
+
+	// Guest memory file compression, disabled if nil
+	compression *CompressionCfg
+
+	// Deduplication of the guest memory files, disabled if nil
+	pageStoreCfg *PageStoreCfg
+	pages        *PageStore
 }
 
-// Snapshot identified by VM id
+// SnapshotManagerOption Options to pass to SnapshotManager
+type SnapshotManagerOption func(*SnapshotManager)
+
+// WithCapacity Sets the maximum total size in bytes and the maximum number of stored snapshots. Committed snapshots
+// that are not in use are evicted once either limit is exceeded. A zero value disables the corresponding limit.
+func WithCapacity(capacityBytes int64, capacityCount int) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.capacityBytes = capacityBytes
+		mgr.capacityCount = capacityCount
+	}
+}
 
-func NewSnapshotManager(baseFolder string) *SnapshotManager {
+// WithEvictionPolicy Sets the policy used to select snapshots to evict (LRU by default)
+func WithEvictionPolicy(policy EvictionPolicy) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.policy = policy
+	}
+}
+
+// WithSnapshotStore Sets a store to which committed snapshots are uploaded and from which snapshots that are
+// missing on the node are downloaded
+func WithSnapshotStore(store SnapshotStore) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.store = store
+	}
+}
+
+// WithIntegrityCheck Records the checksums of the snapshot files on commit and verifies them when a snapshot is
+// acquired. Corrupt snapshots are moved to the quarantine directory and reported as missing, so that the function
+// instance boots from scratch.
+func WithIntegrityCheck(cfg IntegrityCfg) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		if cfg.Parallelism <= 0 {
+			cfg.Parallelism = runtime.NumCPU()
+		}
+		if cfg.SampledChunks <= 0 {
+			cfg.SampledChunks = 4
+		}
+		mgr.integrity = &cfg
+	}
+}
+
+// WithZeroPageDetection Records the pages of the guest memory file that only contain zeros when a snapshot is
+// committed, so that they can be served without reading the memory file. The zero pages are also deallocated from
+// the memory file if cfg.PunchHoles is set, including after a snapshot has been downloaded from the snapshot store.
+func WithZeroPageDetection(cfg ZeroPageCfg) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		if cfg.PageSize <= 0 {
+			cfg.PageSize = int64(os.Getpagesize())
+		}
+		mgr.zeroPages = &cfg
+	}
+}
+
+// WithCompression Replaces the guest memory file of committed snapshots with a compressed file, from which the
+// memory manager decompresses the pages on demand. Snapshots committed with compression can thus only be loaded with
+// user-level page faults.
+func WithCompression(cfg CompressionCfg) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.compression = &cfg
+	}
+}
+
+// WithPageStore Replaces the guest memory file of committed snapshots with a manifest of its chunks, which are
+// stored once per node in a content-addressed page store and shared between snapshots. Deduplication takes
+// precedence over compression, requires user-level page faults to load the snapshots, and cannot be combined with a
+// snapshot store, since the chunks are not uploaded.
+func WithPageStore(cfg PageStoreCfg) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		if cfg.ChunkSize <= 0 {
+			cfg.ChunkSize = int64(os.Getpagesize())
+		}
+		mgr.pageStoreCfg = &cfg
+	}
+}
+
+// NewSnapshotManager creates a snapshot manager and restores the snapshots that were committed to baseFolder
+// before the previous shutdown. Incomplete and superseded snapshots are removed from disk, while the other entries of
+// baseFolder are left alone.
+func NewSnapshotManager(baseFolder string, opts ...SnapshotManagerOption) *SnapshotManager {
 	manager := new(SnapshotManager)
 	manager.snapshots = make(map[string]*Snapshot)
+	manager.pending = make(map[string]*Snapshot)
 	manager.baseFolder = baseFolder
+	manager.policy = LRU{}
+
+	for _, opt := range opts {
+		opt(manager)
+	}
+
+	if manager.integrity != nil && manager.integrity.QuarantineDir == "" {
+		manager.integrity.QuarantineDir = filepath.Clean(baseFolder) + quarantineSuffix
+	}
+
+	if cfg := manager.pageStoreCfg; cfg != nil && manager.store != nil {
+		log.Warn("Deduplicated snapshots cannot be uploaded to the snapshot store, disabling deduplication")
+	} else if cfg != nil {
+		if cfg.Dir == "" {
+			cfg.Dir = filepath.Clean(baseFolder) + pagesSuffix
+		}
+		pages, err := NewPageStore(cfg.Dir)
+		if err != nil {
+			log.WithError(err).Warn("failed to create page store, disabling deduplication")
+		}
+		manager.pages = pages
+	}
 
-	// Clean & init basefolder
-	_ = os.RemoveAll(manager.baseFolder)
+	// Init basefolder and recover snapshots stored in it
 	_ = os.MkdirAll(manager.baseFolder, os.ModePerm)
+	manager.recoverSnapshots()
+	manager.recoverPages()
+
+	manager.Lock()
+	victims := manager.evictLocked()
+	manager.Unlock()
+	cleanupSnapshots(victims)
 
 	return manager
 }
 
-// AcquireSnapshot returns a snapshot for the specified revision if it is available.
+// recoverSnapshots rebuilds the snapshot map from the snapshot directories found in the base folder, keeping the
+// latest complete generation of each revision. Snapshots that are incomplete, e.g., because the daemon stopped while
+// the snapshot was being created, are discarded along with the superseded generations. Only the directories that hold
+// a snapshot are ever removed, so that the entries that do not belong to the manager survive.
+func (mgr *SnapshotManager) recoverSnapshots() {
+	entries, err := os.ReadDir(mgr.baseFolder)
+	if err != nil {
+		log.WithError(err).Warnf("failed to read snapshots folder %s", mgr.baseFolder)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		revision := entry.Name()
+		revisionDir := filepath.Join(mgr.baseFolder, revision)
+		logger := log.WithFields(log.Fields{"revision": revision})
+
+		generations, err := os.ReadDir(revisionDir)
+		if err != nil {
+			logger.WithError(err).Warn("failed to read revision snapshots folder")
+			continue
+		}
+
+		for _, genEntry := range generations {
+			genLogger := logger.WithFields(log.Fields{"generation": genEntry.Name()})
+
+			generation, err := strconv.ParseUint(genEntry.Name(), 10, 64)
+			if err != nil || !genEntry.IsDir() || !IsSnapshotDir(filepath.Join(revisionDir, genEntry.Name())) {
+				genLogger.Debug("Ignoring unknown entry in revision snapshots folder")
+				continue
+			}
+
+			snap, err := loadSnapshot(revision, mgr.baseFolder, generation)
+			if err != nil {
+				genLogger.WithError(err).Debug("Discarding incomplete snapshot")
+				if err := snap.Cleanup(); err != nil {
+					genLogger.WithError(err).Warn("failed to remove incomplete snapshot")
+				}
+				continue
+			}
+
+			// Entries are sorted by name, which does not order generations of different lengths
+			if current, ok := mgr.snapshots[revision]; ok {
+				superseded := snap
+				if current.Generation < generation {
+					mgr.snapshots[revision] = snap
+					superseded = current
+				}
+				if err := superseded.Cleanup(); err != nil {
+					genLogger.WithError(err).Warn("failed to remove superseded snapshot")
+				}
+				continue
+			}
+
+			mgr.snapshots[revision] = snap
+		}
+
+		// The revision folder is only removed if nothing else is left in it
+		if snap, ok := mgr.snapshots[revision]; ok {
+			logger.WithFields(log.Fields{"generation": snap.GetGeneration()}).Debug("Recovered snapshot")
+		} else if err := os.Remove(revisionDir); err != nil && !os.IsExist(err) && !errors.Is(err, syscall.ENOTEMPTY) {
+			logger.WithError(err).Warn("failed to remove revision snapshots folder")
+		}
+	}
+}
+
+// recoverPages references the chunks of the page store used by the recovered snapshots, and removes the chunks
+// that are not used by any of them.
+func (mgr *SnapshotManager) recoverPages() {
+	if mgr.pages == nil {
+		return
+	}
+
+	for _, snap := range mgr.snapshots {
+		manifest, err := ReadMemManifest(snap.GetMemManifestFilePath())
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		} else if err != nil {
+			log.WithError(err).WithFields(log.Fields{"revision": snap.GetId()}).Warn("failed to read guest memory manifest")
+			continue
+		}
+		if filepath.Clean(manifest.StoreDir) != filepath.Clean(mgr.pages.dir) {
+			continue
+		}
+
+		mgr.pages.acquire(manifest)
+		snap.pages = mgr.pages
+		snap.manifest = manifest
+	}
+
+	if err := mgr.pages.sweep(); err != nil {
+		log.WithError(err).Warn("failed to remove unused chunks from the page store")
+	}
+}
+
+// AcquireSnapshot returns the latest generation of the snapshot for the specified revision if it is available. If
+// the snapshot is not stored on the node, it is downloaded from the snapshot store, if one is configured. The
+// snapshot must be released with ReleaseSnapshot once it has been loaded.
 func (mgr *SnapshotManager) AcquireSnapshot(revision string) (*Snapshot, error) {
 	mgr.Lock()
-	defer mgr.Unlock()
 
 	// Check if idle snapshot is available for the given image
 	snap, ok := mgr.snapshots[revision]
 	if !ok {
-		return nil, errors.New(fmt.Sprintf("Get: Snapshot for revision %s does not exist", revision))
+		// Snapshot registered in manager but creation not finished yet
+		if _, creating := mgr.pending[revision]; creating {
+			mgr.Unlock()
+			return nil, errors.New("Snapshot is not yet usable")
+		}
+
+		if mgr.store == nil {
+			mgr.Unlock()
+			return nil, errors.New(fmt.Sprintf("Get: Snapshot for revision %s does not exist", revision))
+		}
+		// Unlocks the manager
+		return mgr.fetchSnapshot(revision)
 	}
 
-	// Snapshot registered in manager but creation not finished yet
-	if !snap.ready {
-		return nil, errors.New("Snapshot is not yet usable")
+	// Snapshot cannot be evicted until it is released
+	snap.refs++
+	snap.useCount++
+	snap.lastUsed = time.Now()
+
+	verify := mgr.needsVerificationLocked(snap)
+	mgr.Unlock()
+
+	if verify {
+		if err := mgr.verifySnapshot(snap); err != nil {
+			mgr.Lock()
+			snap.refs--
+			if mgr.snapshots[revision] == snap {
+				delete(mgr.snapshots, revision)
+			}
+			// Other users keep using the snapshot until they release it, after which it is quarantined
+			snap.superseded = true
+			snap.corrupt = true
+			quarantine := snap.refs == 0
+			mgr.Unlock()
+
+			if quarantine {
+				mgr.quarantineSnapshot(snap)
+			}
+			return nil, err
+		}
 	}
 
 	// Return snapshot for supplied revision
-	return mgr.snapshots[revision], nil
+	return snap, nil
+}
+
+// fetchSnapshot downloads the latest generation of the snapshot for the specified revision from the snapshot
+// store and acquires it. A placeholder is registered as a pending snapshot while the download is in progress, so
+// that concurrent requests for the same revision fail fast instead of downloading it again. Must be called with the
+// manager lock held, which is released before downloading.
+func (mgr *SnapshotManager) fetchSnapshot(revision string) (*Snapshot, error) {
+	logger := log.WithFields(log.Fields{"revision": revision})
+
+	placeholder := newSnapshotGeneration(revision, mgr.baseFolder, "", 0)
+	mgr.pending[revision] = placeholder
+	mgr.Unlock()
+
+	// The generation is only known once the snapshot info has been downloaded
+	downloadDir := filepath.Join(mgr.baseFolder, revision, "download")
+
+	abort := func(err error) (*Snapshot, error) {
+		mgr.Lock()
+		delete(mgr.pending, revision)
+		mgr.Unlock()
+
+		if cleanupErr := os.RemoveAll(downloadDir); cleanupErr != nil {
+			logger.WithError(cleanupErr).Warn("failed to remove partially downloaded snapshot")
+		}
+		return nil, err
+	}
+
+	_ = os.RemoveAll(downloadDir)
+	if err := os.MkdirAll(downloadDir, 0755); err != nil {
+		return abort(errors.Wrapf(err, "creating snapDir for snapshot %s", revision))
+	}
+
+	logger.Debug("Downloading snapshot from the snapshot store")
+	if err := mgr.store.Download(context.Background(), revision, downloadDir); err != nil {
+		if errors.Is(err, ErrSnapshotNotInStore) {
+			return abort(errors.New(fmt.Sprintf("Get: Snapshot for revision %s does not exist", revision)))
+		}
+		return abort(errors.Wrapf(err, "downloading snapshot %s", revision))
+	}
+
+	info := new(Snapshot)
+	if err := info.LoadSnapInfo(filepath.Join(downloadDir, "info_file")); err != nil {
+		return abort(errors.Wrapf(err, "loading downloaded snapshot %s", revision))
+	}
+
+	placeholder = newSnapshotGeneration(revision, mgr.baseFolder, "", info.Generation)
+	if err := os.Rename(downloadDir, placeholder.snapDir); err != nil {
+		return abort(errors.Wrapf(err, "moving downloaded snapshot %s", revision))
+	}
+	downloadDir = placeholder.snapDir
+
+	// Downloads write out the zero pages, which have to be deallocated again
+	if mgr.zeroPages != nil && mgr.zeroPages.PunchHoles {
+		if err := placeholder.punchZeroPageHoles(); err != nil {
+			logger.WithError(err).Warn("failed to punch holes in the downloaded memory file")
+		}
+	}
+
+	snap, err := loadSnapshot(revision, mgr.baseFolder, info.Generation)
+	if err != nil {
+		return abort(errors.Wrapf(err, "loading downloaded snapshot %s", revision))
+	}
+
+	if mgr.integrity != nil && mgr.integrity.Verify != "" {
+		if err := mgr.verifySnapshot(snap); err != nil {
+			mgr.quarantineSnapshot(snap)
+			return abort(err)
+		}
+	}
+
+	mgr.Lock()
+	delete(mgr.pending, revision)
+	snap.refs = 1
+	snap.useCount = 1
+	snap.lastUsed = time.Now()
+	mgr.snapshots[revision] = snap
+
+	victims := mgr.evictLocked()
+	mgr.Unlock()
+
+	cleanupSnapshots(victims)
+
+	return snap, nil
 }
 
-// InitSnapshot initializes a snapshot by adding its metadata to the SnapshotManager. Once the snapshot has
-// been created, CommitSnapshot must be run to finalize the snapshot creation and make the snapshot available for use.
+// ReleaseSnapshot marks a snapshot returned by AcquireSnapshot as no longer in use, so that it can be evicted, or
+// removed if a newer generation has been committed in the meantime.
+func (mgr *SnapshotManager) ReleaseSnapshot(snap *Snapshot) error {
+	mgr.Lock()
+
+	if snap.refs == 0 {
+		mgr.Unlock()
+		return errors.New(fmt.Sprintf("Release: Snapshot for revision %s is not in use", snap.GetId()))
+	}
+
+	victims, corrupt := mgr.releaseLocked(snap)
+	mgr.Unlock()
+
+	cleanupSnapshots(victims)
+	if corrupt != nil {
+		mgr.quarantineSnapshot(corrupt)
+	}
+
+	return nil
+}
+
+// UploadWorkingSet uploads the record-and-prefetch artifacts of a snapshot to the snapshot store, if one is
+// configured, so that the VMs loaded from the snapshot on other nodes replay the working set instead of recording it
+// again. It should be called once a VM loaded from the snapshot has been stopped, before the snapshot is released,
+// since the memory manager records or extends the working set then. Unchanged artifacts are not uploaded again.
+func (mgr *SnapshotManager) UploadWorkingSet(snap *Snapshot) error {
+	if mgr.store == nil {
+		return nil
+	}
+
+	info, err := os.Stat(snap.GetWorkingSetFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "looking up working set of snapshot %s", snap.GetId())
+	}
+
+	mgr.Lock()
+	uploaded := snap.workingSetUploaded.Equal(info.ModTime())
+	mgr.Unlock()
+	if uploaded {
+		return nil
+	}
+
+	if err := mgr.store.UploadWorkingSet(context.Background(), snap); err != nil {
+		return errors.Wrapf(err, "uploading working set of snapshot %s", snap.GetId())
+	}
+
+	mgr.Lock()
+	snap.workingSetUploaded = info.ModTime()
+	mgr.Unlock()
+
+	return nil
+}
+
+// InitSnapshot initializes a new generation of the snapshot for a revision by adding its metadata to the
+// SnapshotManager. Once the snapshot has been created, CommitSnapshot must be run to finalize the snapshot creation
+// and make the snapshot available for use. Only one generation of a revision can be created at a time.
 func (mgr *SnapshotManager) InitSnapshot(revision, image string) (*Snapshot, error) {
 	mgr.Lock()
 
 	logger := log.WithFields(log.Fields{"revision": revision, "image": image})
 	logger.Debug("Initializing snapshot corresponding to revision and image")
 
-	if _, present := mgr.snapshots[revision]; present {
+	if _, present := mgr.pending[revision]; present {
 		mgr.Unlock()
-		return nil, errors.New(fmt.Sprintf("Add: Snapshot for revision %s already exists", revision))
+		return nil, errors.New(fmt.Sprintf("Add: Snapshot for revision %s is already being created", revision))
+	}
+
+	// Generations are numbered by their creation time, so that they are ordered across nodes and restarts
+	generation := uint64(time.Now().UnixNano())
+	if current, ok := mgr.snapshots[revision]; ok && current.Generation >= generation {
+		generation = current.Generation + 1
 	}
 
 	// Create snapshot object and move into creating state
-	snap := NewSnapshot(revision, mgr.baseFolder, image)
-	mgr.snapshots[snap.GetId()] = snap
+	snap := newSnapshotGeneration(revision, mgr.baseFolder, image, generation)
+	mgr.pending[snap.GetId()] = snap
 	mgr.Unlock()
 
 	// Create directory to store snapshot data
 	err := snap.CreateSnapDir()
 	if err != nil {
+		mgr.Lock()
+		delete(mgr.pending, revision)
+		mgr.Unlock()
 		return nil, errors.Wrapf(err, "creating snapDir for snapshots %s", revision)
 	}
 
 	return snap, nil
 }
 
-// CommitSnapshot finalizes the snapshot creation and makes it available for use.
+// CommitSnapshot finalizes the snapshot creation and atomically promotes the snapshot to the latest generation of
+// its revision. Users of the superseded generation keep using it until they release it, after which it is removed.
 func (mgr *SnapshotManager) CommitSnapshot(revision string) error {
 	mgr.Lock()
-	defer mgr.Unlock()
 
-	snap, ok := mgr.snapshots[revision]
+	snap, ok := mgr.pending[revision]
 	if !ok {
+		mgr.Unlock()
 		return errors.New(fmt.Sprintf("Snapshot for revision %s to commit does not exist", revision))
 	}
 
 	if snap.ready {
-		return errors.New(fmt.Sprintf("Snapshot for revision %s has already been committed", revision))
+		mgr.Unlock()
+		return errors.New(fmt.Sprintf("Snapshot for revision %s is already being committed", revision))
 	}
 
+	// Prevent concurrent commits of the same snapshot
 	snap.ready = true
 
+	if mgr.zeroPages != nil || mgr.pages != nil || mgr.compression != nil || mgr.integrity != nil {
+		// Scanning and hashing large memory files takes a while, the snapshot cannot be acquired in the meantime
+		// since it is still pending
+		mgr.Unlock()
+		err := mgr.postProcessSnapshot(snap)
+		mgr.Lock()
+
+		if err != nil {
+			snap.ready = false
+			mgr.Unlock()
+			return errors.Wrapf(err, "post-processing snapshot %s", revision)
+		}
+		snap.verified = mgr.integrity != nil
+	}
+
+	size, err := snap.computeSize()
+	if err != nil {
+		snap.ready = false
+		mgr.Unlock()
+		return errors.Wrapf(err, "computing size of snapshot %s", revision)
+	}
+
+	snap.size = size
+	snap.lastUsed = time.Now()
+
+	delete(mgr.pending, revision)
+	previous, hasPrevious := mgr.snapshots[revision]
+	mgr.snapshots[revision] = snap
+
+	var superseded []*Snapshot
+	if hasPrevious {
+		log.WithFields(log.Fields{"revision": revision, "generation": snap.GetGeneration(),
+			"superseded": previous.GetGeneration()}).Debug("Promoted new snapshot generation")
+		previous.superseded = true
+		if previous.refs == 0 {
+			superseded = append(superseded, previous)
+		}
+	}
+
+	if mgr.store == nil {
+		victims := mgr.evictLocked()
+		mgr.Unlock()
+
+		cleanupSnapshots(append(victims, superseded...))
+
+		return nil
+	}
+
+	// Keep the snapshot from being evicted while it is being uploaded
+	snap.refs++
+	mgr.Unlock()
+
+	cleanupSnapshots(superseded)
+
+	// A failed upload only affects other nodes, which fall back to booting the function from scratch
+	if err := mgr.store.Upload(context.Background(), snap); err != nil {
+		log.WithError(err).WithFields(log.Fields{"revision": revision}).Warn("failed to upload snapshot to the snapshot store")
+	}
+
+	mgr.Lock()
+	victims, corrupt := mgr.releaseLocked(snap)
+	mgr.Unlock()
+
+	cleanupSnapshots(victims)
+	if corrupt != nil {
+		mgr.quarantineSnapshot(corrupt)
+	}
+
+	return nil
+}
+
+// AbortSnapshot discards a snapshot that was initialized but could not be created, so that the snapshot of the
+// revision can be initialized again.
+func (mgr *SnapshotManager) AbortSnapshot(revision string) error {
+	mgr.Lock()
+
+	snap, ok := mgr.pending[revision]
+	if !ok {
+		mgr.Unlock()
+		return errors.New(fmt.Sprintf("Snapshot for revision %s to abort does not exist", revision))
+	}
+
+	if snap.ready {
+		mgr.Unlock()
+		return errors.New(fmt.Sprintf("Snapshot for revision %s is being committed", revision))
+	}
+
+	delete(mgr.pending, revision)
+	mgr.Unlock()
+
+	return errors.Wrapf(snap.Cleanup(), "removing aborted snapshot %s", revision)
+}
+
+// postProcessSnapshot records the zero pages, deduplicates or compresses the guest memory file and records the
+// checksums of a snapshot that is being committed, in this order, so that the checksums cover the files that are
+// eventually stored.
+func (mgr *SnapshotManager) postProcessSnapshot(snap *Snapshot) error {
+	if mgr.zeroPages != nil {
+		if err := snap.DetectZeroPages(*mgr.zeroPages); err != nil {
+			return errors.Wrap(err, "detecting zero pages")
+		}
+	}
+
+	// The guest memory file has already been replaced if a previous commit attempt failed afterwards
+	if mgr.pages != nil && snap.manifest == nil {
+		if err := snap.DedupMemFile(mgr.pages, mgr.pageStoreCfg.ChunkSize); err != nil {
+			return errors.Wrap(err, "deduplicating the guest memory file")
+		}
+	} else if _, err := os.Stat(snap.GetMemFilePath()); mgr.compression != nil && err == nil {
+		if err := snap.CompressMemFile(*mgr.compression); err != nil {
+			return errors.Wrap(err, "compressing the guest memory file")
+		}
+	}
+
+	if mgr.integrity != nil {
+		if err := snap.ComputeChecksums(mgr.integrity.ChunkSize, mgr.integrity.Parallelism); err != nil {
+			return errors.Wrap(err, "computing checksums")
+		}
+		return snap.SerializeSnapInfo()
+	}
+
+	return nil
+}
+
+// needsVerificationLocked reports whether the snapshot files have to be verified before the snapshot is used.
+// Must be called with the manager lock held.
+func (mgr *SnapshotManager) needsVerificationLocked(snap *Snapshot) bool {
+	if mgr.integrity == nil {
+		return false
+	}
+
+	return mgr.integrity.Verify == VerifySampled || (mgr.integrity.Verify == VerifyFull && !snap.verified)
+}
+
+// verifySnapshot checks the snapshot files against their checksums.
+func (mgr *SnapshotManager) verifySnapshot(snap *Snapshot) error {
+	sampledChunks := 0
+	if mgr.integrity.Verify == VerifySampled {
+		sampledChunks = mgr.integrity.SampledChunks
+	}
+
+	if err := snap.VerifyChecksums(sampledChunks, mgr.integrity.Parallelism); err != nil {
+		return errors.Wrapf(err, "verifying snapshot %s", snap.GetId())
+	}
+
+	if mgr.integrity.Verify == VerifyFull {
+		mgr.Lock()
+		snap.verified = true
+		mgr.Unlock()
+	}
+
 	return nil
 }
+
+// quarantineSnapshot moves the files of a corrupt snapshot out of the snapshots folder, keeping them for
+// inspection. The snapshot must have been removed from the manager.
+func (mgr *SnapshotManager) quarantineSnapshot(snap *Snapshot) {
+	logger := log.WithFields(log.Fields{"revision": snap.GetId()})
+
+	dst := filepath.Join(mgr.integrity.QuarantineDir, fmt.Sprintf("%s-%s", snap.GetId(), time.Now().Format("20060102150405")))
+	logger.WithFields(log.Fields{"quarantinePath": dst}).Warn("Quarantining corrupt snapshot")
+
+	if err := os.MkdirAll(mgr.integrity.QuarantineDir, 0755); err == nil {
+		if err := os.Rename(snap.snapDir, dst); err == nil {
+			snap.releasePages()
+			return
+		}
+	}
+
+	logger.Warn("failed to quarantine corrupt snapshot, removing it")
+	if err := snap.Cleanup(); err != nil {
+		logger.WithError(err).Warn("failed to remove corrupt snapshot")
+	}
+}
+
+// releaseLocked drops a reference to the snapshot and returns the snapshots whose files have to be removed once
+// the lock is released, which include the snapshot itself if it was superseded and is no longer in use. A snapshot
+// that failed verification is returned separately, so that it is quarantined instead. Must be called with the
+// manager lock held.
+func (mgr *SnapshotManager) releaseLocked(snap *Snapshot) ([]*Snapshot, *Snapshot) {
+	snap.refs--
+
+	victims := mgr.evictLocked()
+	if !snap.superseded || snap.refs != 0 {
+		return victims, nil
+	}
+	if snap.corrupt {
+		return victims, snap
+	}
+	return append(victims, snap), nil
+}
+
+// evictLocked removes snapshots from the manager until it fits its capacity, and returns the evicted snapshots
+// so that their files can be deleted once the lock is released. Snapshots that are being created or are in use
+// are never evicted. Must be called with the manager lock held.
+func (mgr *SnapshotManager) evictLocked() []*Snapshot {
+	var victims []*Snapshot
+
+	for mgr.overCapacityLocked() {
+		candidates := make([]*Snapshot, 0, len(mgr.snapshots))
+		for _, snap := range mgr.snapshots {
+			if snap.ready && snap.refs == 0 {
+				candidates = append(candidates, snap)
+			}
+		}
+		if len(candidates) == 0 {
+			log.Warn("Snapshot capacity exceeded but all snapshots are in use")
+			break
+		}
+
+		victim := mgr.policy.Victim(candidates)
+		if victim == nil {
+			break
+		}
+
+		log.WithFields(log.Fields{"revision": victim.GetId(), "size": victim.GetSize()}).Debug("Evicting snapshot")
+		delete(mgr.snapshots, victim.GetId())
+		victims = append(victims, victim)
+	}
+
+	return victims
+}
+
+func (mgr *SnapshotManager) overCapacityLocked() bool {
+	if mgr.capacityCount > 0 && len(mgr.snapshots) > mgr.capacityCount {
+		return true
+	}
+
+	if mgr.capacityBytes > 0 {
+		var total int64
+		for _, snap := range mgr.snapshots {
+			total += snap.size
+		}
+		return total > mgr.capacityBytes
+	}
+
+	return false
+}
+
+// cleanupSnapshots removes the files of evicted snapshots.
+func cleanupSnapshots(victims []*Snapshot) {
+	for _, snap := range victims {
+		if err := snap.Cleanup(); err != nil {
+			log.WithError(err).WithFields(log.Fields{"revision": snap.GetId()}).Warn("failed to remove evicted snapshot")
+		}
+	}
+}
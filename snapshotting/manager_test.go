@@ -29,6 +29,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/vhive-serverless/vhive/snapshotting"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 )
@@ -97,3 +98,199 @@ func TestSnapshotManagerConcurrent(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestSnapshotManagerRecovery(t *testing.T) {
+	baseFolder := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(baseFolder)
+
+	// Committed snapshot with all files present
+	snap, err := mgr.InitSnapshot("complete-rev", "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	for _, path := range []string{snap.GetSnapshotFilePath(), snap.GetMemFilePath(), snap.GetPatchFilePath()} {
+		require.NoError(t, os.WriteFile(path, []byte("data"), 0644), "Failed to write snapshot file")
+	}
+	require.NoError(t, snap.SerializeSnapInfo(), "Failed to serialize snapshot info")
+	require.NoError(t, mgr.CommitSnapshot(snap.GetId()), "Failed to commit snapshot")
+
+	// Snapshot whose creation was interrupted before the memory file was written
+	partial, err := mgr.InitSnapshot("partial-rev", "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	require.NoError(t, os.WriteFile(partial.GetSnapshotFilePath(), []byte("data"), 0644), "Failed to write snapshot file")
+	require.NoError(t, partial.SerializeSnapInfo(), "Failed to serialize snapshot info")
+
+	mgr = snapshotting.NewSnapshotManager(baseFolder)
+
+	recovered, err := mgr.AcquireSnapshot("complete-rev")
+	require.NoError(t, err, "Committed snapshot was not recovered")
+	require.Equal(t, "testImage", recovered.GetImage())
+	require.Equal(t, snap.GetContainerSnapName(), recovered.GetContainerSnapName())
+	require.Equal(t, snap.GetMemFilePath(), recovered.GetMemFilePath())
+
+	_, err = mgr.AcquireSnapshot("partial-rev")
+	require.Error(t, err, "Incomplete snapshot should not be recovered")
+	_, err = os.Stat(filepath.Join(baseFolder, "partial-rev"))
+	require.True(t, os.IsNotExist(err), "Incomplete snapshot should be removed from disk")
+}
+
+func TestSnapshotManagerRecoveryKeepsUnknownEntries(t *testing.T) {
+	baseFolder := t.TempDir()
+
+	// Entries that do not hold snapshots, e.g., the base dir of a VM and a snapshot without info
+	vmDir := filepath.Join(baseFolder, "vm-1")
+	require.NoError(t, os.MkdirAll(vmDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(vmDir, "vm_info"), []byte("{}"), 0644))
+	noInfoDir := filepath.Join(baseFolder, "rev", "123")
+	require.NoError(t, os.MkdirAll(noInfoDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(noInfoDir, "working_set_pages"), nil, 0644))
+
+	mgr := snapshotting.NewSnapshotManager(baseFolder)
+	_, err := mgr.AcquireSnapshot("vm-1")
+	require.Error(t, err, "Entry without snapshot was recovered")
+
+	_, err = os.Stat(filepath.Join(vmDir, "vm_info"))
+	require.NoError(t, err, "Entry without snapshot was removed")
+	_, err = os.Stat(noInfoDir)
+	require.NoError(t, err, "Snapshot dir without info was removed")
+
+	require.Equal(t, "/fccd/snapshots/functions", snapshotting.FunctionSnapshotsDir("/fccd/snapshots"))
+	require.True(t, snapshotting.IsFunctionSnapshotsEntry("functions"))
+	require.True(t, snapshotting.IsFunctionSnapshotsEntry("functions-quarantine"))
+	require.False(t, snapshotting.IsFunctionSnapshotsEntry("vm-1"))
+}
+
+func commitTestSnapshot(t *testing.T, mgr *snapshotting.SnapshotManager, revision string, size int) *snapshotting.Snapshot {
+	snap, err := mgr.InitSnapshot(revision, "testImage")
+	require.NoError(t, err, fmt.Sprintf("Failed to create snapshot for %s", revision))
+	require.NoError(t, os.WriteFile(snap.GetMemFilePath(), make([]byte, size), 0644), "Failed to write memory file")
+	require.NoError(t, mgr.CommitSnapshot(revision), fmt.Sprintf("Failed to commit snapshot for %s", revision))
+	return snap
+}
+
+func TestSnapshotManagerAbort(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir())
+
+	snap, err := mgr.InitSnapshot("rev", "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	require.NoError(t, mgr.AbortSnapshot("rev"), "Failed to abort snapshot")
+	require.Error(t, mgr.AbortSnapshot("rev"), "Abort should fail when no snapshot is being created")
+	require.Error(t, mgr.CommitSnapshot("rev"), "Commit should fail when the snapshot was aborted")
+
+	_, err = os.Stat(filepath.Dir(snap.GetMemFilePath()))
+	require.True(t, os.IsNotExist(err), "Aborted snapshot should be removed")
+
+	// The snapshot of the revision can be created again
+	commitTestSnapshot(t, mgr, "rev", 16)
+	_, err = mgr.AcquireSnapshot("rev")
+	require.NoError(t, err, "Failed to acquire snapshot")
+}
+
+func TestSnapshotManagerEvictionLRU(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithCapacity(0, 2))
+
+	first := commitTestSnapshot(t, mgr, "rev-1", 16)
+	commitTestSnapshot(t, mgr, "rev-2", 16)
+
+	// Using the first snapshot makes the second one the least recently used
+	acquired, err := mgr.AcquireSnapshot("rev-1")
+	require.NoError(t, err, "Failed to acquire snapshot")
+	require.NoError(t, mgr.ReleaseSnapshot(acquired), "Failed to release snapshot")
+
+	commitTestSnapshot(t, mgr, "rev-3", 16)
+
+	_, err = mgr.AcquireSnapshot("rev-2")
+	require.Error(t, err, "Least recently used snapshot should have been evicted")
+	_, err = mgr.AcquireSnapshot("rev-1")
+	require.NoError(t, err, "Recently used snapshot should not have been evicted")
+	_, err = os.Stat(first.GetMemFilePath())
+	require.NoError(t, err, "Files of the retained snapshot should be kept")
+}
+
+func TestSnapshotManagerEvictionSkipsSnapshotsInUse(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithCapacity(32, 0))
+
+	inUse := commitTestSnapshot(t, mgr, "rev-1", 16)
+	_, err := mgr.AcquireSnapshot("rev-1")
+	require.NoError(t, err, "Failed to acquire snapshot")
+
+	commitTestSnapshot(t, mgr, "rev-2", 16)
+	commitTestSnapshot(t, mgr, "rev-3", 16)
+
+	_, err = os.Stat(inUse.GetMemFilePath())
+	require.NoError(t, err, "Snapshot in use must not be evicted")
+	_, err = mgr.AcquireSnapshot("rev-2")
+	require.Error(t, err, "Unused snapshot should have been evicted")
+
+	require.NoError(t, mgr.ReleaseSnapshot(inUse), "Failed to release snapshot")
+	require.Error(t, mgr.ReleaseSnapshot(inUse), "Release should fail when the snapshot is not in use")
+}
+
+func TestSnapshotManagerGenerations(t *testing.T) {
+	baseFolder := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(baseFolder)
+
+	first := createStoredSnapshot(t, mgr, "rev")
+	reader, err := mgr.AcquireSnapshot("rev")
+	require.NoError(t, err, "Failed to acquire snapshot")
+	require.Equal(t, first, reader)
+
+	second, err := mgr.InitSnapshot("rev", "testImage")
+	require.NoError(t, err, "Failed to create a new snapshot generation")
+	require.Greater(t, second.GetGeneration(), first.GetGeneration())
+	require.NotEqual(t, first.GetContainerSnapName(), second.GetContainerSnapName())
+	_, err = mgr.InitSnapshot("rev", "testImage")
+	require.Error(t, err, "Init should fail while a snapshot generation is being created")
+
+	// The committed generation is used until the new one is committed
+	acquired, err := mgr.AcquireSnapshot("rev")
+	require.NoError(t, err, "Failed to acquire snapshot")
+	require.Equal(t, first, acquired)
+	require.NoError(t, mgr.ReleaseSnapshot(acquired), "Failed to release snapshot")
+
+	for _, path := range []string{second.GetSnapshotFilePath(), second.GetMemFilePath(), second.GetPatchFilePath()} {
+		require.NoError(t, os.WriteFile(path, []byte("data"), 0644), "Failed to write snapshot file")
+	}
+	require.NoError(t, second.SerializeSnapInfo(), "Failed to serialize snapshot info")
+	require.NoError(t, mgr.CommitSnapshot("rev"), "Failed to commit snapshot")
+
+	acquired, err = mgr.AcquireSnapshot("rev")
+	require.NoError(t, err, "Failed to acquire snapshot")
+	require.Equal(t, second, acquired)
+	require.NoError(t, mgr.ReleaseSnapshot(acquired), "Failed to release snapshot")
+
+	// Superseded generation is kept until its last reader releases it
+	_, err = os.Stat(first.GetMemFilePath())
+	require.NoError(t, err, "Superseded snapshot in use must be kept")
+
+	// Restarting while the superseded generation is still on disk only recovers the latest generation
+	recovered, err := snapshotting.NewSnapshotManager(baseFolder).AcquireSnapshot("rev")
+	require.NoError(t, err, "Failed to recover snapshot")
+	require.Equal(t, second.GetGeneration(), recovered.GetGeneration())
+	_, err = os.Stat(first.GetMemFilePath())
+	require.True(t, os.IsNotExist(err), "Superseded snapshot should be removed on recovery")
+
+	require.NoError(t, mgr.ReleaseSnapshot(reader), "Failed to release snapshot")
+	_, err = os.Stat(second.GetMemFilePath())
+	require.NoError(t, err, "Latest snapshot must be kept")
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir())
+
+	small := commitTestSnapshot(t, mgr, "small", 16)
+	large := commitTestSnapshot(t, mgr, "large", 4096)
+	for i := 0; i < 3; i++ {
+		_, err := mgr.AcquireSnapshot("large")
+		require.NoError(t, err, "Failed to acquire snapshot")
+	}
+	_, err := mgr.AcquireSnapshot("small")
+	require.NoError(t, err, "Failed to acquire snapshot")
+
+	candidates := []*snapshotting.Snapshot{small, large}
+
+	require.Equal(t, large, snapshotting.LRU{}.Victim(candidates))
+	require.Equal(t, small, snapshotting.LFU{}.Victim(candidates))
+	require.Equal(t, large, snapshotting.SizeWeighted{}.Victim(candidates))
+
+	_, err = snapshotting.NewEvictionPolicy("unknown")
+	require.Error(t, err, "Unknown eviction policy should be rejected")
+}
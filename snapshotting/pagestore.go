@@ -0,0 +1,354 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ChunkDigest SHA-256 digest of a guest memory chunk. The zero digest denotes a chunk that only contains zeros,
+// which is not stored.
+type ChunkDigest [sha256.Size]byte
+
+// MemManifest Guest memory file of a snapshot whose chunks are stored in a page store. Only capitalized fields are
+// serialised.
+type MemManifest struct {
+	// Directory of the page store holding the chunks
+	StoreDir  string
+	Size      int64
+	ChunkSize int64
+	Chunks    []ChunkDigest
+}
+
+// PageStoreCfg Configuration of the node-local page store
+type PageStoreCfg struct {
+	// Directory of the page store, <snapshots dir>-pages by default
+	Dir string
+	// Size of the deduplicated chunks of the guest memory files, the host page size by default
+	ChunkSize int64
+}
+
+// PageStore Node-local content-addressed store of guest memory chunks, which deduplicates the identical chunks of
+// the guest memory files of different snapshots, e.g., the pages of a guest kernel or language runtime shared by
+// several functions. Each chunk is stored once in <dir>/<digest prefix>/<digest>, and is removed once no snapshot
+// references it anymore.
+type PageStore struct {
+	sync.Mutex
+	dir string
+	// Number of references to each stored chunk by the manifests of the snapshots
+	refs map[ChunkDigest]int
+}
+
+// NewPageStore creates a page store backed by dir.
+func NewPageStore(dir string) (*PageStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "creating page store dir %s", dir)
+	}
+
+	return &PageStore{dir: dir, refs: make(map[ChunkDigest]int)}, nil
+}
+
+func chunkPath(storeDir string, digest ChunkDigest) string {
+	name := hex.EncodeToString(digest[:])
+	return filepath.Join(storeDir, name[:2], name)
+}
+
+// put stores a chunk if it is not stored yet, and references it.
+func (ps *PageStore) put(data []byte) (ChunkDigest, error) {
+	if isZero(data) {
+		return ChunkDigest{}, nil
+	}
+
+	digest := ChunkDigest(sha256.Sum256(data))
+
+	ps.Lock()
+	defer ps.Unlock()
+
+	if ps.refs[digest] == 0 {
+		path := chunkPath(ps.dir, digest)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return digest, err
+		}
+		// Chunks are written atomically, so that a stored chunk is always complete
+		if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+			return digest, err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return digest, err
+		}
+	}
+	ps.refs[digest]++
+
+	return digest, nil
+}
+
+// acquire references the chunks of a manifest, e.g., of a snapshot recovered after a restart.
+func (ps *PageStore) acquire(manifest *MemManifest) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for _, digest := range manifest.Chunks {
+		if digest != (ChunkDigest{}) {
+			ps.refs[digest]++
+		}
+	}
+}
+
+// release drops the references of a manifest to its chunks, and removes the chunks that are no longer referenced.
+func (ps *PageStore) release(manifest *MemManifest) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for _, digest := range manifest.Chunks {
+		if digest == (ChunkDigest{}) || ps.refs[digest] == 0 {
+			continue
+		}
+		ps.refs[digest]--
+		if ps.refs[digest] == 0 {
+			delete(ps.refs, digest)
+			if err := os.Remove(chunkPath(ps.dir, digest)); err != nil && !os.IsNotExist(err) {
+				log.WithError(err).Warn("failed to remove unreferenced chunk from the page store")
+			}
+		}
+	}
+}
+
+// sweep removes the stored chunks that are not referenced, e.g., left behind by a snapshot that was being committed
+// when the daemon stopped.
+func (ps *PageStore) sweep() error {
+	ps.Lock()
+	defer ps.Unlock()
+
+	return filepath.WalkDir(ps.dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		var digest ChunkDigest
+		if n, err := hex.Decode(digest[:], []byte(entry.Name())); err == nil && n == len(digest) && ps.refs[digest] > 0 {
+			return nil
+		}
+		return os.Remove(path)
+	})
+}
+
+// dedupMemFile stores the chunks of a guest memory file, and returns the manifest referencing them.
+func (ps *PageStore) dedupMemFile(path string, chunkSize int64) (*MemManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &MemManifest{StoreDir: ps.dir, Size: info.Size(), ChunkSize: chunkSize}
+	buf := make([]byte, chunkSize)
+	for offset := int64(0); offset < info.Size(); offset += chunkSize {
+		chunk := buf[:min(chunkSize, info.Size()-offset)]
+		if _, err := io.ReadFull(f, chunk); err != nil {
+			ps.release(manifest)
+			return nil, errors.Wrapf(err, "reading %s", path)
+		}
+
+		digest, err := ps.put(chunk)
+		if err != nil {
+			ps.release(manifest)
+			return nil, errors.Wrap(err, "storing chunk")
+		}
+		manifest.Chunks = append(manifest.Chunks, digest)
+	}
+
+	return manifest, nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ReadMemManifest loads a manifest written by WriteFile.
+func ReadMemManifest(path string) (*MemManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	manifest := new(MemManifest)
+	if err := gob.NewDecoder(f).Decode(manifest); err != nil {
+		return nil, errors.Wrapf(err, "decoding manifest %s", path)
+	}
+	if manifest.ChunkSize <= 0 || int64(len(manifest.Chunks)) != (manifest.Size+manifest.ChunkSize-1)/manifest.ChunkSize {
+		return nil, errors.Errorf("invalid manifest %s", path)
+	}
+
+	return manifest, nil
+}
+
+// WriteFile atomically stores the manifest at path.
+func (m *MemManifest) WriteFile(path string) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(path + ".tmp") }()
+
+	if err := gob.NewEncoder(f).Encode(m); err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "encoding manifest %s", path)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// DedupedMemFile Reader of a guest memory file whose chunks are stored in a page store. It is safe for concurrent
+// use.
+type DedupedMemFile struct {
+	manifest *MemManifest
+}
+
+// OpenDedupedMemFile opens the guest memory file described by the manifest at path.
+func OpenDedupedMemFile(path string) (*DedupedMemFile, error) {
+	manifest, err := ReadMemManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DedupedMemFile{manifest: manifest}, nil
+}
+
+// Size returns the size of the guest memory file.
+func (f *DedupedMemFile) Size() int64 {
+	return f.manifest.Size
+}
+
+// ReadAt reads the guest memory file at offset from the chunks in the page store.
+func (f *DedupedMemFile) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.Errorf("negative offset %d", offset)
+	}
+
+	var n int
+	for n < len(p) && offset+int64(n) < f.manifest.Size {
+		pos := offset + int64(n)
+		chunk := pos / f.manifest.ChunkSize
+		chunkOffset := pos % f.manifest.ChunkSize
+		length := min(int64(len(p)-n), f.manifest.ChunkSize-chunkOffset, f.manifest.Size-pos)
+
+		digest := f.manifest.Chunks[chunk]
+		if digest == (ChunkDigest{}) {
+			clear(p[n : n+int(length)])
+			n += int(length)
+			continue
+		}
+
+		read, err := readChunk(chunkPath(f.manifest.StoreDir, digest), p[n:n+int(length)], chunkOffset)
+		n += read
+		if err != nil {
+			return n, errors.Wrapf(err, "reading chunk %d", chunk)
+		}
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func readChunk(path string, p []byte, offset int64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	n, err := f.ReadAt(p, offset)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+// Close releases the reader.
+func (f *DedupedMemFile) Close() error {
+	return nil
+}
+
+// GetMemManifestFilePath returns the path of the manifest of the guest memory file, which replaces the guest memory
+// file if the snapshot was committed with a page store.
+func (snp *Snapshot) GetMemManifestFilePath() string {
+	return filepath.Join(snp.snapDir, "mem_manifest")
+}
+
+// DedupMemFile replaces the guest memory file with a manifest of its chunks, which are stored in the page store.
+func (snp *Snapshot) DedupMemFile(pages *PageStore, chunkSize int64) error {
+	manifest, err := pages.dedupMemFile(snp.GetMemFilePath(), chunkSize)
+	if err != nil {
+		return err
+	}
+
+	if err := manifest.WriteFile(snp.GetMemManifestFilePath()); err != nil {
+		pages.release(manifest)
+		return err
+	}
+
+	snp.pages = pages
+	snp.manifest = manifest
+
+	return os.Remove(snp.GetMemFilePath())
+}
+
+// releasePages drops the references of the snapshot to the chunks in the page store.
+func (snp *Snapshot) releasePages() {
+	if snp.pages != nil {
+		snp.pages.release(snp.manifest)
+		snp.pages = nil
+		snp.manifest = nil
+	}
+}
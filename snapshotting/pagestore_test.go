@@ -0,0 +1,123 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+// countFiles returns the number of files in dir and its subdirectories.
+func countFiles(t *testing.T, dir string) int {
+	var files int
+	require.NoError(t, filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			files++
+		}
+		return err
+	}), "Failed to walk %s", dir)
+	return files
+}
+
+// exclusiveMemFileData returns guest memory that differs from the data of testMemFileData.
+func exclusiveMemFileData(size int) []byte {
+	data := testMemFileData(size)
+	data[0] ^= 0xff
+	return data
+}
+
+// commitMemSnapshot creates and commits a snapshot whose guest memory file holds data.
+func commitMemSnapshot(t *testing.T, mgr *snapshotting.SnapshotManager, revision string, data []byte) *snapshotting.Snapshot {
+	snap, err := mgr.InitSnapshot(revision, "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	for _, path := range []string{snap.GetSnapshotFilePath(), snap.GetPatchFilePath()} {
+		require.NoError(t, os.WriteFile(path, []byte(path), 0644), "Failed to write snapshot file")
+	}
+	require.NoError(t, os.WriteFile(snap.GetMemFilePath(), data, 0644), "Failed to write memory file")
+	require.NoError(t, snap.SerializeSnapInfo(), "Failed to serialize snapshot info")
+	require.NoError(t, mgr.CommitSnapshot(revision), "Failed to commit snapshot")
+	return snap
+}
+
+func TestSnapshotManagerPageStore(t *testing.T) {
+	baseFolder := filepath.Join(t.TempDir(), "snapshots")
+	pagesDir := filepath.Join(t.TempDir(), "pages")
+	pageStore := snapshotting.WithPageStore(snapshotting.PageStoreCfg{Dir: pagesDir, ChunkSize: zeroTestPageSize})
+
+	// Both snapshots share their first 8 pages, half of which are zero pages
+	shared := testMemFileData(8 * zeroTestPageSize)
+	first := append(append([]byte{}, shared...), exclusiveMemFileData(2*zeroTestPageSize)...)
+	second := append(append([]byte{}, shared...), make([]byte, zeroTestPageSize)...)
+	second[len(second)-1] = 1
+
+	mgr := snapshotting.NewSnapshotManager(baseFolder, pageStore)
+	firstSnap := commitMemSnapshot(t, mgr, "first-rev", first)
+	secondSnap := commitMemSnapshot(t, mgr, "second-rev", second)
+
+	_, err := os.Stat(firstSnap.GetMemFilePath())
+	require.True(t, os.IsNotExist(err), "Memory file should be replaced by its manifest")
+	// 4 shared pages, 1 exclusive page of the first snapshot, and the last page of the second snapshot
+	require.Equal(t, 6, countFiles(t, pagesDir), "Identical chunks should be stored once")
+
+	for snap, data := range map[*snapshotting.Snapshot][]byte{firstSnap: first, secondSnap: second} {
+		mem, err := snapshotting.OpenDedupedMemFile(snap.GetMemManifestFilePath())
+		require.NoError(t, err, "Failed to open deduplicated memory file")
+		buf := make([]byte, len(data))
+		_, err = mem.ReadAt(buf, 0)
+		require.NoError(t, err, "Failed to read deduplicated memory file")
+		require.Equal(t, data, buf)
+	}
+
+	// Chunk references are recovered after a restart, and chunks are removed with their last snapshot
+	require.NoError(t, os.WriteFile(filepath.Join(pagesDir, "stale"), []byte("stale"), 0644))
+	snapshotting.NewSnapshotManager(baseFolder, pageStore)
+	require.Equal(t, 6, countFiles(t, pagesDir), "Unreferenced chunks should be removed on recovery")
+
+	mgr = snapshotting.NewSnapshotManager(baseFolder, pageStore, snapshotting.WithCapacity(0, 1))
+	require.Equal(t, 5, countFiles(t, pagesDir), "Exclusive chunks of the evicted snapshot should be removed")
+	commitMemSnapshot(t, mgr, "third-rev", shared)
+	require.Equal(t, 4, countFiles(t, pagesDir), "Chunks of evicted snapshots should be removed")
+}
+
+func TestAnalyzeDedup(t *testing.T) {
+	baseFolder := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(baseFolder)
+	shared := testMemFileData(8 * zeroTestPageSize)
+	commitMemSnapshot(t, mgr, "first-rev", append(append([]byte{}, shared...), exclusiveMemFileData(2*zeroTestPageSize)...))
+	commitMemSnapshot(t, mgr, "second-rev", shared)
+
+	report, err := snapshotting.AnalyzeDedup(baseFolder, zeroTestPageSize)
+	require.NoError(t, err, "Failed to analyze snapshots")
+	require.Len(t, report.Snapshots, 2)
+	require.Equal(t, int64(18*zeroTestPageSize), report.TotalBytes)
+	require.Equal(t, int64(9*zeroTestPageSize), report.ZeroBytes)
+	require.Equal(t, int64(5*zeroTestPageSize), report.UniqueBytes)
+	require.Equal(t, int64(zeroTestPageSize), report.Snapshots[0].ExclusiveBytes)
+	require.Equal(t, int64(0), report.Snapshots[1].ExclusiveBytes)
+	require.InDelta(t, 3.6, report.Ratio(), 1e-9)
+}
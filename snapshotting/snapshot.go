@@ -27,6 +27,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -40,8 +42,48 @@ type Snapshot struct {
 	ContainerSnapName string
 	snapDir           string
 	Image             string
+	// Generation of the snapshot among the snapshots of the same revision, newer generations have larger numbers
+	Generation uint64
+	superseded bool
+
+	// Checksums of the snapshot files, recorded on commit if integrity checks are enabled
+	Checksums map[string]FileChecksum
+	verified  bool
+	// Set once the snapshot failed verification, so that it is quarantined rather than removed once it is released
+	corrupt bool
+
+	// Names of the record-and-prefetch artifacts in the snapshot directory, which are written by the memory manager
+	// when the first VM loaded from the snapshot is deactivated
+	TraceFile      string
+	WorkingSetFile string
+	// Modification time of the working set when it was last uploaded to the snapshot store
+	workingSetUploaded time.Time
+
+	// Machine configuration of the VM that the snapshot was taken of, which the VMs loaded from the snapshot are
+	// created with. Zero fields stand for the defaults of the orchestrator, e.g., in the snapshots of earlier versions
+	VcpuCount       uint32
+	MemSizeMib      uint32
+	HtEnabled       bool
+	KernelArgs      string
+	KernelImagePath string
+
+	// Page store holding the chunks of the guest memory file, if it has been deduplicated
+	pages    *PageStore
+	manifest *MemManifest
+
+	// Usage tracking for eviction
+	refs     int
+	useCount uint64
+	lastUsed time.Time
+	size     int64
 }
 
+// Default names of the record-and-prefetch artifacts in the snapshot directory
+const (
+	traceFile      = "trace"
+	workingSetFile = "working_set_pages"
+)
+
 func NewSnapshot(id, baseFolder, image string) *Snapshot {
 	s := &Snapshot{
 		id:                id,
@@ -49,17 +91,91 @@ func NewSnapshot(id, baseFolder, image string) *Snapshot {
 		snapDir:           filepath.Join(baseFolder, id),
 		ContainerSnapName: fmt.Sprintf("%s%s", id, time.Now().Format("20060102150405")),
 		Image:             image,
+		TraceFile:         traceFile,
+		WorkingSetFile:    workingSetFile,
 	}
 
 	return s
 }
 
-func (snp *Snapshot) CreateSnapDir() error {
-	err := os.Mkdir(snp.snapDir, 0755)
-	if err != nil && os.IsExist(err) {
-		return nil
+// newSnapshotGeneration creates a snapshot that is stored in the <baseFolder>/<id>/<generation> directory.
+func newSnapshotGeneration(id, baseFolder, image string, generation uint64) *Snapshot {
+	s := NewSnapshot(id, baseFolder, image)
+	s.snapDir = filepath.Join(baseFolder, id, strconv.FormatUint(generation, 10))
+	s.ContainerSnapName = fmt.Sprintf("%s%d", id, generation)
+	s.Generation = generation
+
+	return s
+}
+
+// loadSnapshot loads a committed snapshot generation from its directory in baseFolder. An error is returned if the
+// snapshot info cannot be decoded or if any of the snapshot files is missing. The returned snapshot can always be
+// used to clean up the snapshot directory.
+func loadSnapshot(id, baseFolder string, generation uint64) (*Snapshot, error) {
+	snap := newSnapshotGeneration(id, baseFolder, "", generation)
+	if err := snap.LoadSnapInfo(snap.GetInfoFilePath()); err != nil {
+		return snap, err
+	}
+	// The directory name is authoritative, e.g., for snapshots downloaded from a snapshot store
+	snap.Generation = generation
+
+	for _, path := range []string{snap.GetSnapshotFilePath(), snap.GetMemFilePath(), snap.GetPatchFilePath()} {
+		_, err := os.Stat(path)
+		// The guest memory file is replaced by its compressed version or its manifest if compression or
+		// deduplication is enabled
+		if os.IsNotExist(err) && path == snap.GetMemFilePath() {
+			_, err = os.Stat(snap.GetCompressedMemFilePath())
+			if os.IsNotExist(err) {
+				_, err = os.Stat(snap.GetMemManifestFilePath())
+			}
+		}
+		if err != nil {
+			return snap, errors.Wrapf(err, "checking snapshot file %s", path)
+		}
 	}
-	return err
+
+	size, err := snap.computeSize()
+	if err != nil {
+		return snap, err
+	}
+
+	info, err := os.Stat(snap.GetInfoFilePath())
+	if err != nil {
+		return snap, err
+	}
+
+	snap.size = size
+	snap.lastUsed = info.ModTime()
+	snap.ready = true
+
+	return snap, nil
+}
+
+// IsSnapshotDir reports whether snapDir holds a snapshot whose info has been serialized.
+func IsSnapshotDir(snapDir string) bool {
+	_, err := os.Stat(filepath.Join(snapDir, "info_file"))
+	return err == nil
+}
+
+// ContainsSnapshots reports whether revisionDir holds at least one snapshot generation whose info has been
+// serialized.
+func ContainsSnapshots(revisionDir string) bool {
+	entries, err := os.ReadDir(revisionDir)
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() && IsSnapshotDir(filepath.Join(revisionDir, entry.Name())) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (snp *Snapshot) CreateSnapDir() error {
+	return os.MkdirAll(snp.snapDir, 0755)
 }
 
 func (snp *Snapshot) GetImage() string {
@@ -74,6 +190,26 @@ func (snp *Snapshot) GetContainerSnapName() string {
 	return snp.ContainerSnapName
 }
 
+// GetGeneration returns the generation of the snapshot among the snapshots of its revision.
+func (snp *Snapshot) GetGeneration() uint64 {
+	return snp.Generation
+}
+
+// GetSize returns the disk space used by the snapshot files, as computed on commit.
+func (snp *Snapshot) GetSize() int64 {
+	return snp.size
+}
+
+// GetUseCount returns the number of times the snapshot has been acquired.
+func (snp *Snapshot) GetUseCount() uint64 {
+	return snp.useCount
+}
+
+// GetLastUsed returns the time the snapshot was last acquired or committed.
+func (snp *Snapshot) GetLastUsed() time.Time {
+	return snp.lastUsed
+}
+
 func (snp *Snapshot) GetSnapshotFilePath() string {
 	return filepath.Join(snp.snapDir, "snap_file")
 }
@@ -90,6 +226,18 @@ func (snp *Snapshot) GetInfoFilePath() string {
 	return filepath.Join(snp.snapDir, "info_file")
 }
 
+// GetTraceFilePath returns the path of the trace of the pages accessed by the first VM loaded from the snapshot,
+// which is recorded by the memory manager in the record-and-prefetch mode.
+func (snp *Snapshot) GetTraceFilePath() string {
+	return filepath.Join(snp.snapDir, snp.TraceFile)
+}
+
+// GetWorkingSetFilePath returns the path of the working set pages that are prefetched when a VM is loaded from the
+// snapshot in the record-and-prefetch mode.
+func (snp *Snapshot) GetWorkingSetFilePath() string {
+	return filepath.Join(snp.snapDir, snp.WorkingSetFile)
+}
+
 // SerializeSnapInfo serializes the snapshot info using gob. This can be useful for remote snapshots
 func (snp *Snapshot) SerializeSnapInfo() error {
 	file, err := os.Create(snp.GetInfoFilePath())
@@ -125,6 +273,34 @@ func (snp *Snapshot) LoadSnapInfo(infoPath string) error {
 	return nil
 }
 
+// computeSize returns the total size of the files in the snapshot directory. Sparse files only account for the
+// blocks allocated to them.
+func (snp *Snapshot) computeSize() (int64, error) {
+	entries, err := os.ReadDir(snp.snapDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			size += min(info.Size(), stat.Blocks*512)
+		} else {
+			size += info.Size()
+		}
+	}
+
+	return size, nil
+}
+
 func (snp *Snapshot) Cleanup() error {
+	snp.releasePages()
 	return os.RemoveAll(snp.snapDir)
 }
@@ -0,0 +1,318 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
+)
+
+// ErrSnapshotNotInStore is returned by a SnapshotStore when it holds no snapshot for the requested revision.
+var ErrSnapshotNotInStore = errors.New("snapshot does not exist in the snapshot store")
+
+// SnapshotStore stores snapshots outside of the node, so that a snapshot created on one node can be loaded on
+// any other node.
+type SnapshotStore interface {
+	// Upload stores the files of a committed snapshot generation.
+	Upload(ctx context.Context, snap *Snapshot) error
+	// Download fetches the files of the latest generation of the snapshot for the given revision into snapDir.
+	// ErrSnapshotNotInStore is returned if the store holds no such snapshot.
+	Download(ctx context.Context, revision, snapDir string) error
+	// UploadWorkingSet stores the record-and-prefetch artifacts of a snapshot generation, which the memory manager
+	// writes after the snapshot has been uploaded, once the first VM loaded from it is stopped.
+	UploadWorkingSet(ctx context.Context, snap *Snapshot) error
+}
+
+// snapshotFiles returns the names of the files that make up a snapshot, including the optional files for which
+// exists returns true. The info file comes last, since its presence in a store marks the snapshot as complete.
+func snapshotFiles(exists func(name string) bool) []string {
+	files := []string{"snap_file", "patch_file"}
+	// The guest memory file is replaced by its compressed version if compression is enabled
+	for _, name := range []string{"mem_file", "mem_file.zst", "zero_pages"} {
+		if exists(name) {
+			files = append(files, name)
+		}
+	}
+	files = append(files, workingSetFiles(exists)...)
+
+	return append(files, "info_file")
+}
+
+// workingSetFiles returns the names of the record-and-prefetch artifacts of a snapshot for which exists returns
+// true. The working set comes last, since the memory manager only replays it if it exists, which requires the trace.
+func workingSetFiles(exists func(name string) bool) []string {
+	if !exists(traceFile) || !exists(workingSetFile) {
+		return nil
+	}
+
+	return []string{traceFile, workingSetFile}
+}
+
+// fileInDir returns a function that reports whether a file exists in dir.
+func fileInDir(dir string) func(name string) bool {
+	return func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+}
+
+// LocalSnapshotStore stores snapshots in a directory, e.g., on a file system shared between nodes. Each snapshot
+// generation is stored in the <revision>/<generation> subdirectory.
+type LocalSnapshotStore struct {
+	rootDir string
+}
+
+// NewLocalSnapshotStore creates a snapshot store backed by rootDir.
+func NewLocalSnapshotStore(rootDir string) (*LocalSnapshotStore, error) {
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "creating snapshot store dir %s", rootDir)
+	}
+
+	return &LocalSnapshotStore{rootDir: rootDir}, nil
+}
+
+// Upload copies the snapshot files into the store.
+func (s *LocalSnapshotStore) Upload(_ context.Context, snap *Snapshot) error {
+	dstDir := filepath.Join(s.rootDir, snap.GetId(), strconv.FormatUint(snap.GetGeneration(), 10))
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return errors.Wrapf(err, "creating snapshot dir %s", dstDir)
+	}
+
+	for _, name := range snapshotFiles(fileInDir(snap.snapDir)) {
+		if err := copyFile(filepath.Join(snap.snapDir, name), filepath.Join(dstDir, name)); err != nil {
+			return errors.Wrapf(err, "uploading %s", name)
+		}
+	}
+
+	return nil
+}
+
+// UploadWorkingSet copies the record-and-prefetch artifacts of the snapshot into the store.
+func (s *LocalSnapshotStore) UploadWorkingSet(_ context.Context, snap *Snapshot) error {
+	dstDir := filepath.Join(s.rootDir, snap.GetId(), strconv.FormatUint(snap.GetGeneration(), 10))
+
+	for _, name := range workingSetFiles(fileInDir(snap.snapDir)) {
+		if err := copyFile(filepath.Join(snap.snapDir, name), filepath.Join(dstDir, name)); err != nil {
+			return errors.Wrapf(err, "uploading %s", name)
+		}
+	}
+
+	return nil
+}
+
+// Download copies the snapshot files of the latest generation from the store into snapDir.
+func (s *LocalSnapshotStore) Download(_ context.Context, revision, snapDir string) error {
+	entries, err := os.ReadDir(filepath.Join(s.rootDir, revision))
+	if os.IsNotExist(err) {
+		return ErrSnapshotNotInStore
+	} else if err != nil {
+		return errors.Wrapf(err, "looking up snapshot %s", revision)
+	}
+
+	var (
+		latest uint64
+		found  bool
+	)
+	for _, entry := range entries {
+		generation, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if err != nil || !IsSnapshotDir(filepath.Join(s.rootDir, revision, entry.Name())) {
+			continue
+		}
+		if !found || generation > latest {
+			latest, found = generation, true
+		}
+	}
+	if !found {
+		return ErrSnapshotNotInStore
+	}
+
+	srcDir := filepath.Join(s.rootDir, revision, strconv.FormatUint(latest, 10))
+
+	for _, name := range snapshotFiles(fileInDir(srcDir)) {
+		if err := copyFile(filepath.Join(srcDir, name), filepath.Join(snapDir, name)); err != nil {
+			return errors.Wrapf(err, "downloading %s", name)
+		}
+	}
+
+	return nil
+}
+
+// copyFile copies a file through a temporary file, so that a file that is copied over is never read partially.
+func copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	tmpPath := dstPath + ".tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, dstPath)
+}
+
+// S3SnapshotStoreCfg Config of an S3-compatible snapshot store
+type S3SnapshotStoreCfg struct {
+	Endpoint string
+	Bucket   string
+	Region   string
+	Secure   bool
+	// Static credentials. If empty, credentials are taken from the AWS_* or MINIO_* environment variables.
+	AccessKey, SecretKey string
+}
+
+// S3SnapshotStore stores snapshots in a bucket of an S3-compatible object storage, e.g., MinIO. The snapshot
+// files are stored as objects named <revision>/<generation>/<file>.
+type S3SnapshotStore struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3SnapshotStore creates a snapshot store backed by an existing bucket.
+func NewS3SnapshotStore(cfg S3SnapshotStoreCfg) (*S3SnapshotStore, error) {
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+	})
+	if cfg.AccessKey != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, "")
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: cfg.Secure,
+		Region: region,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating S3 client for %s", cfg.Endpoint)
+	}
+
+	return &S3SnapshotStore{client: client, bucket: cfg.Bucket}, nil
+}
+
+// Upload stores the snapshot files as objects in the bucket.
+func (s *S3SnapshotStore) Upload(ctx context.Context, snap *Snapshot) error {
+	for _, name := range snapshotFiles(fileInDir(snap.snapDir)) {
+		_, err := s.client.FPutObject(ctx, s.bucket, s.objectName(snap.GetId(), snap.GetGeneration(), name),
+			filepath.Join(snap.snapDir, name), minio.PutObjectOptions{ContentType: "application/octet-stream"})
+		if err != nil {
+			return errors.Wrapf(err, "uploading %s", name)
+		}
+	}
+
+	return nil
+}
+
+// UploadWorkingSet stores the record-and-prefetch artifacts of the snapshot as objects in the bucket.
+func (s *S3SnapshotStore) UploadWorkingSet(ctx context.Context, snap *Snapshot) error {
+	for _, name := range workingSetFiles(fileInDir(snap.snapDir)) {
+		_, err := s.client.FPutObject(ctx, s.bucket, s.objectName(snap.GetId(), snap.GetGeneration(), name),
+			filepath.Join(snap.snapDir, name), minio.PutObjectOptions{ContentType: "application/octet-stream"})
+		if err != nil {
+			return errors.Wrapf(err, "uploading %s", name)
+		}
+	}
+
+	return nil
+}
+
+// Download fetches the snapshot objects of the latest generation from the bucket into snapDir.
+func (s *S3SnapshotStore) Download(ctx context.Context, revision, snapDir string) error {
+	var (
+		latest uint64
+		found  bool
+		// Names of the objects of each generation
+		objects = make(map[uint64]map[string]bool)
+	)
+
+	// Generations whose info object has not been uploaded yet are incomplete
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: revision + "/", Recursive: true}) {
+		if object.Err != nil {
+			return errors.Wrapf(object.Err, "looking up snapshot %s", revision)
+		}
+
+		genName, name, ok := strings.Cut(strings.TrimPrefix(object.Key, revision+"/"), "/")
+		if !ok {
+			continue
+		}
+		generation, err := strconv.ParseUint(genName, 10, 64)
+		if err != nil {
+			continue
+		}
+		if objects[generation] == nil {
+			objects[generation] = make(map[string]bool)
+		}
+		objects[generation][name] = true
+		if name != "info_file" {
+			continue
+		}
+		if !found || generation > latest {
+			latest, found = generation, true
+		}
+	}
+	if !found {
+		return ErrSnapshotNotInStore
+	}
+
+	exists := func(name string) bool { return objects[latest][name] }
+	for _, name := range snapshotFiles(exists) {
+		err := s.client.FGetObject(ctx, s.bucket, s.objectName(revision, latest, name), filepath.Join(snapDir, name),
+			minio.GetObjectOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "downloading %s", name)
+		}
+	}
+
+	return nil
+}
+
+func (s *S3SnapshotStore) objectName(revision string, generation uint64, name string) string {
+	return fmt.Sprintf("%s/%d/%s", revision, generation, name)
+}
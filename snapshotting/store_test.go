@@ -0,0 +1,255 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+// createStoredSnapshot creates and commits a snapshot with all of its files present.
+func createStoredSnapshot(t *testing.T, mgr *snapshotting.SnapshotManager, revision string) *snapshotting.Snapshot {
+	snap, err := mgr.InitSnapshot(revision, "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	for _, path := range []string{snap.GetSnapshotFilePath(), snap.GetMemFilePath(), snap.GetPatchFilePath()} {
+		require.NoError(t, os.WriteFile(path, []byte(path), 0644), "Failed to write snapshot file")
+	}
+	require.NoError(t, snap.SerializeSnapInfo(), "Failed to serialize snapshot info")
+	require.NoError(t, mgr.CommitSnapshot(revision), "Failed to commit snapshot")
+	return snap
+}
+
+// testSnapshotStore commits a snapshot on one node and checks that another node sharing the same store
+// downloads it on first use.
+func testSnapshotStore(t *testing.T, store snapshotting.SnapshotStore) {
+	producer := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithSnapshotStore(store))
+	snap := createStoredSnapshot(t, producer, "shared-rev")
+
+	consumer := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithSnapshotStore(store))
+	fetched, err := consumer.AcquireSnapshot("shared-rev")
+	require.NoError(t, err, "Failed to fetch snapshot from the store")
+	require.Equal(t, snap.GetImage(), fetched.GetImage())
+	require.Equal(t, snap.GetContainerSnapName(), fetched.GetContainerSnapName())
+
+	data, err := os.ReadFile(fetched.GetMemFilePath())
+	require.NoError(t, err, "Failed to read downloaded memory file")
+	require.Equal(t, snap.GetMemFilePath(), string(data))
+	require.NoError(t, consumer.ReleaseSnapshot(fetched), "Failed to release snapshot")
+
+	// Second acquisition is served from the local copy
+	_, err = consumer.AcquireSnapshot("shared-rev")
+	require.NoError(t, err, "Failed to acquire downloaded snapshot")
+
+	// The working set that is recorded after the snapshot was uploaded is uploaded separately
+	_, err = os.Stat(fetched.GetWorkingSetFilePath())
+	require.True(t, os.IsNotExist(err), "Working set should not have been recorded yet")
+	require.NoError(t, os.WriteFile(snap.GetTraceFilePath(), []byte("trace"), 0644), "Failed to write trace")
+	require.NoError(t, os.WriteFile(snap.GetWorkingSetFilePath(), []byte("pages"), 0644), "Failed to write working set")
+	require.NoError(t, producer.UploadWorkingSet(snap), "Failed to upload working set")
+
+	fetched, err = snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithSnapshotStore(store)).AcquireSnapshot("shared-rev")
+	require.NoError(t, err, "Failed to fetch snapshot from the store")
+	for path, content := range map[string]string{fetched.GetTraceFilePath(): "trace", fetched.GetWorkingSetFilePath(): "pages"} {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err, "Failed to read downloaded record-and-prefetch artifact")
+		require.Equal(t, content, string(data))
+	}
+
+	// Nodes without a local copy download the latest generation
+	latest := createStoredSnapshot(t, producer, "shared-rev")
+	fetched, err = snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithSnapshotStore(store)).AcquireSnapshot("shared-rev")
+	require.NoError(t, err, "Failed to fetch snapshot from the store")
+	require.Equal(t, latest.GetGeneration(), fetched.GetGeneration())
+
+	_, err = consumer.AcquireSnapshot("missing-rev")
+	require.Error(t, err, "Acquire should fail when the store does not hold the snapshot")
+	_, err = consumer.InitSnapshot("missing-rev", "testImage")
+	require.NoError(t, err, "Failed download should not leave a snapshot behind")
+}
+
+func TestLocalSnapshotStore(t *testing.T) {
+	store, err := snapshotting.NewLocalSnapshotStore(t.TempDir())
+	require.NoError(t, err, "Failed to create snapshot store")
+
+	testSnapshotStore(t, store)
+}
+
+func TestS3SnapshotStore(t *testing.T) {
+	server := httptest.NewServer(newFakeS3Server("snapshots"))
+	defer server.Close()
+
+	store, err := snapshotting.NewS3SnapshotStore(snapshotting.S3SnapshotStoreCfg{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Bucket:    "snapshots",
+		AccessKey: "minio",
+		SecretKey: "minio123",
+	})
+	require.NoError(t, err, "Failed to create snapshot store")
+
+	testSnapshotStore(t, store)
+}
+
+// fakeS3Server is an in-memory stand-in for MinIO that supports the path-style object and listing requests used
+// by the S3 snapshot store.
+type fakeS3Server struct {
+	sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func newFakeS3Server(bucket string) *fakeS3Server {
+	return &fakeS3Server{bucket: bucket, objects: make(map[string][]byte)}
+}
+
+func (s *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := "/" + s.bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		s.listObjects(w, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodPut:
+		data, err := readS3Payload(r)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = data
+		w.Header().Set("ETag", etag(data))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (s *fakeS3Server) listObjects(w http.ResponseWriter, prefix string) {
+	type object struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []object
+	}{Name: s.bucket, Prefix: prefix}
+
+	for key, data := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, object{
+				Key:          key,
+				LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+				ETag:         etag(data),
+				Size:         len(data),
+			})
+		}
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+// readS3Payload returns the object data of a PUT request, decoding the aws-chunked encoding used by clients
+// that sign the payload in a streaming fashion.
+func readS3Payload(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data bytes.Buffer
+	reader := bufio.NewReader(r.Body)
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(header), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		// The last chunk may be followed by trailing headers, which are ignored
+		if size == 0 {
+			return data.Bytes(), nil
+		}
+		if _, err := io.CopyN(&data, reader, size); err != nil {
+			return nil, err
+		}
+		if _, err := reader.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+}
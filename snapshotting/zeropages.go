@@ -0,0 +1,239 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ZeroPageCfg Configuration of the zero page detection, which records the pages of the guest memory file that only
+// contain zeros upon snapshot commit, so that the memory manager can serve them without reading the memory file.
+type ZeroPageCfg struct {
+	// Granularity of the detection, the host page size by default
+	PageSize int64
+	// Deallocate the zero pages of the memory file, making it sparse
+	PunchHoles bool
+}
+
+// ZeroPageBitmap Pages of a guest memory file that only contain zeros. Only capitalized fields are serialised.
+type ZeroPageBitmap struct {
+	PageSize int64
+	// Size of the memory file
+	Size int64
+	// Bit i is set if page i only contains zeros
+	Bits []byte
+}
+
+// DetectZeroPages scans a guest memory file for pages that only contain zeros.
+func DetectZeroPages(path string, pageSize int64) (*ZeroPageBitmap, error) {
+	if pageSize <= 0 {
+		return nil, errors.New("zero page size must be positive")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	pages := (info.Size() + pageSize - 1) / pageSize
+	bitmap := &ZeroPageBitmap{
+		PageSize: pageSize,
+		Size:     info.Size(),
+		Bits:     make([]byte, (pages+7)/8),
+	}
+
+	// Read many pages at once, the memory file can be large
+	const pagesPerRead = 256
+	var (
+		buf  = make([]byte, pagesPerRead*pageSize)
+		zero = make([]byte, pageSize)
+	)
+	for page := int64(0); page < pages; page += pagesPerRead {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, errors.Wrapf(err, "reading %s", path)
+		}
+
+		for i := int64(0); i*pageSize < int64(n); i++ {
+			chunk := buf[i*pageSize : min((i+1)*pageSize, int64(n))]
+			if bytes.Equal(chunk, zero[:len(chunk)]) {
+				bitmap.Bits[(page+i)/8] |= 1 << ((page + i) % 8)
+			}
+		}
+	}
+
+	return bitmap, nil
+}
+
+// ReadZeroPageBitmap loads a zero page bitmap written by WriteFile.
+func ReadZeroPageBitmap(path string) (*ZeroPageBitmap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	bitmap := new(ZeroPageBitmap)
+	if err := gob.NewDecoder(f).Decode(bitmap); err != nil {
+		return nil, errors.Wrapf(err, "decoding zero page bitmap %s", path)
+	}
+	if bitmap.PageSize <= 0 || int64(len(bitmap.Bits))*8*bitmap.PageSize < bitmap.Size {
+		return nil, errors.Errorf("invalid zero page bitmap %s", path)
+	}
+
+	return bitmap, nil
+}
+
+// WriteFile stores the bitmap at path.
+func (b *ZeroPageBitmap) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	if err := gob.NewEncoder(f).Encode(b); err != nil {
+		return errors.Wrapf(err, "encoding zero page bitmap %s", path)
+	}
+
+	return f.Sync()
+}
+
+// IsZero reports whether all pages overlapping the [offset, offset+length) range of the memory file only contain
+// zeros.
+func (b *ZeroPageBitmap) IsZero(offset, length int64) bool {
+	if b == nil || length <= 0 || offset < 0 || offset+length > b.Size {
+		return false
+	}
+
+	for page := offset / b.PageSize; page*b.PageSize < offset+length; page++ {
+		if b.Bits[page/8]&(1<<(page%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ZeroBytes returns the number of bytes of the memory file in zero pages.
+func (b *ZeroPageBitmap) ZeroBytes() int64 {
+	var zeroBytes int64
+	b.forEachRun(func(offset, length int64) error {
+		zeroBytes += length
+		return nil
+	})
+
+	return zeroBytes
+}
+
+// PunchHoles deallocates the zero pages of the memory file at path, which keeps its size and contents.
+func (b *ZeroPageBitmap) PunchHoles(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	return b.forEachRun(func(offset, length int64) error {
+		err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+		return errors.Wrapf(err, "punching hole at %#x in %s", offset, path)
+	})
+}
+
+// forEachRun calls fn for each run of consecutive zero pages until fn returns an error.
+func (b *ZeroPageBitmap) forEachRun(fn func(offset, length int64) error) error {
+	pages := (b.Size + b.PageSize - 1) / b.PageSize
+	runStart := int64(-1)
+	for page := int64(0); page <= pages; page++ {
+		if page < pages && b.Bits[page/8]&(1<<(page%8)) != 0 {
+			if runStart < 0 {
+				runStart = page
+			}
+			continue
+		}
+		if runStart >= 0 {
+			offset := runStart * b.PageSize
+			if err := fn(offset, min(page*b.PageSize, b.Size)-offset); err != nil {
+				return err
+			}
+			runStart = -1
+		}
+	}
+
+	return nil
+}
+
+// GetZeroPagesFilePath returns the path of the zero page bitmap of the guest memory file, which only exists if zero
+// page detection was enabled when the snapshot was committed.
+func (snp *Snapshot) GetZeroPagesFilePath() string {
+	return filepath.Join(snp.snapDir, "zero_pages")
+}
+
+// DetectZeroPages records the zero page bitmap of the guest memory file alongside it, and deallocates the zero pages
+// of the memory file if configured to.
+func (snp *Snapshot) DetectZeroPages(cfg ZeroPageCfg) error {
+	bitmap, err := DetectZeroPages(snp.GetMemFilePath(), cfg.PageSize)
+	if err != nil {
+		return err
+	}
+
+	if err := bitmap.WriteFile(snp.GetZeroPagesFilePath()); err != nil {
+		return err
+	}
+
+	if cfg.PunchHoles {
+		return bitmap.PunchHoles(snp.GetMemFilePath())
+	}
+
+	return nil
+}
+
+// punchZeroPageHoles deallocates the zero pages of the guest memory file according to its recorded bitmap, e.g.,
+// after the memory file has been downloaded. Snapshots without a bitmap or a guest memory file are left untouched.
+func (snp *Snapshot) punchZeroPageHoles() error {
+	if _, err := os.Stat(snp.GetMemFilePath()); os.IsNotExist(err) {
+		return nil
+	}
+
+	bitmap, err := ReadZeroPageBitmap(snp.GetZeroPagesFilePath())
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return bitmap.PunchHoles(snp.GetMemFilePath())
+}
@@ -0,0 +1,124 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting_test
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+const zeroTestPageSize = 4096
+
+// writeTestMemFile writes a memory file of the given number of pages, of which the pages in dataPages are non-zero.
+func writeTestMemFile(t *testing.T, path string, pages int, dataPages ...int) {
+	data := make([]byte, pages*zeroTestPageSize)
+	for _, page := range dataPages {
+		data[page*zeroTestPageSize+7] = 0xaa
+	}
+	require.NoError(t, os.WriteFile(path, data, 0644), "Failed to write memory file")
+}
+
+func TestDetectZeroPages(t *testing.T) {
+	memFilePath := filepath.Join(t.TempDir(), "mem_file")
+	// Spans multiple reads and ends with a partial page
+	writeTestMemFile(t, memFilePath, 600, 1, 256, 599)
+	f, err := os.OpenFile(memFilePath, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err, "Failed to open memory file")
+	_, err = f.Write(make([]byte, 100))
+	require.NoError(t, err, "Failed to extend memory file")
+	require.NoError(t, f.Close())
+
+	bitmap, err := snapshotting.DetectZeroPages(memFilePath, zeroTestPageSize)
+	require.NoError(t, err, "Failed to detect zero pages")
+
+	require.True(t, bitmap.IsZero(0, zeroTestPageSize))
+	require.False(t, bitmap.IsZero(zeroTestPageSize, zeroTestPageSize))
+	require.False(t, bitmap.IsZero(0, 2*zeroTestPageSize), "Ranges overlapping non-zero pages are not zero")
+	require.True(t, bitmap.IsZero(2*zeroTestPageSize, 254*zeroTestPageSize))
+	require.False(t, bitmap.IsZero(256*zeroTestPageSize+8, 8))
+	require.False(t, bitmap.IsZero(599*zeroTestPageSize, zeroTestPageSize))
+	require.True(t, bitmap.IsZero(600*zeroTestPageSize, 100), "Trailing partial page should be zero")
+	require.False(t, bitmap.IsZero(600*zeroTestPageSize, zeroTestPageSize), "Ranges beyond the file are not zero")
+	require.Equal(t, int64(597*zeroTestPageSize+100), bitmap.ZeroBytes())
+
+	bitmapPath := filepath.Join(t.TempDir(), "zero_pages")
+	require.NoError(t, bitmap.WriteFile(bitmapPath), "Failed to write zero page bitmap")
+	loaded, err := snapshotting.ReadZeroPageBitmap(bitmapPath)
+	require.NoError(t, err, "Failed to read zero page bitmap")
+	require.Equal(t, bitmap, loaded)
+}
+
+func TestZeroPageHoles(t *testing.T) {
+	memFilePath := filepath.Join(t.TempDir(), "mem_file")
+	writeTestMemFile(t, memFilePath, 64, 3, 40)
+	data, err := os.ReadFile(memFilePath)
+	require.NoError(t, err, "Failed to read memory file")
+
+	bitmap, err := snapshotting.DetectZeroPages(memFilePath, zeroTestPageSize)
+	require.NoError(t, err, "Failed to detect zero pages")
+	if err := bitmap.PunchHoles(memFilePath); err != nil {
+		t.Skipf("Punching holes is not supported: %v", err)
+	}
+
+	punched, err := os.ReadFile(memFilePath)
+	require.NoError(t, err, "Failed to read memory file")
+	require.Equal(t, data, punched, "Punching holes must not change the memory file contents")
+
+	info, err := os.Stat(memFilePath)
+	require.NoError(t, err, "Failed to stat memory file")
+	require.Less(t, info.Sys().(*syscall.Stat_t).Blocks*512, info.Size(), "Memory file should be sparse")
+}
+
+func TestSnapshotManagerZeroPageDetection(t *testing.T) {
+	store, err := snapshotting.NewLocalSnapshotStore(t.TempDir())
+	require.NoError(t, err, "Failed to create snapshot store")
+	zeroPages := snapshotting.WithZeroPageDetection(snapshotting.ZeroPageCfg{PageSize: zeroTestPageSize})
+
+	producer := snapshotting.NewSnapshotManager(t.TempDir(), zeroPages, snapshotting.WithSnapshotStore(store),
+		snapshotting.WithIntegrityCheck(snapshotting.IntegrityCfg{Verify: snapshotting.VerifyFull}))
+	snap, err := producer.InitSnapshot("zero-rev", "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	for _, path := range []string{snap.GetSnapshotFilePath(), snap.GetPatchFilePath()} {
+		require.NoError(t, os.WriteFile(path, []byte(path), 0644), "Failed to write snapshot file")
+	}
+	writeTestMemFile(t, snap.GetMemFilePath(), 16, 5)
+	require.NoError(t, snap.SerializeSnapInfo(), "Failed to serialize snapshot info")
+	require.NoError(t, producer.CommitSnapshot("zero-rev"), "Failed to commit snapshot")
+	require.Contains(t, snap.Checksums, "zero_pages", "Checksum of the zero page bitmap should be recorded")
+
+	// The zero page bitmap is shared through the snapshot store
+	consumer := snapshotting.NewSnapshotManager(t.TempDir(), zeroPages, snapshotting.WithSnapshotStore(store))
+	fetched, err := consumer.AcquireSnapshot("zero-rev")
+	require.NoError(t, err, "Failed to fetch snapshot from the store")
+
+	bitmap, err := snapshotting.ReadZeroPageBitmap(fetched.GetZeroPagesFilePath())
+	require.NoError(t, err, "Failed to read zero page bitmap")
+	require.True(t, bitmap.IsZero(0, 5*zeroTestPageSize))
+	require.False(t, bitmap.IsZero(5*zeroTestPageSize, zeroTestPageSize))
+	require.True(t, bitmap.IsZero(6*zeroTestPageSize, 10*zeroTestPageSize))
+}
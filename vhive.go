@@ -24,12 +24,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 
 	"net"
 	"os"
 	"runtime"
+	"time"
 
 	ctrdlog "github.com/containerd/log"
 	log "github.com/sirupsen/logrus"
@@ -37,8 +39,13 @@ import (
 	fccri "github.com/vhive-serverless/vhive/cri/firecracker"
 	ctriface "github.com/vhive-serverless/vhive/ctriface"
 	hpb "github.com/vhive-serverless/vhive/examples/protobuf/helloworld"
+	"github.com/vhive-serverless/vhive/memory/manager"
+	"github.com/vhive-serverless/vhive/misc"
 	pb "github.com/vhive-serverless/vhive/proto"
+	"github.com/vhive-serverless/vhive/snapshotting"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -58,7 +65,6 @@ var (
 	isUPFEnabled       *bool
 	isLazyMode         *bool
 	isMetricsMode      *bool
-	servedThreshold    *uint64
 	pinnedFuncNum      *int
 	criSock            *string
 	hostIface          *string
@@ -76,15 +82,42 @@ func main() {
 	isSnapshotsEnabled = flag.Bool("snapshots", false, "Use VM snapshots when adding function instances")
 	isUPFEnabled = flag.Bool("upf", false, "Enable user-level page faults guest memory management")
 	isMetricsMode = flag.Bool("metrics", false, "Calculate UPF metrics")
-	servedThreshold = flag.Uint64("st", 1000*1000, "Functions serves X RPCs before it shuts down (if saveMemory=true)")
+	keepAliveName := flag.String("keepAlive", "fixed", "Keep-alive policy of the instances of idle functions that are not pinned (requires -ms unless never), valid options: fixed, hybrid, never")
+	keepAliveTTL := flag.Duration("keepAliveTTL", 10*time.Minute, "Keep-alive duration of the instances of idle functions with the fixed policy, and of those whose idle times the hybrid policy cannot predict")
+	maxInstances := flag.Int("maxInstances", 1, "Maximum number of instances of a function")
+	instanceConcurrency := flag.Int("instanceConcurrency", 0, "Number of requests that an instance of a function serves concurrently before more instances are added, 0 is unlimited")
 	pinnedFuncNum = flag.Int("hn", 0, "Number of functions pinned in memory (IDs from 0 to X)")
 	isLazyMode = flag.Bool("lazy", false, "Enable lazy serving mode when UPFs are enabled")
+	hugePages := flag.Bool("hugePages", false, "Back the guest memory of VMs with 2MiB huge pages (requires -upf with snapshots)")
+	upfPrefetch := flag.String("upfPrefetch", "", "Prefetch guest memory pages outside the working set in the background after loading a snapshot when UPFs are enabled, valid options: address, probability (disabled by default)")
+	upfPrefetchRate := flag.Uint64("upfPrefetchRate", 0, "Maximum rate of the background prefetching of guest memory in bytes per second (0 means unlimited)")
+	upfFaultWorkers := flag.Int("upfFaultWorkers", 0, "Number of goroutines serving the page faults of each VM concurrently when UPFs are enabled (0 means the default of 4)")
+	upfTraceDir := flag.String("upfTraceDir", "", "Directory where the page faults of each VM loaded from a snapshot are traced for analysis with vhive-trace when UPFs are enabled (disabled by default)")
+	upfRerecordThreshold := flag.Float64("upfRerecordThreshold", 0, "Ratio of the pages missing from the recorded working set of a snapshot to its size, above which the pages missed by a VM are merged into the working set when UPFs are enabled (0 means disabled)")
+	upfSocket := flag.String("upfSocket", "", "Unix socket of a standalone memory manager process (vhive-memory-manager) serving the UPFs, which are served in-process if empty")
+	reconcile := flag.String("reconcile", string(ctriface.ReconcileReport), "What to do with the VMs and resources left behind by a previous vHive process on startup, valid options: none, report, teardown, adopt")
 	criSock = flag.String("criSock", "/etc/vhive-cri/vhive-cri.sock", "Socket address for CRI service")
 	hostIface = flag.String("hostIface", "", "Host net-interface for the VMs to bind to for internet access")
 	netPoolSize = flag.Int("netPoolSize", 10, "Amount of network configs to preallocate in a pool")
 	sandbox := flag.String("sandbox", "firecracker", "Sandbox tech to use, valid options: firecracker")
 	vethPrefix := flag.String("vethPrefix", "172.17", "Prefix for IP addresses of veth devices, expected subnet is /16")
 	clonePrefix := flag.String("clonePrefix", "172.18", "Prefix for node-accessible IP addresses of uVMs, expected subnet is /16")
+	snapCapacityBytes := flag.Int64("snapCapacityBytes", 0, "Maximum disk space used by stored snapshots in bytes (0 means unlimited)")
+	snapCapacityCount := flag.Int("snapCapacityCount", 0, "Maximum number of stored snapshots (0 means unlimited)")
+	snapEvictionPolicy := flag.String("snapEvictionPolicy", snapshotting.LRUPolicy, "Snapshot eviction policy, valid options: lru, lfu, size")
+	snapStore := flag.String("snapStore", "", "Remote store to share snapshots between nodes, valid options: local, s3 (disabled by default)")
+	snapStoreDir := flag.String("snapStoreDir", "", "Directory of the local snapshot store, e.g., on a shared file system")
+	snapStoreEndpoint := flag.String("snapStoreEndpoint", "", "Endpoint of the S3 snapshot store (credentials are taken from the AWS_* or MINIO_* environment variables)")
+	snapStoreBucket := flag.String("snapStoreBucket", "snapshots", "Bucket of the S3 snapshot store")
+	snapStoreSecure := flag.Bool("snapStoreSecure", false, "Use HTTPS to connect to the S3 snapshot store")
+	snapVerify := flag.String("snapVerify", "", "Verify snapshot checksums before loading snapshots, valid options: full, sampled (disabled by default)")
+	snapChecksumChunkSize := flag.Int64("snapChecksumChunkSize", 64<<20, "Size of the snapshot file chunks that are hashed and verified independently in bytes")
+	snapZeroPages := flag.Bool("snapZeroPages", false, "Record the zero pages of the guest memory when committing snapshots, which are then served without reading the memory file")
+	snapPunchHoles := flag.Bool("snapPunchHoles", false, "Deallocate the zero pages of the guest memory files of snapshots, making them sparse (requires -snapZeroPages)")
+	snapCompress := flag.Bool("snapCompress", false, "Replace the guest memory files of snapshots with compressed files that are decompressed on page faults (requires -upf)")
+	snapCompressChunkSize := flag.Int64("snapCompressChunkSize", snapshotting.DefaultCompressionChunkSize, "Size of the independently compressed chunks of the guest memory files in bytes")
+	snapDedup := flag.Bool("snapDedup", false, "Deduplicate the guest memory files of snapshots in a node-local content-addressed page store (requires -upf)")
+	snapDedupChunkSize := flag.Int64("snapDedupChunkSize", int64(os.Getpagesize()), "Size of the deduplicated chunks of the guest memory files in bytes")
 	dockerCredentials := flag.String("dockerCredentials", "", "Docker credentials for pulling images from inside a microVM") // https://github.com/firecracker-microvm/firecracker-containerd/blob/main/docker-credential-mmds
 	flag.Parse()
 
@@ -97,16 +130,142 @@ func main() {
 		log.Error("User-level page faults are not supported without snapshots")
 		return
 	}
-	if *isUPFEnabled && !*isLazyMode {
-		log.Error("User-level page faults currently require lazy serving mode")
-		return
-	}
 
 	if !*isUPFEnabled && *isLazyMode {
 		log.Error("Lazy page fault serving mode is not supported without user-level page faults")
 		return
 	}
 
+	if *hugePages && *isSnapshotsEnabled && !*isUPFEnabled {
+		log.Error("Snapshots of VMs backed by huge pages are not supported without user-level page faults")
+		return
+	}
+
+	prefetchOrder, err := manager.ParsePrefetchOrder(*upfPrefetch)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if prefetchOrder != manager.PrefetchDisabled && !*isUPFEnabled {
+		log.Error("Prefetching guest memory is not supported without user-level page faults")
+		return
+	}
+	if *upfSocket != "" && !*isUPFEnabled {
+		log.Error("The standalone memory manager is not supported without user-level page faults")
+		return
+	}
+	if *upfRerecordThreshold < 0 {
+		log.Error("The working set re-recording threshold must not be negative")
+		return
+	}
+
+	reconcilePolicy, err := ctriface.ParseReconcilePolicy(*reconcile)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	keepAlive, err := ParseKeepAlivePolicy(*keepAliveName, *keepAliveTTL)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	// All functions are pinned in memory without memory saving, so their instances are never stopped
+	if !*isSaveMemory && ((isFlagSet("keepAlive") && *keepAliveName != "never") || isFlagSet("keepAliveTTL")) {
+		log.Error("Keep-alive policies are not supported without memory saving")
+		return
+	}
+
+	scaling := ScalingCfg{
+		MaxInstances:        *maxInstances,
+		InstanceConcurrency: *instanceConcurrency,
+	}
+	if err := scaling.Validate(); err != nil {
+		log.Error(err)
+		return
+	}
+
+	evictionPolicy, err := snapshotting.NewEvictionPolicy(*snapEvictionPolicy)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	snapshotOpts := []snapshotting.SnapshotManagerOption{
+		snapshotting.WithCapacity(*snapCapacityBytes, *snapCapacityCount),
+		snapshotting.WithEvictionPolicy(evictionPolicy),
+	}
+
+	if *snapPunchHoles && !*snapZeroPages {
+		log.Error("Punching holes in guest memory files is not supported without zero page detection")
+		return
+	}
+	if *snapZeroPages {
+		snapshotOpts = append(snapshotOpts, snapshotting.WithZeroPageDetection(snapshotting.ZeroPageCfg{
+			PunchHoles: *snapPunchHoles,
+		}))
+	}
+
+	if *snapCompress {
+		if !*isUPFEnabled {
+			log.Error("Compressed guest memory files are not supported without user-level page faults")
+			return
+		}
+		snapshotOpts = append(snapshotOpts, snapshotting.WithCompression(snapshotting.CompressionCfg{
+			ChunkSize: *snapCompressChunkSize,
+		}))
+	}
+
+	if *snapDedup {
+		if !*isUPFEnabled {
+			log.Error("Deduplicated guest memory files are not supported without user-level page faults")
+			return
+		}
+		if *snapStore != "" {
+			log.Error("Deduplicated guest memory files are not supported with a remote snapshot store")
+			return
+		}
+		snapshotOpts = append(snapshotOpts, snapshotting.WithPageStore(snapshotting.PageStoreCfg{
+			ChunkSize: *snapDedupChunkSize,
+		}))
+	}
+
+	switch *snapVerify {
+	case "":
+	case snapshotting.VerifyFull, snapshotting.VerifySampled:
+		snapshotOpts = append(snapshotOpts, snapshotting.WithIntegrityCheck(snapshotting.IntegrityCfg{
+			Verify:    *snapVerify,
+			ChunkSize: *snapChecksumChunkSize,
+		}))
+	default:
+		log.Errorf("Unknown snapshot verification mode %q, valid options: full, sampled", *snapVerify)
+		return
+	}
+
+	switch *snapStore {
+	case "":
+	case "local":
+		store, err := snapshotting.NewLocalSnapshotStore(*snapStoreDir)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		snapshotOpts = append(snapshotOpts, snapshotting.WithSnapshotStore(store))
+	case "s3":
+		store, err := snapshotting.NewS3SnapshotStore(snapshotting.S3SnapshotStoreCfg{
+			Endpoint: *snapStoreEndpoint,
+			Bucket:   *snapStoreBucket,
+			Secure:   *snapStoreSecure,
+		})
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		snapshotOpts = append(snapshotOpts, snapshotting.WithSnapshotStore(store))
+	default:
+		log.Errorf("Unknown snapshot store %q, valid options: local, s3", *snapStore)
+		return
+	}
+
 	if flog, err = os.Create("/tmp/fccd.log"); err != nil {
 		panic(err)
 	}
@@ -142,18 +301,39 @@ func main() {
 			ctriface.WithUPF(*isUPFEnabled),
 			ctriface.WithMetricsMode(*isMetricsMode),
 			ctriface.WithLazyMode(*isLazyMode),
+			ctriface.WithHugePages(*hugePages),
+			ctriface.WithUPFPrefetch(manager.PrefetchCfg{Order: prefetchOrder, Rate: *upfPrefetchRate}),
+			ctriface.WithUPFFaultWorkers(*upfFaultWorkers),
+			ctriface.WithUPFTraceDir(*upfTraceDir),
+			ctriface.WithUPFRerecordThreshold(*upfRerecordThreshold),
+			ctriface.WithUPFSocket(*upfSocket),
+			ctriface.WithReconcilePolicy(reconcilePolicy),
 			ctriface.WithNetPoolSize(*netPoolSize),
 			ctriface.WithVethPrefix(*vethPrefix),
 			ctriface.WithClonePrefix(*clonePrefix),
 			ctriface.WithDockerCredentials(*dockerCredentials),
 		)
-		funcPool = NewFuncPool(*isSaveMemory, *servedThreshold, *pinnedFuncNum, testModeOn)
-		go setupFirecrackerCRI()
+		// The function pool and the CRI service share the snapshots of the functions
+		snapshotManager := snapshotting.NewSnapshotManager(snapshotting.FunctionSnapshotsDir(orch.GetSnapshotsDir()), snapshotOpts...)
+		funcPool = NewFuncPool(orch, *isSnapshotsEnabled, *isSaveMemory, keepAlive, scaling, *pinnedFuncNum, testModeOn, snapshotManager)
+		go setupFirecrackerCRI(snapshotManager)
 		go orchServe()
 		fwdServe()
 	}
 }
 
+// isFlagSet Returns whether the flag was set on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
 type server struct {
 	pb.UnimplementedOrchestratorServer
 }
@@ -162,7 +342,7 @@ type fwdServer struct {
 	hpb.UnimplementedFwdGreeterServer
 }
 
-func setupFirecrackerCRI() {
+func setupFirecrackerCRI(snapshotManager *snapshotting.SnapshotManager) {
 	lis, err := net.Listen("unix", *criSock)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
@@ -170,7 +350,7 @@ func setupFirecrackerCRI() {
 
 	s := grpc.NewServer()
 
-	fcService, err := fccri.NewFirecrackerService(orch)
+	fcService, err := fccri.NewFirecrackerService(orch, snapshotManager)
 	if err != nil {
 		log.Fatalf("failed to create firecracker service %v", err)
 	}
@@ -226,7 +406,7 @@ func (s *server) StartVM(ctx context.Context, in *pb.StartVMReq) (*pb.StartVMRes
 
 	_, _, err := funcPool.Serve(ctx, fID, imageName, "record")
 	if err != nil {
-		return &pb.StartVMResp{Message: "First serve failed", Profile: tProfile}, err
+		return &pb.StartVMResp{Message: "First serve failed", Profile: tProfile}, statusError(err)
 	}
 
 	return &pb.StartVMResp{Message: "started VM instance for a function " + fID, Profile: tProfile}, nil
@@ -241,7 +421,7 @@ func (s *server) StopSingleVM(ctx context.Context, in *pb.StopSingleVMReq) (*pb.
 		log.Warn(message, err)
 	}
 
-	return &pb.Status{Message: message}, err
+	return &pb.Status{Message: message}, statusError(err)
 }
 
 // Note: this function is to be used only before tearing down the whole orchestrator
@@ -265,5 +445,24 @@ func (s *fwdServer) FwdHello(ctx context.Context, in *hpb.FwdHelloReq) (*hpb.Fwd
 	logger.Debug("Received FwdHelloVM")
 
 	resp, _, err := funcPool.Serve(ctx, fID, imageName, payload)
-	return resp, err
+	return resp, statusError(err)
+}
+
+// statusError Converts the errors of the function pool to gRPC status errors, so that clients can tell the instances
+// that could not be started or do not exist from the errors returned by the functions
+func statusError(err error) error {
+	var (
+		bootErr     *misc.BootErr
+		snapErr     *misc.SnapshotErr
+		nonExistErr misc.NonExistErr
+	)
+
+	switch {
+	case errors.As(err, &bootErr), errors.As(err, &snapErr):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.As(err, &nonExistErr):
+		return status.Error(codes.NotFound, err.Error())
+	default:
+		return err
+	}
 }
@@ -29,11 +29,16 @@ import (
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	ctrdlog "github.com/containerd/log"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	ctriface "github.com/vhive-serverless/vhive/ctriface"
+	"github.com/vhive-serverless/vhive/ctriface/fake"
+	hpb "github.com/vhive-serverless/vhive/examples/protobuf/helloworld"
+	"github.com/vhive-serverless/vhive/snapshotting"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -48,8 +53,56 @@ var (
 	isLazyModeTest         = flag.Bool("lazyTest", false, "Enable lazy serving mode when UPFs are enabled")
 	isWithCache            = flag.Bool("withCache", false, "Do not drop the cache before measurements")
 	benchDir               = flag.String("benchDirTest", "bench_results", "Directory where stats should be saved")
+	isRealOrchTest         = flag.Bool("realOrchTest", false, "Run the functions in firecracker VMs instead of in-memory fakes")
+
+	vmController        ctriface.VMController
+	testSnapshotManager *snapshotting.SnapshotManager
 )
 
+// testGreeter Serves the functions in fake VMs like the helloworld function does
+type testGreeter struct {
+	hpb.UnimplementedGreeterServer
+}
+
+func (g *testGreeter) SayHello(ctx context.Context, req *hpb.HelloRequest) (*hpb.HelloReply, error) {
+	name := req.GetName()
+	if name == "record" || name == "replay" {
+		name += "_response"
+	}
+	return &hpb.HelloReply{Message: "Hello, " + name + "!"}, nil
+}
+
+// requireRealOrch Skips the test unless it runs with the orchestrator
+func requireRealOrch(t *testing.T) {
+	if !*isRealOrchTest {
+		t.Skip("skipping test that requires firecracker VMs, run with -realOrchTest")
+	}
+}
+
+// simClock Simulated clock that only moves when it is advanced
+type simClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func newSimClock() *simClock {
+	return &simClock{now: time.Unix(0, 0)}
+}
+
+func (c *simClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.now
+}
+
+func (c *simClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
 func TestMain(m *testing.M) {
 	// call flag.Parse() here if TestMain uses flags
 
@@ -75,6 +128,23 @@ func TestMain(m *testing.M) {
 	log.Infof("Orchestrator UPF metrics enabled: %t", *isMetricsModeTest)
 	log.Infof("Drop cache: %t", !*isWithCache)
 	log.Infof("Bench dir: %s", *benchDir)
+	log.Infof("Real orchestrator: %t", *isRealOrchTest)
+
+	if !*isRealOrchTest {
+		vmController = fake.NewVMController(fake.WithGuestServices(func(s *grpc.Server) {
+			hpb.RegisterGreeterServer(s, &testGreeter{})
+		}))
+
+		snapshotsDir, err := os.MkdirTemp("", "snapshots")
+		if err != nil {
+			log.Fatalf("Failed to create snapshots dir: %v", err)
+		}
+		testSnapshotManager = snapshotting.NewSnapshotManager(snapshotsDir)
+
+		ret := m.Run()
+		_ = os.RemoveAll(snapshotsDir)
+		os.Exit(ret)
+	}
 
 	orch = ctriface.NewOrchestrator(
 		"devmapper",
@@ -85,6 +155,8 @@ func TestMain(m *testing.M) {
 		ctriface.WithMetricsMode(*isMetricsModeTest),
 		ctriface.WithLazyMode(*isLazyModeTest),
 	)
+	vmController = orch
+	testSnapshotManager = snapshotting.NewSnapshotManager(snapshotting.FunctionSnapshotsDir(orch.GetSnapshotsDir()))
 
 	ret := m.Run()
 
@@ -101,10 +173,10 @@ func TestMain(m *testing.M) {
 func TestSendToFunctionSerial(t *testing.T) {
 	fID := "1"
 	var (
-		servedTh      uint64
+		keepAlive     = NewNeverEvict()
 		pinnedFuncNum int
 	)
-	funcPool = NewFuncPool(!isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, !isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	for i := 0; i < 2; i++ {
 		resp, _, err := funcPool.Serve(context.Background(), fID, testImageName, "world")
@@ -123,10 +195,11 @@ func TestSendToFunctionSerial(t *testing.T) {
 func TestSendToFunctionParallel(t *testing.T) {
 	fID := "2"
 	var (
-		servedTh      uint64
+		keepAlive     = NewNeverEvict()
+		scaling       = ScalingCfg{MaxInstances: 4, InstanceConcurrency: 10}
 		pinnedFuncNum int
 	)
-	funcPool = NewFuncPool(!isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, !isSaveMemoryConst, keepAlive, scaling, pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	var vmGroup sync.WaitGroup
 	for i := 0; i < 100; i++ {
@@ -142,6 +215,9 @@ func TestSendToFunctionParallel(t *testing.T) {
 	}
 	vmGroup.Wait()
 
+	startsGot := funcPool.stats.statMap[fID].started
+	require.LessOrEqual(t, int(startsGot), scaling.MaxInstances, "Function scaled out to too many instances")
+
 	message, err := funcPool.RemoveInstance(fID, testImageName, true)
 	require.NoError(t, err, "Function returned error, "+message)
 }
@@ -149,10 +225,10 @@ func TestSendToFunctionParallel(t *testing.T) {
 func TestStartSendStopTwice(t *testing.T) {
 	fID := "3"
 	var (
-		servedTh      uint64 = 1
-		pinnedFuncNum        = 2
+		keepAlive     = NewNeverEvict()
+		pinnedFuncNum = 2
 	)
-	funcPool = NewFuncPool(!isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, !isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	for i := 0; i < 2; i++ {
 		for k := 0; k < 2; k++ {
@@ -174,10 +250,10 @@ func TestStartSendStopTwice(t *testing.T) {
 func TestStatsNotNumericFunction(t *testing.T) {
 	fID := "not-cld"
 	var (
-		servedTh      uint64 = 1
-		pinnedFuncNum        = 2
+		keepAlive     = NewNeverEvict()
+		pinnedFuncNum = 2
 	)
-	funcPool = NewFuncPool(isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	resp, _, err := funcPool.Serve(context.Background(), fID, testImageName, "world")
 	require.NoError(t, err, "Function returned error")
@@ -195,10 +271,10 @@ func TestStatsNotNumericFunction(t *testing.T) {
 func TestStatsNotColdFunction(t *testing.T) {
 	fID := "4"
 	var (
-		servedTh      uint64 = 1
-		pinnedFuncNum        = 4
+		keepAlive     = NewNeverEvict()
+		pinnedFuncNum = 4
 	)
-	funcPool = NewFuncPool(isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	resp, _, err := funcPool.Serve(context.Background(), fID, testImageName, "world")
 	require.NoError(t, err, "Function returned error")
@@ -216,12 +292,19 @@ func TestStatsNotColdFunction(t *testing.T) {
 func TestSaveMemorySerial(t *testing.T) {
 	fID := "5"
 	var (
-		servedTh      uint64 = 40
-		pinnedFuncNum        = 2
+		keepAlive     = NewFixedKeepAlive(time.Minute)
+		pinnedFuncNum = 2
 	)
-	funcPool = NewFuncPool(isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
+	clock := newSimClock()
+	funcPool.clock = clock
 
 	for i := 0; i < 100; i++ {
+		if i > 0 && i%40 == 0 {
+			clock.Advance(2 * time.Minute)
+			funcPool.reapIdleInstances(clock.Now())
+		}
+
 		resp, _, err := funcPool.Serve(context.Background(), fID, testImageName, "world")
 		require.NoError(t, err, "Function returned error")
 		require.Equal(t, resp.Payload, "Hello, world!")
@@ -237,40 +320,44 @@ func TestSaveMemorySerial(t *testing.T) {
 func TestSaveMemoryParallel(t *testing.T) {
 	fID := "6"
 	var (
-		servedTh      uint64 = 40
-		pinnedFuncNum        = 2
+		keepAlive     = NewFixedKeepAlive(time.Minute)
+		pinnedFuncNum = 2
 	)
-	funcPool = NewFuncPool(isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
+	clock := newSimClock()
+	funcPool.clock = clock
 
-	var vmGroup sync.WaitGroup
-	for i := 0; i < 100; i++ {
-		vmGroup.Add(1)
+	for round := 0; round < 3; round++ {
+		var vmGroup sync.WaitGroup
+		for i := 0; i < 33; i++ {
+			vmGroup.Add(1)
 
-		go func(i int) {
-			defer vmGroup.Done()
+			go func(i int) {
+				defer vmGroup.Done()
 
-			resp, _, err := funcPool.Serve(context.Background(), fID, testImageName, "world")
-			require.NoError(t, err, "Function returned error")
-			require.Equal(t, resp.Payload, "Hello, world!")
-		}(i)
+				resp, _, err := funcPool.Serve(context.Background(), fID, testImageName, "world")
+				require.NoError(t, err, "Function returned error")
+				require.Equal(t, resp.Payload, "Hello, world!")
+			}(i)
 
+		}
+		vmGroup.Wait()
+
+		clock.Advance(2 * time.Minute)
+		funcPool.reapIdleInstances(clock.Now())
 	}
-	vmGroup.Wait()
 
 	startsGot := funcPool.stats.statMap[fID].started
 	require.Equal(t, 3, int(startsGot), "Cold start (starts) stats are wrong")
-
-	message, err := funcPool.RemoveInstance(fID, testImageName, true)
-	require.NoError(t, err, "Function returned error, "+message)
 }
 
 func TestDirectStartStopVM(t *testing.T) {
 	fID := "7"
 	var (
-		servedTh      uint64
+		keepAlive     = NewNeverEvict()
 		pinnedFuncNum int
 	)
-	funcPool = NewFuncPool(!isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, !isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	message, err := funcPool.AddInstance(fID, testImageName)
 	require.NoError(t, err, "This error should never happen (addInstance())"+message)
@@ -302,10 +389,10 @@ func TestAllFunctions(t *testing.T) {
 		"ghcr.io/ease-lab/springboot:var_workload",
 	}
 	var (
-		servedTh      uint64
+		keepAlive     = NewNeverEvict()
 		pinnedFuncNum int
 	)
-	funcPool = NewFuncPool(!isSaveMemoryConst, servedTh, pinnedFuncNum, isTestModeConst)
+	funcPool = NewFuncPool(vmController, *isSnapshotsEnabledTest, !isSaveMemoryConst, keepAlive, DefaultScalingCfg(), pinnedFuncNum, isTestModeConst, testSnapshotManager)
 
 	for i := 0; i < 2; i++ {
 		var vmGroup sync.WaitGroup